@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/redhatinsights/module-update-router/identity"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoCredentials occurs when a request does not carry the credentials an
+// Authenticator looks for. Errors matching ErrNoCredentials let a chain of
+// Authenticators fall through to the next one.
+var ErrNoCredentials = errors.New("no credentials")
+
+// missingCredentialsError is an error matching ErrNoCredentials with a more
+// specific message.
+type missingCredentialsError struct {
+	err error
+}
+
+func (e missingCredentialsError) Error() string {
+	return e.err.Error()
+}
+
+func (e missingCredentialsError) Is(target error) bool {
+	return target == ErrNoCredentials
+}
+
+func (e missingCredentialsError) Unwrap() error {
+	return e.err
+}
+
+// ErrUnknownIdentityType occurs when an identity carries a type that is not
+// one of the known identity types, and unknown types are rejected.
+var ErrUnknownIdentityType = errors.New("unknown identity type")
+
+// Authenticator verifies the credentials carried by a request and returns the
+// identity they establish.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*identity.Identity, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as
+// Authenticators.
+type AuthenticatorFunc func(r *http.Request) (*identity.Identity, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*identity.Identity, error) {
+	return f(r)
+}
+
+// identityHeaderAuthenticator authenticates requests by the X-Rh-Identity
+// header. It is the default Authenticator.
+type identityHeaderAuthenticator struct {
+	// metrics counts the headers decoded, by encoding.
+	metrics *appMetrics
+}
+
+func (a identityHeaderAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	id, encoding, err := identity.Decode(r.Header.Get("X-Rh-Identity"))
+	if err != nil {
+		if errors.Is(err, identity.ErrMissingIdentityHeader) {
+			return nil, missingCredentialsError{err}
+		}
+		a.metrics.incIdentityDecodes("failed")
+		log.WithFields(log.Fields{
+			"request-id": requestIDOf(r),
+			"error":      err,
+		}).Warn("cannot decode identity header")
+		return nil, err
+	}
+	a.metrics.incIdentityDecodes(encoding)
+	return id, nil
+}
+
+// orgIDHeaderAuthenticator authenticates requests from trusted networks by the
+// X-Org-Id header, synthesizing an identity carrying only the org ID.
+type orgIDHeaderAuthenticator struct {
+	networks []*net.IPNet
+}
+
+func (a orgIDHeaderAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	orgID := r.Header.Get("X-Org-Id")
+	if orgID == "" || !a.isTrusted(r) {
+		return nil, ErrNoCredentials
+	}
+	var id identity.Identity
+	id.Identity.OrgID = orgID
+	id.Identity.AuthType = "x-org-id"
+	return &id, nil
+}
+
+// isTrusted reports whether the remote address of r is within one of the
+// trusted networks.
+func (a orgIDHeaderAuthenticator) isTrusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// chainAuthenticator tries each of its Authenticators in order, returning the
+// first identity established. An error not matching ErrNoCredentials stops the
+// chain. If no Authenticator finds credentials, the most specific
+// ErrNoCredentials error is returned.
+type chainAuthenticator []Authenticator
+
+func (c chainAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	var noCredentials error = ErrNoCredentials
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		switch {
+		case err == nil:
+			return id, nil
+		case !errors.Is(err, ErrNoCredentials):
+			return nil, err
+		case noCredentials == ErrNoCredentials:
+			noCredentials = err
+		}
+	}
+	return nil, noCredentials
+}
+
+// parseNetworks parses a comma-separated list of CIDR ranges.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse network: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// identityTypeAuthenticator checks the type of the identities established by
+// next against the known identity types. Identities of an unknown type are
+// rejected with ErrUnknownIdentityType if reject is set, and allowed with a
+// logged warning otherwise. Identities without a type, such as those
+// synthesized from X-Org-Id, are of an unknown type.
+type identityTypeAuthenticator struct {
+	next   Authenticator
+	known  map[string]bool
+	reject bool
+}
+
+func (a identityTypeAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	id, err := a.next.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	var identityType string
+	if id.Identity.Type != nil {
+		identityType = *id.Identity.Type
+	}
+	if a.known[identityType] {
+		return id, nil
+	}
+	if a.reject {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownIdentityType, identityType)
+	}
+	log.WithFields(log.Fields{
+		"request-id":    requestIDOf(r),
+		"identity_type": identityType,
+		"org_id":        id.Identity.OrgID,
+	}).Warn("unknown identity type")
+	return id, nil
+}
+
+// parseIdentityTypes parses a comma-separated list of identity types into a
+// set, ignoring empty entries.
+func parseIdentityTypes(value string) map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	return types
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/module-update-router/identity"
+	"github.com/redhatinsights/module-update-router/internal/config"
+)
+
+func TestChainAuthenticator(t *testing.T) {
+	errInvalid := errors.New("invalid credentials")
+	found := AuthenticatorFunc(func(r *http.Request) (*identity.Identity, error) {
+		var id identity.Identity
+		id.Identity.OrgID = "1979710"
+		return &id, nil
+	})
+	missing := AuthenticatorFunc(func(r *http.Request) (*identity.Identity, error) {
+		return nil, ErrNoCredentials
+	})
+	missingHeader := AuthenticatorFunc(func(r *http.Request) (*identity.Identity, error) {
+		return nil, missingCredentialsError{identity.ErrMissingIdentityHeader}
+	})
+	invalid := AuthenticatorFunc(func(r *http.Request) (*identity.Identity, error) {
+		return nil, errInvalid
+	})
+
+	tests := []struct {
+		description string
+		input       chainAuthenticator
+		want        string
+		wantError   error
+	}{
+		{
+			description: "falls through to found",
+			input:       chainAuthenticator{missing, found},
+			want:        "1979710",
+		},
+		{
+			description: "invalid stops chain",
+			input:       chainAuthenticator{invalid, found},
+			wantError:   errInvalid,
+		},
+		{
+			description: "most specific missing error",
+			input:       chainAuthenticator{missing, missingHeader},
+			wantError:   identity.ErrMissingIdentityHeader,
+		},
+		{
+			description: "empty chain",
+			input:       chainAuthenticator{},
+			wantError:   ErrNoCredentials,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := test.input.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if test.wantError != nil {
+				if !errors.Is(err, test.wantError) {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Identity.OrgID != test.want {
+					t.Errorf("%v != %v", got.Identity.OrgID, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthRejectionReason(t *testing.T) {
+	tests := []struct {
+		description string
+		input       error
+		want        string
+	}{
+		{
+			description: "no credentials",
+			input:       ErrNoCredentials,
+			want:        "missing_credentials",
+		},
+		{
+			description: "missing identity header",
+			input:       missingCredentialsError{identity.ErrMissingIdentityHeader},
+			want:        "missing_credentials",
+		},
+		{
+			description: "invalid token",
+			input:       fmt.Errorf("%w: token expired", ErrInvalidToken),
+			want:        "invalid_token",
+		},
+		{
+			description: "unknown identity type",
+			input:       fmt.Errorf("%w: \"Robot\"", ErrUnknownIdentityType),
+			want:        "unknown_identity_type",
+		},
+		{
+			description: "invalid identity header",
+			input:       identity.InvalidIdentityError{Reason: "not base64-encoded or raw JSON"},
+			want:        "invalid_identity",
+		},
+		{
+			description: "invalid credentials",
+			input:       errors.New("invalid fake credentials"),
+			want:        "invalid_credentials",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := authRejectionReason(test.input); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithAuthenticator(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	fake := AuthenticatorFunc(func(r *http.Request) (*identity.Identity, error) {
+		if r.Header.Get("Authorization") != "Fake 1979710" {
+			return nil, errors.New("invalid fake credentials")
+		}
+		var id identity.Identity
+		id.Identity.OrgID = "1979710"
+		return &id, nil
+	})
+
+	tests := []struct {
+		desc  string
+		input string
+		want  response
+	}{
+		{
+			desc:  "accepted",
+			input: "Fake 1979710",
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "rejected",
+			input: "Fake 0",
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid fake credentials"}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			db, err := Open("sqlite3", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Migrate(false); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.seedData([]byte(`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)); err != nil {
+				t.Fatal(err)
+			}
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil, WithAuthenticator(fake))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("Authorization", test.input)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIdentityTypeAuthenticator(t *testing.T) {
+	typed := func(identityType string) Authenticator {
+		return AuthenticatorFunc(func(r *http.Request) (*identity.Identity, error) {
+			var id identity.Identity
+			id.Identity.OrgID = "1979710"
+			if identityType != "" {
+				id.Identity.Type = &identityType
+			}
+			return &id, nil
+		})
+	}
+
+	type input struct {
+		identityType string
+		reject       bool
+	}
+	tests := []struct {
+		desc      string
+		input     input
+		wantError error
+	}{
+		{
+			desc:  "known",
+			input: input{"User", true},
+		},
+		{
+			desc:      "no type, rejected",
+			input:     input{"", true},
+			wantError: ErrUnknownIdentityType,
+		},
+		{
+			desc:  "no type, logged",
+			input: input{"", false},
+		},
+		{
+			desc:      "unknown, rejected",
+			input:     input{"Robot", true},
+			wantError: ErrUnknownIdentityType,
+		},
+		{
+			desc:  "unknown, logged",
+			input: input{"Robot", false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			a := identityTypeAuthenticator{
+				next:   typed(test.input.identityType),
+				known:  parseIdentityTypes("Associate, User,"),
+				reject: test.input.reject,
+			}
+			got, err := a.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if test.wantError != nil {
+				if !errors.Is(err, test.wantError) {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Identity.OrgID != "1979710" {
+					t.Errorf("%v != %v", got.Identity.OrgID, "1979710")
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownIdentityType(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input struct{ policy, identityType, orgIDHeader string }
+		want  response
+	}{
+		{
+			desc:  "allow",
+			input: struct{ policy, identityType, orgIDHeader string }{"allow", "Robot", ""},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "log",
+			input: struct{ policy, identityType, orgIDHeader string }{"log", "Robot", ""},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "reject",
+			input: struct{ policy, identityType, orgIDHeader string }{"reject", "Robot", ""},
+			want:  response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":"unknown identity type: \"Robot\""}]}`},
+		},
+		{
+			desc:  "reject, known type",
+			input: struct{ policy, identityType, orgIDHeader string }{"reject", "System", ""},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "reject, empty type",
+			input: struct{ policy, identityType, orgIDHeader string }{"reject", "", ""},
+			want:  response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":"unknown identity type: \"\""}]}`},
+		},
+		{
+			desc:  "reject, X-Org-Id",
+			input: struct{ policy, identityType, orgIDHeader string }{"reject", "", "1979710"},
+			want:  response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":"unknown identity type: \"\""}]}`},
+		},
+		{
+			desc:  "log, X-Org-Id",
+			input: struct{ policy, identityType, orgIDHeader string }{"log", "", "1979710"},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.UnknownIdentityType.Value = test.input.policy
+			config.DefaultConfig.TrustOrgIDHeader = true
+			config.DefaultConfig.TrustedNetworks = "192.0.2.0/24"
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			if test.input.orgIDHeader != "" {
+				req.Header.Add("X-Org-Id", test.input.orgIDHeader)
+			} else {
+				req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "`+test.input.identityType+`" } }`)))
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// routingRule is the routing data recorded for an org and module, from which
+// the channel the org is routed to is resolved.
+type routingRule struct {
+	// matched is set if the org has a rule routing it to the testing channel.
+	matched bool
+	// minVersion is the minimum client version required for the testing
+	// channel. It is only looked up when routing by version is enabled.
+	minVersion string
+	// defaultChannel is the module's default channel for orgs without a
+	// rule, or empty for the global default.
+	defaultChannel string
+	// url is the URL the org is sent to in place of the URL of its channel,
+	// or empty if none is recorded.
+	url string
+	// ttl is the duration the rule is cached for, overriding the cache's TTL
+	// if hasTTL is set.
+	ttl    time.Duration
+	hasTTL bool
+}
+
+// ruleKey identifies the routingRule of an org and module.
+type ruleKey struct {
+	module string
+	orgID  string
+}
+
+// ruleCacheMaxEntries bounds the number of entries held by a ruleCache.
+const ruleCacheMaxEntries = 100000
+
+// ruleCache caches routingRules for a TTL and coalesces concurrent lookups of
+// the same rule into a single load. Rules carrying their own TTL are cached
+// for that TTL instead. A zero TTL disables caching, but lookups are still
+// coalesced. Failed loads are not cached. It is safe for concurrent use.
+type ruleCache struct {
+	ttl   time.Duration
+	clock Clock
+	// jitter is the largest fraction of its TTL by which an entry's lifetime
+	// is randomly shortened, so that entries loaded together, such as after a
+	// restart, do not all expire together.
+	jitter float64
+	rand   Rand
+	// keepStale keeps rules after they expire, even with a zero TTL, so that
+	// the last loaded rule is available from stale until it is evicted.
+	keepStale bool
+
+	mu      sync.Mutex
+	entries map[ruleKey]ruleEntry
+	flights map[ruleKey]*ruleFlight
+}
+
+// ruleEntry is a cached routingRule and the time it expires.
+type ruleEntry struct {
+	rule    routingRule
+	expires time.Time
+}
+
+// ruleFlight is an in-progress load of a routingRule, waited on by every
+// concurrent lookup of the rule.
+type ruleFlight struct {
+	done chan struct{}
+	rule routingRule
+	err  error
+	// invalidated is set if the rule was invalidated while it was loading,
+	// in which case the loaded rule may predate the change and is not
+	// cached. It is guarded by ruleCache.mu.
+	invalidated bool
+}
+
+func newRuleCache(ttl time.Duration, clock Clock) *ruleCache {
+	return &ruleCache{
+		ttl:     ttl,
+		clock:   clock,
+		rand:    systemRand{},
+		entries: make(map[ruleKey]ruleEntry),
+		flights: make(map[ruleKey]*ruleFlight),
+	}
+}
+
+// get returns the cached rule for key, calling load to look it up if it is
+// not cached or has expired. If a load of key is already in progress, get
+// waits for it and returns its result instead.
+func (c *ruleCache) get(key ruleKey, load func() (routingRule, error)) (routingRule, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && c.clock.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.rule, nil
+	}
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.rule, f.err
+	}
+	f := &ruleFlight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	f.rule, f.err = load()
+
+	ttl := c.ttl
+	if f.rule.hasTTL {
+		ttl = f.rule.ttl
+	}
+	ttl = c.jittered(ttl)
+	c.mu.Lock()
+	delete(c.flights, key)
+	if f.err == nil && !f.invalidated && (ttl > 0 || c.keepStale) {
+		now := c.clock.Now()
+		if len(c.entries) >= ruleCacheMaxEntries {
+			c.evict(now)
+		}
+		c.entries[key] = ruleEntry{rule: f.rule, expires: now.Add(ttl)}
+	}
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.rule, f.err
+}
+
+// jittered returns ttl shortened by a random fraction of up to c.jitter.
+func (c *ruleCache) jittered(ttl time.Duration) time.Duration {
+	if c.jitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(c.jitter*c.rand.Float64()*float64(ttl))
+}
+
+// invalidate drops the cached rule for key, so that the next lookup of key
+// loads it again. A load of key already in progress is still returned to its
+// waiters, but its rule is not cached.
+func (c *ruleCache) invalidate(key ruleKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	if f, ok := c.flights[key]; ok {
+		f.invalidated = true
+	}
+}
+
+// stale returns the last rule loaded for key, even if it has expired. Expired
+// rules are only kept if keepStale is set.
+func (c *ruleCache) stale(key ruleKey) (routingRule, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e.rule, ok
+}
+
+// evict drops expired entries, or every entry if none have expired. The
+// caller must hold c.mu.
+func (c *ruleCache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if len(c.entries) >= ruleCacheMaxEntries {
+		c.entries = make(map[ruleKey]ruleEntry)
+	}
+}
+
+// moduleInfo is the routing data recorded for a module, regardless of org.
+// Each moduleCache only loads the fields it is used for.
+type moduleInfo struct {
+	// retired is set if the module is retired, in which case replacement is
+	// the module replacing it, or empty if none is recorded.
+	retired     bool
+	replacement string
+	// canonical is the module name the module is an alias of, or the module
+	// itself if it is not an alias.
+	canonical string
+}
+
+// moduleCacheMaxEntries bounds the number of entries held by a moduleCache.
+const moduleCacheMaxEntries = 10000
+
+// moduleCache caches moduleInfos by module name for a TTL, so that data
+// recorded per module is not looked up again for every org routed to it. A
+// zero TTL disables caching. Failed loads are not cached. Unlike ruleCache,
+// concurrent lookups are not coalesced, as modules are few. It is safe for
+// concurrent use.
+type moduleCache struct {
+	ttl   time.Duration
+	clock Clock
+
+	mu      sync.Mutex
+	entries map[string]moduleEntry
+}
+
+// moduleEntry is a cached moduleInfo and the time it expires.
+type moduleEntry struct {
+	info    moduleInfo
+	expires time.Time
+}
+
+func newModuleCache(ttl time.Duration, clock Clock) *moduleCache {
+	return &moduleCache{
+		ttl:     ttl,
+		clock:   clock,
+		entries: make(map[string]moduleEntry),
+	}
+}
+
+// get returns the cached moduleInfo for module, calling load to look it up if
+// it is not cached or has expired.
+func (c *moduleCache) get(module string, load func() (moduleInfo, error)) (moduleInfo, error) {
+	c.mu.Lock()
+	e, ok := c.entries[module]
+	c.mu.Unlock()
+	if ok && c.clock.Now().Before(e.expires) {
+		return e.info, nil
+	}
+
+	info, err := load()
+	if err != nil || c.ttl <= 0 {
+		return info, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	if len(c.entries) >= moduleCacheMaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= moduleCacheMaxEntries {
+			c.entries = make(map[string]moduleEntry)
+		}
+	}
+	c.entries[module] = moduleEntry{info: info, expires: now.Add(c.ttl)}
+	return info, nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRuleCacheTTL(t *testing.T) {
+	clock := &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		description string
+		input       struct {
+			ttl     time.Duration
+			advance time.Duration
+		}
+		want int
+	}{
+		{
+			description: "cached",
+			input: struct {
+				ttl     time.Duration
+				advance time.Duration
+			}{time.Minute, 30 * time.Second},
+			want: 1,
+		},
+		{
+			description: "expired",
+			input: struct {
+				ttl     time.Duration
+				advance time.Duration
+			}{time.Minute, time.Minute},
+			want: 2,
+		},
+		{
+			description: "disabled",
+			input: struct {
+				ttl     time.Duration
+				advance time.Duration
+			}{0, 0},
+			want: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			c := newRuleCache(test.input.ttl, clock)
+			var loads int
+			load := func() (routingRule, error) {
+				loads++
+				return routingRule{matched: true}, nil
+			}
+			key := ruleKey{"insights-core", "1979710"}
+
+			if _, err := c.get(key, load); err != nil {
+				t.Fatal(err)
+			}
+			clock.t = clock.t.Add(test.input.advance)
+			got, err := c.get(key, load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.matched {
+				t.Errorf("%+v: want matched rule", got)
+			}
+			if loads != test.want {
+				t.Errorf("%v != %v", loads, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleCacheRuleTTL(t *testing.T) {
+	clock := &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		description string
+		input       routingRule
+		advance     time.Duration
+		want        int
+	}{
+		{
+			description: "shorter, expired",
+			input:       routingRule{ttl: 10 * time.Second, hasTTL: true},
+			advance:     30 * time.Second,
+			want:        2,
+		},
+		{
+			description: "longer, cached",
+			input:       routingRule{ttl: time.Hour, hasTTL: true},
+			advance:     30 * time.Minute,
+			want:        1,
+		},
+		{
+			description: "zero, disabled",
+			input:       routingRule{hasTTL: true},
+			want:        2,
+		},
+		{
+			description: "unset, cache TTL",
+			input:       routingRule{},
+			advance:     30 * time.Second,
+			want:        1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			c := newRuleCache(time.Minute, clock)
+			var loads int
+			load := func() (routingRule, error) {
+				loads++
+				return test.input, nil
+			}
+			key := ruleKey{"insights-core", "1979710"}
+
+			if _, err := c.get(key, load); err != nil {
+				t.Fatal(err)
+			}
+			clock.t = clock.t.Add(test.advance)
+			if _, err := c.get(key, load); err != nil {
+				t.Fatal(err)
+			}
+			if loads != test.want {
+				t.Errorf("%v != %v", loads, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleCacheJitter(t *testing.T) {
+	tests := []struct {
+		description string
+		input       struct {
+			jitter  float64
+			rand    float64
+			advance time.Duration
+		}
+		want int
+	}{
+		{
+			description: "shortened, not expired",
+			input: struct {
+				jitter  float64
+				rand    float64
+				advance time.Duration
+			}{0.5, 0.5, 44 * time.Second},
+			want: 1,
+		},
+		{
+			description: "shortened, expired",
+			input: struct {
+				jitter  float64
+				rand    float64
+				advance time.Duration
+			}{0.5, 0.5, 45 * time.Second},
+			want: 2,
+		},
+		{
+			description: "disabled",
+			input: struct {
+				jitter  float64
+				rand    float64
+				advance time.Duration
+			}{0, 0.5, 59 * time.Second},
+			want: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			clock := &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+			c := newRuleCache(time.Minute, clock)
+			c.jitter = test.input.jitter
+			c.rand = fixedRand(test.input.rand)
+			var loads int
+			load := func() (routingRule, error) {
+				loads++
+				return routingRule{matched: true}, nil
+			}
+			key := ruleKey{"insights-core", "1979710"}
+
+			if _, err := c.get(key, load); err != nil {
+				t.Fatal(err)
+			}
+			clock.t = clock.t.Add(test.input.advance)
+			if _, err := c.get(key, load); err != nil {
+				t.Fatal(err)
+			}
+			if loads != test.want {
+				t.Errorf("%v != %v", loads, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleCacheErrorNotCached(t *testing.T) {
+	c := newRuleCache(time.Minute, &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)})
+	key := ruleKey{"insights-core", "1979710"}
+	errLoad := errors.New("connection refused")
+
+	if _, err := c.get(key, func() (routingRule, error) { return routingRule{}, errLoad }); !errors.Is(err, errLoad) {
+		t.Fatalf("%v != %v", err, errLoad)
+	}
+	got, err := c.get(key, func() (routingRule, error) { return routingRule{matched: true}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.matched {
+		t.Errorf("%+v: want matched rule", got)
+	}
+}
+
+func TestRuleCacheCoalesce(t *testing.T) {
+	c := newRuleCache(time.Minute, &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)})
+	key := ruleKey{"insights-core", "1979710"}
+
+	var loads int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	load := func() (routingRule, error) {
+		if atomic.AddInt32(&loads, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return routingRule{matched: true}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]routingRule, 8)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = c.get(key, load)
+	}()
+	<-started
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.get(key, load)
+		}(i)
+	}
+	// Lookups that start after the load finishes are served from the cache,
+	// so exactly one load happens however the goroutines are scheduled.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&loads); got != 1 {
+		t.Errorf("%v != %v", got, 1)
+	}
+	for i, r := range results {
+		if !r.matched {
+			t.Errorf("result %v: want matched rule", i)
+		}
+	}
+}
+
+func TestRuleCacheInvalidate(t *testing.T) {
+	c := newRuleCache(time.Minute, &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)})
+	key := ruleKey{"insights-core", "1979710"}
+
+	if _, err := c.get(key, func() (routingRule, error) { return routingRule{matched: true}, nil }); err != nil {
+		t.Fatal(err)
+	}
+	c.invalidate(key)
+	got, err := c.get(key, func() (routingRule, error) { return routingRule{}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.matched {
+		t.Errorf("%+v: want unmatched rule", got)
+	}
+}
+
+func TestRuleCacheInvalidateInFlight(t *testing.T) {
+	c := newRuleCache(time.Minute, &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)})
+	key := ruleKey{"insights-core", "1979710"}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = c.get(key, func() (routingRule, error) {
+			close(started)
+			<-release
+			return routingRule{matched: true}, nil
+		})
+	}()
+	<-started
+	c.invalidate(key)
+	close(release)
+	<-done
+
+	got, err := c.get(key, func() (routingRule, error) { return routingRule{}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.matched {
+		t.Errorf("%+v: want the rule loaded before invalidation not to be cached", got)
+	}
+}
+
+func TestModuleCache(t *testing.T) {
+	clock := &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		description string
+		input       struct {
+			ttl     time.Duration
+			advance time.Duration
+			err     error
+		}
+		want int
+	}{
+		{
+			description: "cached",
+			input: struct {
+				ttl     time.Duration
+				advance time.Duration
+				err     error
+			}{time.Minute, 30 * time.Second, nil},
+			want: 1,
+		},
+		{
+			description: "expired",
+			input: struct {
+				ttl     time.Duration
+				advance time.Duration
+				err     error
+			}{time.Minute, time.Minute, nil},
+			want: 2,
+		},
+		{
+			description: "disabled",
+			input: struct {
+				ttl     time.Duration
+				advance time.Duration
+				err     error
+			}{0, 0, nil},
+			want: 2,
+		},
+		{
+			description: "error not cached",
+			input: struct {
+				ttl     time.Duration
+				advance time.Duration
+				err     error
+			}{time.Minute, 0, errors.New("connection refused")},
+			want: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			c := newModuleCache(test.input.ttl, clock)
+			var loads int
+			load := func() (moduleInfo, error) {
+				loads++
+				if loads == 1 && test.input.err != nil {
+					return moduleInfo{}, test.input.err
+				}
+				return moduleInfo{retired: true, replacement: "insights-core"}, nil
+			}
+
+			if _, err := c.get("oldmod", load); !errors.Is(err, test.input.err) {
+				t.Fatalf("%v != %v", err, test.input.err)
+			}
+			clock.t = clock.t.Add(test.input.advance)
+			got, err := c.get("oldmod", load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (moduleInfo{retired: true, replacement: "insights-core"}); got != want {
+				t.Errorf("%+v != %+v", got, want)
+			}
+			if loads != test.want {
+				t.Errorf("%v != %v", loads, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/redhatinsights/module-update-router/internal/config"
+)
+
+// errCheckFailed is returned by check when the configuration or the seed files
+// are invalid.
+var errCheckFailed = errors.New("check failed")
+
+// check validates config.DefaultConfig and the seed files it names, without
+// binding ports or connecting to the configured database, and writes a line
+// reporting the outcome of each to w. The configuration is validated with
+// Config.Validate and by creating a server from it. The seed files are loaded
+// into a freshly migrated in-memory database, incrementally if SeedIncremental
+// is set, as they would be into the configured one. It returns errCheckFailed
+// if either is invalid.
+func check(w io.Writer, apiroots []string) error {
+	failed := false
+	if problems := checkConfig(apiroots); len(problems) > 0 {
+		failed = true
+		for _, problem := range problems {
+			fmt.Fprintf(w, "config: FAIL: %v\n", problem)
+		}
+	} else {
+		fmt.Fprintln(w, "config: ok")
+	}
+
+	if err := checkSeed(w); err != nil {
+		failed = true
+		fmt.Fprintf(w, "seed: FAIL: %v\n", err)
+	}
+
+	if failed {
+		return errCheckFailed
+	}
+	return nil
+}
+
+// checkConfig returns the problems found in config.DefaultConfig, creating a
+// server backed by an in-memory database to validate the values parsed by
+// NewServer.
+func checkConfig(apiroots []string) []string {
+	var problems []string
+	var invalid config.ValidationError
+	if err := config.DefaultConfig.Validate(); errors.As(err, &invalid) {
+		problems = append(problems, invalid...)
+	} else if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if !metricsNamespacePattern.MatchString(config.DefaultConfig.MetricsPrefix) {
+		problems = append(problems, fmt.Sprintf("metrics_prefix: invalid namespace: %q", config.DefaultConfig.MetricsPrefix))
+	}
+	if _, err := DataSourceName(config.DefaultConfig); err != nil {
+		problems = append(problems, err.Error())
+	}
+	db, err := openCheckDB()
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	srv, err := NewServer(config.DefaultConfig.Addr, apiroots, db, nil)
+	if err != nil {
+		db.Close()
+		problems = append(problems, err.Error())
+	} else {
+		srv.Close()
+	}
+	return problems
+}
+
+// checkSeed loads the seed files named by config.DefaultConfig into an
+// in-memory database and reports the routing rows they seed to w. Rows an
+// incremental seed would discard as duplicates are reported, but are not an
+// error. When there are several files, the file of each duplicate and the
+// number of rows each file contributes are reported too.
+func checkSeed(w io.Writer) error {
+	if config.DefaultConfig.SeedPath == "" {
+		fmt.Fprintln(w, "seed: skipped: no seed-path")
+		return nil
+	}
+	paths, err := seedPaths(config.DefaultConfig.SeedPath)
+	if err != nil {
+		return err
+	}
+	db, err := openCheckDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !config.DefaultConfig.SeedIncremental {
+		if err := db.Seed(paths); err != nil {
+			return err
+		}
+		n, err := db.RoutingRows()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "seed: ok: %v routing rows\n", n)
+		return nil
+	}
+	report, err := db.SeedIncremental(paths, config.DefaultConfig.SeedDuplicates.Value == "first")
+	if err != nil {
+		return err
+	}
+	for _, d := range report.Duplicates {
+		if len(paths) > 1 {
+			fmt.Fprintf(w, "seed: duplicate row in %v: %v (conflicting: %v, from: %v, merged from: %v)\n", d.Table, d.Key, d.Conflicting, d.Path, d.MergedPath)
+			continue
+		}
+		fmt.Fprintf(w, "seed: duplicate row in %v: %v (conflicting: %v)\n", d.Table, d.Key, d.Conflicting)
+	}
+	if len(paths) > 1 {
+		rows := make(map[string]int)
+		for _, r := range report.Rows {
+			rows[r.Path]++
+		}
+		for _, path := range paths {
+			fmt.Fprintf(w, "seed: %v: %v routing rows\n", path, rows[path])
+		}
+	}
+	fmt.Fprintf(w, "seed: ok: %v routing rows, %v duplicates\n", report.Added+report.Updated+report.Unchanged, len(report.Duplicates))
+	return nil
+}
+
+// openCheckDB opens and migrates a new in-memory database for check.
+func openCheckDB() (*DB, error) {
+	db, err := Open("sqlite3", fmt.Sprintf("file:check%v?mode=memory&cache=shared", time.Now().UnixNano()))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Migrate(false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
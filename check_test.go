@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/module-update-router/internal/config"
+)
+
+func TestCheck(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		desc  string
+		input struct {
+			configure   func(c *config.Config)
+			seed        string
+			incremental bool
+		}
+		want      string
+		wantError error
+	}{
+		{
+			desc: "no seed",
+			input: struct {
+				configure   func(c *config.Config)
+				seed        string
+				incremental bool
+			}{func(c *config.Config) {}, "", false},
+			want: "config: ok\nseed: skipped: no seed-path\n",
+		},
+		{
+			desc: "seed",
+			input: struct {
+				configure   func(c *config.Config)
+				seed        string
+				incremental bool
+			}{func(c *config.Config) {}, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1', 'insights-core'), ('2', 'insights-core');`, false},
+			want: "config: ok\nseed: ok: 2 routing rows\n",
+		},
+		{
+			desc: "incremental seed with duplicates",
+			input: struct {
+				configure   func(c *config.Config)
+				seed        string
+				incremental bool
+			}{func(c *config.Config) {}, `INSERT INTO modules_default_channels (module_name, channel) VALUES ('insights-core', 'testing'), ('insights-core', 'release');`, true},
+			want: "config: ok\nseed: duplicate row in modules_default_channels: insights-core (conflicting: true)\nseed: ok: 1 routing rows, 1 duplicates\n",
+		},
+		{
+			desc: "invalid seed",
+			input: struct {
+				configure   func(c *config.Config)
+				seed        string
+				incremental bool
+			}{func(c *config.Config) {}, `INSERT INTO no_such_table VALUES ('1');`, false},
+			want:      "config: ok\nseed: FAIL: db: db.handle.Exec failed: no such table: no_such_table\n",
+			wantError: errCheckFailed,
+		},
+		{
+			desc: "invalid config",
+			input: struct {
+				configure   func(c *config.Config)
+				seed        string
+				incremental bool
+			}{func(c *config.Config) {
+				c.EventSampleRate = 2
+				c.TypeRateLimits = "User"
+			}, "", false},
+			want:      "config: FAIL: event_sample_rate: must be between 0.0 and 1.0\nconfig: FAIL: invalid type rate limit: missing type: \"User\"\nseed: skipped: no seed-path\n",
+			wantError: errCheckFailed,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			test.input.configure(&config.DefaultConfig)
+			config.DefaultConfig.SeedIncremental = test.input.incremental
+			config.DefaultConfig.SeedPath = ""
+			if test.input.seed != "" {
+				path := filepath.Join(dir, fmt.Sprintf("seed%v.sql", i))
+				if err := os.WriteFile(path, []byte(test.input.seed), 0600); err != nil {
+					t.Fatal(err)
+				}
+				config.DefaultConfig.SeedPath = path
+			}
+
+			var buf bytes.Buffer
+			err := check(&buf, []string{"/api/module-update-router/v1"})
+
+			if !errors.Is(err, test.wantError) {
+				t.Errorf("%v != %v", err, test.wantError)
+			}
+			if got := buf.String(); !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestCheckSeedFiles(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+
+	dir := t.TempDir()
+	for name, seed := range map[string]string{
+		"10-base.sql": `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1', 'insights-core');
+INSERT INTO modules_default_channels (module_name, channel) VALUES ('insights-core', 'release');`,
+		"20-team.sql": `INSERT INTO modules_default_channels (module_name, channel) VALUES ('insights-core', 'testing');`,
+		"README.md":   `not a seed file`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(seed), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extra := filepath.Join(t.TempDir(), "extra.sql")
+	if err := os.WriteFile(extra, []byte(`INSERT INTO orgs_modules (org_id, module_name) VALUES ('2', 'insights-core');`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.DefaultConfig.SeedPath = dir + ", " + extra
+	config.DefaultConfig.SeedIncremental = true
+
+	var buf bytes.Buffer
+	if err := check(&buf, []string{"/api/module-update-router/v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	base, team := filepath.Join(dir, "10-base.sql"), filepath.Join(dir, "20-team.sql")
+	want := "config: ok\n" +
+		"seed: duplicate row in modules_default_channels: insights-core (conflicting: true, from: " + base + ", merged from: " + team + ")\n" +
+		"seed: " + base + ": 1 routing rows\n" +
+		"seed: " + team + ": 1 routing rows\n" +
+		"seed: " + extra + ": 1 routing rows\n" +
+		"seed: ok: 3 routing rows, 1 duplicates\n"
+	if got := buf.String(); !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Clock is a source of the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Rand is a source of pseudo-random numbers.
+type Rand interface {
+	// Float64 returns a number in [0.0,1.0).
+	Float64() float64
+	// Intn returns a number in [0,n). It panics if n <= 0.
+	Intn(n int) int
+}
+
+// systemClock is a Clock that reads the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// systemRand is a Rand backed by the top-level math/rand functions, which are
+// safe for concurrent use.
+type systemRand struct{}
+
+func (systemRand) Float64() float64 {
+	return rand.Float64()
+}
+
+func (systemRand) Intn(n int) int {
+	return rand.Intn(n)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// fixedClock is a Clock that always returns the same time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// fixedRand is a Rand that always returns the same fraction f, scaled to n in
+// calls to Intn.
+type fixedRand float64
+
+func (f fixedRand) Float64() float64 {
+	return float64(f)
+}
+
+func (f fixedRand) Intn(n int) int {
+	return int(float64(f) * float64(n))
+}
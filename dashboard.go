@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboardStats is the snapshot of live stats shown by the dashboard.
+type dashboardStats struct {
+	// Requests is the total number of routing decisions made by channel since
+	// the server started. The dashboard derives the request rate from
+	// successive snapshots.
+	Requests map[string]float64 `json:"requests"`
+	// DBUp is set if the database answered a ping.
+	DBUp bool `json:"db_up"`
+	// EventBuffer is the number of events queued for the Kafka producer, and
+	// EventBufferCapacity the size of the queue. Both are zero if events are
+	// not produced.
+	EventBuffer         int `json:"event_buffer"`
+	EventBufferCapacity int `json:"event_buffer_capacity"`
+	// OldestPendingEventAge is the age in seconds of the oldest event not yet
+	// produced.
+	OldestPendingEventAge float64 `json:"oldest_pending_event_age_seconds"`
+}
+
+// dashboardPingTimeout bounds the database ping made for each stats snapshot.
+const dashboardPingTimeout = time.Second
+
+// handleDashboard creates an http.HandlerFunc serving the dashboard page. The
+// page polls /dashboard/stats and refreshes itself client-side.
+func (s *Server) handleDashboard() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write(dashboardHTML); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// handleDashboardStats creates an http.HandlerFunc responding with a
+// dashboardStats snapshot, read from the server's prometheus registry and
+// state.
+func (s *Server) handleDashboardStats() http.HandlerFunc {
+	requestsName := prometheus.BuildFQName(s.metricsPrefix, "", "requests")
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := dashboardStats{
+			Requests:              make(map[string]float64),
+			OldestPendingEventAge: pendingEvents.age(s.clock.Now()).Seconds(),
+		}
+
+		families, err := s.registry.Gather()
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		for _, family := range families {
+			if family.GetName() != requestsName {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "endpoint" {
+						stats.Requests[label.GetValue()] += m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), dashboardPingTimeout)
+		defer cancel()
+		stats.DBUp = s.db.handle.PingContext(ctx) == nil
+
+		if s.events != nil {
+			stats.EventBuffer = len(*s.events)
+			stats.EventBufferCapacity = cap(*s.events)
+		}
+
+		data, err := json.Marshal(stats)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+	events := make(chan queuedEvent, 10)
+	events <- queuedEvent{}
+	srv.events = &events
+
+	rr := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if strings.Contains(rr.Body.String(), "<html") {
+		t.Errorf("dashboard served while disabled")
+	}
+
+	srv.dashboard = true
+	rr = httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("%v != %v", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("%v != %v", got, "text/html; charset=utf-8")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+	req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr = httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/dashboard/stats", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("%v != %v", rr.Code, http.StatusOK)
+	}
+	var got dashboardStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Requests["/testing"] < 1 {
+		t.Errorf("requests to /testing: %v < 1", got.Requests["/testing"])
+	}
+	if !got.DBUp {
+		t.Error("database reported down")
+	}
+	if got.EventBuffer != 1 || got.EventBufferCapacity != 10 {
+		t.Errorf("event buffer: %v/%v != 1/10", got.EventBuffer, got.EventBufferCapacity)
+	}
+}
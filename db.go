@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -14,6 +21,7 @@ import (
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/redhatinsights/module-update-router/internal/config"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/mattn/go-sqlite3"
@@ -28,8 +36,25 @@ type DB struct {
 	handle     *sqlx.DB
 	statements map[string]*sqlx.Stmt
 	driverName string
+
+	// conns holds a token for each connection in use by a request-path query
+	// when the connection pool is bounded. It is nil when the pool is
+	// unbounded.
+	conns          chan struct{}
+	acquireTimeout time.Duration
+	// observeAcquireWait, if set, observes how long each acquisition waited.
+	observeAcquireWait func(time.Duration)
+
+	// seedBatchSize and seedWorkers configure the merge of an incremental
+	// seed; see SetSeedBatching.
+	seedBatchSize int
+	seedWorkers   int
 }
 
+// ErrDatabaseBusy is returned by queries that cannot acquire a database
+// connection within the acquisition timeout because the pool is exhausted.
+var ErrDatabaseBusy = errors.New("db: database busy")
+
 // Open opens a database specified by dataSourceName. The only supported driver
 // types are "sqlite3" or "pgx".
 //
@@ -52,6 +77,150 @@ func Open(driverName, dataSourceName string) (*DB, error) {
 	}, nil
 }
 
+// DataSourceName returns a data source name for c.DBDriver, suitable for
+// passing to Open. A non-empty c.DBURL always takes precedence and is returned
+// as-is. Otherwise, the "pgx" driver builds a connection URL from the discrete
+// DBHost, DBPort, DBName, DBUser and DBPass fields and the "sqlite3" driver
+// uses a shared in-memory database.
+func DataSourceName(c config.Config) (string, error) {
+	if c.DBURL != "" {
+		return c.DBURL, nil
+	}
+	switch c.DBDriver.Value {
+	case "pgx":
+		return fmt.Sprintf("postgres://%v:%v@%v:%v/%v", c.DBUser, c.DBPass, c.DBHost, c.DBPort, c.DBName), nil
+	case "sqlite3":
+		return "file::memory:?cache=shared", nil
+	default:
+		return "", fmt.Errorf("db: unsupported database: %v", c.DBDriver.Value)
+	}
+}
+
+// DBURLConflicts returns the flag names of the discrete database fields in c
+// whose values disagree with the corresponding component of c.DBURL. It
+// returns nil if c.DBURL is empty or is not a URL.
+func DBURLConflicts(c config.Config) []string {
+	if c.DBURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.DBURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil
+	}
+
+	var conflicts []string
+	if u.Hostname() != c.DBHost {
+		conflicts = append(conflicts, "db-host")
+	}
+	if u.Port() != "" && u.Port() != strconv.Itoa(c.DBPort) {
+		conflicts = append(conflicts, "db-port")
+	}
+	if name := strings.TrimPrefix(u.Path, "/"); name != "" && name != c.DBName {
+		conflicts = append(conflicts, "db-name")
+	}
+	if u.User != nil {
+		if u.User.Username() != c.DBUser {
+			conflicts = append(conflicts, "db-user")
+		}
+		if pass, ok := u.User.Password(); ok && pass != c.DBPass {
+			conflicts = append(conflicts, "db-pass")
+		}
+	}
+	return conflicts
+}
+
+// SetMaxConns bounds the connection pool to n open connections. Request-path
+// queries wait at most acquireTimeout for a connection once all n are in use
+// and then fail with ErrDatabaseBusy; a zero acquireTimeout waits
+// indefinitely. A zero n leaves the pool unbounded. SetMaxConns must be
+// called before the database is queried.
+func (db *DB) SetMaxConns(n int, acquireTimeout time.Duration) {
+	db.handle.SetMaxOpenConns(n)
+	db.conns = nil
+	if n > 0 {
+		db.conns = make(chan struct{}, n)
+	}
+	db.acquireTimeout = acquireTimeout
+}
+
+// SetSeedBatching configures incremental seeds to merge their rows in
+// transactions of at most batchSize rows each, committed by up to workers
+// concurrent goroutines, rather than in a single transaction. A zero batchSize
+// merges every row in a single transaction, as does a seed into SQLite, which
+// serializes writers, regardless of workers.
+func (db *DB) SetSeedBatching(batchSize, workers int) {
+	db.seedBatchSize = batchSize
+	db.seedWorkers = workers
+}
+
+// Warm opens n connections to the database, pinging each, and returns them to
+// the pool as idle connections so that the first queries do not pay the cost
+// of establishing them. The pool keeps at least n idle connections from then
+// on. n is capped by the bound set by SetMaxConns, if any. Warm returns the
+// number of connections opened, which is less than n if an error occurs.
+func (db *DB) Warm(ctx context.Context, n int) (int, error) {
+	if db.conns != nil && n > cap(db.conns) {
+		n = cap(db.conns)
+	}
+	if n > 2 {
+		db.handle.SetMaxIdleConns(n)
+	}
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c, err := db.handle.Conn(ctx)
+		if err != nil {
+			return len(conns), fmt.Errorf("db: db.handle.Conn failed: %w", err)
+		}
+		conns = append(conns, c)
+		if err := c.PingContext(ctx); err != nil {
+			return len(conns) - 1, fmt.Errorf("db: c.PingContext failed: %w", err)
+		}
+	}
+	return len(conns), nil
+}
+
+// acquire reserves a connection for a request-path query, returning a func to
+// release it once the query is done. It fails with ErrDatabaseBusy if no
+// connection becomes available within the acquisition timeout.
+func (db *DB) acquire() (func(), error) {
+	if db.conns == nil {
+		return func() {}, nil
+	}
+	release := func() { <-db.conns }
+
+	start := time.Now()
+	observe := func() {
+		if db.observeAcquireWait != nil {
+			db.observeAcquireWait(time.Since(start))
+		}
+	}
+	select {
+	case db.conns <- struct{}{}:
+		observe()
+		return release, nil
+	default:
+	}
+	var timeout <-chan time.Time
+	if db.acquireTimeout > 0 {
+		t := time.NewTimer(db.acquireTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case db.conns <- struct{}{}:
+		observe()
+		return release, nil
+	case <-timeout:
+		observe()
+		return nil, ErrDatabaseBusy
+	}
+}
+
 // Close closes all open prepared statements and returns the connection to the
 // connection pool.
 func (db *DB) Close() error {
@@ -64,6 +233,12 @@ func (db *DB) Close() error {
 // Count returns the number of records found in the orgs_modules table with the
 // given module name and org ID.
 func (db *DB) Count(moduleName, orgID string) (int, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return -1, err
+	}
+	defer release()
+
 	stmt, err := db.preparedStatement(`SELECT COUNT(*) FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`)
 	if err != nil {
 		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
@@ -77,6 +252,195 @@ func (db *DB) Count(moduleName, orgID string) (int, error) {
 	return count, nil
 }
 
+// MinClientVersion returns the minimum client version required to be routed
+// to the testing channel for the given module name. If no minimum is recorded
+// for the module, an empty string is returned.
+func (db *DB) MinClientVersion(moduleName string) (string, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT min_version FROM modules_client_versions WHERE module_name = $1;`)
+	if err != nil {
+		return "", fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var version string
+	err = stmt.QueryRow(moduleName).Scan(&version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return version, nil
+}
+
+// DefaultChannel returns the channel that orgs without a rule for the given
+// module name are routed to. If no default is recorded for the module, an
+// empty string is returned.
+func (db *DB) DefaultChannel(moduleName string) (string, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT channel FROM modules_default_channels WHERE module_name = $1;`)
+	if err != nil {
+		return "", fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var channel string
+	err = stmt.QueryRow(moduleName).Scan(&channel)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return channel, nil
+}
+
+// OrgModuleURL returns the URL recorded for orgID in place of the URL of its
+// channel for the given module name. If none is recorded, an empty string is
+// returned.
+func (db *DB) OrgModuleURL(moduleName, orgID string) (string, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT url FROM orgs_modules_urls WHERE module_name = $1 AND org_id = $2;`)
+	if err != nil {
+		return "", fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var url string
+	err = stmt.QueryRow(moduleName, orgID).Scan(&url)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return url, nil
+}
+
+// CacheTTL returns the duration the routing rules of the given module name are
+// cached for, and whether one is recorded for the module.
+func (db *DB) CacheTTL(moduleName string) (time.Duration, bool, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return 0, false, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT ttl_seconds FROM modules_cache_ttls WHERE module_name = $1;`)
+	if err != nil {
+		return 0, false, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var seconds int64
+	err = stmt.QueryRow(moduleName).Scan(&seconds)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return time.Duration(seconds) * time.Second, true, nil
+}
+
+// RetiredModule reports whether the given module name is retired and, if so,
+// the name of the module replacing it. The replacement is empty if none is
+// recorded.
+func (db *DB) RetiredModule(moduleName string) (string, bool, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return "", false, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT replacement FROM modules_retired WHERE module_name = $1;`)
+	if err != nil {
+		return "", false, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var replacement string
+	err = stmt.QueryRow(moduleName).Scan(&replacement)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return replacement, true, nil
+}
+
+// Modules returns the names of every module known to the database, being any
+// module that has an org routed to it, a default channel or a minimum client
+// version, in lexical order. Retired modules are excluded.
+func (db *DB) Modules() ([]string, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT module_name FROM orgs_modules UNION SELECT module_name FROM modules_default_channels UNION SELECT module_name FROM modules_client_versions EXCEPT SELECT module_name FROM modules_retired ORDER BY module_name;`)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("db: stmt.Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var modules []string
+	for rows.Next() {
+		var module string
+		if err := rows.Scan(&module); err != nil {
+			return nil, fmt.Errorf("db: rows.Scan failed: %w", err)
+		}
+		modules = append(modules, module)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("db: rows.Err failed: %w", err)
+	}
+	return modules, nil
+}
+
+// CanonicalModule returns the module name that the given module name is an
+// alias of. If moduleName is not an alias, it is returned unchanged.
+func (db *DB) CanonicalModule(moduleName string) (string, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT module_name FROM modules_aliases WHERE alias = $1;`)
+	if err != nil {
+		return "", fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var canonical string
+	err = stmt.QueryRow(moduleName).Scan(&canonical)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return moduleName, nil
+		}
+		return "", fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return canonical, nil
+}
+
 // InsertOrgsModules creates a new record in the orgs_modules table with the
 // given module name and org ID, creating their respective table records if
 // necessary.
@@ -93,19 +457,99 @@ func (db *DB) InsertOrgsModules(moduleName, orgID string) error {
 	return nil
 }
 
-// InsertEvents creates a new record in the events table.
-func (db *DB) InsertEvents(phase string, startedAt time.Time, exit int, exception sql.NullString, endedAt time.Time, machineID string, coreVersion string, corePath string) error {
+// DeleteOrgsModules deletes the records in the orgs_modules table with the
+// given module name and org ID, and returns the number of records deleted.
+func (db *DB) DeleteOrgsModules(moduleName, orgID string) (int64, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`DELETE FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`)
+	if err != nil {
+		return 0, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	res, err := stmt.Exec(moduleName, orgID)
+	if err != nil {
+		return 0, fmt.Errorf("db: stmt.Exec failed: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("db: res.RowsAffected failed: %w", err)
+	}
+	return n, nil
+}
+
+// quotaDayLayout formats the day column of the channel_quota_usage table.
+const quotaDayLayout = "2006-01-02"
+
+// IncrementQuotaUsage counts a response routing orgID to channel on the UTC
+// day of t and returns the number of such responses counted that day,
+// including this one. Concurrent increments may each observe the other's
+// count.
+func (db *DB) IncrementQuotaUsage(orgID, channel string, t time.Time) (int, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return -1, err
+	}
+	defer release()
+
+	day := t.UTC().Format(quotaDayLayout)
+	stmt, err := db.preparedStatement(`INSERT INTO channel_quota_usage (org_id, channel, day, responses) VALUES ($1, $2, $3, 1) ON CONFLICT (org_id, channel, day) DO UPDATE SET responses = channel_quota_usage.responses + 1;`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	if _, err := stmt.Exec(orgID, channel, day); err != nil {
+		return -1, fmt.Errorf("db: stmt.Exec failed: %w", err)
+	}
+
+	stmt, err = db.preparedStatement(`SELECT responses FROM channel_quota_usage WHERE org_id = $1 AND channel = $2 AND day = $3;`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	var responses int
+	if err := stmt.QueryRow(orgID, channel, day).Scan(&responses); err != nil {
+		return -1, fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return responses, nil
+}
+
+// DeleteQuotaUsage deletes the quota usage counted on UTC days before the day
+// of older and returns the number of rows deleted.
+func (db *DB) DeleteQuotaUsage(older time.Time) (int64, error) {
+	stmt, err := db.preparedStatement(`DELETE FROM channel_quota_usage WHERE day < $1;`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	result, err := stmt.Exec(older.UTC().Format(quotaDayLayout))
+	if err != nil {
+		return -1, fmt.Errorf("db: stmt.Exec failed: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return -1, fmt.Errorf("db: result.RowsAffected failed: %w", err)
+	}
+
+	return rowsAffected, nil
+}
+
+// InsertEvents creates a new record in the events table. An empty source is
+// stored as NULL.
+func (db *DB) InsertEvents(phase string, startedAt time.Time, exit int, exception sql.NullString, endedAt time.Time, machineID string, coreVersion string, corePath string, source string) error {
 	eventID, err := uuid.NewUUID()
 	if err != nil {
 		return fmt.Errorf("db: uuid.NewUUID failed: %w", err)
 	}
 
-	stmt, err := db.preparedStatement(`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`)
+	stmt, err := db.preparedStatement(`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path, source) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`)
 	if err != nil {
 		return fmt.Errorf("db: db.preparedStatement failed: %w", err)
 	}
 
-	_, err = stmt.Exec(eventID.String(), phase, startedAt, exit, exception, endedAt, machineID, coreVersion, corePath)
+	_, err = stmt.Exec(eventID.String(), phase, startedAt, exit, exception, endedAt, machineID, coreVersion, corePath, sql.NullString{String: source, Valid: source != ""})
 	if err != nil {
 		return fmt.Errorf("db: stmt.Exec failed: %w", err)
 	}
@@ -113,66 +557,271 @@ func (db *DB) InsertEvents(phase string, startedAt time.Time, exit int, exceptio
 	return nil
 }
 
+// ErrResultTooLarge occurs when loading a query result would exceed the
+// memory budget given for it.
+var ErrResultTooLarge = errors.New("db: result exceeds memory budget")
+
+// eventOverhead approximates the memory, in bytes, taken by a loaded event
+// beyond the length of its string fields.
+const eventOverhead = 512
+
 // GetEvents returns a slice of maps loaded with records from the events table.
 func (db *DB) GetEvents(limit int, offset int) ([]map[string]interface{}, error) {
-	type event struct {
-		EventID     string         `db:"event_id"`
-		Phase       string         `db:"phase"`
-		StartedAt   time.Time      `db:"started_at"`
-		Exit        int            `db:"exit"`
-		Exception   sql.NullString `db:"exception"`
-		EndedAt     time.Time      `db:"ended_at"`
-		MachineID   string         `db:"machine_id"`
-		CoreVersion string         `db:"core_version"`
-		CorePath    sql.NullString `db:"core_path"`
-	}
-	var stmt *sqlx.Stmt
-	if limit < 0 {
-		var err error
-		stmt, err = db.preparedStatement(`SELECT * FROM events ORDER BY started_at;`)
-		if err != nil {
-			return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	return db.GetEventsMaxSize(limit, offset, 0, "", time.Time{}, time.Time{})
+}
+
+// GetEventsMaxSize is like GetEvents, but stops loading records and returns
+// ErrResultTooLarge once their approximate size in memory exceeds maxSize
+// bytes. A maxSize of zero or less means no limit. If source is not empty,
+// only events posted by that source are loaded. If since or until are not
+// zero, only events started at or after since, or before until, are loaded.
+func (db *DB) GetEventsMaxSize(limit int, offset int, maxSize int64, source string, since, until time.Time) ([]map[string]interface{}, error) {
+	size := 0
+	if limit > 0 {
+		size = limit
+		if maxSize > 0 && int64(size) > maxSize/eventOverhead {
+			size = int(maxSize / eventOverhead)
 		}
-	} else {
-		var err error
-		stmt, err = db.preparedStatement(fmt.Sprintf(`SELECT * FROM events ORDER BY started_at LIMIT %v OFFSET %v;`, limit, offset))
-		if err != nil {
-			return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+		if size > 1000 {
+			size = 1000
 		}
 	}
+	events := make([]map[string]interface{}, 0, size)
+	var total int64
+	err := db.EachEvent(limit, offset, source, since, until, func(event map[string]interface{}) error {
+		total += eventSize(event)
+		if maxSize > 0 && total > maxSize {
+			return ErrResultTooLarge
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
 
-	rows, err := stmt.Queryx()
+// EachEvent calls fn with each record of the events table, in the order and
+// range GetEvents loads them, without holding more than one record in memory.
+// If fn returns an error, EachEvent stops and returns it unwrapped. Events are
+// selected by source, since and until as by GetEventsMaxSize.
+func (db *DB) EachEvent(limit int, offset int, source string, since, until time.Time, fn func(event map[string]interface{}) error) error {
+	release, err := db.acquire()
 	if err != nil {
-		return nil, fmt.Errorf("db: stmt.Queryx failed: %w", err)
+		return err
+	}
+	defer release()
+
+	where, args := eventConditions(source, since, until)
+	query := `SELECT * FROM events` + where + ` ORDER BY started_at`
+	if limit >= 0 {
+		query += fmt.Sprintf(` LIMIT %v OFFSET %v`, limit, offset)
+	}
+	stmt, err := db.preparedStatement(query + `;`)
+	if err != nil {
+		return fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	rows, err := stmt.Queryx(args...)
+	if err != nil {
+		return fmt.Errorf("db: stmt.Queryx failed: %w", err)
 	}
 	defer rows.Close()
 
-	events := make([]map[string]interface{}, 0)
 	for rows.Next() {
-		var e event
+		var e eventRow
 		if err := rows.StructScan(&e); err != nil {
-			return nil, fmt.Errorf("db: rows.StructScan failed: %w", err)
-		}
-		event := make(map[string]interface{})
-		event["event_id"] = e.EventID
-		event["phase"] = e.Phase
-		event["started_at"] = e.StartedAt
-		event["exit"] = e.Exit
-		if e.Exception.Valid {
-			event["exception"] = e.Exception.String
-		}
-		event["ended_at"] = e.EndedAt
-		event["machine_id"] = e.MachineID
-		event["core_version"] = e.CoreVersion
-		if e.CorePath.Valid {
-			event["core_path"] = e.CorePath.String
+			return fmt.Errorf("db: rows.StructScan failed: %w", err)
+		}
+		if err := fn(e.fields()); err != nil {
+			return err
 		}
-		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("db: rows.Err failed: %w", err)
+	}
+	return nil
+}
+
+// eventConditions returns the WHERE clause, if any, selecting events posted by
+// source, if not empty, and started at or after since and before until, if not
+// zero, along with its arguments.
+func eventConditions(source string, since, until time.Time) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if source != "" {
+		args = append(args, source)
+		conditions = append(conditions, fmt.Sprintf(`source = $%v`, len(args)))
+	}
+	if !since.IsZero() {
+		args = append(args, since.UTC().Format(time.RFC3339))
+		conditions = append(conditions, fmt.Sprintf(`started_at >= $%v`, len(args)))
+	}
+	if !until.IsZero() {
+		args = append(args, until.UTC().Format(time.RFC3339))
+		conditions = append(conditions, fmt.Sprintf(`started_at < $%v`, len(args)))
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return ` WHERE ` + strings.Join(conditions, ` AND `), args
+}
+
+// GetEvent returns the record of the events table with the given ID, loaded
+// into a map as by GetEvents. If there is no such record, false is returned.
+func (db *DB) GetEvent(id string) (map[string]interface{}, bool, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT * FROM events WHERE event_id = $1;`)
+	if err != nil {
+		return nil, false, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var e eventRow
+	if err := stmt.QueryRowx(id).StructScan(&e); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("db: stmt.QueryRowx failed: %w", err)
+	}
+	return e.fields(), true, nil
+}
+
+// eventRow is a record of the events table.
+type eventRow struct {
+	EventID     string         `db:"event_id"`
+	Phase       string         `db:"phase"`
+	StartedAt   time.Time      `db:"started_at"`
+	Exit        int            `db:"exit"`
+	Exception   sql.NullString `db:"exception"`
+	EndedAt     time.Time      `db:"ended_at"`
+	MachineID   string         `db:"machine_id"`
+	CoreVersion string         `db:"core_version"`
+	CorePath    sql.NullString `db:"core_path"`
+	Source      sql.NullString `db:"source"`
+}
+
+// fields returns the columns of e as a map, omitting null ones.
+func (e eventRow) fields() map[string]interface{} {
+	event := make(map[string]interface{})
+	event["event_id"] = e.EventID
+	event["phase"] = e.Phase
+	event["started_at"] = e.StartedAt
+	event["exit"] = e.Exit
+	if e.Exception.Valid {
+		event["exception"] = e.Exception.String
+	}
+	event["ended_at"] = e.EndedAt
+	event["machine_id"] = e.MachineID
+	event["core_version"] = e.CoreVersion
+	if e.CorePath.Valid {
+		event["core_path"] = e.CorePath.String
+	}
+	if e.Source.Valid {
+		event["source"] = e.Source.String
+	}
+	return event
+}
+
+// CountEvents returns the number of records in the events table. Events are
+// selected by source, since and until as by GetEventsMaxSize.
+func (db *DB) CountEvents(source string, since, until time.Time) (int, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return -1, err
+	}
+	defer release()
+
+	where, args := eventConditions(source, since, until)
+	stmt, err := db.preparedStatement(`SELECT COUNT(*) FROM events` + where + `;`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var count int
+	if err := stmt.QueryRow(args...).Scan(&count); err != nil {
+		return -1, fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return count, nil
+}
+
+// eventSize approximates the memory, in bytes, taken by a loaded event.
+func eventSize(event map[string]interface{}) int64 {
+	size := int64(eventOverhead)
+	for _, v := range event {
+		if s, ok := v.(string); ok {
+			size += int64(len(s))
+		}
+	}
+	return size
+}
+
+// EventCount is the number of events sharing a value of the dimension they
+// are grouped by.
+type EventCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// EventDimensions lists the dimensions events can be grouped by in
+// EventStats.
+var EventDimensions = []string{"core_version", "day", "exit", "phase"}
+
+// EventStats returns the number of events started in the interval [from, to)
+// grouped by dimension, one of EventDimensions, in order of the dimension's
+// value. Events are grouped by day in the time zone they were recorded in,
+// formatted as YYYY-MM-DD.
+func (db *DB) EventStats(dimension string, from, to time.Time) ([]EventCount, error) {
+	var key string
+	switch dimension {
+	case "core_version", "phase":
+		key = dimension
+	case "exit":
+		key = "CAST(exit AS VARCHAR(11))"
+	case "day":
+		if db.driverName == "pgx" {
+			key = "to_char(started_at, 'YYYY-MM-DD')"
+		} else {
+			key = "substr(started_at, 1, 10)"
+		}
+	default:
+		return nil, fmt.Errorf("db: unsupported event dimension: %v", dimension)
+	}
+
+	release, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(fmt.Sprintf(`SELECT %v AS key, COUNT(*) AS count FROM events WHERE started_at >= $1 AND started_at < $2 GROUP BY key ORDER BY key;`, key))
+	if err != nil {
+		return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	rows, err := stmt.Query(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("db: stmt.Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	stats := []EventCount{}
+	for rows.Next() {
+		var c EventCount
+		if err := rows.Scan(&c.Key, &c.Count); err != nil {
+			return nil, fmt.Errorf("db: rows.Scan failed: %w", err)
+		}
+		stats = append(stats, c)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("db: rows.Err failed: %w", err)
 	}
-	return events, nil
+	return stats, nil
 }
 
 // DeleteEvents deletes all rows from the events table that have a started_at
@@ -196,6 +845,131 @@ func (db *DB) DeleteEvents(older time.Time) (int64, error) {
 	return rowsAffected, nil
 }
 
+// SpooledEvent is an event spooled in the event_spool table after it failed to
+// be produced to Kafka. Event holds its JSON encoding.
+type SpooledEvent struct {
+	ID          string
+	EnqueuedAt  time.Time
+	Traceparent string
+	Event       string
+}
+
+// SpoolEvent inserts an event into the event_spool table, then deletes the
+// oldest rows beyond max and returns the number of rows deleted.
+func (db *DB) SpoolEvent(enqueuedAt time.Time, traceparent, event string, max int) (int64, error) {
+	spoolID, err := uuid.NewUUID()
+	if err != nil {
+		return -1, fmt.Errorf("db: uuid.NewUUID failed: %w", err)
+	}
+
+	stmt, err := db.preparedStatement(`INSERT INTO event_spool (spool_id, enqueued_at, traceparent, event) VALUES ($1, $2, $3, $4);`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	if _, err := stmt.Exec(spoolID.String(), enqueuedAt.UTC(), traceparent, event); err != nil {
+		return -1, fmt.Errorf("db: stmt.Exec failed: %w", err)
+	}
+
+	stmt, err = db.preparedStatement(`DELETE FROM event_spool WHERE spool_id NOT IN (SELECT spool_id FROM event_spool ORDER BY enqueued_at DESC, spool_id DESC LIMIT $1);`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	result, err := stmt.Exec(max)
+	if err != nil {
+		return -1, fmt.Errorf("db: stmt.Exec failed: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return -1, fmt.Errorf("db: result.RowsAffected failed: %w", err)
+	}
+	return rowsAffected, nil
+}
+
+// SpooledEvents returns up to limit of the oldest rows of the event_spool
+// table, oldest first.
+func (db *DB) SpooledEvents(limit int) ([]SpooledEvent, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT spool_id, enqueued_at, traceparent, event FROM event_spool ORDER BY enqueued_at, spool_id LIMIT $1;`)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	rows, err := stmt.Query(limit)
+	if err != nil {
+		return nil, fmt.Errorf("db: stmt.Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var events []SpooledEvent
+	for rows.Next() {
+		var e SpooledEvent
+		if err := rows.Scan(&e.ID, &e.EnqueuedAt, &e.Traceparent, &e.Event); err != nil {
+			return nil, fmt.Errorf("db: rows.Scan failed: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("db: rows.Err failed: %w", err)
+	}
+	return events, nil
+}
+
+// DeleteSpooledEvent deletes the row of the event_spool table with the given
+// ID.
+func (db *DB) DeleteSpooledEvent(id string) error {
+	stmt, err := db.preparedStatement(`DELETE FROM event_spool WHERE spool_id = $1;`)
+	if err != nil {
+		return fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	if _, err := stmt.Exec(id); err != nil {
+		return fmt.Errorf("db: stmt.Exec failed: %w", err)
+	}
+	return nil
+}
+
+// CountSpooledEvents returns the number of rows of the event_spool table.
+func (db *DB) CountSpooledEvents() (int, error) {
+	release, err := db.acquire()
+	if err != nil {
+		return -1, err
+	}
+	defer release()
+
+	stmt, err := db.preparedStatement(`SELECT COUNT(*) FROM event_spool;`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var count int
+	if err := stmt.QueryRow().Scan(&count); err != nil {
+		return -1, fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+	}
+	return count, nil
+}
+
+// Maintain runs the driver-appropriate maintenance to reclaim space and refresh
+// query planner statistics: "VACUUM ANALYZE" for "pgx" and "VACUUM" for
+// "sqlite3".
+func (db *DB) Maintain() error {
+	var query string
+	switch db.driverName {
+	case "pgx":
+		query = `VACUUM ANALYZE;`
+	case "sqlite3":
+		query = `VACUUM;`
+	default:
+		return fmt.Errorf("db: unsupported database: %v", db.driverName)
+	}
+	if _, err := db.handle.Exec(query); err != nil {
+		return fmt.Errorf("db: db.handle.Exec failed: %w", err)
+	}
+	return nil
+}
+
 // Migrate inspects the current active migration version and runs all necessary
 // steps to migrate all the way up. If reset is true, everything is deleted in
 // the database before applying migrations.
@@ -228,13 +1002,23 @@ func (db *DB) Migrate(reset bool) error {
 	return nil
 }
 
-// Seed executes the SQL contained in path in order to seed the database.
-func (db *DB) Seed(path string) error {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return fmt.Errorf("db: os.ReadFile failed: %w", err)
+// Seed executes the SQL contained in the files at paths, in the order given,
+// in order to seed the database. If there are several files, errors name the
+// file that failed.
+func (db *DB) Seed(paths []string) error {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("db: os.ReadFile failed: %w", err)
+		}
+		if err := db.seedData(data); err != nil {
+			if len(paths) > 1 {
+				return fmt.Errorf("%v: %w", path, err)
+			}
+			return err
+		}
 	}
-	return db.seedData(data)
+	return nil
 }
 
 func (db *DB) seedData(data []byte) error {
@@ -245,6 +1029,477 @@ func (db *DB) seedData(data []byte) error {
 	return nil
 }
 
+// RoutingRows returns the total number of rows in the routing tables, being
+// those merged by an incremental seed.
+func (db *DB) RoutingRows() (int, error) {
+	var total int
+	for _, table := range seedTables {
+		var count int
+		if err := db.handle.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %v;`, table.name)).Scan(&count); err != nil {
+			return -1, fmt.Errorf("db: db.handle.QueryRow failed: %w", err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// SnapshotRoutingRules copies the routing tables to a migrated SQLite
+// database file at path, replacing any file there, and returns the number of
+// rows copied. The file is written to a temporary path next to path first and
+// then renamed, so that a reader never opens a partial snapshot.
+func (db *DB) SnapshotRoutingRules(path string) (int, error) {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return -1, fmt.Errorf("db: os.Remove failed: %w", err)
+	}
+	snapshot, err := Open("sqlite3", "file:"+tmp)
+	if err != nil {
+		return -1, err
+	}
+	defer snapshot.Close()
+	if err := snapshot.Migrate(false); err != nil {
+		return -1, err
+	}
+
+	tx, err := snapshot.handle.Begin()
+	if err != nil {
+		return -1, fmt.Errorf("db: snapshot.handle.Begin failed: %w", err)
+	}
+	defer tx.Rollback()
+	var total int
+	for _, table := range seedTables {
+		columns := append(append([]string{}, table.keys...), table.values...)
+		n, err := db.copyRows(tx, table.name, columns)
+		if err != nil {
+			return -1, err
+		}
+		total += n
+	}
+	if err := tx.Commit(); err != nil {
+		return -1, fmt.Errorf("db: tx.Commit failed: %w", err)
+	}
+	if err := snapshot.Close(); err != nil {
+		return -1, fmt.Errorf("db: snapshot.Close failed: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return -1, fmt.Errorf("db: os.Rename failed: %w", err)
+	}
+	return total, nil
+}
+
+// copyRows inserts the given columns of every row of table into the same
+// table within tx, and returns the number of rows copied.
+func (db *DB) copyRows(tx *sql.Tx, table string, columns []string) (int, error) {
+	rows, err := db.handle.Query(fmt.Sprintf(`SELECT %v FROM %v;`, strings.Join(columns, ", "), table))
+	if err != nil {
+		return -1, fmt.Errorf("db: db.handle.Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	placeholders := make([]string, len(columns))
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%v", i+1)
+	}
+	insert := fmt.Sprintf(`INSERT INTO %v (%v) VALUES (%v);`, table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	var n int
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return -1, fmt.Errorf("db: rows.Scan failed: %w", err)
+		}
+		if _, err := tx.Exec(insert, values...); err != nil {
+			return -1, fmt.Errorf("db: tx.Exec failed: %w", err)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return -1, fmt.Errorf("db: rows.Err failed: %w", err)
+	}
+	return n, nil
+}
+
+// SeedReport counts the routing rows considered by an incremental seed, and
+// lists the rows it discarded as duplicates and the seed file each row it
+// merged came from.
+type SeedReport struct {
+	Added      int             `json:"added"`
+	Updated    int             `json:"updated"`
+	Unchanged  int             `json:"unchanged"`
+	Duplicates []SeedDuplicate `json:"duplicates,omitempty"`
+	Rows       []SeedRow       `json:"rows,omitempty"`
+}
+
+// SeedDuplicate is a row discarded by an incremental seed because the seed
+// set another row with the same primary key.
+type SeedDuplicate struct {
+	Table string `json:"table"`
+	// Key holds the comma-separated primary key columns of the row.
+	Key string `json:"key"`
+	// Conflicting is set if the row's values differ from those of the row
+	// merged in its place.
+	Conflicting bool `json:"conflicting"`
+	// Path is the seed file the row came from, and MergedPath the one the row
+	// merged in its place came from.
+	Path       string `json:"path,omitempty"`
+	MergedPath string `json:"merged_path,omitempty"`
+}
+
+// SeedRow is a row merged by an incremental seed, and the seed file it came
+// from.
+type SeedRow struct {
+	Table string `json:"table"`
+	// Key holds the comma-separated primary key columns of the row.
+	Key  string `json:"key"`
+	Path string `json:"path"`
+}
+
+// seedFile is the SQL contained in a seed file. Rows seeded from a seedFile
+// with an empty path are not listed in SeedReport.Rows.
+type seedFile struct {
+	path string
+	data []byte
+}
+
+// seedTables lists the routing tables merged by an incremental seed, with the
+// columns forming their primary key and the remaining value columns.
+var seedTables = []struct {
+	name   string
+	keys   []string
+	values []string
+}{
+	{"orgs_modules", []string{"module_name", "org_id"}, nil},
+	{"modules_client_versions", []string{"module_name"}, []string{"min_version"}},
+	{"modules_aliases", []string{"alias"}, []string{"module_name"}},
+	{"modules_default_channels", []string{"module_name"}, []string{"channel"}},
+	{"modules_retired", []string{"module_name"}, []string{"replacement"}},
+	{"modules_cache_ttls", []string{"module_name"}, []string{"ttl_seconds"}},
+	{"orgs_modules_urls", []string{"module_name", "org_id"}, []string{"url"}},
+}
+
+// SeedIncremental merges the routing rules seeded by the SQL contained in the
+// files at paths into the database, without resetting it. Rows seeded by the
+// files are inserted, or updated if a row with the same primary key exists
+// with different values. Rows not seeded by the files, as well as events, are
+// left intact.
+//
+// The files are seeded in the order given. Rows seeded more than once with the
+// same primary key, by the same file or by different ones, are reported as
+// duplicates, and only one of them is merged: the first seeded if firstWins is
+// set, the last seeded otherwise. Each merged row is reported with the file it
+// came from. If there are several files, errors name the file that failed.
+//
+// The seed SQL is first executed against a scratch in-memory SQLite database,
+// so it must be compatible with SQLite.
+func (db *DB) SeedIncremental(paths []string, firstWins bool) (SeedReport, error) {
+	files := make([]seedFile, len(paths))
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return SeedReport{}, fmt.Errorf("db: os.ReadFile failed: %w", err)
+		}
+		files[i] = seedFile{path, data}
+	}
+	return db.seedFilesIncremental(files, firstWins)
+}
+
+// primaryKeyClause matches the table constraint declaring the primary key of
+// a table, as written in the migrations.
+var primaryKeyClause = regexp.MustCompile(`(?i),\s*PRIMARY KEY\s*\([^)]*\)`)
+
+// dropSeedKeys recreates the seed tables of the scratch database db without
+// their primary keys, so that seeding duplicate rows does not fail and the
+// duplicates can be resolved once seeded.
+func dropSeedKeys(db *DB) error {
+	for _, table := range seedTables {
+		var create string
+		if err := db.handle.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = $1;`, table.name).Scan(&create); err != nil {
+			return fmt.Errorf("db: db.handle.QueryRow failed: %w", err)
+		}
+		if _, err := db.handle.Exec(fmt.Sprintf(`DROP TABLE %v;`, table.name)); err != nil {
+			return fmt.Errorf("db: db.handle.Exec failed: %w", err)
+		}
+		if _, err := db.handle.Exec(primaryKeyClause.ReplaceAllString(create, "")); err != nil {
+			return fmt.Errorf("db: db.handle.Exec failed: %w", err)
+		}
+	}
+	return nil
+}
+
+func (db *DB) seedDataIncremental(data []byte, firstWins bool) (SeedReport, error) {
+	return db.seedFilesIncremental([]seedFile{{data: data}}, firstWins)
+}
+
+func (db *DB) seedFilesIncremental(files []seedFile, firstWins bool) (SeedReport, error) {
+	var report SeedReport
+
+	scratch, err := Open("sqlite3", fmt.Sprintf("file:seed%v?mode=memory&cache=shared", time.Now().UnixNano()))
+	if err != nil {
+		return report, err
+	}
+	defer scratch.Close()
+	if err := scratch.Migrate(false); err != nil {
+		return report, err
+	}
+	if err := dropSeedKeys(scratch); err != nil {
+		return report, err
+	}
+	// ends holds, for each table, the largest rowid seeded by each file, from
+	// which the file a row came from is found.
+	ends := make(map[string][]int64)
+	for _, f := range files {
+		if err := scratch.seedData(f.data); err != nil {
+			if len(files) > 1 {
+				return report, fmt.Errorf("%v: %w", f.path, err)
+			}
+			return report, err
+		}
+		for _, table := range seedTables {
+			var end int64
+			if err := scratch.handle.QueryRow(fmt.Sprintf(`SELECT COALESCE(MAX(rowid), 0) FROM %v;`, table.name)).Scan(&end); err != nil {
+				return report, fmt.Errorf("db: scratch.handle.QueryRow failed: %w", err)
+			}
+			ends[table.name] = append(ends[table.name], end)
+		}
+	}
+	sourcePath := func(table string, rowid int64) string {
+		for i, end := range ends[table] {
+			if rowid <= end {
+				return files[i].path
+			}
+		}
+		return ""
+	}
+
+	var merges []seedMerge
+	for _, table := range seedTables {
+		columns := append(append([]string{}, table.keys...), table.values...)
+		rows, err := scratch.handle.Query(fmt.Sprintf(`SELECT rowid, %v FROM %v ORDER BY rowid;`, strings.Join(columns, ", "), table.name))
+		if err != nil {
+			return report, fmt.Errorf("db: scratch.handle.Query failed: %w", err)
+		}
+		var seeded [][]string
+		var paths []string
+		seen := make(map[string]int)
+		for rows.Next() {
+			var rowid int64
+			row := make([]string, len(columns))
+			dest := []interface{}{&rowid}
+			for i := range row {
+				dest = append(dest, &row[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return report, fmt.Errorf("db: rows.Scan failed: %w", err)
+			}
+			path := sourcePath(table.name, rowid)
+			key := strings.Join(row[:len(table.keys)], "\x00")
+			i, ok := seen[key]
+			if !ok {
+				seen[key] = len(seeded)
+				seeded = append(seeded, row)
+				paths = append(paths, path)
+				continue
+			}
+			duplicate := SeedDuplicate{
+				Table:       table.name,
+				Key:         strings.Join(row[:len(table.keys)], ", "),
+				Conflicting: strings.Join(seeded[i], "\x00") != strings.Join(row, "\x00"),
+				Path:        path,
+				MergedPath:  paths[i],
+			}
+			if !firstWins {
+				duplicate.Path, duplicate.MergedPath = paths[i], path
+				seeded[i], paths[i] = row, path
+			}
+			report.Duplicates = append(report.Duplicates, duplicate)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, fmt.Errorf("db: rows.Err failed: %w", err)
+		}
+
+		for i, row := range seeded {
+			merges = append(merges, seedMerge{table.name, table.keys, table.values, row})
+			if paths[i] != "" {
+				report.Rows = append(report.Rows, SeedRow{
+					Table: table.name,
+					Key:   strings.Join(row[:len(table.keys)], ", "),
+					Path:  paths[i],
+				})
+			}
+		}
+	}
+
+	if err := db.mergeSeedRows(merges, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// seedMerge is a row, holding the keys followed by the values columns of
+// table, to be merged by an incremental seed.
+type seedMerge struct {
+	table  string
+	keys   []string
+	values []string
+	row    []string
+}
+
+// mergeSeedRows merges merges into the database in batches, as configured by
+// SetSeedBatching, and adds the outcome to report. Batches are committed
+// independently, so that if one fails, the rows of batches already committed
+// stay merged; as merging the same rows again changes nothing, the seed can
+// simply be retried. Once a batch fails, no further batch is started, and the
+// first error is returned.
+func (db *DB) mergeSeedRows(merges []seedMerge, report *SeedReport) error {
+	size, workers := db.seedBatchSize, db.seedWorkers
+	if size <= 0 {
+		size = len(merges)
+	}
+	if workers < 1 || db.driverName == "sqlite3" {
+		workers = 1
+	}
+	var batches [][]seedMerge
+	for len(merges) > 0 {
+		n := size
+		if n > len(merges) {
+			n = len(merges)
+		}
+		batches = append(batches, merges[:n])
+		merges = merges[n:]
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	queue := make(chan []seedMerge)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				var r SeedReport
+				err := db.mergeSeedBatch(batch, &r)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				report.Added += r.Added
+				report.Updated += r.Updated
+				report.Unchanged += r.Unchanged
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, batch := range batches {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		queue <- batch
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// mergeSeedBatch merges batch into the database in a single transaction and
+// records the outcome in report. Nothing is recorded if the transaction fails.
+func (db *DB) mergeSeedBatch(batch []seedMerge, report *SeedReport) error {
+	tx, err := db.handle.Beginx()
+	if err != nil {
+		return fmt.Errorf("db: db.handle.Beginx failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	var r SeedReport
+	for _, m := range batch {
+		if err := mergeSeedRow(tx, m.table, m.keys, m.values, m.row, &r); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db: tx.Commit failed: %w", err)
+	}
+	report.Added += r.Added
+	report.Updated += r.Updated
+	report.Unchanged += r.Unchanged
+	return nil
+}
+
+// mergeSeedRow inserts or updates row, holding the keys followed by the
+// values columns of table, and records the outcome in report.
+func mergeSeedRow(tx *sqlx.Tx, table string, keys, values []string, row []string, report *SeedReport) error {
+	where := make([]string, len(keys))
+	keyArgs := make([]interface{}, len(keys))
+	for i, k := range keys {
+		where[i] = fmt.Sprintf("%v = $%v", k, i+1)
+		keyArgs[i] = row[i]
+	}
+
+	selected := "1"
+	if len(values) > 0 {
+		selected = strings.Join(values, ", ")
+	}
+	current := make([]string, len(values))
+	dest := make([]interface{}, len(values))
+	for i := range current {
+		dest[i] = &current[i]
+	}
+	if len(dest) == 0 {
+		dest = []interface{}{new(int)}
+	}
+	err := tx.QueryRow(fmt.Sprintf(`SELECT %v FROM %v WHERE %v;`, selected, table, strings.Join(where, " AND ")), keyArgs...).Scan(dest...)
+	switch {
+	case err == sql.ErrNoRows:
+		columns := append(append([]string{}, keys...), values...)
+		placeholders := make([]string, len(columns))
+		args := make([]interface{}, len(columns))
+		for i := range columns {
+			placeholders[i] = fmt.Sprintf("$%v", i+1)
+			args[i] = row[i]
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO %v (%v) VALUES (%v);`, table, strings.Join(columns, ", "), strings.Join(placeholders, ", ")), args...); err != nil {
+			return fmt.Errorf("db: tx.Exec failed: %w", err)
+		}
+		report.Added++
+	case err != nil:
+		return fmt.Errorf("db: tx.QueryRow failed: %w", err)
+	default:
+		changed := false
+		for i := range values {
+			changed = changed || current[i] != row[len(keys)+i]
+		}
+		if !changed {
+			report.Unchanged++
+			return nil
+		}
+		set := make([]string, len(values))
+		args := make([]interface{}, 0, len(values)+len(keys))
+		for i, v := range values {
+			set[i] = fmt.Sprintf("%v = $%v", v, i+1)
+			args = append(args, row[len(keys)+i])
+		}
+		for i, k := range keys {
+			where[i] = fmt.Sprintf("%v = $%v", k, len(values)+i+1)
+			args = append(args, row[i])
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %v SET %v WHERE %v;`, table, strings.Join(set, ", "), strings.Join(where, " AND ")), args...); err != nil {
+			return fmt.Errorf("db: tx.Exec failed: %w", err)
+		}
+		report.Updated++
+	}
+	return nil
+}
+
 // preparedStatement creates a prepared statement for the given query, caches
 // it in a map and returns the prepared statement. If a statement already exists
 // for query, the cached statement is returned.
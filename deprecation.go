@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// deprecatedParam is a query parameter renamed to replacement. It is still
+// accepted in place of replacement until it is removed, so that clients can
+// be migrated off it.
+type deprecatedParam struct {
+	name        string
+	replacement string
+}
+
+// channelDeprecatedParams and eventDeprecatedParams are the deprecated query
+// parameters of /channel and GET /event. When a parameter is renamed, its old
+// name is added here with the new name as its replacement, and removed once
+// the deprecated_params metric shows it is no longer used.
+var (
+	channelDeprecatedParams []deprecatedParam
+	eventDeprecatedParams   []deprecatedParam
+)
+
+// replaceDeprecatedParams renames each parameter of deprecated found in query
+// to its replacement, unless the replacement is also given, in which case the
+// replacement wins and the deprecated parameter is dropped. Each use of a
+// deprecated parameter adds a Warning header naming its replacement to w and
+// is counted in the deprecated_params metric under endpoint.
+func (s *Server) replaceDeprecatedParams(w http.ResponseWriter, query url.Values, endpoint string, deprecated []deprecatedParam) {
+	for _, d := range deprecated {
+		values, ok := query[d.name]
+		if !ok {
+			continue
+		}
+		delete(query, d.name)
+		if _, ok := query[d.replacement]; !ok {
+			query[d.replacement] = values
+		}
+		w.Header().Add("Warning", warningHeader(fmt.Sprintf("parameter '%v' is deprecated, use '%v' instead", d.name, d.replacement)))
+		s.appMetrics.incDeprecatedParams(endpoint, d.name)
+	}
+}
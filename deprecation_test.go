@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReplaceDeprecatedParams(t *testing.T) {
+	deprecated := []deprecatedParam{{"account", "org_id"}, {"module_name", "module"}}
+
+	tests := []struct {
+		desc        string
+		input       string
+		want        url.Values
+		wantWarning []string
+	}{
+		{
+			desc:  "none",
+			input: "module=insights-core",
+			want:  url.Values{"module": {"insights-core"}},
+		},
+		{
+			desc:        "renamed",
+			input:       "account=1979710&module=insights-core",
+			want:        url.Values{"org_id": {"1979710"}, "module": {"insights-core"}},
+			wantWarning: []string{`299 - "parameter 'account' is deprecated, use 'org_id' instead"`},
+		},
+		{
+			desc:  "replacement wins",
+			input: "module_name=modfoo&module=insights-core",
+			want:  url.Values{"module": {"insights-core"}},
+			wantWarning: []string{
+				`299 - "parameter 'module_name' is deprecated, use 'module' instead"`,
+			},
+		},
+	}
+
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			query, err := url.ParseQuery(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			srv.replaceDeprecatedParams(rr, query, "channel", deprecated)
+
+			if !cmp.Equal(query, test.want) {
+				t.Errorf("%v", cmp.Diff(query, test.want))
+			}
+			if got := rr.Header().Values("Warning"); !cmp.Equal(got, test.wantWarning) {
+				t.Errorf("%v", cmp.Diff(got, test.wantWarning))
+			}
+		})
+	}
+}
+
+func TestChannelDeprecatedParams(t *testing.T) {
+	defer func(d []deprecatedParam) { channelDeprecatedParams = d }(channelDeprecatedParams)
+	channelDeprecatedParams = []deprecatedParam{{"module_name", "module"}}
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+	counter := srv.appMetrics.deprecatedParams.WithLabelValues("channel", "module_name")
+	before := testutil.ToFloat64(counter)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module_name=insights-core", nil)
+	req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	if got, want := rr.Body.String(), `{"url":"/testing"}`; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := rr.Header().Get("Warning"), `299 - "parameter 'module_name' is deprecated, use 'module' instead"`; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("%v != %v", got, 1)
+	}
+}
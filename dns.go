@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// hostCache caches the addresses that database hosts resolve to, so that new
+// connections dial the cached addresses instead of resolving the host each
+// time, and keep connecting while DNS flaps. Cached addresses are only
+// replaced by a successful refresh. It is safe for concurrent use.
+type hostCache struct {
+	resolve func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.Mutex
+	addrs map[string][]string
+}
+
+func newHostCache(resolve func(ctx context.Context, host string) ([]string, error)) *hostCache {
+	return &hostCache{
+		resolve: resolve,
+		addrs:   make(map[string][]string),
+	}
+}
+
+// lookup returns the cached addresses of host, resolving it and caching them
+// if it is not cached yet.
+func (c *hostCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	addrs, ok := c.addrs[host]
+	c.mu.Unlock()
+	if ok {
+		return addrs, nil
+	}
+
+	addrs, err := c.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.addrs[host] = addrs
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// refresh resolves every cached host again. A host that cannot be resolved,
+// or resolves to no addresses, keeps its cached addresses and the failure is
+// logged.
+func (c *hostCache) refresh(ctx context.Context) {
+	c.mu.Lock()
+	hosts := make([]string, 0, len(c.addrs))
+	for host := range c.addrs {
+		hosts = append(hosts, host)
+	}
+	c.mu.Unlock()
+
+	for _, host := range hosts {
+		addrs, err := c.resolve(ctx, host)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses")
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":  host,
+				"error": err,
+			}).Warn("cannot resolve database host; keeping cached addresses")
+			continue
+		}
+		c.mu.Lock()
+		if !equalStrings(c.addrs[host], addrs) {
+			log.WithFields(log.Fields{
+				"host":  host,
+				"addrs": addrs,
+			}).Info("database host addresses changed")
+		}
+		c.addrs[host] = addrs
+		c.mu.Unlock()
+	}
+}
+
+// refreshEvery refreshes the cache every interval, forever.
+func (c *hostCache) refreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		c.refresh(ctx)
+		cancel()
+	}
+}
+
+// equalStrings reports whether a and b hold the same strings in the same
+// order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cachingDNS returns a data source name for the "pgx" driver that connects to
+// the database of dataSourceName, resolving its hosts through cache. TLS
+// connections still verify the server certificate against the host name.
+func cachingDNS(dataSourceName string, cache *hostCache) (string, error) {
+	cfg, err := pgx.ParseConfig(dataSourceName)
+	if err != nil {
+		return "", fmt.Errorf("db: pgx.ParseConfig failed: %w", err)
+	}
+	cfg.LookupFunc = cache.lookup
+	return stdlib.RegisterConnConfig(cfg), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/redhatinsights/module-update-router event.proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+	"github.com/redhatinsights/module-update-router/internal/eventpb"
+	"google.golang.org/protobuf/proto"
+)
+
+// eventEncoder serializes Events into the values of the Kafka messages
+// produced for them.
+type eventEncoder interface {
+	Encode(e Event) ([]byte, error)
+}
+
+// newEventEncoder returns the eventEncoder for format, one of "json", "avro"
+// or "protobuf". The avro encoder registers its schema with the schema
+// registry at registryURL under the value subject of topic, and so requires
+// registryURL to be set.
+func newEventEncoder(format, registryURL, topic string) (eventEncoder, error) {
+	switch format {
+	case "json":
+		return jsonEncoder{}, nil
+	case "avro":
+		if registryURL == "" {
+			return nil, fmt.Errorf("encoder: avro requires a schema registry URL")
+		}
+		return newAvroEncoder(registryURL, topic+"-value")
+	case "protobuf":
+		return protobufEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("encoder: unsupported format: %v", format)
+	}
+}
+
+// jsonEncoder encodes Events as JSON objects.
+type jsonEncoder struct{}
+
+// Encode implements eventEncoder.
+func (jsonEncoder) Encode(e Event) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// eventAvroSchema is the Avro schema of Event. Times are encoded as
+// milliseconds since the Unix epoch.
+const eventAvroSchema = `{"type":"record","name":"Event","namespace":"com.redhat.insights.moduleupdaterouter","fields":[` +
+	`{"name":"phase","type":"string"},` +
+	`{"name":"started_at","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"exit","type":"int"},` +
+	`{"name":"exception","type":["null","string"],"default":null},` +
+	`{"name":"ended_at","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"machine_id","type":"string"},` +
+	`{"name":"core_version","type":"string"},` +
+	`{"name":"core_path","type":["null","string"],"default":null},` +
+	`{"name":"source","type":["null","string"],"default":null}]}`
+
+// avroEncoder encodes Events in the Avro binary encoding of eventAvroSchema,
+// framed in the schema registry wire format: a zero magic byte and the
+// big-endian schema ID precede the encoded record. The schema is registered
+// with the registry on first use; if registration fails, Encode fails and
+// registration is attempted again by the next call.
+type avroEncoder struct {
+	registry *registry.Client
+	subject  string
+	schema   avro.Schema
+
+	mu sync.Mutex
+	id int
+}
+
+func newAvroEncoder(registryURL, subject string) (*avroEncoder, error) {
+	schema, err := avro.Parse(eventAvroSchema)
+	if err != nil {
+		return nil, fmt.Errorf("encoder: avro.Parse failed: %w", err)
+	}
+	client, err := registry.NewClient(registryURL, registry.WithHTTPClient(&http.Client{Timeout: 10 * time.Second}))
+	if err != nil {
+		return nil, fmt.Errorf("encoder: registry.NewClient failed: %w", err)
+	}
+	return &avroEncoder{
+		registry: client,
+		subject:  subject,
+		schema:   schema,
+		id:       -1,
+	}, nil
+}
+
+// avroEvent is the Event record of eventAvroSchema.
+type avroEvent struct {
+	Phase       string    `avro:"phase"`
+	StartedAt   time.Time `avro:"started_at"`
+	Exit        int       `avro:"exit"`
+	Exception   *string   `avro:"exception"`
+	EndedAt     time.Time `avro:"ended_at"`
+	MachineID   string    `avro:"machine_id"`
+	CoreVersion string    `avro:"core_version"`
+	CorePath    *string   `avro:"core_path"`
+	Source      *string   `avro:"source"`
+}
+
+// Encode implements eventEncoder.
+func (a *avroEncoder) Encode(e Event) ([]byte, error) {
+	id, err := a.schemaID()
+	if err != nil {
+		return nil, err
+	}
+	record, err := avro.Marshal(a.schema, avroEvent{
+		Phase:       e.Phase,
+		StartedAt:   e.StartedAt,
+		Exit:        e.Exit,
+		Exception:   e.Exception,
+		EndedAt:     e.EndedAt,
+		MachineID:   e.MachineID,
+		CoreVersion: e.CoreVersion,
+		CorePath:    e.CorePath,
+		Source:      optionalString(e.Source),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoder: avro.Marshal failed: %w", err)
+	}
+	buf := make([]byte, 5, 5+len(record))
+	binary.BigEndian.PutUint32(buf[1:], uint32(id))
+	return append(buf, record...), nil
+}
+
+// schemaID returns the registry ID of eventAvroSchema, registering the
+// schema if it has not been registered yet.
+func (a *avroEncoder) schemaID() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.id >= 0 {
+		return a.id, nil
+	}
+
+	id, _, err := a.registry.CreateSchema(url.PathEscape(a.subject), eventAvroSchema)
+	if err != nil {
+		return 0, fmt.Errorf("encoder: cannot register schema: %w", err)
+	}
+	a.id = id
+	return a.id, nil
+}
+
+// protobufEncoder encodes Events as the Event message defined in
+// event.proto. Times are encoded as milliseconds since the Unix epoch.
+type protobufEncoder struct{}
+
+// Encode implements eventEncoder.
+func (protobufEncoder) Encode(e Event) ([]byte, error) {
+	b, err := proto.Marshal(&eventpb.Event{
+		Phase:       e.Phase,
+		StartedAt:   e.StartedAt.UnixNano() / int64(time.Millisecond),
+		Exit:        int32(e.Exit),
+		Exception:   e.Exception,
+		EndedAt:     e.EndedAt.UnixNano() / int64(time.Millisecond),
+		MachineId:   e.MachineID,
+		CoreVersion: e.CoreVersion,
+		CorePath:    e.CorePath,
+		Source:      optionalString(e.Source),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoder: proto.Marshal failed: %w", err)
+	}
+	return b, nil
+}
+
+// optionalString returns a pointer to s, or nil if s is empty.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAvroEncoder(t *testing.T) {
+	exception := "boom"
+	tests := []struct {
+		description string
+		input       Event
+		want        []byte
+	}{
+		{
+			description: "required fields",
+			input: Event{
+				Phase:       "pre",
+				StartedAt:   time.Unix(1, 0),
+				Exit:        -1,
+				EndedAt:     time.Unix(2, 0),
+				MachineID:   "m",
+				CoreVersion: "3",
+			},
+			want: []byte{
+				0, 0, 0, 0, 7,
+				6, 'p', 'r', 'e',
+				0xd0, 0x0f,
+				1,
+				0,
+				0xa0, 0x1f,
+				2, 'm',
+				2, '3',
+				0,
+				0,
+			},
+		},
+		{
+			description: "optional fields",
+			input: Event{
+				Phase:       "pre",
+				StartedAt:   time.Unix(1, 0),
+				Exception:   &exception,
+				EndedAt:     time.Unix(2, 0),
+				MachineID:   "m",
+				CoreVersion: "3",
+				CorePath:    &exception,
+				Source:      "app",
+			},
+			want: []byte{
+				0, 0, 0, 0, 7,
+				6, 'p', 'r', 'e',
+				0xd0, 0x0f,
+				0,
+				2, 8, 'b', 'o', 'o', 'm',
+				0xa0, 0x1f,
+				2, 'm',
+				2, '3',
+				2, 8, 'b', 'o', 'o', 'm',
+				2, 6, 'a', 'p', 'p',
+			},
+		},
+	}
+
+	var registrations int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registrations++
+		if r.URL.Path != "/subjects/platform.insights.events-value/versions" {
+			t.Errorf("unexpected path: %v", r.URL.Path)
+		}
+		var body struct{ Schema string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if body.Schema != eventAvroSchema {
+			t.Errorf("unexpected schema: %v", body.Schema)
+		}
+		w.Write([]byte(`{"id":7}`))
+	}))
+	defer ts.Close()
+
+	enc, err := newEventEncoder("avro", ts.URL, "platform.insights.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := enc.Encode(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+	if registrations != 1 {
+		t.Errorf("registrations: %v != %v", registrations, 1)
+	}
+}
+
+func TestAvroEncoderSubjectEscaped(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.EscapedPath()
+		w.Write([]byte(`{"id":7}`))
+	}))
+	defer ts.Close()
+
+	enc, err := newEventEncoder("avro", ts.URL, "platform/insights?events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Encode(Event{Phase: "pre", MachineID: "m", CoreVersion: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/subjects/platform%2Finsights%3Fevents-value/versions"; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestProtobufEncoder(t *testing.T) {
+	exception := "boom"
+	tests := []struct {
+		description string
+		input       Event
+		want        []byte
+	}{
+		{
+			description: "required fields",
+			input: Event{
+				Phase:       "pre",
+				StartedAt:   time.Unix(1, 0),
+				Exit:        1,
+				EndedAt:     time.Unix(2, 0),
+				MachineID:   "m",
+				CoreVersion: "3",
+			},
+			want: []byte{
+				0x0a, 3, 'p', 'r', 'e',
+				0x10, 0xe8, 0x07,
+				0x18, 1,
+				0x28, 0xd0, 0x0f,
+				0x32, 1, 'm',
+				0x3a, 1, '3',
+			},
+		},
+		{
+			description: "optional fields",
+			input: Event{
+				Phase:       "pre",
+				StartedAt:   time.Unix(1, 0),
+				Exception:   &exception,
+				EndedAt:     time.Unix(2, 0),
+				MachineID:   "m",
+				CoreVersion: "3",
+				Source:      "app",
+			},
+			want: []byte{
+				0x0a, 3, 'p', 'r', 'e',
+				0x10, 0xe8, 0x07,
+				0x22, 4, 'b', 'o', 'o', 'm',
+				0x28, 0xd0, 0x0f,
+				0x32, 1, 'm',
+				0x3a, 1, '3',
+				0x4a, 3, 'a', 'p', 'p',
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := protobufEncoder{}.Encode(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestNewEventEncoder(t *testing.T) {
+	if _, err := newEventEncoder("avro", "", "platform.insights.events"); err == nil {
+		t.Error("avro without schema registry: want error")
+	}
+	if _, err := newEventEncoder("xml", "", "platform.insights.events"); err == nil {
+		t.Error("unsupported format: want error")
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/redhatinsights/module-update-router/identity"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -31,6 +35,194 @@ func formatJSONError(w http.ResponseWriter, code int, msg string) {
 	writeError(w, string(data), code)
 }
 
+// formatMethodNotAllowedError replies to a request with a method the endpoint
+// does not serve with 405, listing the methods it does serve in the Allow
+// header.
+func formatMethodNotAllowedError(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	formatJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("error: '%s' not allowed", r.Method))
+}
+
+// formatBusyError replies to a request that cannot be served because the
+// database is busy with a 503 asking the client to retry shortly.
+func formatBusyError(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	formatJSONError(w, http.StatusServiceUnavailable, "database busy")
+}
+
+// eventRetryAfter is the number of seconds clients are told to wait before
+// retrying events rejected while the event buffer is above its high-water mark.
+const eventRetryAfter = 5
+
+// formatBackpressureError replies to an event rejected while the event buffer
+// is above its high-water mark with 503, telling the client when to retry.
+func formatBackpressureError(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(eventRetryAfter))
+	formatJSONError(w, http.StatusServiceUnavailable, "event buffer full; retry later")
+}
+
+// formatNotFoundError replies to a request for an unknown path under an API
+// prefix with 404, listing the API version and the endpoints it serves.
+func formatNotFoundError(w http.ResponseWriter, version string, endpoints []string) {
+	e := map[string]interface{}{
+		"status": http.StatusText(http.StatusNotFound),
+		"title":  "no such endpoint",
+		"meta": map[string]interface{}{
+			"version":   version,
+			"endpoints": endpoints,
+		},
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"errors": []map[string]interface{}{e},
+	})
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeError(w, string(data), http.StatusNotFound)
+}
+
+// formatReadOnlyError replies to a request that would write to the database
+// of a read-only server with 503.
+func formatReadOnlyError(w http.ResponseWriter) {
+	formatJSONError(w, http.StatusServiceUnavailable, "server is read-only")
+}
+
+// internalErrorMessage is the message of all internal server errors returned
+// to clients.
+const internalErrorMessage = "internal server error"
+
+// formatInternalError logs err along with the request ID of r and replies to
+// the request with a generic 500 error, so that internal details, such as
+// database or serialization errors, are not disclosed to clients. The
+// response carries the request ID so that a reported error can be matched to
+// its log entry.
+func formatInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	id := requestIDOf(r)
+	log.WithFields(log.Fields{
+		"request-id": id,
+		"error":      err,
+	}).Error(internalErrorMessage)
+
+	e := map[string]interface{}{
+		"status": http.StatusText(http.StatusInternalServerError),
+		"title":  internalErrorMessage,
+	}
+	if id != "" {
+		e["id"] = id
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"errors": []map[string]interface{}{e},
+	})
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeError(w, string(data), http.StatusInternalServerError)
+}
+
+// formatRoutingError replies to a request whose routing decision failed with
+// err: with 410 if the module is retired (see formatRetiredError), with 503 if
+// the database is busy, so the client retries, and with a generic 500
+// otherwise.
+func formatRoutingError(w http.ResponseWriter, r *http.Request, err error) {
+	var retired retiredModuleError
+	if errors.As(err, &retired) {
+		formatRetiredError(w, retired.replacement)
+		return
+	}
+	if errors.Is(err, ErrDatabaseBusy) {
+		formatBusyError(w)
+		return
+	}
+	formatInternalError(w, r, err)
+}
+
+// formatRetiredError replies to a request for a retired module with 410,
+// naming the module replacing it, if any, so clients can migrate to it.
+func formatRetiredError(w http.ResponseWriter, replacement string) {
+	data, err := json.Marshal(struct {
+		Error       string `json:"error"`
+		Replacement string `json:"replacement,omitempty"`
+	}{"module retired", replacement})
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	if _, err := w.Write(data); err != nil {
+		log.Errorf("cannot write HTTP response: %v", err)
+	}
+}
+
+// missingOrgIDMessage is the message of errors returned for identities
+// without an org_id.
+const missingOrgIDMessage = "missing org_id identity field"
+
+// formatMissingOrgIDError replies to a request whose identity id carries no
+// org_id with 400. If diagnostic is set, the error also names the identity
+// fields that are present and missing, so that integrators can debug the
+// identity their proxy sends. Field values are never included.
+func formatMissingOrgIDError(w http.ResponseWriter, id *identity.Identity, diagnostic bool) {
+	if !diagnostic {
+		formatJSONError(w, http.StatusBadRequest, missingOrgIDMessage)
+		return
+	}
+
+	present, missing := identityFields(id)
+	e := map[string]interface{}{
+		"status": http.StatusText(http.StatusBadRequest),
+		"title":  missingOrgIDMessage,
+		"detail": fmt.Sprintf("the X-Rh-Identity header carries the identity fields [%v] but not identity.org_id; check that the identity proxy sets it", strings.Join(present, ", ")),
+		"meta": map[string]interface{}{
+			"present": present,
+			"missing": missing,
+		},
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"errors": []map[string]interface{}{e},
+	})
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeError(w, string(data), http.StatusBadRequest)
+}
+
+// identityFields returns the names of the fields of id that are set and of
+// those that are not, each in the order the Identity type declares them.
+func identityFields(id *identity.Identity) (present, missing []string) {
+	present, missing = make([]string, 0), make([]string, 0)
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"entitlements", id.Entitlements != nil},
+		{"identity.account_number", id.Identity.AccountNumber != nil},
+		{"identity.associate", id.Identity.Associate != nil},
+		{"identity.auth_type", id.Identity.AuthType != ""},
+		{"identity.employee_account_number", id.Identity.EmployeeAccountNumber != nil},
+		{"identity.internal", id.Identity.Internal != nil},
+		{"identity.org_id", id.Identity.OrgID != ""},
+		{"identity.system", id.Identity.System != nil},
+		{"identity.type", id.Identity.Type != nil},
+		{"identity.user", id.Identity.User != nil},
+		{"identity.x509", id.Identity.X509 != nil},
+	} {
+		if f.set {
+			present = append(present, f.name)
+		} else {
+			missing = append(missing, f.name)
+		}
+	}
+	return present, missing
+}
+
 // writeError replies to the request with the specified error message and HTTP
 // code.
 func writeError(w http.ResponseWriter, error string, code int) {
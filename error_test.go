@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/module-update-router/identity"
+)
+
+func TestFormatInternalError(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "request ID",
+			input: "c0ffee",
+			want:  `{"errors":[{"id":"c0ffee","status":"Internal Server Error","title":"internal server error"}]}`,
+		},
+		{
+			desc: "no request ID",
+			want: `{"errors":[{"status":"Internal Server Error","title":"internal server error"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.input != "" {
+				req = withRequestID(req, test.input)
+			}
+			rr := httptest.NewRecorder()
+
+			formatInternalError(rr, req, errors.New("db: stmt.Query failed: connection refused"))
+
+			if rr.Code != http.StatusInternalServerError {
+				t.Errorf("%v != %v", rr.Code, http.StatusInternalServerError)
+			}
+			if got := strings.TrimSpace(rr.Body.String()); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatMissingOrgIDError(t *testing.T) {
+	tests := []struct {
+		desc       string
+		diagnostic bool
+		want       string
+	}{
+		{
+			desc: "terse",
+			want: `{"errors":[{"status":"Bad Request","title":"missing org_id identity field"}]}`,
+		},
+		{
+			desc:       "diagnostic",
+			diagnostic: true,
+			want:       `{"errors":[{"detail":"the X-Rh-Identity header carries the identity fields [identity.account_number, identity.type, identity.user] but not identity.org_id; check that the identity proxy sets it","meta":{"missing":["entitlements","identity.associate","identity.auth_type","identity.employee_account_number","identity.internal","identity.org_id","identity.system","identity.x509"],"present":["identity.account_number","identity.type","identity.user"]},"status":"Bad Request","title":"missing org_id identity field"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var id identity.Identity
+			if err := json.Unmarshal([]byte(`{"identity":{"account_number":"540155","type":"User","user":{"username":"jsmith"}}}`), &id); err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+
+			formatMissingOrgIDError(rr, &id, test.diagnostic)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%v != %v", rr.Code, http.StatusBadRequest)
+			}
+			if got := strings.TrimSpace(rr.Body.String()); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+			if strings.Contains(rr.Body.String(), "540155") || strings.Contains(rr.Body.String(), "jsmith") {
+				t.Errorf("identity values disclosed: %v", rr.Body.String())
+			}
+		})
+	}
+}
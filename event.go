@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Event is a client update event, as posted to the /event endpoint and
+// produced to Kafka.
+type Event struct {
+	Phase       string    `json:"phase"`
+	StartedAt   time.Time `json:"started_at"`
+	Exit        int       `json:"exit"`
+	Exception   *string   `json:"exception,omitempty"`
+	EndedAt     time.Time `json:"ended_at"`
+	MachineID   string    `json:"machine_id"`
+	CoreVersion string    `json:"core_version"`
+	CorePath    *string   `json:"core_path,omitempty"`
+	// Source names the client application that posted the event. It is
+	// empty if the application did not identify itself.
+	Source string `json:"source,omitempty"`
+}
+
+// parseEvent decodes data as an Event and checks that its required fields
+// are set.
+func parseEvent(data []byte) (Event, error) {
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Event{}, err
+	}
+	for _, field := range []struct {
+		name    string
+		missing bool
+	}{
+		{"phase", e.Phase == ""},
+		{"started_at", e.StartedAt.IsZero()},
+		{"ended_at", e.EndedAt.IsZero()},
+		{"machine_id", e.MachineID == ""},
+		{"core_version", e.CoreVersion == ""},
+	} {
+		if field.missing {
+			return Event{}, fmt.Errorf("missing required field: '%v'", field.name)
+		}
+	}
+	return e, nil
+}
+
+// eventSourceHeader is the request header a client application may identify
+// itself with instead of setting the source field of an event.
+const eventSourceHeader = "X-Event-Source"
+
+// parseEventSources parses a comma-separated list of event sources into a
+// set. It returns nil, allowing any source, if value lists none.
+func parseEventSources(value string) map[string]bool {
+	var sources map[string]bool
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if sources == nil {
+			sources = make(map[string]bool)
+		}
+		sources[source] = true
+	}
+	return sources
+}
+
+// queuedEvent is an Event queued on the events channel for the Kafka
+// producer.
+type queuedEvent struct {
+	Event Event
+	// Traceparent is the W3C trace context of the request that posted the
+	// event, propagated to consumers as a message header. It is empty if the
+	// request carried no valid trace context.
+	Traceparent string
+	// EnqueuedAt is the time the event was queued.
+	EnqueuedAt time.Time
+}
+
+// pendingEvents tracks the events queued by the server that the producer has
+// not yet written to Kafka or dropped.
+var pendingEvents = newEventTracker()
+
+// eventTracker tracks the enqueue times of pending events, so the age of the
+// oldest one can be reported even while the producer is not consuming the
+// events channel. It is safe for concurrent use.
+type eventTracker struct {
+	mu      sync.Mutex
+	pending map[int64]int
+}
+
+func newEventTracker() *eventTracker {
+	return &eventTracker{pending: make(map[int64]int)}
+}
+
+// add records an event enqueued at t as pending.
+func (e *eventTracker) add(t time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending[t.UnixNano()]++
+}
+
+// done records that an event enqueued at t is no longer pending.
+func (e *eventTracker) done(t time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	k := t.UnixNano()
+	if e.pending[k] <= 1 {
+		delete(e.pending, k)
+		return
+	}
+	e.pending[k]--
+}
+
+// oldest returns the enqueue time of the oldest pending event. It reports
+// false if there are no pending events.
+func (e *eventTracker) oldest() (time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var min int64
+	found := false
+	for k := range e.pending {
+		if !found || k < min {
+			min = k
+			found = true
+		}
+	}
+	if !found {
+		return time.Time{}, false
+	}
+	return time.Unix(0, min), true
+}
+
+// age returns how long the oldest pending event has been pending at now, or
+// zero if there are no pending events.
+func (e *eventTracker) age(now time.Time) time.Duration {
+	t, ok := e.oldest()
+	if !ok {
+		return 0
+	}
+	return now.Sub(t)
+}
+
+// watchPendingEvents logs a warning whenever the oldest pending event has
+// been pending for longer than maxAge, which indicates a stuck producer. It
+// blocks forever.
+func watchPendingEvents(maxAge time.Duration) {
+	interval := maxAge / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		if age := pendingEvents.age(time.Now()); age > maxAge {
+			log.WithFields(log.Fields{
+				"age":     age,
+				"max_age": maxAge,
+			}).Warn("oldest pending event exceeds maximum age; is the producer stuck?")
+		}
+	}
+}
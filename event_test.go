@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseEvent(t *testing.T) {
+	exception := "OSError"
+	tests := []struct {
+		description string
+		input       string
+		want        Event
+		wantError   string
+	}{
+		{
+			description: "valid",
+			input:       `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 1, "exception": "OSError", "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`,
+			want: Event{
+				Phase:       "pre_update",
+				StartedAt:   time.Date(2020, time.June, 19, 11, 18, 3, 0, time.UTC),
+				Exit:        1,
+				Exception:   &exception,
+				EndedAt:     time.Date(2020, time.June, 19, 11, 19, 3, 0, time.UTC),
+				MachineID:   "60654767-dfba-47af-8bca-cb2d1d01d9a6",
+				CoreVersion: "3.0.156",
+			},
+		},
+		{
+			description: "missing field",
+			input:       `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "core_version": "3.0.156"}`,
+			wantError:   "missing required field: 'machine_id'",
+		},
+		{
+			description: "invalid json",
+			input:       `{`,
+			wantError:   "unexpected end of JSON input",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseEvent([]byte(test.input))
+
+			if test.wantError != "" {
+				if err == nil || err.Error() != test.wantError {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%v", cmp.Diff(got, test.want))
+				}
+			}
+		})
+	}
+}
+
+func TestEventTracker(t *testing.T) {
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	now := start.Add(time.Minute)
+	e := newEventTracker()
+
+	if got := e.age(now); got != 0 {
+		t.Errorf("empty: %v != %v", got, 0)
+	}
+
+	e.add(start)
+	e.add(start)
+	e.add(start.Add(30 * time.Second))
+	if got := e.age(now); got != time.Minute {
+		t.Errorf("pending: %v != %v", got, time.Minute)
+	}
+
+	e.done(start)
+	if got := e.age(now); got != time.Minute {
+		t.Errorf("one of two oldest done: %v != %v", got, time.Minute)
+	}
+
+	e.done(start)
+	if got := e.age(now); got != 30*time.Second {
+		t.Errorf("oldest done: %v != %v", got, 30*time.Second)
+	}
+
+	e.done(start.Add(30 * time.Second))
+	e.done(start.Add(30 * time.Second))
+	if got := e.age(now); got != 0 {
+		t.Errorf("all done: %v != %v", got, 0)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redhatinsights/module-update-router/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// fallbackSnapshotInterval is how often the routing rules are copied to
+// config.Config.DBFallbackPath while the database is reachable.
+const fallbackSnapshotInterval = time.Hour
+
+// openFallbackDB opens the routing rules snapshot at config.Config.DBFallbackPath
+// in place of the "pgx" database that could not be opened at startup because
+// of cause. The server is switched to read-only mode, as writes would be lost
+// to the snapshot. cause is returned as-is if no fallback is configured, and
+// along with the reason the snapshot cannot be opened otherwise.
+func openFallbackDB(cause error) (*DB, error) {
+	path := config.DefaultConfig.DBFallbackPath
+	if path == "" || config.DefaultConfig.DBDriver.Value != "pgx" {
+		return nil, cause
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("%w; cannot fall back to routing rules snapshot: %v", cause, err)
+	}
+	db, err := Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("%w; cannot fall back to routing rules snapshot: %v", cause, err)
+	}
+
+	config.DefaultConfig.ReadOnly = true
+	log.WithFields(log.Fields{
+		"path":  path,
+		"error": cause,
+	}).Error("cannot open database; degraded: serving stale routing rules from snapshot in read-only mode")
+	return db, nil
+}
+
+// snapshotRoutingRules copies the routing rules of db to path once ready is
+// closed, and then every fallbackSnapshotInterval, forever, so that
+// openFallbackDB has recent rules to fall back to. Failures are logged and
+// leave the previous snapshot in place.
+func snapshotRoutingRules(db *DB, path string, ready <-chan struct{}) {
+	<-ready
+	for {
+		rows, err := db.SnapshotRoutingRules(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"routine": "db_snapshot",
+				"path":    path,
+				"error":   err,
+			}).Error("cannot snapshot routing rules")
+		} else {
+			log.WithFields(log.Fields{
+				"routine": "db_snapshot",
+				"path":    path,
+				"rows":    rows,
+			}).Info("snapshotted routing rules")
+		}
+		time.Sleep(fallbackSnapshotInterval)
+	}
+}
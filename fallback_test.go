@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhatinsights/module-update-router/internal/config"
+)
+
+func TestOpenFallbackDB(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	errUnreachable := errors.New("db: handle.Ping failed: connection refused")
+
+	src, err := Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.seedData([]byte(`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "rules.db")
+	if _, err := src.SnapshotRoutingRules(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc  string
+		input struct {
+			driver, path string
+		}
+		wantFallback bool
+	}{
+		{
+			desc: "disabled",
+			input: struct {
+				driver, path string
+			}{"pgx", ""},
+		},
+		{
+			desc: "sqlite3",
+			input: struct {
+				driver, path string
+			}{"sqlite3", path},
+		},
+		{
+			desc: "missing snapshot",
+			input: struct {
+				driver, path string
+			}{"pgx", filepath.Join(t.TempDir(), "missing.db")},
+		},
+		{
+			desc: "fallback",
+			input: struct {
+				driver, path string
+			}{"pgx", path},
+			wantFallback: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.DBDriver.Value = test.input.driver
+			config.DefaultConfig.DBFallbackPath = test.input.path
+			config.DefaultConfig.ReadOnly = false
+
+			db, err := openFallbackDB(errUnreachable)
+
+			if !test.wantFallback {
+				if !errors.Is(err, errUnreachable) {
+					t.Errorf("%v != %v", err, errUnreachable)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			count, err := db.Count("insights-core", "1979710")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 1 {
+				t.Errorf("%v != %v", count, 1)
+			}
+			if !config.DefaultConfig.ReadOnly {
+				t.Error("want read-only mode")
+			}
+		})
+	}
+}
@@ -6,15 +6,17 @@ require (
 	github.com/golang-migrate/migrate/v4 v4.15.2
 	github.com/google/go-cmp v0.5.6
 	github.com/google/uuid v1.3.0
+	github.com/hamba/avro v1.6.6
 	github.com/jackc/pgx/v4 v4.10.1
 	github.com/jmoiron/sqlx v1.3.1
 	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/peterbourgon/ff/v3 v3.0.0
 	github.com/prometheus/client_golang v1.11.0
 	github.com/redhatinsights/app-common-go v1.6.3
-	github.com/redhatinsights/platform-go-middlewares v0.10.0
 	github.com/segmentio/kafka-go v0.3.7
 	github.com/sgreben/flagvar v1.10.1
 	github.com/sirupsen/logrus v1.9.0
 	github.com/slok/go-http-metrics v0.6.1
+	google.golang.org/grpc v1.45.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,326 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/redhatinsights/module-update-router --go-grpc_out=. --go-grpc_opt=module=github.com/redhatinsights/module-update-router channel.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/redhatinsights/module-update-router/identity"
+	"github.com/redhatinsights/module-update-router/internal/channelpb"
+	"github.com/redhatinsights/module-update-router/internal/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/slok/go-http-metrics/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxGRPCMessageSize bounds the size of gRPC request messages. It stands in
+// for the URL length limit of the HTTP API, as gRPC requests carry their
+// parameters in the message.
+const maxGRPCMessageSize = 64 << 10
+
+// GRPCServer returns a gRPC server serving the ChannelResolver service defined
+// in channel.proto. Calls pass through interceptors matching the middleware of
+// the HTTP API: they are recorded in the HTTP request metrics, carry a request
+// ID, are logged, are rejected while the server is not ready, are
+// authenticated with the server's Authenticator from the request metadata, as
+// HTTP API clients are from the request headers, and are rate limited.
+func (s *Server) GRPCServer() *grpc.Server {
+	gs := grpc.NewServer(
+		grpc.MaxRecvMsgSize(maxGRPCMessageSize),
+		grpc.ChainUnaryInterceptor(
+			s.grpcMetrics,
+			s.grpcRequestID,
+			s.grpcLog,
+			s.grpcReady,
+			s.grpcAuth,
+			s.grpcRateLimit,
+		),
+	)
+	channelpb.RegisterChannelResolverServer(gs, channelResolver{s: s})
+	return gs
+}
+
+// channelResolver implements the ChannelResolver gRPC service. Channels are
+// resolved by resolveClient, as for /channel, so that a client gets the same
+// answer over either; a retired module fails with NotFound.
+type channelResolver struct {
+	channelpb.UnimplementedChannelResolverServer
+
+	s *Server
+}
+
+func (c channelResolver) ResolveChannel(ctx context.Context, req *channelpb.ResolveChannelRequest) (*channelpb.Channel, error) {
+	if req.GetModule() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing required field: 'module'")
+	}
+	channels, err := c.s.resolveGRPCModules(ctx, []string{req.GetModule()})
+	if err != nil {
+		return nil, err
+	}
+	return channels[0], nil
+}
+
+func (c channelResolver) ResolveChannels(ctx context.Context, req *channelpb.ResolveChannelsRequest) (*channelpb.ResolveChannelsResponse, error) {
+	if len(req.GetModules()) < 1 {
+		return nil, status.Error(codes.InvalidArgument, "missing required field: 'modules'")
+	}
+	if len(req.GetModules()) > maxBatchModules {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("too many values for field 'modules': at most %v allowed", maxBatchModules))
+	}
+	channels, err := c.s.resolveGRPCModules(ctx, req.GetModules())
+	if err != nil {
+		return nil, err
+	}
+	return &channelpb.ResolveChannelsResponse{Channels: channels}, nil
+}
+
+// resolveGRPCModules resolves the channels of modules for the client of the
+// gRPC call in ctx, in the order of modules. It fails as a whole if any module
+// fails.
+func (s *Server) resolveGRPCModules(ctx context.Context, modules []string) ([]*channelpb.Channel, error) {
+	r := grpcRequestOf(ctx)
+	id, err := identity.GetIdentity(r)
+	if err != nil {
+		return nil, grpcStatus(r, err)
+	}
+	delim := config.DefaultConfig.ModuleVersionDelim
+	channels := make([]*channelpb.Channel, 0, len(modules))
+	for _, module := range modules {
+		if name, _ := splitModuleVersion(module, delim); name == "" {
+			return nil, status.Error(codes.InvalidArgument, "empty field: 'module'")
+		}
+		if !validModuleName(module) {
+			return nil, status.Error(codes.InvalidArgument, "invalid field: 'module' must be valid UTF-8 without control characters")
+		}
+		module, url, err := s.resolveModule(r, id.Identity.OrgID, module, delim)
+		if err != nil {
+			return nil, grpcStatus(r, err)
+		}
+		channels = append(channels, &channelpb.Channel{Module: module, Url: url})
+	}
+	return channels, nil
+}
+
+// grpcStatus converts err, returned while serving the gRPC call r, to a gRPC
+// status error. Retired modules fail with NotFound, naming their replacement,
+// if any, and a busy database with Unavailable. Other errors are logged and
+// returned as Internal.
+func grpcStatus(r *http.Request, err error) error {
+	var retired retiredModuleError
+	switch {
+	case errors.As(err, &retired):
+		message := retired.Error()
+		if retired.replacement != "" {
+			message += "; replaced by " + retired.replacement
+		}
+		return status.Error(codes.NotFound, message)
+	case errors.Is(err, ErrDatabaseBusy):
+		return status.Error(codes.Unavailable, "database busy")
+	default:
+		log.WithFields(log.Fields{
+			"method":     r.URL.Path,
+			"request-id": requestIDOf(r),
+			"error":      err,
+		}).Error(internalErrorMessage)
+		return status.Error(codes.Internal, internalErrorMessage)
+	}
+}
+
+// grpcRequestKey is the context key under which the gRPC interceptors store
+// the http.Request standing for the call.
+type grpcRequestKey struct{}
+
+// grpcRequestOf returns the http.Request standing for the gRPC call in ctx:
+// a POST of the full method name, carrying the call metadata as headers and
+// the peer address as RemoteAddr, so that the gRPC service shares the
+// Authenticator and channel resolution of the HTTP API. It is built on first
+// use and kept in the context by withGRPCRequest.
+func grpcRequestOf(ctx context.Context) *http.Request {
+	if r, ok := ctx.Value(grpcRequestKey{}).(*http.Request); ok {
+		return r
+	}
+	method, _ := grpc.Method(ctx)
+	r := (&http.Request{
+		Method:     http.MethodPost,
+		URL:        &url.URL{Path: method},
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+	}).WithContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, values := range md {
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		for _, v := range values {
+			r.Header.Add(k, v)
+		}
+	}
+	if values := md.Get(":authority"); len(values) > 0 {
+		r.Host = values[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r
+}
+
+// withGRPCRequest returns a copy of ctx in which r stands for the gRPC call.
+func withGRPCRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, grpcRequestKey{}, r)
+}
+
+// grpcMetrics is a gRPC interceptor that records calls in the HTTP request
+// metrics, under the "grpc" service and their full method name, with their
+// status code name as code.
+func (s *Server) grpcMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var recorder metrics.Recorder = s.recorder
+	if s.statsd != nil {
+		recorder = multiRecorder{recorder, s.statsd}
+	}
+	recorder.AddInflightRequests(ctx, metrics.HTTPProperties{Service: "grpc", ID: info.FullMethod}, 1)
+	defer recorder.AddInflightRequests(ctx, metrics.HTTPProperties{Service: "grpc", ID: info.FullMethod}, -1)
+
+	start := s.clock.Now()
+	resp, err := handler(ctx, req)
+
+	props := metrics.HTTPReqProperties{
+		Service: "grpc",
+		ID:      info.FullMethod,
+		Method:  http.MethodPost,
+		Code:    status.Code(err).String(),
+	}
+	recorder.ObserveHTTPRequestDuration(ctx, props, s.clock.Now().Sub(start))
+	if m, ok := resp.(proto.Message); ok && err == nil {
+		recorder.ObserveHTTPResponseSize(ctx, props, int64(proto.Size(m)))
+	}
+	return resp, err
+}
+
+// grpcRequestID is a gRPC interceptor that reads the request ID from the
+// metadata key named by the server's request ID header, generating one if it
+// is absent, and sends it back in the response header metadata.
+func (s *Server) grpcRequestID(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	r := grpcRequestOf(ctx)
+	id := r.Header.Get(s.requestIDHeader)
+	if id == "" {
+		id = uuid.New().String()
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(s.requestIDHeader, id)); err != nil {
+		log.Errorf("cannot set gRPC header: %v", err)
+	}
+	return handler(withGRPCRequest(ctx, withRequestID(r, id)), req)
+}
+
+// grpcLog is a gRPC interceptor that logs each call as the log middleware logs
+// HTTP requests, with its status code name as status. Calls whose method
+// matches one of the server's logExcludePaths are not logged.
+func (s *Server) grpcLog(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := s.clock.Now()
+	resp, err := handler(ctx, req)
+
+	if matchesAnyPath(s.logExcludePaths, info.FullMethod) {
+		return resp, err
+	}
+	code := status.Code(err)
+	var level log.Level
+	switch code {
+	case codes.OK:
+		level = log.InfoLevel
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		level = log.ErrorLevel
+	default:
+		level = log.WarnLevel
+	}
+	r := grpcRequestOf(ctx)
+	fields := make(log.Fields)
+	for k, v := range map[string]interface{}{
+		"ident":      r.Host,
+		"method":     r.Method,
+		"url":        sanitizeLogValue(info.FullMethod),
+		"user-agent": sanitizeLogValue(r.UserAgent()),
+		"status":     code.String(),
+		"response":   status.Convert(err).Message(),
+		"duration":   s.clock.Now().Sub(start),
+		"request-id": requestIDOf(r),
+	} {
+		fields[fieldName(s.logFields, k)] = v
+	}
+	log.WithFields(fields).Log(level)
+	return resp, err
+}
+
+// grpcReady is a gRPC interceptor that rejects calls with Unavailable while the
+// server is not ready to serve routing decisions, such as during initial
+// seeding.
+func (s *Server) grpcReady(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !s.Ready() {
+		return nil, status.Error(codes.Unavailable, "not ready")
+	}
+	return handler(ctx, req)
+}
+
+// grpcAuth is a gRPC interceptor that ensures the call carries valid
+// credentials, as verified by the server's Authenticator, for an identity with
+// an org ID, and adds the identity to the request standing for the call.
+func (s *Server) grpcAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	r := grpcRequestOf(ctx)
+	id, err := s.authenticator.Authenticate(r)
+	if err != nil {
+		reason := authRejectionReason(err)
+		s.appMetrics.incAuthRejections(reason)
+		s.statsd.incr("auth_rejections." + reason)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if id.Identity.OrgID == "" {
+		s.appMetrics.incMissingOrgIDs()
+		return nil, status.Error(codes.InvalidArgument, missingOrgIDMessage)
+	}
+	s.activeOrgs.add(id.Identity.OrgID)
+	return handler(withGRPCRequest(ctx, r.WithContext(identity.NewContext(r.Context(), id))), req)
+}
+
+// grpcRateLimit is a gRPC interceptor that limits the call rate of each org as
+// the rateLimit middleware limits its request rate. The org's bucket is
+// described in the x-ratelimit-limit, x-ratelimit-remaining and
+// x-ratelimit-reset response header metadata; calls over the limit fail with
+// ResourceExhausted.
+func (s *Server) grpcRateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	r := grpcRequestOf(ctx)
+	id, err := identity.GetIdentity(r)
+	if err != nil {
+		return nil, grpcStatus(r, err)
+	}
+	limiter := s.orgRateLimiter(id)
+	if limiter == nil {
+		return handler(ctx, req)
+	}
+	allowed, state := limiter.allow(id.Identity.OrgID)
+	md := metadata.Pairs(
+		"x-ratelimit-limit", strconv.Itoa(state.Limit),
+		"x-ratelimit-remaining", strconv.Itoa(state.Remaining),
+		"x-ratelimit-reset", strconv.FormatInt(state.Reset.Unix(), 10),
+	)
+	if !allowed {
+		md.Set("retry-after", strconv.Itoa(int(state.RetryAfter.Seconds())))
+	}
+	if err := grpc.SetHeader(ctx, md); err != nil {
+		log.Errorf("cannot set gRPC header: %v", err)
+	}
+	if !allowed {
+		return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return handler(ctx, req)
+}
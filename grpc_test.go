@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/module-update-router/internal/channelpb"
+	"github.com/redhatinsights/module-update-router/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newGRPCTestClient serves the gRPC service of srv over an in-memory
+// connection and returns a client of it, along with a func to stop both.
+func newGRPCTestClient(t *testing.T, srv *Server) (channelpb.ChannelResolverClient, func()) {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	gs := srv.GRPCServer()
+	go gs.Serve(ln)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return channelpb.NewChannelResolverClient(conn), func() {
+		conn.Close()
+		gs.Stop()
+	}
+}
+
+func TestGRPCServer(t *testing.T) {
+	type response struct {
+		status  string
+		message string
+		body    proto.Message
+	}
+
+	identity := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`))
+
+	tests := []struct {
+		desc  string
+		input struct {
+			identity string
+			req      proto.Message
+		}
+		want response
+	}{
+		{
+			desc: "resolve channel",
+			input: struct {
+				identity string
+				req      proto.Message
+			}{identity, &channelpb.ResolveChannelRequest{Module: "insights-core"}},
+			want: response{"OK", "", &channelpb.Channel{Module: "insights-core", Url: "/testing"}},
+		},
+		{
+			desc: "resolve channels",
+			input: struct {
+				identity string
+				req      proto.Message
+			}{identity, &channelpb.ResolveChannelsRequest{Modules: []string{"insights-core", "modfoo"}}},
+			want: response{"OK", "", &channelpb.ResolveChannelsResponse{Channels: []*channelpb.Channel{
+				{Module: "insights-core", Url: "/testing"},
+				{Module: "modfoo", Url: "/release"},
+			}}},
+		},
+		{
+			desc: "missing module",
+			input: struct {
+				identity string
+				req      proto.Message
+			}{identity, &channelpb.ResolveChannelRequest{}},
+			want: response{"InvalidArgument", "missing required field: 'module'", nil},
+		},
+		{
+			desc: "invalid module",
+			input: struct {
+				identity string
+				req      proto.Message
+			}{identity, &channelpb.ResolveChannelsRequest{Modules: []string{"insights-core\n"}}},
+			want: response{"InvalidArgument", "invalid field: 'module' must be valid UTF-8 without control characters", nil},
+		},
+		{
+			desc: "retired module",
+			input: struct {
+				identity string
+				req      proto.Message
+			}{identity, &channelpb.ResolveChannelRequest{Module: "oldmod"}},
+			want: response{"NotFound", "module retired; replaced by insights-core", nil},
+		},
+		{
+			desc: "missing identity",
+			input: struct {
+				identity string
+				req      proto.Message
+			}{"", &channelpb.ResolveChannelRequest{Module: "insights-core"}},
+			want: response{"Unauthenticated", "missing X-Rh-Identity header", nil},
+		},
+		{
+			desc: "missing org id",
+			input: struct {
+				identity string
+				req      proto.Message
+			}{base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "account_number": "540155", "type": "User" } }`)), &channelpb.ResolveChannelRequest{Module: "insights-core"}},
+			want: response{"InvalidArgument", missingOrgIDMessage, nil},
+		},
+	}
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');
+INSERT INTO modules_retired (module_name, replacement) VALUES ('oldmod', 'insights-core');`)
+	defer srv.Close()
+	client, stop := newGRPCTestClient(t, srv)
+	defer stop()
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx := context.Background()
+			if test.input.identity != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-rh-identity", test.input.identity)
+			}
+			var body proto.Message
+			var err error
+			switch req := test.input.req.(type) {
+			case *channelpb.ResolveChannelRequest:
+				body, err = client.ResolveChannel(ctx, req)
+			case *channelpb.ResolveChannelsRequest:
+				body, err = client.ResolveChannels(ctx, req)
+			}
+
+			s := status.Convert(err)
+			got := response{s.Code().String(), s.Message(), nil}
+			if err == nil {
+				got.body = body
+			}
+			opts := []cmp.Option{cmp.AllowUnexported(response{}), cmp.Comparer(proto.Equal)}
+			if !cmp.Equal(got, test.want, opts...) {
+				t.Errorf("%v", cmp.Diff(got, test.want, opts...))
+			}
+		})
+	}
+}
+
+func TestGRPCServerRateLimit(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.RateLimit = 1
+	config.DefaultConfig.RateLimitBurst = 1
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+	client, stop := newGRPCTestClient(t, srv)
+	defer stop()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-rh-identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+	var got []string
+	var header metadata.MD
+	for i := 0; i < 2; i++ {
+		_, err := client.ResolveChannel(ctx, &channelpb.ResolveChannelRequest{Module: "insights-core"}, grpc.Header(&header))
+		got = append(got, status.Code(err).String())
+	}
+
+	if want := []string{"OK", "ResourceExhausted"}; !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+	if got, want := header.Get("x-ratelimit-remaining"), []string{"0"}; !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+	if got := header.Get("x-request-id"); len(got) != 1 || got[0] == "" {
+		t.Errorf("want request ID, got %v", got)
+	}
+}
+
+func TestGRPCServerNotReady(t *testing.T) {
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+	client, stop := newGRPCTestClient(t, srv)
+	defer stop()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-rh-identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+	var got []string
+	for _, ready := range []bool{false, true} {
+		srv.SetReady(ready)
+		_, err := client.ResolveChannel(ctx, &channelpb.ResolveChannelRequest{Module: "insights-core"})
+		got = append(got, status.Code(err).String())
+	}
+
+	if want := []string{"Unavailable", "OK"}; !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+}
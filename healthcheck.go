@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// healthcheckPaths are the endpoints a healthcheck requests, in order.
+var healthcheckPaths = []string{"/ping", "/readyz"}
+
+// healthcheckURL returns the base URL of a server listening on addr, as given
+// to the -addr flag. A listen address without a host, such as ":8080", is
+// reached on localhost.
+func healthcheckURL(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse address: %w", err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+// healthcheck requests each of healthcheckPaths from the server at baseURL and
+// returns an error describing the first that does not respond with 200.
+func healthcheck(ctx context.Context, client *http.Client, baseURL string) error {
+	for _, p := range healthcheckPaths {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+p, nil)
+		if err != nil {
+			return fmt.Errorf("healthcheck: http.NewRequest failed: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("healthcheck: %v: %w", p, err)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("healthcheck: %v: cannot read body: %w", p, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("healthcheck: %v: unexpected response status: %v: %v", p, resp.Status, strings.TrimSpace(string(body)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthcheckURL(t *testing.T) {
+	tests := []struct {
+		input     string
+		want      string
+		wantError bool
+	}{
+		{input: ":8080", want: "http://localhost:8080"},
+		{input: "0.0.0.0:8080", want: "http://localhost:8080"},
+		{input: "10.0.0.1:8080", want: "http://10.0.0.1:8080"},
+		{input: "[::1]:8080", want: "http://[::1]:8080"},
+		{input: "8080", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := healthcheckURL(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	tests := []struct {
+		desc      string
+		ready     bool
+		wantError string
+	}{
+		{
+			desc:  "ready",
+			ready: true,
+		},
+		{
+			desc:      "not ready",
+			wantError: "healthcheck: /readyz: unexpected response status: 503 Service Unavailable: not ready",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			srv.SetReady(test.ready)
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+
+			err := healthcheck(context.Background(), ts.Client(), ts.URL)
+			if test.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("%v != %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func TestHealthcheckUnreachable(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+
+	if err := healthcheck(context.Background(), http.DefaultClient, ts.URL); err == nil {
+		t.Error("want error, got nil")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// hllPrecision is the number of hash bits used to select a register of a
+// hyperLogLog. The standard error of its estimate is about 1.04/sqrt(2^p),
+// or 1.6% for p = 12.
+const hllPrecision = 12
+
+// hyperLogLog is a HyperLogLog sketch estimating the number of distinct
+// values added to it in constant memory.
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+// hllHash hashes s for use with a hyperLogLog. FNV-1a is finalized with the
+// SplitMix64 mixer, as HyperLogLog relies on well distributed high bits.
+func hllHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// add adds the value hashed to x to the sketch.
+func (h *hyperLogLog) add(x uint64) {
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// merge adds the values added to o to the sketch.
+func (h *hyperLogLog) merge(o *hyperLogLog) {
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// estimate returns the estimated number of distinct values added to the
+// sketch.
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Small range correction: linear counting is more accurate.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return e
+}
+
+// activeOrgsWindow is the window over which a Server counts distinct active
+// orgs, and activeOrgsBuckets the number of sketches it is divided into. The
+// window slides by one bucket at a time.
+const (
+	activeOrgsWindow  = time.Hour
+	activeOrgsBuckets = 4
+)
+
+// slidingCounter estimates the number of distinct values seen within a
+// sliding window, using a ring of hyperLogLog sketches each covering a fraction
+// of the window. It is safe for concurrent use.
+type slidingCounter struct {
+	bucketWidth time.Duration
+	clock       Clock
+
+	mu      sync.Mutex
+	buckets []hyperLogLog
+	// epoch is the index, counted in bucket widths since the zero time, of
+	// the bucket holding the current time.
+	epoch int64
+}
+
+func newSlidingCounter(window time.Duration, buckets int, clock Clock) *slidingCounter {
+	return &slidingCounter{
+		bucketWidth: window / time.Duration(buckets),
+		clock:       clock,
+		buckets:     make([]hyperLogLog, buckets),
+	}
+}
+
+// advance clears the buckets that have slid out of the window since the last
+// call. The caller must hold c.mu.
+func (c *slidingCounter) advance() {
+	epoch := c.clock.Now().UnixNano() / int64(c.bucketWidth)
+	n := int64(len(c.buckets))
+	for e := c.epoch + 1; e <= epoch && e <= c.epoch+n; e++ {
+		c.buckets[e%n] = hyperLogLog{}
+	}
+	if epoch > c.epoch {
+		c.epoch = epoch
+	}
+}
+
+// add records that s was seen now.
+func (c *slidingCounter) add(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance()
+	c.buckets[c.epoch%int64(len(c.buckets))].add(hllHash(s))
+}
+
+// estimate returns the estimated number of distinct values seen within the
+// window.
+func (c *slidingCounter) estimate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance()
+	var union hyperLogLog
+	for i := range c.buckets {
+		union.merge(&c.buckets[i])
+	}
+	return union.estimate()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	tests := []struct {
+		description string
+		input       int
+	}{
+		{"empty", 0},
+		{"small", 10},
+		{"medium", 1000},
+		{"large", 100000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var h hyperLogLog
+			for i := 0; i < test.input; i++ {
+				// Add every value twice; duplicates must not be counted.
+				h.add(hllHash(fmt.Sprintf("%07d", i)))
+				h.add(hllHash(fmt.Sprintf("%07d", i)))
+			}
+			got := h.estimate()
+
+			if math.Abs(got-float64(test.input)) > 0.05*float64(test.input)+0.5 {
+				t.Errorf("%v != %v", got, test.input)
+			}
+		})
+	}
+}
+
+func TestSlidingCounter(t *testing.T) {
+	clock := &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+	c := newSlidingCounter(time.Hour, 4, clock)
+
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("org%v", i))
+	}
+	clock.t = clock.t.Add(30 * time.Minute)
+	for i := 50; i < 150; i++ {
+		c.add(fmt.Sprintf("org%v", i))
+	}
+
+	tests := []struct {
+		description string
+		input       time.Duration
+		want        float64
+	}{
+		{"both halves in window", 0, 150},
+		{"first half slid out", 45 * time.Minute, 100},
+		{"all slid out", time.Hour, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			clock.t = clock.t.Add(test.input)
+			got := c.estimate()
+
+			if math.Abs(got-test.want) > 0.05*test.want+0.5 {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
@@ -2,24 +2,59 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-// responseRecorder records status code and body from an http.ResponseWriter.
+// ErrUnsupportedEncoding occurs when a request body is encoded with a
+// Content-Encoding that cannot be decoded.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// ErrBodyTooLarge occurs when a decoded request body exceeds its size limit.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// allowMethods reports whether the method of r is one of allowed. If it is
+// not, the request is replied to with formatMethodNotAllowedError.
+func allowMethods(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+	formatMethodNotAllowedError(w, r, allowed...)
+	return false
+}
+
+// responseRecorder records status code, size and the first maxBody bytes of
+// the body from an http.ResponseWriter. Bytes past maxBody are passed through
+// without being copied, so that large and streamed responses do not
+// accumulate in memory.
 type responseRecorder struct {
 	http.ResponseWriter
-	Code int
-	Body *bytes.Buffer
+	Code    int
+	Size    int
+	Body    *bytes.Buffer
+	maxBody int
 }
 
 // newResponseRecorder creates a new responseRecorder, wrapping the given
-// http.ResponseWriter w.
-func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+// http.ResponseWriter w and keeping at most maxBody bytes of the body.
+func newResponseRecorder(w http.ResponseWriter, maxBody int) *responseRecorder {
 	return &responseRecorder{
 		ResponseWriter: w,
 		Code:           0,
 		Body:           new(bytes.Buffer),
+		maxBody:        maxBody,
 	}
 }
 
@@ -32,12 +67,156 @@ func (r *responseRecorder) Write(buf []byte) (int, error) {
 	if r.Code == 0 {
 		r.WriteHeader(http.StatusOK)
 	}
-	if r.Body != nil {
-		r.Body.Write(buf)
+	r.Size += len(buf)
+	if r.Body != nil && r.Body.Len() < r.maxBody {
+		n := r.maxBody - r.Body.Len()
+		if n > len(buf) {
+			n = len(buf)
+		}
+		r.Body.Write(buf[:n])
 	}
 	return r.ResponseWriter.Write(buf)
 }
 
+// Flush flushes the wrapped http.ResponseWriter, if it supports flushing.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (r *responseRecorder) String() string {
 	return fmt.Sprintf("%v %v", r.Code, r.Body.String())
 }
+
+// readBody reads and returns the body of r, decoding it according to its
+// Content-Encoding header. Only "gzip" and "identity" encodings are supported;
+// any other encoding returns ErrUnsupportedEncoding. If the decoded body
+// exceeds limit bytes, ErrBodyTooLarge is returned, guarding against
+// decompression bombs.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	var body io.Reader = r.Body
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode gzip body: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read body: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return data, nil
+}
+
+// writeChunkSize is the number of bytes written per call by writeChunked.
+const writeChunkSize = 32 * 1024
+
+// writeChunked writes data to w in chunks, checking ctx before each chunk so
+// that the write is abandoned once the client is gone, and extending deadline
+// before each chunk so that a chunk a stalled client does not read fails. The
+// error of ctx is returned in the first case.
+func writeChunked(ctx context.Context, w io.Writer, data []byte, deadline writeDeadline) error {
+	for len(data) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		deadline.extend()
+		n := len(data)
+		if n > writeChunkSize {
+			n = writeChunkSize
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// connContextKey is the context key of the *writeDeadlineConn a request was
+// received on.
+type connContextKey struct{}
+
+// writeDeadlineListener is a net.Listener wrapping the connections it accepts
+// in writeDeadlineConns.
+type writeDeadlineListener struct {
+	net.Listener
+}
+
+func (l writeDeadlineListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writeDeadlineConn{Conn: c}, nil
+}
+
+// writeDeadlineConn is a net.Conn recording whether a write to it timed out.
+type writeDeadlineConn struct {
+	net.Conn
+	// timedOut is non-zero once a write has timed out. It is accessed
+	// atomically.
+	timedOut int32
+}
+
+func (c *writeDeadlineConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil && isTimeout(err) {
+		atomic.StoreInt32(&c.timedOut, 1)
+	}
+	return n, err
+}
+
+// writeDeadline bounds each write of a long response to the connection of its
+// request, rather than the response as a whole: a client that stops reading
+// is dropped once a write has blocked for timeout, while a response that
+// keeps being read is never cut off, however long it takes.
+type writeDeadline struct {
+	// conn is nil if the request was not received by Server.Serve, as in
+	// tests, in which case writes are not bounded.
+	conn    *writeDeadlineConn
+	timeout time.Duration
+}
+
+// newWriteDeadline returns a writeDeadline for the connection r was received
+// on. A timeout of zero leaves writes unbounded.
+func newWriteDeadline(r *http.Request, timeout time.Duration) writeDeadline {
+	conn, _ := r.Context().Value(connContextKey{}).(*writeDeadlineConn)
+	return writeDeadline{conn: conn, timeout: timeout}
+}
+
+// extend sets the write deadline of the connection to timeout from now. It is
+// called before each write.
+func (d writeDeadline) extend() {
+	if d.conn != nil && d.timeout > 0 {
+		if err := d.conn.SetWriteDeadline(time.Now().Add(d.timeout)); err != nil {
+			log.Errorf("cannot set write deadline: %v", err)
+		}
+	}
+}
+
+// timedOut reports whether a write to the connection timed out.
+func (d writeDeadline) timedOut() bool {
+	return d.conn != nil && atomic.LoadInt32(&d.conn.timedOut) != 0
+}
+
+// isTimeout reports whether err is the result of a context deadline or a
+// network timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
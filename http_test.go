@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteChunked(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*writeChunkSize+1)
+
+	t.Run("complete", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeChunked(context.Background(), &buf, data, writeDeadline{}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("wrote %v bytes, want %v", buf.Len(), len(data))
+		}
+	})
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		var buf bytes.Buffer
+		err := writeChunked(ctx, &buf, data, writeDeadline{})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%v != %v", err, context.DeadlineExceeded)
+		}
+		if !isTimeout(err) {
+			t.Errorf("want timeout error")
+		}
+		if buf.Len() != 0 {
+			t.Errorf("wrote %v bytes, want 0", buf.Len())
+		}
+	})
+}
+
+func TestResponseRecorder(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct {
+			maxBody int
+			writes  []string
+		}
+		want string
+	}{
+		{
+			desc: "under limit",
+			input: struct {
+				maxBody int
+				writes  []string
+			}{8, []string{"abc", "de"}},
+			want: "abcde",
+		},
+		{
+			desc: "over limit",
+			input: struct {
+				maxBody int
+				writes  []string
+			}{4, []string{"abc", "def", "ghi"}},
+			want: "abcd",
+		},
+		{
+			desc: "disabled",
+			input: struct {
+				maxBody int
+				writes  []string
+			}{0, []string{"abc"}},
+			want: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rr := newResponseRecorder(w, test.input.maxBody)
+			var all string
+			for _, s := range test.input.writes {
+				if _, err := rr.Write([]byte(s)); err != nil {
+					t.Fatal(err)
+				}
+				all += s
+			}
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+			if rr.Size != len(all) {
+				t.Errorf("%v != %v", rr.Size, len(all))
+			}
+			if got := w.Body.String(); got != all {
+				t.Errorf("%v != %v", got, all)
+			}
+		})
+	}
+}
@@ -10,6 +10,28 @@ import (
 // the Identity.
 var ErrMissingIdentityValue = fmt.Errorf("identity: nil value found in request context")
 
+// ErrMissingIdentityHeader occurs when a request is missing the X-Rh-Identity
+// header.
+var ErrMissingIdentityHeader = fmt.Errorf("missing X-Rh-Identity header")
+
+// ErrInvalidIdentityHeader occurs when the X-Rh-Identity header of a request
+// cannot be decoded.
+var ErrInvalidIdentityHeader = fmt.Errorf("invalid X-Rh-Identity header")
+
+// InvalidIdentityError is an error matching ErrInvalidIdentityHeader that
+// describes why the header could not be decoded.
+type InvalidIdentityError struct {
+	Reason string
+}
+
+func (e InvalidIdentityError) Error() string {
+	return ErrInvalidIdentityHeader.Error() + ": " + e.Reason
+}
+
+func (e InvalidIdentityError) Is(target error) bool {
+	return target == ErrInvalidIdentityHeader
+}
+
 // TypeCastError represents a failed attempt at casting a type.
 type TypeCastError struct {
 	from, to interface{}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"net/http"
 )
 
@@ -73,29 +72,63 @@ type X509 struct {
 // presence of the X-Rh-Identity header and adds it to the context.
 func Identify(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		data := r.Header.Get("X-Rh-Identity")
-		if data == "" {
-			formatJSONError(w, http.StatusBadRequest, "missing X-Rh-Identity header")
-			return
-		}
-
-		bytes, err := base64.StdEncoding.DecodeString(data)
+		identity, err := FromRequest(r)
 		if err != nil {
-			formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+			formatJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		var identity Identity
-		if err := json.Unmarshal(bytes, &identity); err != nil {
-			formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
-			return
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), identity)))
+	})
+}
+
+// Encodings of the X-Rh-Identity header recognized by Decode.
+const (
+	EncodingBase64 = "base64"
+	EncodingJSON   = "json"
+)
+
+// FromRequest decodes the Identity carried in the X-Rh-Identity header of r. It
+// returns ErrMissingIdentityHeader if the header is absent or empty, and an
+// error matching ErrInvalidIdentityHeader if the header cannot be decoded.
+func FromRequest(r *http.Request) (*Identity, error) {
+	identity, _, err := Decode(r.Header.Get("X-Rh-Identity"))
+	return identity, err
+}
+
+// Decode decodes the value of an X-Rh-Identity header. The value is expected
+// to be base64-encoded JSON; a value that is not valid base64 is decoded as
+// raw JSON instead. Decode returns the encoding the value was decoded from,
+// EncodingBase64 or EncodingJSON. It returns ErrMissingIdentityHeader if data
+// is empty, and an error matching ErrInvalidIdentityHeader if it cannot be
+// decoded.
+func Decode(data string) (*Identity, string, error) {
+	if data == "" {
+		return nil, "", ErrMissingIdentityHeader
+	}
+
+	var identity Identity
+	bytes, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		if err := json.Unmarshal([]byte(data), &identity); err != nil {
+			return nil, "", InvalidIdentityError{"not base64-encoded or raw JSON"}
 		}
+		return &identity, EncodingJSON, nil
+	}
 
-		// TODO: One day when the Identity spec is a thing, validate more of it
-		// like has non-zero AccoutNumber, Type, etc.
+	if err := json.Unmarshal(bytes, &identity); err != nil {
+		return nil, "", InvalidIdentityError{"base64-decoded value is not JSON: " + err.Error()}
+	}
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, &identity)))
-	})
+	// TODO: One day when the Identity spec is a thing, validate more of it
+	// like has non-zero AccoutNumber, Type, etc.
+
+	return &identity, EncodingBase64, nil
+}
+
+// NewContext returns a copy of ctx carrying id as its Identity value.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
 }
 
 // GetIdentity examines the request context for the Identity value and extracts
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -57,7 +58,7 @@ func TestIdentify(t *testing.T) {
 			},
 			want: response{
 				code: http.StatusBadRequest,
-				body: `{"errors":[{"status":"Bad Request","title":"illegal base64 data at input byte 8"}]}`,
+				body: `{"errors":[{"status":"Bad Request","title":"invalid X-Rh-Identity header: not base64-encoded or raw JSON"}]}`,
 			},
 		},
 		{
@@ -69,7 +70,7 @@ func TestIdentify(t *testing.T) {
 			},
 			want: response{
 				code: http.StatusBadRequest,
-				body: `{"errors":[{"status":"Bad Request","title":"unexpected end of JSON input"}]}`,
+				body: `{"errors":[{"status":"Bad Request","title":"invalid X-Rh-Identity header: base64-decoded value is not JSON: unexpected end of JSON input"}]}`,
 			},
 		},
 		{
@@ -84,6 +85,18 @@ func TestIdentify(t *testing.T) {
 				body: `{"identity":{"org_id":"12345","user":{"email":"jsmith@redhat.com","first_name":"John","is_active":true,"is_internal":true,"is_org_admin":false,"last_name":"Smith","locale":"en_US","user_id":"jsmith","username":"jsmith"}}}`,
 			},
 		},
+		{
+			description: "raw json",
+			input: request{
+				headers: map[string]string{
+					"X-Rh-Identity": `{"identity":{"org_id":"12345","system":{"cn":"a4e67559-1cb5-43e3-bcf7-cb2b0c196bac"}}}`,
+				},
+			},
+			want: response{
+				code: http.StatusOK,
+				body: `{"identity":{"org_id":"12345","system":{"cn":"a4e67559-1cb5-43e3-bcf7-cb2b0c196bac"}}}`,
+			},
+		},
 		{
 			description: "internal",
 			input: request{
@@ -208,3 +221,55 @@ func TestGetIdentity(t *testing.T) {
 		})
 	}
 }
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantError   error
+	}{
+		{
+			description: "base64",
+			input:       base64.StdEncoding.EncodeToString([]byte(`{"identity":{"org_id":"12345"}}`)),
+			want:        EncodingBase64,
+		},
+		{
+			description: "raw json",
+			input:       `{"identity":{"org_id":"12345"}}`,
+			want:        EncodingJSON,
+		},
+		{
+			description: "empty",
+			input:       "",
+			wantError:   ErrMissingIdentityHeader,
+		},
+		{
+			description: "neither",
+			input:       "0xdeadbeef",
+			wantError:   ErrInvalidIdentityHeader,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, encoding, err := Decode(test.input)
+
+			if test.wantError != nil {
+				if !errors.Is(err, test.wantError) {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if encoding != test.want {
+					t.Errorf("%v != %v", encoding, test.want)
+				}
+				if got.Identity.OrgID != "12345" {
+					t.Errorf("%v != %v", got.Identity.OrgID, "12345")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPostgresDB opens a migrated database on a Postgres server for the
+// duration of the test. If INTEGRATION_DATABASE_URL is set, it names the
+// server to use. Otherwise a disposable postgres container is started with the
+// container runtime named by INTEGRATION_CONTAINER_RUNTIME (default: docker),
+// and the test is skipped if the runtime is not installed.
+func newPostgresDB(t *testing.T) *DB {
+	t.Helper()
+
+	dsn := os.Getenv("INTEGRATION_DATABASE_URL")
+	if dsn == "" {
+		dsn = startPostgresContainer(t)
+	}
+
+	var db *DB
+	var err error
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		db, err = Open("pgx", dsn)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Migrate(true); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// startPostgresContainer starts a postgres container, removed when the test
+// finishes, and returns a connection URL for it.
+func startPostgresContainer(t *testing.T) string {
+	t.Helper()
+
+	runtime := os.Getenv("INTEGRATION_CONTAINER_RUNTIME")
+	if runtime == "" {
+		runtime = "docker"
+	}
+	if _, err := exec.LookPath(runtime); err != nil {
+		t.Skipf("%v not found; set INTEGRATION_DATABASE_URL or INTEGRATION_CONTAINER_RUNTIME", runtime)
+	}
+
+	out, err := exec.Command(runtime, "run", "--detach", "--rm", "--publish", "127.0.0.1::5432", "--env", "POSTGRES_PASSWORD=postgres", "docker.io/library/postgres:13").Output()
+	if err != nil {
+		t.Fatalf("cannot start postgres container: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		if err := exec.Command(runtime, "rm", "--force", id).Run(); err != nil {
+			t.Logf("cannot remove postgres container %v: %v", id, err)
+		}
+	})
+
+	out, err = exec.Command(runtime, "port", id, "5432/tcp").Output()
+	if err != nil {
+		t.Fatalf("cannot look up postgres container port: %v", err)
+	}
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	return fmt.Sprintf("postgres://postgres:postgres@%v/postgres", addr)
+}
+
+func TestIntegrationPostgres(t *testing.T) {
+	db := newPostgresDB(t)
+
+	if err := db.InsertOrgsModules("insights-core", "1979710"); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Count", func(t *testing.T) {
+		for orgID, want := range map[string]int{"1979710": 1, "1979711": 0} {
+			got, err := db.Count("insights-core", orgID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%v: %v != %v", orgID, got, want)
+			}
+		}
+	})
+
+	startedAt := time.Date(2020, time.July, 15, 17, 16, 55, 0, time.UTC)
+	if err := db.InsertEvents("pre_update", startedAt, 1, sql.NullString{String: "OSError", Valid: true}, startedAt.Add(time.Minute), "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("GetEvents", func(t *testing.T) {
+		got, err := db.GetEvents(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("%v != %v", len(got), 1)
+		}
+		for k, want := range map[string]interface{}{
+			"phase":     "pre_update",
+			"exit":      1,
+			"exception": "OSError",
+			"core_path": "/etc/insights-client/rpm.egg",
+		} {
+			if got[0][k] != want {
+				t.Errorf("%v: %v != %v", k, got[0][k], want)
+			}
+		}
+		if ts, ok := got[0]["started_at"].(time.Time); !ok || !ts.Equal(startedAt) {
+			t.Errorf("started_at: %v != %v", got[0]["started_at"], startedAt)
+		}
+	})
+	t.Run("DeleteEvents", func(t *testing.T) {
+		got, err := db.DeleteEvents(startedAt.Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1 {
+			t.Errorf("%v != %v", got, 1)
+		}
+	})
+	t.Run("lookups", func(t *testing.T) {
+		for _, lookup := range []struct {
+			name string
+			fn   func(string) (string, error)
+			want string
+		}{
+			{"MinClientVersion", db.MinClientVersion, ""},
+			{"DefaultChannel", db.DefaultChannel, ""},
+			{"CanonicalModule", db.CanonicalModule, "insights-core"},
+		} {
+			got, err := lookup.fn("insights-core")
+			if err != nil {
+				t.Fatalf("%v: %v", lookup.name, err)
+			}
+			if got != lookup.want {
+				t.Errorf("%v: %v != %v", lookup.name, got, lookup.want)
+			}
+		}
+	})
+	t.Run("Maintain", func(t *testing.T) {
+		if err := db.Maintain(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
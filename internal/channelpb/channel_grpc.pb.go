@@ -0,0 +1,141 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: channel.proto
+
+package channelpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ChannelResolverClient is the client API for ChannelResolver service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChannelResolverClient interface {
+	ResolveChannel(ctx context.Context, in *ResolveChannelRequest, opts ...grpc.CallOption) (*Channel, error)
+	ResolveChannels(ctx context.Context, in *ResolveChannelsRequest, opts ...grpc.CallOption) (*ResolveChannelsResponse, error)
+}
+
+type channelResolverClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChannelResolverClient(cc grpc.ClientConnInterface) ChannelResolverClient {
+	return &channelResolverClient{cc}
+}
+
+func (c *channelResolverClient) ResolveChannel(ctx context.Context, in *ResolveChannelRequest, opts ...grpc.CallOption) (*Channel, error) {
+	out := new(Channel)
+	err := c.cc.Invoke(ctx, "/moduleupdaterouter.ChannelResolver/ResolveChannel", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *channelResolverClient) ResolveChannels(ctx context.Context, in *ResolveChannelsRequest, opts ...grpc.CallOption) (*ResolveChannelsResponse, error) {
+	out := new(ResolveChannelsResponse)
+	err := c.cc.Invoke(ctx, "/moduleupdaterouter.ChannelResolver/ResolveChannels", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ChannelResolverServer is the server API for ChannelResolver service.
+// All implementations must embed UnimplementedChannelResolverServer
+// for forward compatibility
+type ChannelResolverServer interface {
+	ResolveChannel(context.Context, *ResolveChannelRequest) (*Channel, error)
+	ResolveChannels(context.Context, *ResolveChannelsRequest) (*ResolveChannelsResponse, error)
+	mustEmbedUnimplementedChannelResolverServer()
+}
+
+// UnimplementedChannelResolverServer must be embedded to have forward compatible implementations.
+type UnimplementedChannelResolverServer struct {
+}
+
+func (UnimplementedChannelResolverServer) ResolveChannel(context.Context, *ResolveChannelRequest) (*Channel, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolveChannel not implemented")
+}
+func (UnimplementedChannelResolverServer) ResolveChannels(context.Context, *ResolveChannelsRequest) (*ResolveChannelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolveChannels not implemented")
+}
+func (UnimplementedChannelResolverServer) mustEmbedUnimplementedChannelResolverServer() {}
+
+// UnsafeChannelResolverServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChannelResolverServer will
+// result in compilation errors.
+type UnsafeChannelResolverServer interface {
+	mustEmbedUnimplementedChannelResolverServer()
+}
+
+func RegisterChannelResolverServer(s grpc.ServiceRegistrar, srv ChannelResolverServer) {
+	s.RegisterService(&ChannelResolver_ServiceDesc, srv)
+}
+
+func _ChannelResolver_ResolveChannel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveChannelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChannelResolverServer).ResolveChannel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/moduleupdaterouter.ChannelResolver/ResolveChannel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChannelResolverServer).ResolveChannel(ctx, req.(*ResolveChannelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChannelResolver_ResolveChannels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveChannelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChannelResolverServer).ResolveChannels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/moduleupdaterouter.ChannelResolver/ResolveChannels",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChannelResolverServer).ResolveChannels(ctx, req.(*ResolveChannelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ChannelResolver_ServiceDesc is the grpc.ServiceDesc for ChannelResolver service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChannelResolver_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "moduleupdaterouter.ChannelResolver",
+	HandlerType: (*ChannelResolverServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ResolveChannel",
+			Handler:    _ChannelResolver_ResolveChannel_Handler,
+		},
+		{
+			MethodName: "ResolveChannels",
+			Handler:    _ChannelResolver_ResolveChannels_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "channel.proto",
+}
@@ -3,6 +3,10 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	clowder "github.com/redhatinsights/app-common-go/pkg/api/v1"
 	"github.com/sgreben/flagvar"
@@ -10,49 +14,201 @@ import (
 
 // Config stores values that are used to configure the application.
 type Config struct {
-	Addr           string
-	APIVersion     string
-	AppName        string
-	DBDriver       flagvar.Enum
-	DBHost         string
-	DBName         string
-	DBPass         string
-	DBPort         int
-	DBURL          string
-	DBUser         string
-	EventBuffer    int
-	KafkaBootstrap string
-	LogFormat      flagvar.Enum
-	LogLevel       string
-	MAddr          string
-	MetricsTopic   string
-	PathPrefix     string
-	Reset          bool
-	SeedPath       flagvar.File
+	Addr                  string
+	APIVersion            string
+	AppName               string
+	ChannelCacheJitter    float64
+	ChannelCacheTTL       time.Duration
+	ChannelDualSchema     bool
+	ChannelExpiresAt      bool
+	ChannelHeader         string
+	ChannelOverrideSecret string
+	ChannelURLSunset      string
+	Check                 bool
+	CountErrorPolicy      flagvar.Enum
+	Dashboard             bool
+	DBAcquireTimeout      time.Duration
+	DBDNSCacheTTL         time.Duration
+	DBDriver              flagvar.Enum
+	DBFallbackPath        string
+	DBHost                string
+	DBMaxConns            int
+	DBName                string
+	DBPass                string
+	DBPort                int
+	DBURL                 string
+	DBUser                string
+	DBWarmConnections     int
+	DebugTiming           bool
+	DefaultModule         string
+	EnableChannel         bool
+	EnableEvent           bool
+	EventBuffer           int
+	EventBufferHighWater  float64
+	EventFormat           flagvar.Enum
+	EventMaxLookbackDays  int
+	EventSampleRate       float64
+	EventSources          string
+	EventSpoolInterval    time.Duration
+	EventSpoolSize        int
+	GRPCAddr              string
+	HealthcheckTimeout    time.Duration
+	IdleTimeout           time.Duration
+	JWKSURL               string
+	JWTAudience           string
+	JWTIssuer             string
+	KafkaBootstrap        string
+	KnownIdentityTypes    string
+	LogBodyMaxBytes       int
+	LogExcludePaths       string
+	LogFieldMap           string
+	LogFormat             flagvar.Enum
+	LogLevel              string
+	MAddr                 string
+	MaxEventBodySize      int64
+	MaxEventAge           time.Duration
+	MaxEventQuerySize     int64
+	MaxURLLength          int
+	MetricsPrefix         string
+	MetricsTopic          string
+	MissingOrgIDResponse  flagvar.Enum
+	ModuleVersionDelim    string
+	NotFoundResponse      flagvar.Enum
+	PathPrefix            string
+	PollAfter             string
+	PollAfterJitter       int
+	PreviewOrgs           string
+	RateLimit             float64
+	RateLimitBurst        int
+	ReadOnly              bool
+	RedirectTrailingSlash bool
+	RequestIDHeader       string
+	ReleaseMirrors        string
+	Reset                 bool
+	RouteByVersion        bool
+	SchemaRegistryURL     string
+	SeedBatchSize         int
+	SeedDuplicates        flagvar.Enum
+	SeedIncremental       bool
+	SeedPath              string
+	SeedWorkers           int
+	SelftestModule        string
+	SelftestOrgID         string
+	StatsdAddr            string
+	StatsdPrefix          string
+	TCPKeepAlive          time.Duration
+	TestingMirrors        string
+	TestingQuota          int
+	TrustOrgIDHeader      bool
+	TrustedNetworks       string
+	TypeRateLimits        string
+	UnknownIdentityType   flagvar.Enum
+	UnprefixedPaths       flagvar.Enum
+	UserAgentProduct      string
+	WarningMessage        string
+	WebhookSecret         string
+	WebhookURL            string
+	WriteTimeout          time.Duration
 }
 
 // DefaultConfig is the default configuration variable, providing access to
 // configuration values globally.
 var DefaultConfig Config = Config{
-	Addr:           ":8080",
-	APIVersion:     "v1",
-	AppName:        "module-update-router",
-	DBDriver:       flagvar.Enum{Choices: []string{"pgx", "sqlite3"}, Value: "sqlite3"},
-	DBHost:         "localhost",
-	DBName:         "postgres",
-	DBPass:         "",
-	DBPort:         5432,
-	DBURL:          "",
-	DBUser:         "postgres",
-	EventBuffer:    1000,
-	KafkaBootstrap: "",
-	LogFormat:      flagvar.Enum{Choices: []string{"text", "json"}, Value: "text"},
-	LogLevel:       "info",
-	MAddr:          ":2112",
-	MetricsTopic:   "client-metrics",
-	PathPrefix:     "/api",
-	Reset:          false,
-	SeedPath:       flagvar.File{},
+	Addr:                  ":8080",
+	APIVersion:            "v1",
+	AppName:               "module-update-router",
+	ChannelCacheJitter:    0,
+	ChannelCacheTTL:       0,
+	ChannelDualSchema:     false,
+	ChannelExpiresAt:      false,
+	ChannelHeader:         "X-Channel",
+	ChannelOverrideSecret: "",
+	ChannelURLSunset:      "",
+	Check:                 false,
+	CountErrorPolicy:      flagvar.Enum{Choices: []string{"open", "closed", "cached"}, Value: "open"},
+	Dashboard:             false,
+	DBAcquireTimeout:      time.Second,
+	DBDNSCacheTTL:         0,
+	DBDriver:              flagvar.Enum{Choices: []string{"pgx", "sqlite3"}, Value: "sqlite3"},
+	DBFallbackPath:        "",
+	DBHost:                "localhost",
+	DBMaxConns:            0,
+	DBName:                "postgres",
+	DBPass:                "",
+	DBPort:                5432,
+	DBURL:                 "",
+	DBUser:                "postgres",
+	DBWarmConnections:     0,
+	DebugTiming:           false,
+	DefaultModule:         "",
+	EnableChannel:         true,
+	EnableEvent:           true,
+	EventBuffer:           1000,
+	EventBufferHighWater:  0,
+	EventFormat:           flagvar.Enum{Choices: []string{"json", "avro", "protobuf"}, Value: "json"},
+	EventMaxLookbackDays:  0,
+	EventSampleRate:       1.0,
+	EventSources:          "",
+	EventSpoolInterval:    30 * time.Second,
+	EventSpoolSize:        0,
+	GRPCAddr:              "",
+	HealthcheckTimeout:    5 * time.Second,
+	IdleTimeout:           50 * time.Second,
+	JWKSURL:               "",
+	JWTAudience:           "",
+	JWTIssuer:             "",
+	KafkaBootstrap:        "",
+	KnownIdentityTypes:    "Associate,System,User",
+	LogBodyMaxBytes:       1024,
+	LogExcludePaths:       "",
+	LogFieldMap:           "",
+	LogFormat:             flagvar.Enum{Choices: []string{"text", "json"}, Value: "text"},
+	LogLevel:              "info",
+	MAddr:                 ":2112",
+	MaxEventBodySize:      1 << 20,
+	MaxEventAge:           5 * time.Minute,
+	MaxEventQuerySize:     64 << 20,
+	MaxURLLength:          8192,
+	MetricsPrefix:         "module_update_router",
+	MetricsTopic:          "client-metrics",
+	MissingOrgIDResponse:  flagvar.Enum{Choices: []string{"terse", "diagnostic"}, Value: "terse"},
+	ModuleVersionDelim:    "",
+	NotFoundResponse:      flagvar.Enum{Choices: []string{"terse", "endpoints"}, Value: "terse"},
+	PathPrefix:            "/api",
+	PollAfter:             "",
+	PollAfterJitter:       0,
+	PreviewOrgs:           "",
+	RateLimit:             0,
+	RateLimitBurst:        10,
+	ReadOnly:              false,
+	RedirectTrailingSlash: false,
+	RequestIDHeader:       "X-Request-Id",
+	ReleaseMirrors:        "",
+	Reset:                 false,
+	RouteByVersion:        false,
+	SchemaRegistryURL:     "",
+	SeedBatchSize:         0,
+	SeedDuplicates:        flagvar.Enum{Choices: []string{"last", "first"}, Value: "last"},
+	SeedIncremental:       false,
+	SeedPath:              "",
+	SeedWorkers:           1,
+	SelftestModule:        "insights-core",
+	SelftestOrgID:         "selftest",
+	StatsdAddr:            "",
+	StatsdPrefix:          "module_update_router",
+	TCPKeepAlive:          15 * time.Second,
+	TestingMirrors:        "",
+	TestingQuota:          0,
+	TrustOrgIDHeader:      false,
+	TrustedNetworks:       "127.0.0.0/8,::1/128",
+	TypeRateLimits:        "",
+	UnknownIdentityType:   flagvar.Enum{Choices: []string{"allow", "log", "reject"}, Value: "allow"},
+	UnprefixedPaths:       flagvar.Enum{Choices: []string{"reject", "serve", "forwarded"}, Value: "reject"},
+	UserAgentProduct:      "insights-client",
+	WarningMessage:        "",
+	WebhookSecret:         "",
+	WebhookURL:            "",
+	WriteTimeout:          60 * time.Second,
 }
 
 // init can be used to set default values for DefaultConfig that require more
@@ -69,20 +225,248 @@ func init() {
 	}
 }
 
+// secretFiles lists the environment variables naming files that secrets are
+// loaded from, following the container convention of suffixing the name of
+// the variable holding the secret itself with _FILE, along with the field of c
+// each secret is loaded into.
+func (c *Config) secretFiles() []struct {
+	env   string
+	field *string
+} {
+	return []struct {
+		env   string
+		field *string
+	}{
+		{"DATABASE_URL_FILE", &c.DBURL},
+		{"CHANNEL_OVERRIDE_SECRET_FILE", &c.ChannelOverrideSecret},
+		{"DB_PASS_FILE", &c.DBPass},
+		{"WEBHOOK_SECRET_FILE", &c.WebhookSecret},
+	}
+}
+
+// LoadSecretFiles loads the sensitive fields of c from the files named by
+// their _FILE environment variables, as looked up with getenv. A secret loaded
+// from a file takes precedence over the value set inline by the field's flag
+// or environment variable. Trailing newlines are trimmed from the file
+// contents.
+func (c *Config) LoadSecretFiles(getenv func(string) string) error {
+	for _, secret := range c.secretFiles() {
+		path := getenv(secret.env)
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("config: cannot load %v: %w", secret.env, err)
+		}
+		*secret.field = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+// ValidationError lists the invalid fields of a Config found by Validate, one
+// problem per entry.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "config: invalid configuration: " + strings.Join(e, "; ")
+}
+
+// Validate checks that the values of c are within their allowed ranges. It
+// returns a ValidationError listing every invalid field, or nil if there are
+// none. Values that can only be checked by parsing them, such as lists of
+// networks or mirrors, are checked when the server is created instead.
+func (c Config) Validate() error {
+	var problems ValidationError
+	for _, check := range []struct {
+		field   string
+		invalid bool
+		msg     string
+	}{
+		{"channel_cache_jitter", c.ChannelCacheJitter < 0 || c.ChannelCacheJitter > 1, "must be between 0.0 and 1.0"},
+		{"db_acquire_timeout", c.DBAcquireTimeout < 0, "must not be negative"},
+		{"db_dns_cache_ttl", c.DBDNSCacheTTL < 0, "must not be negative"},
+		{"db_max_conns", c.DBMaxConns < 0, "must not be negative"},
+		{"db_port", c.DBPort < 0 || c.DBPort > 65535, "must be a TCP port"},
+		{"db_warm_connections", c.DBWarmConnections < 0, "must not be negative"},
+		{"event_buffer", c.EventBuffer < 0, "must not be negative"},
+		{"event_buffer_high_water", c.EventBufferHighWater < 0 || c.EventBufferHighWater > 1, "must be between 0.0 and 1.0"},
+		{"event_max_lookback_days", c.EventMaxLookbackDays < 0, "must not be negative"},
+		{"event_sample_rate", c.EventSampleRate < 0 || c.EventSampleRate > 1, "must be between 0.0 and 1.0"},
+		{"event_spool_interval", c.EventSpoolSize > 0 && c.EventSpoolInterval <= 0, "must be positive when event_spool_size is set"},
+		{"event_spool_size", c.EventSpoolSize < 0, "must not be negative"},
+		{"log_body_max_bytes", c.LogBodyMaxBytes < 0, "must not be negative"},
+		{"max_event_body_size", c.MaxEventBodySize < 0, "must not be negative"},
+		{"max_event_query_size", c.MaxEventQuerySize < 0, "must not be negative"},
+		{"max_url_length", c.MaxURLLength < 0, "must not be negative"},
+		{"poll_after_jitter", c.PollAfterJitter < 0, "must not be negative"},
+		{"rate_limit", c.RateLimit < 0, "must not be negative"},
+		{"rate_limit_burst", c.RateLimit > 0 && c.RateLimitBurst < 1, "must be positive when rate_limit is set"},
+		{"request_id_header", c.RequestIDHeader == "", "must not be empty"},
+		{"seed_batch_size", c.SeedBatchSize < 0, "must not be negative"},
+		{"seed_workers", c.SeedWorkers < 1, "must be positive"},
+		{"testing_quota", c.TestingQuota < 0, "must not be negative"},
+	} {
+		if check.invalid {
+			problems = append(problems, check.field+": "+check.msg)
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
 // FlagSet creates a new FlagSet, defined with flags for each struct field in
 // the DefaultConfig variable.
 func FlagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
 	fs := flag.NewFlagSet(name, errorHandling)
 
 	fs.Var(&DefaultConfig.DBDriver, "db-driver", fmt.Sprintf("database driver (%v)", DefaultConfig.DBDriver.Help()))
+	fs.DurationVar(&DefaultConfig.DBAcquireTimeout, "db-acquire-timeout", DefaultConfig.DBAcquireTimeout, "maximum duration a request waits for a database connection when db-max-conns are in use (0 waits indefinitely)")
+	fs.DurationVar(&DefaultConfig.DBDNSCacheTTL, "db-dns-cache-ttl", DefaultConfig.DBDNSCacheTTL, "resolve the database host once and reuse its addresses for new connections, re-resolving them in the background at this interval (0 resolves for each connection)")
+	fs.StringVar(&DefaultConfig.DBFallbackPath, "db-fallback-path", DefaultConfig.DBFallbackPath, "SQLite file kept with a snapshot of the routing rules, served read-only when the pgx database is unreachable at startup (empty disables)")
 	fs.StringVar(&DefaultConfig.DBHost, "db-host", DefaultConfig.DBHost, "IP or hostname of database server")
+	fs.IntVar(&DefaultConfig.DBMaxConns, "db-max-conns", DefaultConfig.DBMaxConns, "maximum number of open database connections (0 is unlimited)")
 	fs.StringVar(&DefaultConfig.DBName, "db-name", DefaultConfig.DBName, "database name")
 	fs.StringVar(&DefaultConfig.DBPass, "db-pass", DefaultConfig.DBPass, "database user password")
 	fs.IntVar(&DefaultConfig.DBPort, "db-port", DefaultConfig.DBPort, "TCP port on database server")
 	fs.StringVar(&DefaultConfig.DBURL, "database-url", DefaultConfig.DBURL, "database connection URL")
 	fs.StringVar(&DefaultConfig.DBUser, "db-user", DefaultConfig.DBUser, "database username")
+	fs.IntVar(&DefaultConfig.DBWarmConnections, "db-warm-connections", DefaultConfig.DBWarmConnections, "number of database connections opened at startup, before serving requests")
+	fs.StringVar(&DefaultConfig.LogFieldMap, "log-field-map", DefaultConfig.LogFieldMap, "comma-separated key=name pairs renaming log fields (e.g. time=@timestamp,msg=message)")
 	fs.Var(&DefaultConfig.LogFormat, "log-format", fmt.Sprintf("set logging format (%v)", DefaultConfig.LogFormat.Help()))
 	fs.StringVar(&DefaultConfig.LogLevel, "log-level", DefaultConfig.LogLevel, "logging level")
 
 	return fs
 }
+
+// Summary returns a map of the effective configuration values suitable for
+// structured logging. Secrets are redacted: ChannelOverrideSecret, DBPass and
+// WebhookSecret are omitted and any password in DBURL is masked.
+func (c Config) Summary() map[string]interface{} {
+	return map[string]interface{}{
+		"addr":                    c.Addr,
+		"api_version":             c.APIVersion,
+		"app_name":                c.AppName,
+		"channel_cache_jitter":    c.ChannelCacheJitter,
+		"channel_cache_ttl":       c.ChannelCacheTTL.String(),
+		"channel_dual_schema":     c.ChannelDualSchema,
+		"channel_expires_at":      c.ChannelExpiresAt,
+		"channel_header":          c.ChannelHeader,
+		"channel_url_sunset":      c.ChannelURLSunset,
+		"check":                   c.Check,
+		"count_error_policy":      c.CountErrorPolicy.Value,
+		"dashboard":               c.Dashboard,
+		"database_url":            redactURL(c.DBURL),
+		"db_acquire_timeout":      c.DBAcquireTimeout.String(),
+		"db_dns_cache_ttl":        c.DBDNSCacheTTL.String(),
+		"db_driver":               c.DBDriver.Value,
+		"db_fallback_path":        c.DBFallbackPath,
+		"db_host":                 c.DBHost,
+		"db_max_conns":            c.DBMaxConns,
+		"db_name":                 c.DBName,
+		"db_port":                 c.DBPort,
+		"db_user":                 c.DBUser,
+		"db_warm_connections":     c.DBWarmConnections,
+		"debug_timing":            c.DebugTiming,
+		"default_module":          c.DefaultModule,
+		"enable_channel":          c.EnableChannel,
+		"enable_event":            c.EnableEvent,
+		"event_buffer":            c.EventBuffer,
+		"event_buffer_high_water": c.EventBufferHighWater,
+		"event_format":            c.EventFormat.Value,
+		"event_max_lookback_days": c.EventMaxLookbackDays,
+		"event_sample_rate":       c.EventSampleRate,
+		"event_sources":           c.EventSources,
+		"event_spool_interval":    c.EventSpoolInterval.String(),
+		"event_spool_size":        c.EventSpoolSize,
+		"grpc_addr":               c.GRPCAddr,
+		"healthcheck_timeout":     c.HealthcheckTimeout.String(),
+		"idle_timeout":            c.IdleTimeout.String(),
+		"jwks_url":                redactURL(c.JWKSURL),
+		"jwt_audience":            c.JWTAudience,
+		"jwt_issuer":              c.JWTIssuer,
+		"kafka_enabled":           c.KafkaBootstrap != "",
+		"kafka_bootstrap":         c.KafkaBootstrap,
+		"known_identity_types":    c.KnownIdentityTypes,
+		"log_body_max_bytes":      c.LogBodyMaxBytes,
+		"log_exclude_paths":       c.LogExcludePaths,
+		"log_field_map":           c.LogFieldMap,
+		"log_format":              c.LogFormat.Value,
+		"log_level":               c.LogLevel,
+		"maddr":                   c.MAddr,
+		"max_event_body_size":     c.MaxEventBodySize,
+		"max_event_age":           c.MaxEventAge.String(),
+		"max_event_query_size":    c.MaxEventQuerySize,
+		"max_url_length":          c.MaxURLLength,
+		"metrics_prefix":          c.MetricsPrefix,
+		"metrics_topic":           c.MetricsTopic,
+		"missing_org_id_response": c.MissingOrgIDResponse.Value,
+		"module_version_delim":    c.ModuleVersionDelim,
+		"not_found_response":      c.NotFoundResponse.Value,
+		"path_prefix":             c.PathPrefix,
+		"poll_after":              c.PollAfter,
+		"poll_after_jitter":       c.PollAfterJitter,
+		"preview_orgs":            c.PreviewOrgs,
+		"rate_limit":              c.RateLimit,
+		"rate_limit_burst":        c.RateLimitBurst,
+		"read_only":               c.ReadOnly,
+		"redirect_trailing_slash": c.RedirectTrailingSlash,
+		"request_id_header":       c.RequestIDHeader,
+		"release_mirrors":         c.ReleaseMirrors,
+		"route_by_version":        c.RouteByVersion,
+		"schema_registry_url":     redactURL(c.SchemaRegistryURL),
+		"seed_batch_size":         c.SeedBatchSize,
+		"seed_duplicates":         c.SeedDuplicates.Value,
+		"seed_incremental":        c.SeedIncremental,
+		"seed_workers":            c.SeedWorkers,
+		"selftest_module":         c.SelftestModule,
+		"selftest_org_id":         c.SelftestOrgID,
+		"statsd_addr":             c.StatsdAddr,
+		"statsd_prefix":           c.StatsdPrefix,
+		"tcp_keep_alive":          c.TCPKeepAlive.String(),
+		"testing_mirrors":         c.TestingMirrors,
+		"testing_quota":           c.TestingQuota,
+		"trust_org_id_header":     c.TrustOrgIDHeader,
+		"trusted_networks":        c.TrustedNetworks,
+		"type_rate_limits":        c.TypeRateLimits,
+		"unknown_identity_type":   c.UnknownIdentityType.Value,
+		"unprefixed_paths":        c.UnprefixedPaths.Value,
+		"user_agent_product":      c.UserAgentProduct,
+		"warning_message":         c.WarningMessage,
+		"webhook_url":             redactURL(c.WebhookURL),
+		"write_timeout":           c.WriteTimeout.String(),
+	}
+}
+
+// redactURL masks the password component of rawURL, if any, and the values of
+// its query parameters, which may carry credentials such as tokens or
+// sslpassword. Strings that do not parse as a URL are redacted entirely.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "REDACTED"
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	if u.RawQuery != "" {
+		query, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return "REDACTED"
+		}
+		for _, values := range query {
+			for i, v := range values {
+				if v != "" {
+					values[i] = "REDACTED"
+				}
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
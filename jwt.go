@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhatinsights/module-update-router/identity"
+)
+
+// ErrInvalidToken occurs when a bearer token is malformed, fails signature
+// verification or carries unacceptable claims.
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+// jwtAuthenticator authenticates requests by a JWT bearer token in the
+// Authorization header, verified against the keys published at a JWKS URL.
+// The org_id and type claims of the token are used to synthesize an identity.
+type jwtAuthenticator struct {
+	keys     *jwks
+	issuer   string
+	audience string
+	clock    Clock
+}
+
+// newJWTAuthenticator creates a jwtAuthenticator that verifies tokens with the
+// keys at jwksURL. If issuer or audience are non-empty, tokens must carry a
+// matching iss or aud claim.
+func newJWTAuthenticator(jwksURL, issuer, audience string, clock Clock) *jwtAuthenticator {
+	return &jwtAuthenticator{
+		keys: &jwks{
+			url:    jwksURL,
+			client: &http.Client{Timeout: 10 * time.Second},
+			clock:  clock,
+		},
+		issuer:   issuer,
+		audience: audience,
+		clock:    clock,
+	}
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return nil, missingCredentialsError{errors.New("missing bearer token")}
+	}
+	claims, err := a.verify(strings.TrimSpace(header[7:]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var id identity.Identity
+	id.Identity.OrgID = claims.OrgID
+	id.Identity.AuthType = "jwt-auth"
+	if claims.Type != "" {
+		t := claims.Type
+		id.Identity.Type = &t
+	}
+	return &id, nil
+}
+
+// jwtClaims holds the registered and application claims of a token.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+	OrgID     string      `json:"org_id"`
+	Type      string      `json:"type"`
+}
+
+// jwtAudience is the aud claim, which may be a single string or an array.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	var v []string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// verify checks the signature and claims of token, returning its claims.
+func (a *jwtAuthenticator) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("cannot decode header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode signature: %w", err)
+	}
+	key, err := a.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("cannot decode claims: %w", err)
+	}
+	now := a.clock.Now().Unix()
+	if claims.ExpiresAt == nil || now >= *claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return nil, errors.New("token not yet valid")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if a.audience != "" {
+		var ok bool
+		for _, aud := range claims.Audience {
+			ok = ok || aud == a.audience
+		}
+		if !ok {
+			return nil, errors.New("unexpected audience")
+		}
+	}
+	if claims.OrgID == "" {
+		return nil, errors.New("missing org_id claim")
+	}
+	return &claims, nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON token segment into v.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature verifies signature over signed with key using the JWS
+// algorithm alg. Only the RS* and ES* algorithms are supported.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm: %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return errors.New("algorithm does not match key type")
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return errors.New("algorithm does not match key type")
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
+
+// jwksRefreshInterval is how long fetched keys are used before the key set is
+// fetched again. jwksMinRefreshInterval limits how often an unknown key ID can
+// trigger a fetch.
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+)
+
+// jwks is a cached JSON Web Key Set fetched from a URL. It is safe for
+// concurrent use.
+type jwks struct {
+	url    string
+	client *http.Client
+	clock  Clock
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// key returns the public key with the given key ID, fetching the key set if it
+// is stale or does not contain kid.
+func (s *jwks) key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	key, ok := s.keys[kid]
+	stale := now.Sub(s.fetchedAt) >= jwksRefreshInterval
+	if !stale && (ok || now.Sub(s.fetchedAt) < jwksMinRefreshInterval) {
+		if !ok {
+			return nil, fmt.Errorf("unknown key: %q", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := s.fetch()
+	if err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	s.keys = keys
+	s.fetchedAt = now
+
+	key, ok = s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %q", kid)
+	}
+	return key, nil
+}
+
+// fetch retrieves and parses the key set. Keys of unsupported types are
+// skipped.
+func (s *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: cannot fetch key set: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: cannot fetch key set: %v", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwks: cannot decode key set: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				continue
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				continue
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signJWT encodes claims as a JWT signed with key using alg.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest.Sum(nil))
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			},
+		})
+	}))
+	defer jwksServer.Close()
+
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://sso.example.com",
+			"aud":    "module-update-router",
+			"exp":    now.Add(time.Hour).Unix(),
+			"org_id": "1979710",
+			"type":   "User",
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantError   error
+	}{
+		{
+			description: "RS256",
+			input:       "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(nil)),
+			want:        "1979710",
+		},
+		{
+			description: "ES256",
+			input:       "Bearer " + signJWT(t, "ES256", "ec", ecKey, claims(nil)),
+			want:        "1979710",
+		},
+		{
+			description: "audience array",
+			input:       "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "module-update-router"}})),
+			want:        "1979710",
+		},
+		{
+			description: "missing header",
+			input:       "",
+			wantError:   ErrNoCredentials,
+		},
+		{
+			description: "malformed token",
+			input:       "Bearer abc",
+			wantError:   ErrInvalidToken,
+		},
+		{
+			description: "invalid signature",
+			input:       "Bearer " + signJWT(t, "RS256", "rsa", otherKey, claims(nil)),
+			wantError:   ErrInvalidToken,
+		},
+		{
+			description: "unknown key",
+			input:       "Bearer " + signJWT(t, "RS256", "other", otherKey, claims(nil)),
+			wantError:   ErrInvalidToken,
+		},
+		{
+			description: "expired",
+			input:       "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": now.Unix()})),
+			wantError:   ErrInvalidToken,
+		},
+		{
+			description: "wrong issuer",
+			input:       "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			wantError:   ErrInvalidToken,
+		},
+		{
+			description: "wrong audience",
+			input:       "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+			wantError:   ErrInvalidToken,
+		},
+		{
+			description: "missing org_id",
+			input:       "Bearer " + signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"org_id": ""})),
+			wantError:   ErrInvalidToken,
+		},
+	}
+
+	a := newJWTAuthenticator(jwksServer.URL, "https://sso.example.com", "module-update-router", fixedClock(now))
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.input != "" {
+				req.Header.Add("Authorization", test.input)
+			}
+			got, err := a.Authenticate(req)
+
+			if test.wantError != nil {
+				if !errors.Is(err, test.wantError) {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Identity.OrgID != test.want {
+					t.Errorf("%v != %v", got.Identity.OrgID, test.want)
+				}
+				if got.Identity.Type == nil || *got.Identity.Type != "User" {
+					t.Errorf("unexpected type: %v", got.Identity.Type)
+				}
+			}
+		})
+	}
+}
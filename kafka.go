@@ -2,13 +2,25 @@ package main
 
 import (
 	"context"
+	"hash/fnv"
+	"math"
+	"time"
 
 	"github.com/segmentio/kafka-go"
 	log "github.com/sirupsen/logrus"
 )
 
-// ProduceMessages consumes the in channel and sends the message
-func ProduceMessages(brokers string, topic string, async bool, events *chan []byte) {
+// ProduceMessages consumes the in channel and sends the message, encoded by
+// enc. Messages are keyed by the event's machine ID and sampled by that key
+// according to sampleRate before being written; see sampleMessage. The trace
+// context of each message, if any, is propagated in a traceparent header, and
+// the time each message spent queued is observed in metrics.
+//
+// If spool is not nil, messages that fail to be written are spooled and
+// retried every spoolInterval rather than requeued on the in channel. Write
+// errors are only reported by synchronous writers, so async must be false for
+// the spool to receive any.
+func ProduceMessages(brokers string, topic string, async bool, sampleRate float64, enc eventEncoder, events *chan queuedEvent, spool *eventSpool, spoolInterval time.Duration, metrics *appMetrics) {
 	go func() {
 		w := kafka.NewWriter(kafka.WriterConfig{
 			Brokers:  []string{brokers},
@@ -19,20 +31,96 @@ func ProduceMessages(brokers string, topic string, async bool, events *chan []by
 
 		defer w.Close()
 
+		if spool != nil {
+			go spool.run(spoolInterval, func(v queuedEvent) error {
+				m, err := kafkaMessage(v, enc)
+				if err != nil {
+					log.Errorf("cannot marshal spooled event; dropping: %v", err)
+					return nil
+				}
+				return w.WriteMessages(context.Background(), m)
+			})
+		}
+
 		for v := range *events {
-			go func(v []byte) {
-				err := w.WriteMessages(context.Background(),
-					kafka.Message{
-						Key:   nil,
-						Value: v,
-					},
-				)
+			metrics.observeEventQueueLatency(time.Since(v.EnqueuedAt))
+			if !sampleMessage(messageKey(v.Event), sampleRate, systemRand{}) {
+				metrics.incEventsSampled("dropped")
+				pendingEvents.done(v.EnqueuedAt)
+				continue
+			}
+			metrics.incEventsSampled("kept")
+
+			go func(v queuedEvent) {
+				m, err := kafkaMessage(v, enc)
+				if err != nil {
+					log.Errorf("cannot marshal event; dropping: %v", err)
+					pendingEvents.done(v.EnqueuedAt)
+					return
+				}
+				err = w.WriteMessages(context.Background(), m)
+				if err != nil && spool != nil {
+					log.Errorf("message write failed; spooling: %v", err)
+					if err := spool.add(v); err != nil {
+						log.Errorf("cannot spool event; dropping: %v", err)
+					}
+					pendingEvents.done(v.EnqueuedAt)
+					return
+				}
 				if err != nil {
 					log.Errorf("message write failed; will try again: %v", err)
 					*events <- v
 					return
 				}
+				pendingEvents.done(v.EnqueuedAt)
 			}(v)
 		}
 	}()
 }
+
+// kafkaMessage converts a queuedEvent to the kafka.Message written for it,
+// keyed by messageKey and encoding the event with enc.
+func kafkaMessage(v queuedEvent, enc eventEncoder) (kafka.Message, error) {
+	value, err := enc.Encode(v.Event)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	m := kafka.Message{
+		Key:   messageKey(v.Event),
+		Value: value,
+	}
+	if v.Traceparent != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: "traceparent", Value: []byte(v.Traceparent)})
+	}
+	return m, nil
+}
+
+// messageKey returns the key of the message written for e: its machine ID, so
+// that the events of a host are sampled together and kept in order on one
+// partition, or nil if it has none.
+func messageKey(e Event) []byte {
+	if e.MachineID == "" {
+		return nil
+	}
+	return []byte(e.MachineID)
+}
+
+// sampleMessage reports whether a message with the given key should be kept
+// at the given sample rate. A rate of 1 or more keeps every message and a rate
+// of 0 or less drops every message. If key is non-empty, the decision is
+// derived from a hash of the key so that all messages sharing a key are either
+// kept or dropped together. Otherwise the decision is drawn from rnd.
+func sampleMessage(key []byte, rate float64, rnd Rand) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	if len(key) > 0 {
+		h := fnv.New64a()
+		h.Write(key)
+		return float64(h.Sum64())/math.MaxUint64 < rate
+	}
+	return rnd.Float64() < rate
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestSampleMessage(t *testing.T) {
+	type input struct {
+		key  []byte
+		rate float64
+	}
+	tests := []struct {
+		desc  string
+		input input
+		want  bool
+	}{
+		{
+			desc:  "rate 1 keeps",
+			input: input{rate: 1},
+			want:  true,
+		},
+		{
+			desc:  "rate 0 drops",
+			input: input{key: []byte("60654767-dfba-47af-8bca-cb2d1d01d9a6"), rate: 0},
+			want:  false,
+		},
+		{
+			desc:  "negative rate drops",
+			input: input{rate: -0.5},
+			want:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := sampleMessage(test.input.key, test.input.rate, systemRand{})
+
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSampleMessageDeterministic(t *testing.T) {
+	key := []byte("60654767-dfba-47af-8bca-cb2d1d01d9a6")
+	want := sampleMessage(key, 0.5, fixedRand(0))
+	for i := 0; i < 100; i++ {
+		if got := sampleMessage(key, 0.5, fixedRand(0)); got != want {
+			t.Fatalf("%v != %v", got, want)
+		}
+	}
+}
+
+func TestSampleMessageRand(t *testing.T) {
+	if !sampleMessage(nil, 0.25, fixedRand(0.2)) {
+		t.Errorf("want message kept")
+	}
+	if sampleMessage(nil, 0.25, fixedRand(0.3)) {
+		t.Errorf("want message dropped")
+	}
+}
+
+func TestKafkaMessage(t *testing.T) {
+	event := Event{
+		Phase:       "pre_update",
+		StartedAt:   time.Date(2020, time.June, 19, 11, 18, 3, 0, time.UTC),
+		EndedAt:     time.Date(2020, time.June, 19, 11, 19, 3, 0, time.UTC),
+		MachineID:   "60654767-dfba-47af-8bca-cb2d1d01d9a6",
+		CoreVersion: "3.0.156",
+	}
+	value := []byte(`{"phase":"pre_update","started_at":"2020-06-19T11:18:03Z","exit":0,"ended_at":"2020-06-19T11:19:03Z","machine_id":"60654767-dfba-47af-8bca-cb2d1d01d9a6","core_version":"3.0.156"}`)
+
+	key := []byte("60654767-dfba-47af-8bca-cb2d1d01d9a6")
+
+	tests := []struct {
+		desc  string
+		input queuedEvent
+		want  kafka.Message
+	}{
+		{
+			desc:  "without trace context",
+			input: queuedEvent{Event: event},
+			want:  kafka.Message{Key: key, Value: value},
+		},
+		{
+			desc:  "with trace context",
+			input: queuedEvent{Event: event, Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			want: kafka.Message{
+				Key:     key,
+				Value:   value,
+				Headers: []kafka.Header{{Key: "traceparent", Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := kafkaMessage(test.input, jsonEncoder{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestSampleEventKey(t *testing.T) {
+	event := Event{Phase: "pre_update", MachineID: "60654767-dfba-47af-8bca-cb2d1d01d9a6"}
+
+	m, err := kafkaMessage(queuedEvent{Event: event}, jsonEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The decision for an event depends on its machine ID alone, so that
+	// every event of a host is kept or dropped alike whatever rnd draws.
+	want := sampleMessage(m.Key, 0.5, fixedRand(0))
+	for _, phase := range []string{"pre_update", "post_update"} {
+		event.Phase = phase
+		for _, r := range []float64{0, 0.49, 0.51, 0.99} {
+			if got := sampleMessage(messageKey(event), 0.5, fixedRand(r)); got != want {
+				t.Errorf("phase %v, rand %v: %v != %v", phase, r, got, want)
+			}
+		}
+	}
+}
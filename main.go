@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -15,13 +16,17 @@ import (
 
 	"github.com/peterbourgon/ff/v3"
 	"github.com/peterbourgon/ff/v3/ffcli"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redhatinsights/module-update-router/internal/config"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
 	var db *DB
+	explicit := make(map[string]bool)
+	var override struct {
+		channel, orgID, module string
+		ttl                    time.Duration
+	}
 
 	root := ffcli.Command{
 		FlagSet: config.FlagSet(filepath.Base(os.Args[0]), flag.ExitOnError),
@@ -35,7 +40,11 @@ func main() {
 				FlagSet: func() *flag.FlagSet {
 					fs := flag.NewFlagSet("migrate", flag.ExitOnError)
 
-					fs.Var(&config.DefaultConfig.SeedPath, "seed-path", "path to the SQL seed file")
+					fs.StringVar(&config.DefaultConfig.SeedPath, "seed-path", config.DefaultConfig.SeedPath, "comma-separated paths to SQL seed files or directories of them")
+					fs.BoolVar(&config.DefaultConfig.SeedIncremental, "seed-incremental", config.DefaultConfig.SeedIncremental, "merge the routing rules of the seed files into the database instead of executing them as-is")
+					fs.Var(&config.DefaultConfig.SeedDuplicates, "seed-duplicates", fmt.Sprintf("which of the rows an incremental seed sets more than once with the same key is merged (%v)", config.DefaultConfig.SeedDuplicates.Help()))
+					fs.IntVar(&config.DefaultConfig.SeedBatchSize, "seed-batch-size", config.DefaultConfig.SeedBatchSize, "number of rows an incremental seed merges in each transaction (0 merges every row in a single transaction)")
+					fs.IntVar(&config.DefaultConfig.SeedWorkers, "seed-workers", config.DefaultConfig.SeedWorkers, "number of transactions of seed-batch-size rows an incremental seed merges concurrently (pgx only)")
 					fs.BoolVar(&config.DefaultConfig.Reset, "reset", config.DefaultConfig.Reset, "drop all tables before running migrations")
 
 					return fs
@@ -44,15 +53,21 @@ func main() {
 					ff.WithEnvVarNoPrefix(),
 				},
 				Exec: func(ctx context.Context, args []string) error {
+					var err error
+					if db, err = openDB(explicit); err != nil {
+						return err
+					}
+					defer db.Close()
+
 					log.Debug("running migrations")
 					if err := db.Migrate(config.DefaultConfig.Reset); err != nil {
 						return err
 					}
 					log.Debug("migrations complete")
 
-					if config.DefaultConfig.SeedPath.Value != "" {
+					if config.DefaultConfig.SeedPath != "" {
 						log.Debug("seeding database")
-						if err := db.Seed(config.DefaultConfig.SeedPath.Value); err != nil {
+						if err := seed(db, config.DefaultConfig.SeedPath, config.DefaultConfig.SeedIncremental, nil); err != nil {
 							return err
 						}
 						log.Debug("seed complete")
@@ -60,6 +75,62 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:      "healthcheck",
+				ShortHelp: "check that a running instance is serving",
+				FlagSet: func() *flag.FlagSet {
+					fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+
+					fs.StringVar(&config.DefaultConfig.Addr, "addr", config.DefaultConfig.Addr, "listen address of the instance to check")
+					fs.DurationVar(&config.DefaultConfig.HealthcheckTimeout, "healthcheck-timeout", config.DefaultConfig.HealthcheckTimeout, "maximum duration of the healthcheck")
+
+					return fs
+				}(),
+				Options: []ff.Option{
+					ff.WithEnvVarNoPrefix(),
+				},
+				Exec: func(ctx context.Context, args []string) error {
+					baseURL, err := healthcheckURL(config.DefaultConfig.Addr)
+					if err != nil {
+						return err
+					}
+					ctx, cancel := context.WithTimeout(ctx, config.DefaultConfig.HealthcheckTimeout)
+					defer cancel()
+					if err := healthcheck(ctx, http.DefaultClient, baseURL); err != nil {
+						return err
+					}
+					log.WithFields(log.Fields{
+						"url": baseURL,
+					}).Info("healthcheck passed")
+					return nil
+				},
+			},
+			{
+				Name:      "override-token",
+				ShortHelp: "issue a token overriding the channel of an org's clients",
+				FlagSet: func() *flag.FlagSet {
+					fs := flag.NewFlagSet("override-token", flag.ExitOnError)
+
+					fs.StringVar(&config.DefaultConfig.ChannelOverrideSecret, "channel-override-secret", config.DefaultConfig.ChannelOverrideSecret, "key signing the token, as configured on the servers verifying it")
+					fs.StringVar(&override.channel, "channel", "testing", "channel the token routes to (release, testing)")
+					fs.StringVar(&override.orgID, "org-id", "", "org whose clients the token applies to")
+					fs.StringVar(&override.module, "module", "", "module the token applies to (empty applies it to every module)")
+					fs.DurationVar(&override.ttl, "ttl", 24*time.Hour, "duration for which the token is valid")
+
+					return fs
+				}(),
+				Options: []ff.Option{
+					ff.WithEnvVarNoPrefix(),
+				},
+				Exec: func(ctx context.Context, args []string) error {
+					token, err := issueChannelOverrideToken([]byte(config.DefaultConfig.ChannelOverrideSecret), override.channel, override.orgID, override.module, override.ttl, time.Now())
+					if err != nil {
+						return err
+					}
+					fmt.Println(token)
+					return nil
+				},
+			},
 			{
 				Name:      "http-api",
 				ShortHelp: "run HTTP services",
@@ -70,13 +141,83 @@ func main() {
 					fs := flag.NewFlagSet("http-api", flag.ExitOnError)
 
 					fs.StringVar(&config.DefaultConfig.Addr, "addr", config.DefaultConfig.Addr, "app listen address")
+					fs.StringVar(&config.DefaultConfig.SeedPath, "seed-path", config.DefaultConfig.SeedPath, "comma-separated paths to SQL seed files or directories of them, merged at startup if seed-incremental is set; /readyz reports not ready until they are merged")
+					fs.BoolVar(&config.DefaultConfig.SeedIncremental, "seed-incremental", config.DefaultConfig.SeedIncremental, "merge the routing rules of the seed files into the database instead of executing them as-is")
+					fs.Var(&config.DefaultConfig.SeedDuplicates, "seed-duplicates", fmt.Sprintf("which of the rows an incremental seed sets more than once with the same key is merged (%v)", config.DefaultConfig.SeedDuplicates.Help()))
+					fs.IntVar(&config.DefaultConfig.SeedBatchSize, "seed-batch-size", config.DefaultConfig.SeedBatchSize, "number of rows an incremental seed merges in each transaction (0 merges every row in a single transaction)")
+					fs.IntVar(&config.DefaultConfig.SeedWorkers, "seed-workers", config.DefaultConfig.SeedWorkers, "number of transactions of seed-batch-size rows an incremental seed merges concurrently (pgx only)")
 					fs.StringVar(&config.DefaultConfig.APIVersion, "api-version", config.DefaultConfig.APIVersion, "version to use in the URL path")
 					fs.StringVar(&config.DefaultConfig.AppName, "app-name", config.DefaultConfig.AppName, "name component for the API prefix")
+					fs.StringVar(&config.DefaultConfig.ModuleVersionDelim, "module-version-delim", config.DefaultConfig.ModuleVersionDelim, "delimiter separating a client version suffix from the module parameter, as in module@version (empty disables)")
+					fs.BoolVar(&config.DefaultConfig.DebugTiming, "debug-timing", config.DefaultConfig.DebugTiming, "time each middleware stage of requests carrying the X-Debug-Timing header")
+					fs.StringVar(&config.DefaultConfig.DefaultModule, "default-module", config.DefaultConfig.DefaultModule, "module to use when /channel is requested without a module parameter")
 					fs.IntVar(&config.DefaultConfig.EventBuffer, "event-buffer", config.DefaultConfig.EventBuffer, "the size of the event channel buffer")
+					fs.Float64Var(&config.DefaultConfig.EventBufferHighWater, "event-buffer-high-water", config.DefaultConfig.EventBufferHighWater, "fraction of the event buffer in use above which events are rejected with 503 (0 disables)")
+					fs.StringVar(&config.DefaultConfig.EventSources, "event-sources", config.DefaultConfig.EventSources, "comma-separated list of client applications allowed to post events (empty allows any)")
+					fs.IntVar(&config.DefaultConfig.EventMaxLookbackDays, "event-max-lookback-days", config.DefaultConfig.EventMaxLookbackDays, "number of days back GET /event queries are limited to, even without 'since' (0 is unlimited)")
+					fs.Float64Var(&config.DefaultConfig.EventSampleRate, "event-sample-rate", config.DefaultConfig.EventSampleRate, "fraction of events to produce to kafka (0.0-1.0)")
+					fs.DurationVar(&config.DefaultConfig.EventSpoolInterval, "event-spool-interval", config.DefaultConfig.EventSpoolInterval, "interval between retries of spooled events")
+					fs.IntVar(&config.DefaultConfig.EventSpoolSize, "event-spool-size", config.DefaultConfig.EventSpoolSize, "maximum number of events that failed to produce to spool in the database for retry (0 disables)")
+					fs.Var(&config.DefaultConfig.EventFormat, "event-format", fmt.Sprintf("serialization format of events produced to kafka (%v)", config.DefaultConfig.EventFormat.Help()))
+					fs.StringVar(&config.DefaultConfig.SchemaRegistryURL, "schema-registry-url", config.DefaultConfig.SchemaRegistryURL, "url of the schema registry the avro event schema is registered with")
 					fs.StringVar(&config.DefaultConfig.KafkaBootstrap, "kafka-bootstrap", config.DefaultConfig.KafkaBootstrap, "url of the kafka broker for the cluster")
 					fs.StringVar(&config.DefaultConfig.MAddr, "maddr", config.DefaultConfig.MAddr, "metrics listen address")
+					fs.StringVar(&config.DefaultConfig.GRPCAddr, "grpc-addr", config.DefaultConfig.GRPCAddr, "gRPC listen address (empty disables the gRPC service)")
+					fs.BoolVar(&config.DefaultConfig.Dashboard, "dashboard", config.DefaultConfig.Dashboard, "serve a live stats dashboard at /dashboard on the metrics listen address")
+					fs.Float64Var(&config.DefaultConfig.ChannelCacheJitter, "channel-cache-jitter", config.DefaultConfig.ChannelCacheJitter, "largest fraction (0.0-1.0) of the channel cache TTL by which each cached rule's lifetime is randomly shortened")
+					fs.DurationVar(&config.DefaultConfig.ChannelCacheTTL, "channel-cache-ttl", config.DefaultConfig.ChannelCacheTTL, "duration routing rules are cached for /channel and /channels (0 disables caching)")
+					fs.BoolVar(&config.DefaultConfig.ChannelDualSchema, "channel-dual-schema", config.DefaultConfig.ChannelDualSchema, "add the fields of the new /channel response schema (channel, location) alongside url while clients migrate")
+					fs.BoolVar(&config.DefaultConfig.ChannelExpiresAt, "channel-expires-at", config.DefaultConfig.ChannelExpiresAt, "include the time after which clients should query again as expires_at in /channel responses")
+					fs.StringVar(&config.DefaultConfig.ChannelHeader, "channel-header", config.DefaultConfig.ChannelHeader, "response header carrying the resolved channel name on /channel (empty disables)")
+					fs.StringVar(&config.DefaultConfig.ChannelOverrideSecret, "channel-override-secret", config.DefaultConfig.ChannelOverrideSecret, "key verifying X-Channel-Override tokens on /channel (empty disables overrides)")
+					fs.StringVar(&config.DefaultConfig.ChannelURLSunset, "channel-url-sunset", config.DefaultConfig.ChannelURLSunset, "RFC 3339 time from which url is left out of /channel responses when channel-dual-schema is set, announced until then in a Sunset header (empty keeps url)")
+					fs.BoolVar(&config.DefaultConfig.Check, "check", config.DefaultConfig.Check, "validate the configuration and seed file, report the outcome and exit instead of serving")
+					fs.Var(&config.DefaultConfig.CountErrorPolicy, "count-error-policy", fmt.Sprintf("handling of failed routing rule lookups: route to release, respond 500 or use the last cached rule (%v)", config.DefaultConfig.CountErrorPolicy.Help()))
+					fs.BoolVar(&config.DefaultConfig.EnableChannel, "enable-channel", config.DefaultConfig.EnableChannel, "serve the /channel endpoint")
+					fs.BoolVar(&config.DefaultConfig.EnableEvent, "enable-event", config.DefaultConfig.EnableEvent, "serve the /event endpoint")
+					fs.IntVar(&config.DefaultConfig.MaxURLLength, "max-url-length", config.DefaultConfig.MaxURLLength, "maximum length in bytes of a request URL, including the query string (0 is unlimited)")
+					fs.Int64Var(&config.DefaultConfig.MaxEventBodySize, "max-event-body-size", config.DefaultConfig.MaxEventBodySize, "maximum size in bytes of a decoded POST /event body")
+					fs.DurationVar(&config.DefaultConfig.MaxEventAge, "max-event-age", config.DefaultConfig.MaxEventAge, "age of the oldest unproduced event beyond which a warning is logged (0 disables)")
+					fs.Int64Var(&config.DefaultConfig.MaxEventQuerySize, "max-event-query-size", config.DefaultConfig.MaxEventQuerySize, "approximate memory budget in bytes for the results of a GET /event query (0 disables)")
+					fs.StringVar(&config.DefaultConfig.MetricsPrefix, "metrics-prefix", config.DefaultConfig.MetricsPrefix, "namespace prefixed to the names of all prometheus metrics")
 					fs.StringVar(&config.DefaultConfig.MetricsTopic, "metrics-topic", config.DefaultConfig.MetricsTopic, "topic on which to place metrics data")
+					fs.Var(&config.DefaultConfig.MissingOrgIDResponse, "missing-org-id-response", fmt.Sprintf("response to identities without an org_id: a terse error, or one listing the identity fields present and missing (%v)", config.DefaultConfig.MissingOrgIDResponse.Help()))
+					fs.Var(&config.DefaultConfig.UnprefixedPaths, "unprefixed-paths", fmt.Sprintf("handling of API paths missing the path prefix, as forwarded by gateways stripping it: not found, served, or served if X-Forwarded-Prefix names the prefix (%v)", config.DefaultConfig.UnprefixedPaths.Help()))
+					fs.Var(&config.DefaultConfig.NotFoundResponse, "not-found-response", fmt.Sprintf("response to authenticated requests for unknown API paths: a terse 404, or one listing the available endpoints (%v)", config.DefaultConfig.NotFoundResponse.Help()))
 					fs.StringVar(&config.DefaultConfig.PathPrefix, "path-prefix", config.DefaultConfig.PathPrefix, "API path prefix")
+					fs.StringVar(&config.DefaultConfig.PollAfter, "poll-after", config.DefaultConfig.PollAfter, "comma-separated channel=seconds pairs a client on each channel should wait before checking again (e.g. /release=3600,/testing=600); channels without one omit poll_after")
+					fs.IntVar(&config.DefaultConfig.PollAfterJitter, "poll-after-jitter", config.DefaultConfig.PollAfterJitter, "maximum number of seconds of random jitter added to poll_after")
+					fs.StringVar(&config.DefaultConfig.PreviewOrgs, "preview-orgs", config.DefaultConfig.PreviewOrgs, "comma-separated list of org IDs routed to /preview regardless of their routing rules")
+					fs.BoolVar(&config.DefaultConfig.RouteByVersion, "route-by-version", config.DefaultConfig.RouteByVersion, "only route clients at or above a module's minimum version to testing")
+					fs.IntVar(&config.DefaultConfig.LogBodyMaxBytes, "log-body-max-bytes", config.DefaultConfig.LogBodyMaxBytes, "bytes of each response body captured for the access log (0 captures none)")
+					fs.StringVar(&config.DefaultConfig.LogExcludePaths, "log-exclude-paths", config.DefaultConfig.LogExcludePaths, "comma-separated list of request path patterns left out of the access log (e.g. /api/*/v1/channel)")
+					fs.StringVar(&config.DefaultConfig.SelftestModule, "selftest-module", config.DefaultConfig.SelftestModule, "module resolved by /admin/selftest when the request names none")
+					fs.StringVar(&config.DefaultConfig.SelftestOrgID, "selftest-org-id", config.DefaultConfig.SelftestOrgID, "org ID resolved by /admin/selftest when the request names none")
+					fs.StringVar(&config.DefaultConfig.StatsdAddr, "statsd-addr", config.DefaultConfig.StatsdAddr, "UDP address of a StatsD server to mirror metrics to")
+					fs.StringVar(&config.DefaultConfig.StatsdPrefix, "statsd-prefix", config.DefaultConfig.StatsdPrefix, "prefix for StatsD metric names")
+					fs.Float64Var(&config.DefaultConfig.RateLimit, "rate-limit", config.DefaultConfig.RateLimit, "requests per second allowed for each org (0 disables rate limiting)")
+					fs.IntVar(&config.DefaultConfig.RateLimitBurst, "rate-limit-burst", config.DefaultConfig.RateLimitBurst, "maximum burst of requests allowed for each org")
+					fs.StringVar(&config.DefaultConfig.TypeRateLimits, "type-rate-limits", config.DefaultConfig.TypeRateLimits, "comma-separated type=rate:burst rate limits for each org by identity type, overriding rate-limit (a rate of 0 exempts the type)")
+					fs.StringVar(&config.DefaultConfig.ReleaseMirrors, "release-mirrors", config.DefaultConfig.ReleaseMirrors, "comma-separated url=weight mirrors returned in place of /release")
+					fs.StringVar(&config.DefaultConfig.TestingMirrors, "testing-mirrors", config.DefaultConfig.TestingMirrors, "comma-separated url=weight mirrors returned in place of /testing")
+					fs.IntVar(&config.DefaultConfig.TestingQuota, "testing-quota", config.DefaultConfig.TestingQuota, "number of times a day an org may be routed to /testing before it is routed to /release (0 is unlimited)")
+					fs.BoolVar(&config.DefaultConfig.ReadOnly, "read-only", config.DefaultConfig.ReadOnly, "serve reads only, rejecting write requests with 503, for standbys running against a read-only replica")
+					fs.BoolVar(&config.DefaultConfig.RedirectTrailingSlash, "redirect-trailing-slash", config.DefaultConfig.RedirectTrailingSlash, "redirect API paths with a trailing slash to the canonical path instead of serving them")
+					fs.StringVar(&config.DefaultConfig.WarningMessage, "warning-message", config.DefaultConfig.WarningMessage, "message sent to API clients in a Warning header, such as an upcoming deprecation")
+					fs.StringVar(&config.DefaultConfig.RequestIDHeader, "request-id-header", config.DefaultConfig.RequestIDHeader, "request and response header carrying the request ID, generated when absent")
+					fs.StringVar(&config.DefaultConfig.JWKSURL, "jwks-url", config.DefaultConfig.JWKSURL, "URL of the JSON Web Key Set used to verify bearer tokens (enables JWT authentication)")
+					fs.StringVar(&config.DefaultConfig.JWTIssuer, "jwt-issuer", config.DefaultConfig.JWTIssuer, "required iss claim of bearer tokens")
+					fs.StringVar(&config.DefaultConfig.JWTAudience, "jwt-audience", config.DefaultConfig.JWTAudience, "required aud claim of bearer tokens")
+					fs.StringVar(&config.DefaultConfig.KnownIdentityTypes, "known-identity-types", config.DefaultConfig.KnownIdentityTypes, "comma-separated list of recognized identity types")
+					fs.Var(&config.DefaultConfig.UnknownIdentityType, "unknown-identity-type", fmt.Sprintf("handling of identities of a type not in known-identity-types: allowed, allowed with a logged warning, or rejected with 401 (%v)", config.DefaultConfig.UnknownIdentityType.Help()))
+					fs.BoolVar(&config.DefaultConfig.TrustOrgIDHeader, "trust-org-id-header", config.DefaultConfig.TrustOrgIDHeader, "accept the X-Org-Id header in place of X-Rh-Identity from trusted networks")
+					fs.StringVar(&config.DefaultConfig.TrustedNetworks, "trusted-networks", config.DefaultConfig.TrustedNetworks, "comma-separated CIDR ranges from which X-Org-Id is accepted")
+					fs.StringVar(&config.DefaultConfig.UserAgentProduct, "user-agent-product", config.DefaultConfig.UserAgentProduct, "User-Agent product token carrying the client version")
+					fs.StringVar(&config.DefaultConfig.WebhookURL, "webhook-url", config.DefaultConfig.WebhookURL, "URL notified of channel changes (empty disables)")
+					fs.StringVar(&config.DefaultConfig.WebhookSecret, "webhook-secret", config.DefaultConfig.WebhookSecret, "key for signing webhook notifications")
+					fs.DurationVar(&config.DefaultConfig.IdleTimeout, "idle-timeout", config.DefaultConfig.IdleTimeout, "maximum duration an idle keep-alive connection is kept open between requests (0 disables)")
+					fs.DurationVar(&config.DefaultConfig.TCPKeepAlive, "tcp-keep-alive", config.DefaultConfig.TCPKeepAlive, "period of TCP keep-alive probes sent on idle client connections (0 disables)")
+					fs.DurationVar(&config.DefaultConfig.WriteTimeout, "write-timeout", config.DefaultConfig.WriteTimeout, "maximum duration each write of an /event export may block on a stalled client before the connection is dropped (0 disables)")
 
 					return fs
 				}(),
@@ -86,15 +227,28 @@ func main() {
 						apiroots[i] = path.Join(root, config.DefaultConfig.AppName, config.DefaultConfig.APIVersion)
 					}
 
-					var events *chan []byte
+					if config.DefaultConfig.Check {
+						return check(os.Stdout, apiroots)
+					}
+
+					if err := config.DefaultConfig.Validate(); err != nil {
+						return err
+					}
+
+					var err error
+					fallback := false
+					if db, err = openDB(explicit); err != nil {
+						if db, err = openFallbackDB(err); err != nil {
+							return err
+						}
+						fallback = true
+					}
+					defer db.Close()
+
+					var events *chan queuedEvent
 					if config.DefaultConfig.KafkaBootstrap != "" {
-						c := make(chan []byte, config.DefaultConfig.EventBuffer)
+						c := make(chan queuedEvent, config.DefaultConfig.EventBuffer)
 						events = &c
-						ProduceMessages(config.DefaultConfig.KafkaBootstrap, config.DefaultConfig.MetricsTopic, true, events)
-						log.WithFields(log.Fields{
-							"broker": config.DefaultConfig.KafkaBootstrap,
-							"topic":  config.DefaultConfig.MetricsTopic,
-						}).Info("started kafka producer")
 					}
 
 					srv, err := NewServer(config.DefaultConfig.Addr, apiroots, db, events)
@@ -102,37 +256,128 @@ func main() {
 						log.Fatal(err)
 					}
 					defer srv.Close()
+					srv.appMetrics.setDBFallback(fallback)
 
-					go func() {
+					if events != nil {
+						enc, err := newEventEncoder(config.DefaultConfig.EventFormat.Value, config.DefaultConfig.SchemaRegistryURL, config.DefaultConfig.MetricsTopic)
+						if err != nil {
+							return err
+						}
+						var spool *eventSpool
+						if config.DefaultConfig.EventSpoolSize > 0 && !config.DefaultConfig.ReadOnly {
+							spool = &eventSpool{db: db, max: config.DefaultConfig.EventSpoolSize, metrics: srv.appMetrics}
+						}
+						ProduceMessages(config.DefaultConfig.KafkaBootstrap, config.DefaultConfig.MetricsTopic, spool == nil, config.DefaultConfig.EventSampleRate, enc, events, spool, config.DefaultConfig.EventSpoolInterval, srv.appMetrics)
+						if config.DefaultConfig.MaxEventAge > 0 {
+							go watchPendingEvents(config.DefaultConfig.MaxEventAge)
+						}
 						log.WithFields(log.Fields{
-							"routine": "db_trim",
-						}).Info("started database trimmer")
-						for {
-							rows, err := db.DeleteEvents(time.Now().UTC().Add(-30 * 24 * time.Hour))
-							if err != nil {
-								log.WithFields(log.Fields{
-									"routine": "db_trim",
-									"error":   err,
-								}).Error("deleting events")
+							"broker":      config.DefaultConfig.KafkaBootstrap,
+							"topic":       config.DefaultConfig.MetricsTopic,
+							"sample_rate": config.DefaultConfig.EventSampleRate,
+							"format":      config.DefaultConfig.EventFormat.Value,
+							"spool_size":  config.DefaultConfig.EventSpoolSize,
+						}).Info("started kafka producer")
+					}
+
+					if config.DefaultConfig.ReadOnly {
+						log.Warn("read-only mode: rejecting write requests; not seeding or trimming the database")
+					}
+
+					// Executing the seed as-is fails against a database that
+					// was already seeded, so only incremental seeds run here.
+					seeded := make(chan struct{})
+					switch {
+					case config.DefaultConfig.SeedPath == "" || config.DefaultConfig.ReadOnly:
+						close(seeded)
+					case !config.DefaultConfig.SeedIncremental:
+						log.Warn("seed-path is set without seed-incremental: not seeding the database at startup")
+						close(seeded)
+					default:
+						srv.SetReady(false)
+						go func() {
+							defer close(seeded)
+							log.WithFields(log.Fields{
+								"routine": "seed",
+								"path":    config.DefaultConfig.SeedPath,
+							}).Info("seeding database")
+							if err := seed(db, config.DefaultConfig.SeedPath, true, srv.appMetrics); err != nil {
+								log.Fatalf("error: cannot seed database: %v", err)
 							}
+							srv.SetReady(true)
+							log.WithFields(log.Fields{
+								"routine": "seed",
+							}).Info("seed complete")
+						}()
+					}
+
+					if path := config.DefaultConfig.DBFallbackPath; path != "" && config.DefaultConfig.DBDriver.Value == "pgx" && !fallback {
+						go snapshotRoutingRules(db, path, seeded)
+					}
+
+					if !config.DefaultConfig.ReadOnly {
+						go func() {
 							log.WithFields(log.Fields{
 								"routine": "db_trim",
-								"rows":    rows,
-							}).Info("deleted rows")
-							time.Sleep(1 * time.Hour)
-						}
-					}()
+							}).Info("started database trimmer")
+							for {
+								rows, err := db.DeleteEvents(time.Now().UTC().Add(-30 * 24 * time.Hour))
+								if err != nil {
+									log.WithFields(log.Fields{
+										"routine": "db_trim",
+										"error":   err,
+									}).Error("deleting events")
+								}
+								log.WithFields(log.Fields{
+									"routine": "db_trim",
+									"rows":    rows,
+								}).Info("deleted rows")
+								rows, err = db.DeleteQuotaUsage(time.Now().UTC().Add(-24 * time.Hour))
+								if err != nil {
+									log.WithFields(log.Fields{
+										"routine": "db_trim",
+										"error":   err,
+									}).Error("deleting quota usage")
+								}
+								log.WithFields(log.Fields{
+									"routine": "db_trim",
+									"rows":    rows,
+								}).Info("deleted quota usage rows")
+								time.Sleep(1 * time.Hour)
+							}
+						}()
+					}
 
 					go func() {
 						log.WithFields(log.Fields{
 							"routine": "metrics",
 							"addr":    config.DefaultConfig.MAddr,
 						}).Info("started http listener")
-						if err := http.ListenAndServe(config.DefaultConfig.MAddr, promhttp.Handler()); err != nil {
+						if err := http.ListenAndServe(config.DefaultConfig.MAddr, srv.MetricsHandler()); err != nil {
 							log.Fatalf("error: failed to listen to addr (%v): %v", config.DefaultConfig.MAddr, err)
 						}
 					}()
 
+					switch {
+					case config.DefaultConfig.GRPCAddr == "":
+					case !config.DefaultConfig.EnableChannel:
+						log.Warn("grpc-addr is set while the channel endpoint is disabled: not serving the gRPC service")
+					default:
+						go func() {
+							log.WithFields(log.Fields{
+								"routine": "grpc",
+								"addr":    config.DefaultConfig.GRPCAddr,
+							}).Info("started grpc listener")
+							ln, err := net.Listen("tcp", config.DefaultConfig.GRPCAddr)
+							if err == nil {
+								err = srv.GRPCServer().Serve(ln)
+							}
+							if err != nil {
+								log.Fatalf("error: failed to listen to addr (%v): %v", config.DefaultConfig.GRPCAddr, err)
+							}
+						}()
+					}
+
 					go func() {
 						log.WithFields(log.Fields{
 							"routine": "app",
@@ -157,10 +402,26 @@ func main() {
 	if err := root.Parse(os.Args[1:]); err != nil {
 		log.Fatalf("error: failed to parse flags: %v", err)
 	}
+	if err := config.DefaultConfig.LoadSecretFiles(os.Getenv); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	fieldMap, err := ParseFieldMap(config.DefaultConfig.LogFieldMap)
+	if err != nil {
+		log.Fatalf("error: cannot parse log-field-map: %v", err)
+	}
 
 	switch config.DefaultConfig.LogFormat.Value {
 	case "json":
-		log.SetFormatter(&log.JSONFormatter{})
+		log.SetFormatter(&log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyTime:  fieldName(fieldMap, log.FieldKeyTime),
+				log.FieldKeyLevel: fieldName(fieldMap, log.FieldKeyLevel),
+				log.FieldKeyMsg:   fieldName(fieldMap, log.FieldKeyMsg),
+				log.FieldKeyFunc:  fieldName(fieldMap, log.FieldKeyFunc),
+				log.FieldKeyFile:  fieldName(fieldMap, log.FieldKeyFile),
+			},
+		})
 	default:
 		log.SetFormatter(&log.TextFormatter{})
 	}
@@ -172,34 +433,203 @@ func main() {
 	log.SetLevel(lvl)
 	log.SetReportCaller(true)
 
-	log.Debugf("%+v", config.DefaultConfig)
+	log.WithFields(log.Fields(config.DefaultConfig.Summary())).Info("effective configuration")
 
-	var connString string
-	switch config.DefaultConfig.DBDriver.Value {
-	case "pgx":
-		if config.DefaultConfig.DBURL != "" {
-			connString = config.DefaultConfig.DBURL
-		} else {
-			connString = fmt.Sprintf("postgres://%v:%v@%v:%v/%v",
-				config.DefaultConfig.DBUser, config.DefaultConfig.DBPass, config.DefaultConfig.DBHost, config.DefaultConfig.DBPort, config.DefaultConfig.DBName)
+	// A non-empty database-url takes precedence over the discrete db-* fields.
+	// Remember the flags that were explicitly set, so that discrete fields that
+	// are ignored because they disagree with the URL can be warned about.
+	root.FlagSet.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if err := root.Run(context.Background()); err != nil {
+		log.Fatalf("error: cannot execute command: %v", err)
+	}
+}
+
+// openDB opens the database configured by config.DefaultConfig, bounds its
+// connection pool and warms it. explicit holds the names of the flags set
+// explicitly, so that discrete db-* fields ignored because they disagree with
+// a database-url can be warned about.
+func openDB(explicit map[string]bool) (*DB, error) {
+	for _, name := range DBURLConflicts(config.DefaultConfig) {
+		if explicit[name] {
+			log.WithFields(log.Fields{
+				"flag": name,
+			}).Warn("database-url is set; ignoring conflicting value")
 		}
-	case "sqlite3":
-		if config.DefaultConfig.DBURL != "" {
-			connString = config.DefaultConfig.DBURL
+	}
+
+	connString, err := DataSourceName(config.DefaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case config.DefaultConfig.DBURL != "":
+		log.WithFields(log.Fields{
+			"driver": config.DefaultConfig.DBDriver.Value,
+		}).Info("using database connection from database-url")
+	case config.DefaultConfig.DBDriver.Value == "pgx":
+		log.WithFields(log.Fields{
+			"driver": config.DefaultConfig.DBDriver.Value,
+			"host":   config.DefaultConfig.DBHost,
+			"port":   config.DefaultConfig.DBPort,
+			"name":   config.DefaultConfig.DBName,
+		}).Info("using database connection from discrete db-* fields")
+	}
+
+	if ttl := config.DefaultConfig.DBDNSCacheTTL; ttl > 0 && config.DefaultConfig.DBDriver.Value == "pgx" {
+		cache := newHostCache(net.DefaultResolver.LookupHost)
+		if connString, err = cachingDNS(connString, cache); err != nil {
+			return nil, err
+		}
+		go cache.refreshEvery(ttl)
+		log.WithFields(log.Fields{
+			"ttl": ttl,
+		}).Info("caching database host addresses")
+	}
+
+	db, err := Open(config.DefaultConfig.DBDriver.Value, connString)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxConns(config.DefaultConfig.DBMaxConns, config.DefaultConfig.DBAcquireTimeout)
+	db.SetSeedBatching(config.DefaultConfig.SeedBatchSize, config.DefaultConfig.SeedWorkers)
+	if n := config.DefaultConfig.DBWarmConnections; n > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		warmed, err := db.Warm(ctx, n)
+		cancel()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"warmed": warmed,
+				"error":  err,
+			}).Warn("cannot warm database connections")
 		} else {
-			connString = "file::memory:?cache=shared"
+			log.WithFields(log.Fields{
+				"warmed": warmed,
+			}).Info("warmed database connections")
 		}
-	default:
-		log.Fatalf("error: unsupported database: %v", config.DefaultConfig.DBDriver)
 	}
+	return db, nil
+}
 
-	db, err = Open(config.DefaultConfig.DBDriver.Value, connString)
+// seed loads the SQL seed files named by value (see seedPaths) into db, merging
+// their routing rules into the existing ones if incremental is set. The
+// outcome is logged and, unless metrics is nil, recorded in metrics. An incremental seed loads the rows
+// it adds or updates and skips those unchanged; a full seed loads every routing
+// row left in the database.
+func seed(db *DB, value string, incremental bool, metrics *appMetrics) error {
+	start := time.Now()
+	fields := log.Fields{
+		"path":        value,
+		"incremental": incremental,
+	}
+	var loaded, skipped int
+	err := func() error {
+		paths, err := seedPaths(value)
+		if err != nil {
+			return err
+		}
+		fields["files"] = len(paths)
+		if !incremental {
+			if err := db.Seed(paths); err != nil {
+				return err
+			}
+			n, err := db.RoutingRows()
+			if err != nil {
+				return err
+			}
+			loaded = n
+			return nil
+		}
+		firstWins := config.DefaultConfig.SeedDuplicates.Value == "first"
+		report, err := db.SeedIncremental(paths, firstWins)
+		if err != nil {
+			return err
+		}
+		for _, d := range report.Duplicates {
+			log.WithFields(log.Fields{
+				"path":        d.Path,
+				"merged_path": d.MergedPath,
+				"table":       d.Table,
+				"key":         d.Key,
+				"conflicting": d.Conflicting,
+				"first_wins":  firstWins,
+			}).Warn("duplicate row in seed")
+		}
+		rows := make(map[string]int)
+		for _, r := range report.Rows {
+			rows[r.Path]++
+			log.WithFields(log.Fields{
+				"path":  r.Path,
+				"table": r.Table,
+				"key":   r.Key,
+			}).Debug("seeded row")
+		}
+		for _, path := range paths {
+			log.WithFields(log.Fields{
+				"path": path,
+				"rows": rows[path],
+			}).Info("merged seed file")
+		}
+		fields["added"] = report.Added
+		fields["updated"] = report.Updated
+		fields["unchanged"] = report.Unchanged
+		fields["duplicates"] = len(report.Duplicates)
+		loaded, skipped = report.Added+report.Updated, report.Unchanged
+		return nil
+	}()
+	duration := time.Since(start)
+	fields["duration"] = duration.String()
 	if err != nil {
-		log.Fatal(err)
+		if metrics != nil {
+			metrics.incSeedErrors()
+		}
+		fields["error"] = err
+		log.WithFields(fields).Error("seed failed")
+		return err
+	}
+	if metrics != nil {
+		metrics.observeSeed(loaded, skipped, duration, time.Now())
 	}
-	defer db.Close()
+	fields["loaded"] = loaded
+	fields["skipped"] = skipped
+	log.WithFields(fields).Info("loaded seed")
+	return nil
+}
 
-	if err := root.Run(context.Background()); err != nil {
-		log.Fatalf("error: cannot execute command: %v", err)
+// seedPaths splits a comma-separated list of seed paths, ignoring empty
+// entries, and replaces each directory with the ".sql" files it contains,
+// sorted by name. The files are seeded in the resulting order, so that when
+// several set the same row, the outcome is decided by SeedDuplicates
+// consistently from one startup to the next.
+func seedPaths(value string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		n := len(paths)
+		for _, e := range entries {
+			if !e.IsDir() && filepath.Ext(e.Name()) == ".sql" {
+				paths = append(paths, filepath.Join(p, e.Name()))
+			}
+		}
+		if len(paths) == n {
+			return nil, fmt.Errorf("no .sql seed files in directory: %v", p)
+		}
 	}
+	return paths, nil
 }
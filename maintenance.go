@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maintenanceStatus tracks the state of the most recent database maintenance
+// run. It is safe for concurrent use.
+type maintenanceStatus struct {
+	mu         sync.Mutex
+	running    bool
+	startedAt  time.Time
+	finishedAt time.Time
+	err        error
+}
+
+// maintenanceReport is the JSON representation of a maintenanceStatus.
+type maintenanceReport struct {
+	State      string     `json:"state"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// start marks a run as started at t. It returns false if a run is already in
+// progress.
+func (m *maintenanceStatus) start(t time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		return false
+	}
+	m.running = true
+	m.startedAt = t
+	m.finishedAt = time.Time{}
+	m.err = nil
+	return true
+}
+
+// finish marks the current run as finished at t with the result err.
+func (m *maintenanceStatus) finish(t time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running = false
+	m.finishedAt = t
+	m.err = err
+}
+
+// report returns a snapshot of the status.
+func (m *maintenanceStatus) report() maintenanceReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var r maintenanceReport
+	switch {
+	case m.running:
+		r.State = "running"
+	case m.startedAt.IsZero():
+		r.State = "idle"
+	case m.err != nil:
+		r.State = "failed"
+		r.Error = m.err.Error()
+	default:
+		r.State = "succeeded"
+	}
+	if !m.startedAt.IsZero() {
+		t := m.startedAt
+		r.StartedAt = &t
+	}
+	if !m.finishedAt.IsZero() {
+		t := m.finishedAt
+		r.FinishedAt = &t
+	}
+	return r
+}
@@ -1,17 +1,398 @@
 package main
 
 import (
+	"fmt"
+	"regexp"
+	"time"
+
 	p "github.com/prometheus/client_golang/prometheus"
-	pa "github.com/prometheus/client_golang/prometheus/promauto"
+	pc "github.com/prometheus/client_golang/prometheus/collectors"
+	log "github.com/sirupsen/logrus"
+	"github.com/slok/go-http-metrics/metrics"
+	httpmetrics "github.com/slok/go-http-metrics/metrics/prometheus"
 )
 
-var (
-	requests = pa.NewCounterVec(p.CounterOpts{
-		Name: "module_update_router_requests",
-		Help: "Total number of GETs to router",
+// appMetrics holds the application metrics of a Server, registered with its
+// registry, so that servers in the same process count separately.
+type appMetrics struct {
+	requests              *p.CounterVec
+	eventsSampled         *p.CounterVec
+	responseSize          *p.HistogramVec
+	writeTimeouts         *p.CounterVec
+	authRejections        *p.CounterVec
+	eventQueueLatency     p.Histogram
+	oldestPendingEventAge p.GaugeFunc
+	activeOrgsEstimate    p.GaugeFunc
+	oversizedEventQueries p.Counter
+	quotaExceeded         *p.CounterVec
+	dbAcquireWait         p.Histogram
+	seedRows              *p.GaugeVec
+	seedDuration          p.Gauge
+	seedLastSuccess       p.Gauge
+	seedErrors            p.Counter
+	webhookDeliveries     *p.CounterVec
+	webhookRetries        p.Counter
+	routingErrors         *p.CounterVec
+	identityDecodes       *p.CounterVec
+	missingOrgIDs         p.Counter
+	readOnly              p.Gauge
+	eventsRejected        p.Counter
+	channelDecisions      *p.CounterVec
+	eventSpoolDepth       p.Gauge
+	eventSpoolDropped     p.Counter
+	eventSendWait         p.Histogram
+	eventsDropped         p.Counter
+	deprecatedParams      *p.CounterVec
+	dbFallback            p.Gauge
+}
+
+// defaultMetricsNamespace is the namespace of metric names unless another is
+// configured.
+const defaultMetricsNamespace = "module_update_router"
+
+// metricsNamespacePattern matches valid metric namespaces: metric names
+// without colons, or the empty string for no namespace.
+var metricsNamespacePattern = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)?$`)
+
+// newMetrics creates the application metrics, naming them within namespace,
+// without registering them. activeOrgs is read by the active_orgs gauge.
+func newMetrics(namespace string, activeOrgs *slidingCounter) (*appMetrics, error) {
+	if !metricsNamespacePattern.MatchString(namespace) {
+		return nil, fmt.Errorf("metrics: invalid namespace: %q", namespace)
+	}
+	m := &appMetrics{}
+	m.requests = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests",
+		Help:      "Total number of GETs to router",
 	}, []string{"endpoint"})
-)
+	m.eventsSampled = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_sampled",
+		Help:      "Total number of events kept or dropped by sampling before being produced",
+	}, []string{"result"})
+	m.responseSize = p.NewHistogramVec(p.HistogramOpts{
+		Namespace: namespace,
+		Name:      "response_size_bytes",
+		Help:      "Size of HTTP response bodies",
+		Buckets:   p.ExponentialBuckets(64, 4, 8),
+	}, []string{"endpoint"})
+	m.writeTimeouts = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "response_write_timeouts",
+		Help:      "Total number of responses abandoned because the client did not read them in time",
+	}, []string{"endpoint"})
+	m.authRejections = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_rejections",
+		Help:      "Total number of requests rejected by the auth middleware",
+	}, []string{"reason"})
+	m.eventQueueLatency = p.NewHistogram(p.HistogramOpts{
+		Namespace: namespace,
+		Name:      "event_queue_latency_seconds",
+		Help:      "Time events spend queued before being picked up by the producer",
+		Buckets:   p.ExponentialBuckets(0.001, 4, 8),
+	})
+	m.oldestPendingEventAge = p.NewGaugeFunc(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "oldest_pending_event_age_seconds",
+		Help:      "Age of the oldest event queued but not yet produced to Kafka",
+	}, func() float64 {
+		return pendingEvents.age(time.Now()).Seconds()
+	})
+	m.activeOrgsEstimate = p.NewGaugeFunc(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_orgs",
+		Help:      "Approximate number of distinct orgs authenticated in the last hour",
+	}, func() float64 {
+		return activeOrgs.estimate()
+	})
+	m.oversizedEventQueries = p.NewCounter(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "oversized_event_queries",
+		Help:      "Total number of GET /event queries aborted for exceeding the memory budget",
+	})
+	m.quotaExceeded = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "quota_exceeded",
+		Help:      "Total number of responses routed to release because the org exhausted its daily quota for the channel",
+	}, []string{"channel"})
+	m.dbAcquireWait = p.NewHistogram(p.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_acquire_wait_seconds",
+		Help:      "Time request-path queries wait to acquire a database connection",
+		Buckets:   p.ExponentialBuckets(0.0005, 4, 8),
+	})
+	m.seedRows = p.NewGaugeVec(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "seed_rows",
+		Help:      "Number of routing rows loaded or skipped by the last successful seed",
+	}, []string{"result"})
+	m.seedDuration = p.NewGauge(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "seed_duration_seconds",
+		Help:      "Time taken by the last successful seed",
+	})
+	m.seedLastSuccess = p.NewGauge(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "seed_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful seed",
+	})
+	m.seedErrors = p.NewCounter(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "seed_errors",
+		Help:      "Total number of failed seeds",
+	})
+	m.webhookDeliveries = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries",
+		Help:      "Total number of channel changes delivered to, failed to deliver to or dropped before the webhook",
+	}, []string{"result"})
+	m.webhookRetries = p.NewCounter(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_retries",
+		Help:      "Total number of retried webhook delivery attempts",
+	})
+	m.routingErrors = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "routing_errors",
+		Help:      "Total number of failed routing rule lookups, by the policy handling them",
+	}, []string{"policy"})
+	m.identityDecodes = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "identity_decodes",
+		Help:      "Total number of X-Rh-Identity headers decoded, by the encoding they were decoded from, or failed to decode",
+	}, []string{"encoding"})
+	m.missingOrgIDs = p.NewCounter(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "missing_org_ids",
+		Help:      "Total number of requests rejected for an identity without an org_id",
+	})
+	m.readOnly = p.NewGauge(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "read_only",
+		Help:      "Whether the server is in read-only mode, rejecting write requests (1) or not (0)",
+	})
+	m.eventsRejected = p.NewCounter(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_rejected",
+		Help:      "Total number of events rejected with 503 while the event buffer was above its high-water mark",
+	})
+	m.channelDecisions = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "channel_decisions",
+		Help:      "Total number of /channel routing decisions, by channel and the identity type of the client",
+	}, []string{"channel", "identity_type"})
+	m.eventSpoolDepth = p.NewGauge(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "event_spool_depth",
+		Help:      "Number of events spooled in the database after a failed produce, awaiting retry",
+	})
+	m.eventSpoolDropped = p.NewCounter(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_spool_dropped",
+		Help:      "Total number of spooled events dropped, oldest first, to keep the spool within its size",
+	})
+	m.eventSendWait = p.NewHistogram(p.HistogramOpts{
+		Namespace: namespace,
+		Name:      "event_send_wait_seconds",
+		Help:      "Time POST /event handlers spend sending events to the producer's buffer",
+		Buckets:   p.ExponentialBuckets(0.000001, 4, 10),
+	})
+	m.eventsDropped = p.NewCounter(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_dropped",
+		Help:      "Total number of events dropped by POST /event handlers because the event buffer was full",
+	})
+	m.deprecatedParams = p.NewCounterVec(p.CounterOpts{
+		Namespace: namespace,
+		Name:      "deprecated_params",
+		Help:      "Total number of requests using a deprecated query parameter, by endpoint and parameter",
+	}, []string{"endpoint", "param"})
+	m.dbFallback = p.NewGauge(p.GaugeOpts{
+		Namespace: namespace,
+		Name:      "db_fallback",
+		Help:      "Whether the server is degraded, serving stale routing rules from its snapshot because the database was unreachable at startup (1) or not (0)",
+	})
+
+	return m, nil
+}
+
+// register registers the metrics with reg, along with the Go runtime and
+// process metrics.
+func (m *appMetrics) register(reg p.Registerer) error {
+	collectors := []p.Collector{
+		pc.NewGoCollector(),
+		pc.NewProcessCollector(pc.ProcessCollectorOpts{}),
+		m.requests,
+		m.eventsSampled,
+		m.responseSize,
+		m.writeTimeouts,
+		m.authRejections,
+		m.eventQueueLatency,
+		m.oldestPendingEventAge,
+		m.activeOrgsEstimate,
+		m.oversizedEventQueries,
+		m.quotaExceeded,
+		m.dbAcquireWait,
+		m.seedRows,
+		m.seedDuration,
+		m.seedLastSuccess,
+		m.seedErrors,
+		m.webhookDeliveries,
+		m.webhookRetries,
+		m.routingErrors,
+		m.identityDecodes,
+		m.missingOrgIDs,
+		m.readOnly,
+		m.eventsRejected,
+		m.channelDecisions,
+		m.eventSpoolDepth,
+		m.eventSpoolDropped,
+		m.eventSendWait,
+		m.eventsDropped,
+		m.deprecatedParams,
+		m.dbFallback,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *appMetrics) incRequests(endpoint string) {
+	m.requests.With(p.Labels{"endpoint": endpoint}).Inc()
+}
+
+func (m *appMetrics) incEventsSampled(result string) {
+	m.eventsSampled.With(p.Labels{"result": result}).Inc()
+}
+
+func (m *appMetrics) observeResponseSize(endpoint string, size int) {
+	m.responseSize.With(p.Labels{"endpoint": endpoint}).Observe(float64(size))
+}
+
+func (m *appMetrics) incWriteTimeouts(endpoint string) {
+	m.writeTimeouts.With(p.Labels{"endpoint": endpoint}).Inc()
+}
+
+func (m *appMetrics) incAuthRejections(reason string) {
+	m.authRejections.With(p.Labels{"reason": reason}).Inc()
+}
+
+func (m *appMetrics) incOversizedEventQueries() {
+	m.oversizedEventQueries.Inc()
+}
+
+func (m *appMetrics) incWebhookDeliveries(result string) {
+	m.webhookDeliveries.With(p.Labels{"result": result}).Inc()
+}
+
+func (m *appMetrics) incWebhookRetries() {
+	m.webhookRetries.Inc()
+}
+
+func (m *appMetrics) incRoutingErrors(policy string) {
+	m.routingErrors.With(p.Labels{"policy": policy}).Inc()
+}
+
+func (m *appMetrics) incIdentityDecodes(encoding string) {
+	m.identityDecodes.With(p.Labels{"encoding": encoding}).Inc()
+}
+
+func (m *appMetrics) incMissingOrgIDs() {
+	m.missingOrgIDs.Inc()
+}
+
+func (m *appMetrics) incEventsRejected() {
+	m.eventsRejected.Inc()
+}
+
+func (m *appMetrics) incChannelDecisions(channel, identityType string) {
+	m.channelDecisions.With(p.Labels{"channel": channel, "identity_type": identityType}).Inc()
+}
+
+func (m *appMetrics) setEventSpoolDepth(n int) {
+	m.eventSpoolDepth.Set(float64(n))
+}
+
+func (m *appMetrics) addEventSpoolDropped(n int64) {
+	m.eventSpoolDropped.Add(float64(n))
+}
+
+func (m *appMetrics) setReadOnly(enabled bool) {
+	if enabled {
+		m.readOnly.Set(1)
+	} else {
+		m.readOnly.Set(0)
+	}
+}
+
+func (m *appMetrics) setDBFallback(enabled bool) {
+	if enabled {
+		m.dbFallback.Set(1)
+	} else {
+		m.dbFallback.Set(0)
+	}
+}
+
+func (m *appMetrics) incQuotaExceeded(channel string) {
+	m.quotaExceeded.With(p.Labels{"channel": channel}).Inc()
+}
+
+func (m *appMetrics) observeSeed(loaded, skipped int, duration time.Duration, at time.Time) {
+	m.seedRows.With(p.Labels{"result": "loaded"}).Set(float64(loaded))
+	m.seedRows.With(p.Labels{"result": "skipped"}).Set(float64(skipped))
+	m.seedDuration.Set(duration.Seconds())
+	m.seedLastSuccess.Set(float64(at.Unix()))
+}
+
+func (m *appMetrics) incSeedErrors() {
+	m.seedErrors.Inc()
+}
+
+func (m *appMetrics) observeDBAcquireWait(d time.Duration) {
+	m.dbAcquireWait.Observe(d.Seconds())
+}
+
+func (m *appMetrics) observeEventQueueLatency(d time.Duration) {
+	m.eventQueueLatency.Observe(d.Seconds())
+}
+
+func (m *appMetrics) observeEventSendWait(d time.Duration) {
+	m.eventSendWait.Observe(d.Seconds())
+}
+
+func (m *appMetrics) incEventsDropped() {
+	m.eventsDropped.Inc()
+}
+
+func (m *appMetrics) incDeprecatedParams(endpoint, param string) {
+	m.deprecatedParams.With(p.Labels{"endpoint": endpoint, "param": param}).Inc()
+}
+
+// newDBStatsCollector creates a collector of the connection pool statistics of
+// db (connections open, in use and idle, and the number and duration of waits
+// for a connection), labeled with its driver name. The statistics are read at
+// each scrape, so that an exhausted pool shows up as it happens.
+func newDBStatsCollector(db *DB) p.Collector {
+	return pc.NewDBStatsCollector(db.handle.DB, db.driverName)
+}
 
-func incRequests(endpoint string) {
-	requests.With(p.Labels{"endpoint": endpoint}).Inc()
+// newRecorder creates an HTTP metrics recorder registered with reg, naming its
+// metrics within namespace. A recorder
+// that cannot be registered, for example because reg already holds collectors
+// of the same name, must not take the server down with it, so the
+// error is logged and a recorder that discards measurements is returned
+// instead.
+func newRecorder(reg p.Registerer, namespace string) (recorder metrics.Recorder) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.WithField("error", err).Warn("cannot register HTTP metrics recorder, HTTP metrics are disabled")
+			recorder = metrics.Dummy
+		}
+	}()
+	return httpmetrics.NewRecorder(httpmetrics.Config{Registry: reg, Prefix: namespace})
 }
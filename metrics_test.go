@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	p "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/slok/go-http-metrics/metrics"
+)
+
+// newTestMetrics creates unregistered application metrics for tests of the
+// components outside a Server that record them.
+func newTestMetrics(t *testing.T) *appMetrics {
+	t.Helper()
+	m, err := newMetrics(defaultMetricsNamespace, newSlidingCounter(activeOrgsWindow, activeOrgsBuckets, systemClock{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNewRecorder(t *testing.T) {
+	reg := p.NewRegistry()
+
+	if got := newRecorder(reg, defaultMetricsNamespace); got == metrics.Dummy {
+		t.Errorf("first recorder: want registered recorder, got %v", got)
+	}
+	if got := newRecorder(reg, defaultMetricsNamespace); got != metrics.Dummy {
+		t.Errorf("duplicate recorder: want %v, got %v", metrics.Dummy, got)
+	}
+}
+
+func TestServerRecorder(t *testing.T) {
+	first := newTestServer(t)
+	defer first.Close()
+	second := newTestServer(t)
+	defer second.Close()
+
+	for _, srv := range []*Server{first, second} {
+		if srv.recorder == metrics.Dummy {
+			t.Errorf("want registered recorder, got %v", srv.recorder)
+		}
+	}
+	if first.registry == second.registry {
+		t.Error("want a registry per server")
+	}
+
+	rr := httptest.NewRecorder()
+	first.MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("%v != %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestNewMetrics(t *testing.T) {
+	tests := []struct {
+		desc      string
+		input     string
+		want      string
+		wantError bool
+	}{
+		{
+			desc:  "namespace",
+			input: "mur",
+			want:  "mur_requests",
+		},
+		{
+			desc:  "no namespace",
+			input: "",
+			want:  "requests",
+		},
+		{
+			desc:      "invalid namespace",
+			input:     "module-update-router",
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			m, err := newMetrics(test.input, newSlidingCounter(activeOrgsWindow, activeOrgsBuckets, systemClock{}))
+			if test.wantError {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.incRequests("channel")
+
+			reg := p.NewRegistry()
+			if err := m.register(reg); err != nil {
+				t.Fatal(err)
+			}
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found bool
+			for _, family := range families {
+				found = found || family.GetName() == test.want
+			}
+			if !found {
+				t.Errorf("metric %v not registered", test.want)
+			}
+		})
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	first := newTestServer(t)
+	defer first.Close()
+	second := newTestServer(t)
+	defer second.Close()
+
+	first.appMetrics.incRequests("channel")
+
+	if got := testutil.ToFloat64(first.appMetrics.requests.WithLabelValues("channel")); got != 1 {
+		t.Errorf("first server: %v != %v", got, 1)
+	}
+	if got := testutil.ToFloat64(second.appMetrics.requests.WithLabelValues("channel")); got != 0 {
+		t.Errorf("second server: %v != %v", got, 0)
+	}
+}
+
+func TestServerRuntimeMetrics(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	families, err := srv.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, family := range families {
+		got[family.GetName()] = true
+	}
+	for _, name := range []string{
+		"go_goroutines",
+		"go_sql_in_use_connections",
+		"go_sql_idle_connections",
+		"go_sql_wait_count_total",
+		"go_sql_wait_duration_seconds_total",
+	} {
+		if !got[name] {
+			t.Errorf("missing metric %v", name)
+		}
+	}
+}
@@ -0,0 +1 @@
+DROP TABLE modules_client_versions;
@@ -0,0 +1,5 @@
+CREATE TABLE modules_client_versions (
+    module_name VARCHAR(256),
+    min_version VARCHAR(256) NOT NULL,
+    PRIMARY KEY(module_name)
+);
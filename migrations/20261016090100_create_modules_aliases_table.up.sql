@@ -0,0 +1,5 @@
+CREATE TABLE modules_aliases (
+    alias VARCHAR(256),
+    module_name VARCHAR(256) NOT NULL,
+    PRIMARY KEY(alias)
+);
@@ -0,0 +1,5 @@
+CREATE TABLE modules_default_channels (
+    module_name VARCHAR(256),
+    channel VARCHAR(256) NOT NULL,
+    PRIMARY KEY(module_name)
+);
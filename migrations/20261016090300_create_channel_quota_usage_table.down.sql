@@ -0,0 +1 @@
+DROP TABLE channel_quota_usage;
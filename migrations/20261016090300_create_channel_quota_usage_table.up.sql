@@ -0,0 +1,7 @@
+CREATE TABLE channel_quota_usage (
+    org_id VARCHAR(256),
+    channel VARCHAR(256),
+    day VARCHAR(10),
+    responses INTEGER NOT NULL,
+    PRIMARY KEY(org_id, channel, day)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE events
+ADD COLUMN source VARCHAR(256);
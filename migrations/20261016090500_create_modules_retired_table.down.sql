@@ -0,0 +1 @@
+DROP TABLE modules_retired;
@@ -0,0 +1,5 @@
+CREATE TABLE modules_retired (
+    module_name VARCHAR(256),
+    replacement VARCHAR(256) NOT NULL DEFAULT '',
+    PRIMARY KEY(module_name)
+);
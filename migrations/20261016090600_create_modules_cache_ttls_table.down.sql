@@ -0,0 +1 @@
+DROP TABLE modules_cache_ttls;
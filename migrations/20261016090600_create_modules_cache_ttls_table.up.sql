@@ -0,0 +1,5 @@
+CREATE TABLE modules_cache_ttls (
+    module_name VARCHAR(256),
+    ttl_seconds INTEGER NOT NULL,
+    PRIMARY KEY(module_name)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE event_spool (
+    spool_id VARCHAR(36) PRIMARY KEY,
+    enqueued_at TIMESTAMP NOT NULL,
+    traceparent VARCHAR(55) NOT NULL,
+    event TEXT NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE orgs_modules_urls;
@@ -0,0 +1,6 @@
+CREATE TABLE orgs_modules_urls (
+    module_name VARCHAR(256),
+    org_id VARCHAR(256),
+    url VARCHAR(2048) NOT NULL,
+    PRIMARY KEY(module_name, org_id)
+);
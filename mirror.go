@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// mirror is a URL serving a channel, along with its share of the channel's
+// clients relative to the other mirrors of the channel.
+type mirror struct {
+	url    string
+	weight int
+}
+
+// mirrorSet is the list of mirrors serving a channel.
+type mirrorSet []mirror
+
+// parseMirrors parses a comma-separated list of url=weight pairs into a
+// mirrorSet. The weight may be omitted, in which case it defaults to 1. A
+// weight of 0 disables a mirror without removing it from the list.
+func parseMirrors(s string) (mirrorSet, error) {
+	var mirrors mirrorSet
+	var total int
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		m := mirror{url: item, weight: 1}
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			if w, err := strconv.Atoi(item[i+1:]); err == nil {
+				if w < 0 {
+					return nil, fmt.Errorf("invalid mirror weight: %q", item)
+				}
+				m = mirror{url: strings.TrimSpace(item[:i]), weight: w}
+			}
+		}
+		if m.url == "" {
+			return nil, fmt.Errorf("invalid mirror: %q", item)
+		}
+		mirrors = append(mirrors, m)
+		total += m.weight
+	}
+	if len(mirrors) > 0 && total == 0 {
+		return nil, fmt.Errorf("invalid mirrors: %q: all weights are zero", s)
+	}
+	return mirrors, nil
+}
+
+// pick selects a mirror for key. Selection is stateless and stable: a given
+// key always maps to the same mirror for the same set, and keys are spread
+// across mirrors in proportion to their weights. It returns the empty string
+// if the set is empty.
+func (s mirrorSet) pick(key string) string {
+	var total int
+	for _, m := range s {
+		total += m.weight
+	}
+	if total == 0 {
+		return ""
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	n := int(h.Sum64() % uint64(total))
+	for _, m := range s {
+		if n < m.weight {
+			return m.url
+		}
+		n -= m.weight
+	}
+	return ""
+}
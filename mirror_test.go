@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseMirrors(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        mirrorSet
+		wantError   error
+	}{
+		{
+			description: "empty",
+			input:       "",
+			want:        nil,
+		},
+		{
+			description: "weighted",
+			input:       "https://a.example.com/release=3, https://b.example.com/release=1",
+			want:        mirrorSet{{"https://a.example.com/release", 3}, {"https://b.example.com/release", 1}},
+		},
+		{
+			description: "default weight",
+			input:       "https://a.example.com/release?arch=x86_64",
+			want:        mirrorSet{{"https://a.example.com/release?arch=x86_64", 1}},
+		},
+		{
+			description: "negative weight",
+			input:       "https://a.example.com/release=-1",
+			wantError:   fmt.Errorf(`invalid mirror weight: "https://a.example.com/release=-1"`),
+		},
+		{
+			description: "all weights zero",
+			input:       "https://a.example.com/release=0",
+			wantError:   fmt.Errorf(`invalid mirrors: "https://a.example.com/release=0": all weights are zero`),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseMirrors(test.input)
+
+			if test.wantError != nil {
+				if err == nil || err.Error() != test.wantError.Error() {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want, cmp.AllowUnexported(mirror{})) {
+					t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(mirror{})))
+				}
+			}
+		})
+	}
+}
+
+func TestMirrorSetPick(t *testing.T) {
+	mirrors := mirrorSet{{"a", 3}, {"b", 1}, {"c", 0}}
+
+	got := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("%07d", i)
+		url := mirrors.pick(key)
+		if again := mirrors.pick(key); again != url {
+			t.Fatalf("unstable pick for %v: %v != %v", key, url, again)
+		}
+		got[url]++
+	}
+
+	if got["c"] != 0 {
+		t.Errorf("picked zero-weight mirror %v times", got["c"])
+	}
+	if ratio := float64(got["a"]) / float64(got["b"]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("unexpected a:b ratio %v: %v", ratio, got)
+	}
+	if url := (mirrorSet{}).pick("1979710"); url != "" {
+		t.Errorf("%v != %v", url, "")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// channelOverrideHeader is the request header carrying a channel override
+// token.
+const channelOverrideHeader = "X-Channel-Override"
+
+// overrideChannels maps the channel names accepted in override tokens to the
+// channels they route to.
+var overrideChannels = map[string]string{
+	"release": "/release",
+	"testing": "/testing",
+}
+
+// ErrInvalidOverride occurs when a channel override token is malformed, names
+// an unknown channel, carries a signature that does not match or was issued
+// for another org or module.
+var ErrInvalidOverride = errors.New("invalid channel override token")
+
+// ErrExpiredOverride occurs when a channel override token is past its expiry.
+var ErrExpiredOverride = errors.New("expired channel override token")
+
+// channelOverrideToken is a verified channel override token.
+type channelOverrideToken struct {
+	// channel is the channel the token routes to.
+	channel string
+	// orgID is the org the token was issued for.
+	orgID string
+	// module is the module the token was issued for, or empty if it applies
+	// to every module of the org.
+	module  string
+	expires time.Time
+}
+
+// newChannelOverrideToken returns a token overriding the channel of the
+// clients of orgID to channel, one of the keys of overrideChannels, until
+// expires, for module or, if module is empty, for every module. The token is
+// "<channel>.<org_id>.<module>.<expires>.<signature>", where expires is a Unix
+// time in seconds and signature is the hex-encoded HMAC-SHA256 of everything
+// before it keyed with secret.
+func newChannelOverrideToken(secret []byte, channel, orgID, module string, expires time.Time) string {
+	payload := strings.Join([]string{channel, orgID, module, strconv.FormatInt(expires.Unix(), 10)}, ".")
+	return payload + "." + overrideSignature(secret, payload)
+}
+
+// issueChannelOverrideToken returns a token, as created by
+// newChannelOverrideToken, valid for ttl from now. It fails if channel is not
+// one of the keys of overrideChannels, if orgID is empty or contains a ".",
+// which would make the token ambiguous, or if ttl is not positive.
+func issueChannelOverrideToken(secret []byte, channel, orgID, module string, ttl time.Duration, now time.Time) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("missing channel override secret")
+	}
+	if _, ok := overrideChannels[channel]; !ok {
+		return "", fmt.Errorf("unknown channel '%v'", channel)
+	}
+	if orgID == "" || strings.Contains(orgID, ".") {
+		return "", fmt.Errorf("invalid org ID '%v'", orgID)
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("invalid ttl %v: must be positive", ttl)
+	}
+	return newChannelOverrideToken(secret, channel, orgID, module, now.Add(ttl)), nil
+}
+
+// parseChannelOverride verifies token, as created by newChannelOverrideToken,
+// against secret. Tokens expired at now return ErrExpiredOverride, and tokens
+// that do not verify ErrInvalidOverride.
+func parseChannelOverride(secret []byte, token string, now time.Time) (channelOverrideToken, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return channelOverrideToken{}, ErrInvalidOverride
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(overrideSignature(secret, payload))) {
+		return channelOverrideToken{}, ErrInvalidOverride
+	}
+
+	// Module names may contain dots, so the module is everything between the
+	// org ID and the expiry.
+	fields := strings.Split(payload, ".")
+	if len(fields) < 4 {
+		return channelOverrideToken{}, ErrInvalidOverride
+	}
+	channel, ok := overrideChannels[fields[0]]
+	if !ok {
+		return channelOverrideToken{}, fmt.Errorf("%w: unknown channel '%v'", ErrInvalidOverride, fields[0])
+	}
+	seconds, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return channelOverrideToken{}, fmt.Errorf("%w: %v", ErrInvalidOverride, err)
+	}
+	t := channelOverrideToken{
+		channel: channel,
+		orgID:   fields[1],
+		module:  strings.Join(fields[2:len(fields)-1], "."),
+		expires: time.Unix(seconds, 0).UTC(),
+	}
+	if !now.Before(t.expires) {
+		return t, ErrExpiredOverride
+	}
+	return t, nil
+}
+
+// overrideSignature returns the hex-encoded HMAC-SHA256 of payload keyed with
+// secret.
+func overrideSignature(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// channelOverride returns the channel a valid override token in the
+// X-Channel-Override header of r routes the client of orgID to for module,
+// and whether there is one. Overrides are disabled if the server has no
+// override secret. Invalid and expired tokens, and tokens issued for another
+// org or module, are logged and ignored, so the client is routed normally.
+func (s *Server) channelOverride(r *http.Request, orgID, module string) (string, bool) {
+	token := r.Header.Get(channelOverrideHeader)
+	if token == "" || len(s.overrideSecret) == 0 {
+		return "", false
+	}
+	fields := log.Fields{
+		"org_id":     orgID,
+		"module":     module,
+		"request-id": requestIDOf(r),
+	}
+	t, err := parseChannelOverride(s.overrideSecret, token, s.clock.Now())
+	switch {
+	case err != nil:
+	case t.orgID != orgID:
+		err = fmt.Errorf("%w: issued for org '%v'", ErrInvalidOverride, t.orgID)
+	case t.module != "" && t.module != module:
+		err = fmt.Errorf("%w: issued for module '%v'", ErrInvalidOverride, t.module)
+	}
+	if err != nil {
+		fields["error"] = err
+		log.WithFields(fields).Warn("ignoring channel override")
+		return "", false
+	}
+	fields["channel"] = t.channel
+	fields["expires"] = t.expires
+	log.WithFields(fields).Info("overriding channel")
+	addLogField(r, "channel-override", t.channel)
+	return t.channel, true
+}
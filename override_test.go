@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseChannelOverride(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		input       string
+		want        channelOverrideToken
+		wantError   error
+	}{
+		{
+			description: "testing",
+			input:       newChannelOverrideToken(secret, "testing", "1979710", "", now.Add(time.Hour)),
+			want:        channelOverrideToken{"/testing", "1979710", "", now.Add(time.Hour)},
+		},
+		{
+			description: "release",
+			input:       newChannelOverrideToken(secret, "release", "1979710", "insights-core", now.Add(time.Hour)),
+			want:        channelOverrideToken{"/release", "1979710", "insights-core", now.Add(time.Hour)},
+		},
+		{
+			description: "dotted module",
+			input:       newChannelOverrideToken(secret, "testing", "1979710", "insights.core", now.Add(time.Hour)),
+			want:        channelOverrideToken{"/testing", "1979710", "insights.core", now.Add(time.Hour)},
+		},
+		{
+			description: "expired",
+			input:       newChannelOverrideToken(secret, "testing", "1979710", "", now),
+			wantError:   ErrExpiredOverride,
+		},
+		{
+			description: "wrong secret",
+			input:       newChannelOverrideToken([]byte("other"), "testing", "1979710", "", now.Add(time.Hour)),
+			wantError:   ErrInvalidOverride,
+		},
+		{
+			description: "unknown channel",
+			input:       newChannelOverrideToken(secret, "beta", "1979710", "", now.Add(time.Hour)),
+			wantError:   ErrInvalidOverride,
+		},
+		{
+			description: "tampered channel",
+			input:       "release" + newChannelOverrideToken(secret, "testing", "1979710", "", now.Add(time.Hour))[len("testing"):],
+			wantError:   ErrInvalidOverride,
+		},
+		{
+			description: "tampered org",
+			input:       "testing.1979711" + newChannelOverrideToken(secret, "testing", "1979710", "", now.Add(time.Hour))[len("testing.1979710"):],
+			wantError:   ErrInvalidOverride,
+		},
+		{
+			description: "malformed",
+			input:       "testing",
+			wantError:   ErrInvalidOverride,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseChannelOverride(secret, test.input, now)
+
+			if test.wantError != nil {
+				if !errors.Is(err, test.wantError) {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want, cmp.AllowUnexported(channelOverrideToken{})) {
+					t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(channelOverrideToken{})))
+				}
+			}
+		})
+	}
+}
+
+func TestChannelOverride(t *testing.T) {
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc   string
+		secret string
+		input  string
+		want   string
+	}{
+		{
+			desc:   "override",
+			secret: "s3cret",
+			input:  newChannelOverrideToken([]byte("s3cret"), "testing", "1979711", "", now.Add(time.Hour)),
+			want:   `{"url":"/testing"}`,
+		},
+		{
+			desc:   "module",
+			secret: "s3cret",
+			input:  newChannelOverrideToken([]byte("s3cret"), "testing", "1979711", "insights-core", now.Add(time.Hour)),
+			want:   `{"url":"/testing"}`,
+		},
+		{
+			desc:   "other org",
+			secret: "s3cret",
+			input:  newChannelOverrideToken([]byte("s3cret"), "testing", "1979710", "", now.Add(time.Hour)),
+			want:   `{"url":"/release"}`,
+		},
+		{
+			desc:   "other module",
+			secret: "s3cret",
+			input:  newChannelOverrideToken([]byte("s3cret"), "testing", "1979711", "compliance", now.Add(time.Hour)),
+			want:   `{"url":"/release"}`,
+		},
+		{
+			desc:   "expired",
+			secret: "s3cret",
+			input:  newChannelOverrideToken([]byte("s3cret"), "testing", "1979711", "", now.Add(-time.Hour)),
+			want:   `{"url":"/release"}`,
+		},
+		{
+			desc:   "invalid",
+			secret: "s3cret",
+			input:  "testing.1979711..1792141200.deadbeef",
+			want:   `{"url":"/release"}`,
+		},
+		{
+			desc:  "disabled",
+			input: newChannelOverrideToken(nil, "testing", "1979711", "", now.Add(time.Hour)),
+			want:  `{"url":"/release"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			srv.clock = fixedClock(now)
+			srv.overrideSecret = []byte(test.secret)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979711", "type": "User" } }`)))
+			req.Header.Add(channelOverrideHeader, test.input)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%v != %v", rr.Code, http.StatusOK)
+			}
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIssueChannelOverrideToken(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+
+	type input struct {
+		secret  []byte
+		channel string
+		orgID   string
+		ttl     time.Duration
+	}
+
+	tests := []struct {
+		desc      string
+		input     input
+		want      string
+		wantError bool
+	}{
+		{
+			desc:  "valid",
+			input: input{secret, "testing", "1979710", time.Hour},
+			want:  newChannelOverrideToken(secret, "testing", "1979710", "insights-core", now.Add(time.Hour)),
+		},
+		{
+			desc:      "missing secret",
+			input:     input{nil, "testing", "1979710", time.Hour},
+			wantError: true,
+		},
+		{
+			desc:      "unknown channel",
+			input:     input{secret, "beta", "1979710", time.Hour},
+			wantError: true,
+		},
+		{
+			desc:      "missing org id",
+			input:     input{secret, "testing", "", time.Hour},
+			wantError: true,
+		},
+		{
+			desc:      "dotted org id",
+			input:     input{secret, "testing", "1979.710", time.Hour},
+			wantError: true,
+		},
+		{
+			desc:      "expired",
+			input:     input{secret, "testing", "1979710", 0},
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := issueChannelOverrideToken(test.input.secret, test.input.channel, test.input.orgID, "insights-core", test.input.ttl, now)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("want error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Errorf("%v != %v", got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// previewChannel is the channel orgs on the preview allowlist are routed to.
+const previewChannel = "/preview"
+
+// maxPreviewBodySize bounds the size in bytes of a PUT /admin/preview body.
+const maxPreviewBodySize = 1 << 20
+
+// ErrInvalidPreviewOrg occurs when an org ID on the preview allowlist is empty
+// or is not valid UTF-8 without control characters.
+var ErrInvalidPreviewOrg = errors.New("invalid org_id: must be non-empty valid UTF-8 without control characters")
+
+// previewAllowlist holds the org IDs routed to previewChannel for early access
+// to new routing behavior, regardless of their routing rules. It is safe for
+// concurrent use.
+type previewAllowlist struct {
+	v atomic.Value
+}
+
+// contains reports whether orgID is on the allowlist.
+func (a *previewAllowlist) contains(orgID string) bool {
+	orgs, _ := a.v.Load().(map[string]bool)
+	return orgs[orgID]
+}
+
+// list returns the org IDs on the allowlist, sorted.
+func (a *previewAllowlist) list() []string {
+	orgs, _ := a.v.Load().(map[string]bool)
+	ids := make([]string, 0, len(orgs))
+	for id := range orgs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// set replaces the allowlist with orgIDs. Surrounding whitespace is trimmed
+// from each; an org ID left empty or containing control characters is
+// rejected with ErrInvalidPreviewOrg, leaving the allowlist unchanged.
+func (a *previewAllowlist) set(orgIDs []string) error {
+	orgs := make(map[string]bool, len(orgIDs))
+	for _, id := range orgIDs {
+		id = strings.TrimSpace(id)
+		if id == "" || !validModuleName(id) {
+			return ErrInvalidPreviewOrg
+		}
+		orgs[id] = true
+	}
+	a.v.Store(orgs)
+	return nil
+}
+
+// parsePreviewOrgs splits a comma-separated list of org IDs, ignoring empty
+// entries.
+func parsePreviewOrgs(value string) []string {
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter enforces a per-key token bucket. Each bucket holds up to burst
+// tokens and refills at rate tokens per second. It is safe for concurrent use.
+type rateLimiter struct {
+	rate  float64
+	burst int
+	clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	sweepAt int
+}
+
+// tokenBucket is the state of a single key's bucket as of updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitState describes a bucket after a call to rateLimiter.allow.
+type rateLimitState struct {
+	// Limit is the capacity of the bucket.
+	Limit int
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// Reset is the time at which the bucket will be full again.
+	Reset time.Time
+	// RetryAfter is the time until the next token is available. It is zero
+	// when Remaining is positive.
+	RetryAfter time.Duration
+}
+
+// newRateLimiter creates a rateLimiter refilling rate tokens per second into
+// buckets of burst tokens.
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		clock:   clock,
+		buckets: make(map[string]*tokenBucket),
+		sweepAt: 1024,
+	}
+}
+
+// allow takes a token from the bucket for key, reporting whether one was
+// available along with the state of the bucket afterwards.
+func (l *rateLimiter) allow(key string) (bool, rateLimitState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		l.sweep(now)
+		b = &tokenBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	state := rateLimitState{
+		Limit:     l.burst,
+		Remaining: int(b.tokens),
+		Reset:     now.Add(l.duration(float64(l.burst) - b.tokens)),
+	}
+	if !allowed {
+		state.RetryAfter = l.duration(1 - b.tokens)
+	}
+	return allowed, state
+}
+
+// refill adds the tokens accrued by b since it was last updated.
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(l.burst), b.tokens+elapsed*l.rate)
+	}
+	b.updated = now
+}
+
+// duration returns the time needed to accrue n tokens, rounded up to the
+// second.
+func (l *rateLimiter) duration(n float64) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(n/l.rate)) * time.Second
+}
+
+// sweep drops buckets that have refilled completely, as they are
+// indistinguishable from new ones. To amortize its cost, it only runs once the
+// number of buckets has doubled since the previous sweep.
+func (l *rateLimiter) sweep(now time.Time) {
+	if len(l.buckets) < l.sweepAt {
+		return
+	}
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweepAt = 2 * len(l.buckets)
+	if l.sweepAt < 1024 {
+		l.sweepAt = 1024
+	}
+}
+
+// parseTypeRateLimits parses a comma-separated list of type=rate:burst pairs
+// (i.e. "User=1:5,System=0") into the rate limiters of each identity type.
+// The burst defaults to defaultBurst if omitted. A rate of zero exempts the
+// type from rate limiting, and is mapped to a nil rateLimiter.
+func parseTypeRateLimits(s string, defaultBurst int, clock Clock) (map[string]*rateLimiter, error) {
+	limiters := make(map[string]*rateLimiter)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid type rate limit: missing type: %q", item)
+		}
+		typ, limit := item[:i], item[i+1:]
+		burst := defaultBurst
+		if j := strings.Index(limit, ":"); j >= 0 {
+			b, err := strconv.Atoi(limit[j+1:])
+			if err != nil || b < 1 {
+				return nil, fmt.Errorf("invalid type rate limit: invalid burst: %q", item)
+			}
+			limit, burst = limit[:j], b
+		}
+		rate, err := strconv.ParseFloat(limit, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid type rate limit: invalid rate: %q", item)
+		}
+		if rate == 0 {
+			limiters[typ] = nil
+			continue
+		}
+		limiters[typ] = newRateLimiter(rate, burst, clock)
+	}
+	return limiters, nil
+}
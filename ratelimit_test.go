@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// manualClock is a Clock that returns a time advanced explicitly by tests.
+type manualClock struct {
+	t time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.t
+}
+
+func TestRateLimiter(t *testing.T) {
+	type result struct {
+		Allowed bool
+		State   rateLimitState
+	}
+
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		description string
+		input       time.Duration
+		want        result
+	}{
+		{
+			description: "first request",
+			input:       0,
+			want:        result{true, rateLimitState{Limit: 2, Remaining: 1, Reset: start.Add(2 * time.Second)}},
+		},
+		{
+			description: "second request",
+			input:       0,
+			want:        result{true, rateLimitState{Limit: 2, Remaining: 0, Reset: start.Add(4 * time.Second)}},
+		},
+		{
+			description: "over limit",
+			input:       0,
+			want:        result{false, rateLimitState{Limit: 2, Remaining: 0, Reset: start.Add(4 * time.Second), RetryAfter: 2 * time.Second}},
+		},
+		{
+			description: "partially refilled",
+			input:       time.Second,
+			want:        result{false, rateLimitState{Limit: 2, Remaining: 0, Reset: start.Add(4 * time.Second), RetryAfter: time.Second}},
+		},
+		{
+			description: "refilled one token",
+			input:       time.Second,
+			want:        result{true, rateLimitState{Limit: 2, Remaining: 0, Reset: start.Add(6 * time.Second)}},
+		},
+	}
+
+	clock := &manualClock{start}
+	l := newRateLimiter(0.5, 2, clock)
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			clock.t = clock.t.Add(test.input)
+			allowed, state := l.allow("1979710")
+			got := result{allowed, state}
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+
+	if allowed, _ := l.allow("1979711"); !allowed {
+		t.Errorf("buckets are not independent")
+	}
+}
+
+func TestParseTypeRateLimits(t *testing.T) {
+	type limit struct {
+		Rate  float64
+		Burst int
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		want        map[string]*limit
+		wantError   bool
+	}{
+		{
+			description: "empty",
+			input:       "",
+			want:        map[string]*limit{},
+		},
+		{
+			description: "rates and bursts",
+			input:       "User=0.5:5, System=50",
+			want:        map[string]*limit{"User": {0.5, 5}, "System": {50, 10}},
+		},
+		{
+			description: "exempt",
+			input:       "System=0",
+			want:        map[string]*limit{"System": nil},
+		},
+		{
+			description: "missing type",
+			input:       "=1",
+			wantError:   true,
+		},
+		{
+			description: "invalid rate",
+			input:       "User=-1",
+			wantError:   true,
+		},
+		{
+			description: "invalid burst",
+			input:       "User=1:0",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			limiters, err := parseTypeRateLimits(test.input, 10, &manualClock{})
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("want error, got %v", limiters)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]*limit)
+			for typ, l := range limiters {
+				if l == nil {
+					got[typ] = nil
+					continue
+				}
+				got[typ] = &limit{l.rate, l.burst}
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
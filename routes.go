@@ -1,26 +1,33 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/redhatinsights/module-update-router/identity"
+	"github.com/redhatinsights/module-update-router/internal/config"
 
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/slok/go-http-metrics/metrics"
-	httpmetrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	"github.com/slok/go-http-metrics/middleware"
-
-	request "github.com/redhatinsights/platform-go-middlewares/request_id"
 )
 
-var r metrics.Recorder = httpmetrics.NewRecorder(httpmetrics.Config{})
-
 // Server is the application's HTTP server. It is comprised of an HTTP
 // multiplexer for routing HTTP requests to appropriate handlers and a database
 // handle for looking up application data.
@@ -28,125 +35,1697 @@ type Server struct {
 	mux    *http.ServeMux
 	db     *DB
 	addr   string
-	events *chan []byte
+	events *chan queuedEvent
+	clock  Clock
+	rand   Rand
+
+	// endpoints matches request paths to the API endpoints registered by
+	// handleAPI, serving their metric labels; see endpointLabel.
+	endpoints *http.ServeMux
+
+	// authenticator verifies request credentials in the auth middleware.
+	authenticator Authenticator
+
+	// routeByVersion enables gating the testing channel on the client version
+	// parsed from the userAgentProduct token of the User-Agent.
+	routeByVersion   bool
+	userAgentProduct string
+
+	// logFields renames access log fields; see config.Config.LogFieldMap.
+	logFields map[string]string
+	// logExcludePaths are the path.Match patterns of request paths left out
+	// of the access log; see config.Config.LogExcludePaths.
+	logExcludePaths []string
+	// logBodyMaxBytes bounds the bytes of each response body kept for the
+	// access log; see config.Config.LogBodyMaxBytes.
+	logBodyMaxBytes int
+
+	// pollAfter maps channels to the seconds returned in the poll_after
+	// field of /channel responses routed to them; see
+	// config.Config.PollAfter.
+	pollAfter map[string]int
+
+	// dualSchema adds the fields of the new /channel response schema
+	// alongside url until urlSunset, if set, after which url is dropped; see
+	// config.Config.ChannelDualSchema.
+	dualSchema bool
+	urlSunset  time.Time
+
+	// requestIDHeader is the request and response header carrying the
+	// request ID.
+	requestIDHeader string
+
+	maintenance maintenanceStatus
+
+	// warning is the message sent to API clients in a Warning header.
+	warning warningBanner
+	// preview lists the orgs routed to previewChannel regardless of their
+	// routing rules.
+	preview previewAllowlist
+
+	// maxURLLength bounds the length of request URLs. Zero means no limit.
+	maxURLLength int
+
+	// writeTimeout bounds the time each write of a long response, such as an
+	// /event export, may block on a client that stopped reading. Zero means no
+	// timeout.
+	writeTimeout time.Duration
+
+	// idleTimeout bounds the time an idle keep-alive connection is kept open.
+	// Zero means no timeout.
+	idleTimeout time.Duration
+
+	// tcpKeepAlive is the period of TCP keep-alive probes on client
+	// connections. Zero disables them.
+	tcpKeepAlive time.Duration
+
+	// redirectTrailingSlash answers API paths with a trailing slash with a
+	// redirect to the canonical path rather than serving them directly.
+	redirectTrailingSlash bool
+
+	// debugTiming enables timing the stages of the handler chain for requests
+	// carrying the X-Debug-Timing header.
+	debugTiming bool
+
+	// rules caches the routing rules channels are resolved from.
+	rules *ruleCache
+
+	// modules caches whether modules are retired.
+	modules *moduleCache
+
+	// aliases caches the module names that module names are aliases of.
+	aliases *moduleCache
+
+	// eventHighWater is the fraction of the event buffer in use from which
+	// events are rejected with 503. Zero disables rejecting events.
+	eventHighWater float64
+
+	// countErrorPolicy is how failures to look up routing rules are handled;
+	// see config.Config.CountErrorPolicy.
+	countErrorPolicy string
+
+	// overrideSecret verifies channel override tokens. Empty disables
+	// overrides.
+	overrideSecret []byte
+
+	// readOnly rejects API requests that may write to the database, for
+	// standbys running against a read-only replica.
+	readOnly bool
+
+	// diagnoseMissingOrgID lists the identity fields present and missing in
+	// responses to identities without an org_id.
+	diagnoseMissingOrgID bool
+
+	// listEndpoints lists the API version and its endpoints in responses to
+	// unknown paths under an API prefix.
+	listEndpoints bool
+
+	// unprefixedPaths is how API requests arriving without the path prefix
+	// are handled; see config.Config.UnprefixedPaths. unprefixedRoot is the
+	// API root such requests arrive under.
+	unprefixedPaths string
+	unprefixedRoot  string
+
+	// mirrors maps a channel to the URLs it is served from. Channels without
+	// mirrors are returned as is.
+	mirrors map[string]mirrorSet
+
+	// testingQuota is the number of times a day an org may be routed to the
+	// testing channel. Zero means no quota.
+	testingQuota int
+
+	// rateLimiter limits the request rate of each org. It is nil when rate
+	// limiting is disabled.
+	rateLimiter *rateLimiter
+
+	// typeRateLimiters limit the request rate of each org by identity type in
+	// place of rateLimiter. A nil rateLimiter exempts the type.
+	typeRateLimiters map[string]*rateLimiter
+
+	// notReady is non-zero while the server is not ready to serve routing
+	// decisions, such as during initial seeding. It is accessed atomically.
+	notReady int32
+
+	// registry holds the metrics the server serves: those of its HTTP metrics
+	// recorder and database, the application metrics and the Go runtime and
+	// process metrics, so that servers in the same process do not collide.
+	registry *prometheus.Registry
+	// recorder records HTTP request metrics in the metrics middleware.
+	recorder metrics.Recorder
+	// appMetrics holds the application metrics, registered with registry.
+	appMetrics *appMetrics
+	// activeOrgs estimates the number of distinct orgs authenticated in the
+	// last activeOrgsWindow.
+	activeOrgs *slidingCounter
+	// metricsPrefix is the namespace of the server's metric names.
+	metricsPrefix string
+	// dashboard enables serving the dashboard alongside the metrics.
+	dashboard bool
+
+	// webhook is notified of channel changes. It is nil when the webhook is
+	// not configured.
+	webhook *webhookNotifier
+
+	// statsd mirrors key metrics to a StatsD endpoint. It is nil when StatsD
+	// is not configured.
+	statsd *statsdClient
+}
+
+// ServerOption configures optional behavior of a Server created by NewServer.
+type ServerOption func(*Server)
+
+// WithAuthenticator configures the server to verify request credentials with
+// a, replacing the default Authenticator.
+func WithAuthenticator(a Authenticator) ServerOption {
+	return func(s *Server) {
+		s.authenticator = a
+	}
 }
 
 // NewServer creates a new instance of the application, configured with the
-// provided addr, API roots and database handle.
-func NewServer(addr string, apiroots []string, db *DB, events *chan []byte) (*Server, error) {
+// provided addr, API roots and database handle. Additional options are read
+// from config.DefaultConfig and then applied from opts.
+func NewServer(addr string, apiroots []string, db *DB, events *chan queuedEvent, opts ...ServerOption) (*Server, error) {
 	srv := &Server{
-		mux:    &http.ServeMux{},
-		db:     db,
-		addr:   addr,
-		events: events,
+		mux:              &http.ServeMux{},
+		endpoints:        &http.ServeMux{},
+		db:               db,
+		addr:             addr,
+		events:           events,
+		clock:            systemClock{},
+		rand:             systemRand{},
+		routeByVersion:   config.DefaultConfig.RouteByVersion,
+		userAgentProduct: config.DefaultConfig.UserAgentProduct,
+		writeTimeout:     config.DefaultConfig.WriteTimeout,
+		idleTimeout:      config.DefaultConfig.IdleTimeout,
+		tcpKeepAlive:     config.DefaultConfig.TCPKeepAlive,
+		testingQuota:     config.DefaultConfig.TestingQuota,
+		maxURLLength:     config.DefaultConfig.MaxURLLength,
+		debugTiming:      config.DefaultConfig.DebugTiming,
+		metricsPrefix:    config.DefaultConfig.MetricsPrefix,
+		dashboard:        config.DefaultConfig.Dashboard,
+		registry:         prometheus.NewRegistry(),
+
+		redirectTrailingSlash: config.DefaultConfig.RedirectTrailingSlash,
+	}
+	// The clock and random source are settled before any component that
+	// reads them is built.
+	srv.testSources()
+	srv.activeOrgs = newSlidingCounter(activeOrgsWindow, activeOrgsBuckets, srv.clock)
+	m, err := newMetrics(srv.metricsPrefix, srv.activeOrgs)
+	if err != nil {
+		return nil, err
+	}
+	srv.appMetrics = m
+	srv.authenticator = identityHeaderAuthenticator{srv.appMetrics}
+	if config.DefaultConfig.JWKSURL != "" {
+		srv.authenticator = chainAuthenticator{
+			srv.authenticator,
+			newJWTAuthenticator(config.DefaultConfig.JWKSURL, config.DefaultConfig.JWTIssuer, config.DefaultConfig.JWTAudience, srv.clock),
+		}
+	}
+	if config.DefaultConfig.TrustOrgIDHeader {
+		networks, err := parseNetworks(config.DefaultConfig.TrustedNetworks)
+		if err != nil {
+			return nil, err
+		}
+		srv.authenticator = chainAuthenticator{orgIDHeaderAuthenticator{networks}, srv.authenticator}
+	}
+	srv.countErrorPolicy = config.DefaultConfig.CountErrorPolicy.Value
+	srv.eventHighWater = config.DefaultConfig.EventBufferHighWater
+	srv.diagnoseMissingOrgID = config.DefaultConfig.MissingOrgIDResponse.Value == "diagnostic"
+	srv.listEndpoints = config.DefaultConfig.NotFoundResponse.Value == "endpoints"
+	srv.unprefixedPaths = config.DefaultConfig.UnprefixedPaths.Value
+	srv.unprefixedRoot = path.Join("/", config.DefaultConfig.AppName, config.DefaultConfig.APIVersion)
+	srv.readOnly = config.DefaultConfig.ReadOnly
+	srv.overrideSecret = []byte(config.DefaultConfig.ChannelOverrideSecret)
+	srv.appMetrics.setReadOnly(srv.readOnly)
+	srv.rules = newRuleCache(config.DefaultConfig.ChannelCacheTTL, srv.clock)
+	srv.rules.keepStale = srv.countErrorPolicy == "cached"
+	srv.rules.jitter = config.DefaultConfig.ChannelCacheJitter
+	srv.rules.rand = srv.rand
+	srv.modules = newModuleCache(config.DefaultConfig.ChannelCacheTTL, srv.clock)
+	srv.aliases = newModuleCache(config.DefaultConfig.ChannelCacheTTL, srv.clock)
+	srv.mirrors = make(map[string]mirrorSet)
+	for channel, value := range map[string]string{
+		"/release": config.DefaultConfig.ReleaseMirrors,
+		"/testing": config.DefaultConfig.TestingMirrors,
+	} {
+		mirrors, err := parseMirrors(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(mirrors) > 0 {
+			srv.mirrors[channel] = mirrors
+		}
+	}
+	if config.DefaultConfig.RateLimit > 0 {
+		srv.rateLimiter = newRateLimiter(config.DefaultConfig.RateLimit, config.DefaultConfig.RateLimitBurst, srv.clock)
+	}
+	typeRateLimiters, err := parseTypeRateLimits(config.DefaultConfig.TypeRateLimits, config.DefaultConfig.RateLimitBurst, srv.clock)
+	if err != nil {
+		return nil, err
+	}
+	srv.typeRateLimiters = typeRateLimiters
+	if config.DefaultConfig.StatsdAddr != "" {
+		c, err := newStatsdClient(config.DefaultConfig.StatsdAddr, config.DefaultConfig.StatsdPrefix)
+		if err != nil {
+			return nil, err
+		}
+		srv.statsd = c
+	}
+	logFields, err := ParseFieldMap(config.DefaultConfig.LogFieldMap)
+	if err != nil {
+		return nil, err
+	}
+	srv.logFields = logFields
+	pollAfter, err := parsePollAfter(config.DefaultConfig.PollAfter)
+	if err != nil {
+		return nil, err
+	}
+	srv.pollAfter = pollAfter
+	logExcludePaths, err := parsePathPatterns(config.DefaultConfig.LogExcludePaths)
+	if err != nil {
+		return nil, err
+	}
+	srv.logExcludePaths = logExcludePaths
+	srv.logBodyMaxBytes = config.DefaultConfig.LogBodyMaxBytes
+	srv.dualSchema = config.DefaultConfig.ChannelDualSchema
+	if v := config.DefaultConfig.ChannelURLSunset; v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel url sunset: %w", err)
+		}
+		srv.urlSunset = t
+	}
+	srv.requestIDHeader = config.DefaultConfig.RequestIDHeader
+	if err := srv.warning.set(config.DefaultConfig.WarningMessage); err != nil {
+		return nil, err
+	}
+	if err := srv.preview.set(parsePreviewOrgs(config.DefaultConfig.PreviewOrgs)); err != nil {
+		return nil, err
+	}
+	if config.DefaultConfig.WebhookURL != "" {
+		srv.webhook = newWebhookNotifier(config.DefaultConfig.WebhookURL, config.DefaultConfig.WebhookSecret, srv.clock, srv.appMetrics)
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	// Identity types are checked last, so that they are checked however the
+	// identity is authenticated, including by an Authenticator from opts.
+	if policy := config.DefaultConfig.UnknownIdentityType.Value; policy != "allow" {
+		srv.authenticator = identityTypeAuthenticator{
+			next:   srv.authenticator,
+			known:  parseIdentityTypes(config.DefaultConfig.KnownIdentityTypes),
+			reject: policy == "reject",
+		}
+	}
+	srv.recorder = newRecorder(srv.registry, srv.metricsPrefix)
+	if err := srv.appMetrics.register(srv.registry); err != nil {
+		return nil, err
 	}
+	srv.registry.MustRegister(newDBStatsCollector(db))
 	srv.routes(apiroots...)
 	return srv, nil
 }
 
-func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
-// ListenAndServe simply calls http.ListenAndServe with the configured TCP
-// address and s as the handler.
-func (s Server) ListenAndServe() error {
-	return http.ListenAndServe(s.addr, s)
+// MetricsHandler returns an http.Handler that serves the server's metrics in
+// the prometheus exposition format. If the dashboard is enabled, the handler also
+// serves it at /dashboard.
+func (s *Server) MetricsHandler() http.Handler {
+	metrics := promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{})
+	if !s.dashboard {
+		return metrics
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", metrics)
+	mux.HandleFunc("/dashboard", s.handleDashboard())
+	mux.HandleFunc("/dashboard/stats", s.handleDashboardStats())
+	return mux
+}
+
+// ListenAndServe listens on the configured TCP address and serves requests
+// with s as the handler, as by Serve. Accepted connections send TCP keep-alive
+// probes with the configured period.
+func (s *Server) ListenAndServe() error {
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves requests accepted on ln with s as the handler. Keep-alive
+// connections left idle for the configured idle timeout are closed. Long
+// responses bound each write by the configured write timeout; see
+// writeDeadline.
+func (s *Server) Serve(ln net.Listener) error {
+	srv := &http.Server{
+		Addr:        s.addr,
+		Handler:     s,
+		IdleTimeout: s.idleTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+		// Clear the write deadline of the last response before the next
+		// request on the connection is read.
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateIdle {
+				if err := c.SetWriteDeadline(time.Time{}); err != nil {
+					log.Errorf("cannot clear write deadline: %v", err)
+				}
+			}
+		},
+	}
+	return srv.Serve(writeDeadlineListener{ln})
+}
+
+// listen listens on the configured TCP address, setting TCP keep-alive on
+// accepted connections with the configured period, or disabling it if the
+// period is zero.
+func (s *Server) listen() (net.Listener, error) {
+	addr := s.addr
+	if addr == "" {
+		addr = ":http"
+	}
+	lc := net.ListenConfig{KeepAlive: s.tcpKeepAlive}
+	if s.tcpKeepAlive == 0 {
+		lc.KeepAlive = -1
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
 }
 
-// Close closes the database handle.
+// Close stops the webhook notifier and closes the StatsD connection, if any,
+// and the database handle.
 func (s *Server) Close() error {
+	if err := s.webhook.Close(); err != nil {
+		log.Error(err)
+	}
+	if err := s.statsd.Close(); err != nil {
+		log.Error(err)
+	}
 	return s.db.Close()
 }
 
 // routes registers handlerFuncs for the server paths under the given prefixes.
+// The probe endpoints /ping and /readyz are registered outside the middleware
+// chain of the API paths, so that health probes are neither authenticated nor
+// rate limited, and are kept out of the access log and request metrics.
+//
+// Unless unprefixedPaths is "reject", requests under unprefixedRoot are also
+// served; see handleUnprefixed.
 func (s *Server) routes(prefixes ...string) {
+	s.testHooks()
 	s.mux.HandleFunc("/ping", s.handlePing())
+	s.mux.HandleFunc("/readyz", s.handleReadyz())
+	handlers := make(map[string]http.HandlerFunc, len(prefixes))
 	for _, prefix := range prefixes {
-		s.mux.HandleFunc(prefix+"/", s.metrics(s.requestID(s.log(s.auth(s.handleAPI(prefix))))))
+		h := s.timing(chain(s.handleAPI(prefix),
+			stage{"metrics", s.metrics},
+			stage{"request-id", s.requestID},
+			stage{"log", s.log},
+			stage{"limit-url", s.limitURL},
+			stage{"auth", s.auth},
+			stage{"rate-limit", s.rateLimit},
+		))
+		handlers[prefix] = h
+		s.mux.HandleFunc(prefix+"/", h)
+	}
+	if _, ok := handlers[s.unprefixedRoot]; s.unprefixedPaths != "reject" && !ok && len(prefixes) > 0 {
+		s.mux.HandleFunc(s.unprefixedRoot+"/", s.handleUnprefixed(handlers, prefixes[0]))
+	}
+}
+
+// handleUnprefixed creates an http.HandlerFunc serving requests under
+// unprefixedRoot, as forwarded by a gateway that strips the path prefix from
+// API paths, with the handler of one of the API roots, keyed by their path in
+// handlers. The request path is rewritten under the API root reconstructed
+// from the prefix named by the X-Forwarded-Prefix header, if it is one of
+// handlers. Otherwise, the request is served under fallback if unprefixedPaths
+// is "serve", and is not found if it is "forwarded".
+func (s *Server) handleUnprefixed(handlers map[string]http.HandlerFunc, fallback string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root := ""
+		if prefix := r.Header.Get("X-Forwarded-Prefix"); prefix != "" {
+			if _, ok := handlers[path.Join("/", prefix, s.unprefixedRoot)]; ok {
+				root = path.Join("/", prefix, s.unprefixedRoot)
+			}
+		}
+		if root == "" && s.unprefixedPaths == "serve" {
+			root = fallback
+		}
+		if root == "" {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = root + strings.TrimPrefix(r.URL.Path, s.unprefixedRoot)
+		r2.URL.RawPath = ""
+		handlers[root](w, r2)
 	}
 }
 
 // handlePing creates an http.HandlerFunc that handles the health check endpoint
-// /ping.
+// /ping. It responds to GET and HEAD only.
 func (s *Server) handlePing() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if _, err := w.Write([]byte(`OK`)); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// readyzPingTimeout bounds the database ping made for each readiness check.
+const readyzPingTimeout = time.Second
+
+// handleReadyz creates an http.HandlerFunc that handles the readiness check
+// endpoint /readyz. It responds with 503 until the server is marked ready, and
+// while the database does not answer a ping. Like /ping, it responds to GET
+// and HEAD only.
+func (s *Server) handleReadyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !s.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyzPingTimeout)
+		defer cancel()
+		if err := s.db.handle.PingContext(ctx); err != nil {
+			log.WithField("error", err).Warn("readiness check failed")
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			return
+		}
 		if _, err := w.Write([]byte(`OK`)); err != nil {
 			log.Errorf("cannot write HTTP response: %v", err)
 		}
 	}
 }
 
+// Ready reports whether the server is ready to serve routing decisions.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.notReady) == 0
+}
+
+// SetReady marks the server as ready or not ready to serve routing decisions.
+// A server is ready when created.
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if !ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.notReady, v)
+}
+
 // handleAPI creates an http.HandlerFunc that creates handlerFuncs for
 // operations under the API root.
+//
+// The channel and event operations are only registered when enabled by
+// config.Config.EnableChannel and config.Config.EnableEvent; disabled
+// operations are not found.
+//
+// Operation paths are canonically registered without a trailing slash. A
+// request for an operation path with a trailing slash is either served as the
+// canonical path or, if redirectTrailingSlash is set, redirected to it.
+//
+// If readOnly is set, requests with methods other than GET and HEAD, which
+// may write to the database, are rejected with 503.
 func (s *Server) handleAPI(prefix string) http.HandlerFunc {
 	m := http.ServeMux{}
+	var endpoints []string
+	handle := func(p string, h http.HandlerFunc) {
+		endpoints = append(endpoints, p)
+		m.HandleFunc(p, h)
+		s.endpoints.Handle(p, newEndpoint(prefix, p))
+	}
 
-	m.HandleFunc(path.Join(prefix, "channel"), s.handleChannel())
-	m.HandleFunc(path.Join(prefix, "event"), s.handleEvent())
+	if config.DefaultConfig.EnableChannel {
+		handle(path.Join(prefix, "channel"), s.handleChannel())
+		handle(path.Join(prefix, "channels"), s.handleChannels())
+		handle(path.Join(prefix, "manifest"), s.handleManifest())
+	}
+	if config.DefaultConfig.EnableEvent {
+		handle(path.Join(prefix, "event"), s.handleEvent())
+		handle(path.Join(prefix, "event", "stats"), s.handleEventStats())
+		handle(path.Join(prefix, "event")+"/", s.handleEventByID(path.Join(prefix, "event")+"/"))
+	}
+	handle(path.Join(prefix, "admin", "channel"), s.handleAdminChannel())
+	handle(path.Join(prefix, "admin", "db", "maintenance"), s.handleDBMaintenance())
+	handle(path.Join(prefix, "admin", "drain"), s.handleAdminDrain())
+	handle(path.Join(prefix, "admin", "metrics", "snapshot"), s.handleAdminMetricsSnapshot())
+	handle(path.Join(prefix, "admin", "preview"), s.handleAdminPreview())
+	handle(path.Join(prefix, "admin", "selftest"), s.handleAdminSelftest())
+	handle(path.Join(prefix, "admin", "warning"), s.handleAdminWarning())
+	if s.listEndpoints {
+		version := path.Base(prefix)
+		m.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+			formatNotFoundError(w, version, endpoints)
+		})
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		if msg := s.warning.get(); msg != "" {
+			w.Header().Set("Warning", warningHeader(msg))
+		}
+		if s.readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			formatReadOnlyError(w)
+			return
+		}
+		if p := r.URL.Path; len(p) > len(prefix)+1 && strings.HasSuffix(p, "/") {
+			canonical := strings.TrimRight(p, "/")
+			if s.redirectTrailingSlash {
+				u := *r.URL
+				u.Path = canonical
+				u.RawPath = ""
+				http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+				return
+			}
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = canonical
+			r2.URL.RawPath = ""
+			r = r2
+		}
 		m.ServeHTTP(w, r)
 	}
 }
 
 // handleChannel creates an http.HandlerFunc for the API endpoint /channel.
+// The client version used to route by version is taken from the version
+// parameter, a version suffix of the module parameter separated by
+// config.Config.ModuleVersionDelim, or the User-Agent, in that order. A valid
+// X-Channel-Override token takes precedence over the routing decision, and
+// over the URL recorded for the org, if any (see channelURL). If
+// config.Config.ChannelExpiresAt is set, or the client accepts the version 2
+// response (see acceptsChannelExpiry), the response includes the time after
+// which the client should query again; see channelExpiry.
+//
+// While the response schema is migrated, config.Config.ChannelDualSchema adds
+// the fields of the new schema, channel and location, alongside url, so that
+// clients can move to them on their own timeline. Until
+// config.Config.ChannelURLSunset, responses announce the removal of url in a
+// Sunset header (RFC 8594); from then on, url is left out.
 func (s *Server) handleChannel() http.HandlerFunc {
 	type response struct {
+		URL       string `json:"url,omitempty"`
+		Channel   string `json:"channel,omitempty"`
+		Location  string `json:"location,omitempty"`
+		PollAfter int    `json:"poll_after,omitempty"`
+		Module    string `json:"module,omitempty"`
+		ExpiresAt string `json:"expires_at,omitempty"`
+	}
+	jitter := config.DefaultConfig.PollAfterJitter
+	defaultModule := config.DefaultConfig.DefaultModule
+	channelHeader := config.DefaultConfig.ChannelHeader
+	delim := config.DefaultConfig.ModuleVersionDelim
+	expiresAt := config.DefaultConfig.ChannelExpiresAt
+	deprecated := channelDeprecatedParams
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		s.replaceDeprecatedParams(w, params, "channel", deprecated)
+		var module, version string
+		if values, ok := params["module"]; ok {
+			module, version = splitModuleVersion(values[0], delim)
+			if module == "" {
+				formatJSONError(w, http.StatusBadRequest, "empty parameter: 'module'")
+				return
+			}
+			if !validModuleName(values[0]) {
+				formatJSONError(w, http.StatusBadRequest, invalidModuleMessage)
+				return
+			}
+		} else {
+			module = defaultModule
+			if module == "" {
+				formatJSONError(w, http.StatusBadRequest, "missing required parameter: 'module'")
+				return
+			}
+		}
+
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.OrgID == "" {
+			s.appMetrics.incMissingOrgIDs()
+			formatMissingOrgIDError(w, id, s.diagnoseMissingOrgID)
+			return
+		}
+		if v := params.Get("version"); v != "" {
+			version = v
+		}
+		c, err := s.resolveClient(r, id.Identity.OrgID, module, version)
+		if err != nil {
+			formatRoutingError(w, r, err)
+			return
+		}
+		channel := c.channel
+		resp := response{
+			URL: c.url,
+		}
+		if c.module != module {
+			resp.Module = c.module
+		}
+		if s.dualSchema {
+			resp.Channel = strings.TrimPrefix(channel, "/")
+			resp.Location = resp.URL
+			if !s.urlSunset.IsZero() {
+				if s.clock.Now().Before(s.urlSunset) {
+					w.Header().Set("Sunset", s.urlSunset.UTC().Format(http.TimeFormat))
+				} else {
+					resp.URL = ""
+				}
+			}
+		}
+		if p := s.pollAfter[channel]; p > 0 {
+			resp.PollAfter = p
+			if jitter > 0 {
+				resp.PollAfter += s.rand.Intn(jitter + 1)
+			}
+		}
+		if expiresAt || acceptsChannelExpiry(r) {
+			if t, ok := s.channelExpiry(c.routing); ok {
+				resp.ExpiresAt = t.Format(time.RFC3339)
+			}
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		s.appMetrics.incChannelDecisions(channel, identityTypeLabel(id))
+		if channelHeader != "" {
+			w.Header().Set(channelHeader, strings.TrimPrefix(channel, "/"))
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// channelExpiryVersion is the version of the /channel response carrying
+// expires_at, as requested by the version parameter of an Accept media type.
+const channelExpiryVersion = "2"
+
+// acceptsChannelExpiry reports whether the Accept header of r asks for a JSON
+// response with the channelExpiryVersion parameter, as in
+// "application/json; version=2".
+func acceptsChannelExpiry(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaType)
+			if err != nil {
+				continue
+			}
+			if mediaType == "application/json" && params["version"] == channelExpiryVersion {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// channelExpiry returns the time after which the routing decision rt should
+// be queried again: now plus the module's cache TTL, if the rule records one,
+// or the rule cache's TTL otherwise. It returns false if the TTL is zero, or
+// if the rule could not be looked up, so that clients do not keep a fallback
+// decision.
+func (s *Server) channelExpiry(rt routing) (time.Time, bool) {
+	if rt.fallback {
+		return time.Time{}, false
+	}
+	ttl := s.rules.ttl
+	if rt.rule.hasTTL {
+		ttl = rt.rule.ttl
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	return s.clock.Now().Add(ttl).UTC(), true
+}
+
+// identityTypeLabels are the identity types counted under their own label in
+// metrics. Other types are counted as "other".
+var identityTypeLabels = map[string]bool{
+	"Associate": true,
+	"System":    true,
+	"User":      true,
+}
+
+// identityTypeLabel returns the metric label of the type of id: the type
+// itself if it is one of identityTypeLabels, "none" if it has none, or "other".
+// Bucketing types bounds the cardinality of the label.
+func identityTypeLabel(id *identity.Identity) string {
+	switch {
+	case id.Identity.Type == nil || *id.Identity.Type == "":
+		return "none"
+	case identityTypeLabels[*id.Identity.Type]:
+		return *id.Identity.Type
+	default:
+		return "other"
+	}
+}
+
+// retiredModuleError is returned when a client asks for the channel of a
+// retired module. It names the module replacing it, if any.
+type retiredModuleError struct {
+	replacement string
+}
+
+func (e retiredModuleError) Error() string {
+	return "module retired"
+}
+
+// clientRouting is the channel and URL a client is sent to for a module.
+type clientRouting struct {
+	routing
+	// module is the canonical name of the module.
+	module string
+	url    string
+}
+
+// resolveClient resolves the channel and URL the client of orgID making
+// request r is sent to for module, given without a version suffix, at the
+// client version version or, if empty, the version of its User-Agent. It is
+// shared by /channel, /channels and the gRPC service, so that a client gets
+// the same answer whichever it asks: module is canonicalized, a retired module
+// is rejected with a retiredModuleError, and a valid X-Channel-Override token
+// takes precedence over the decision of routeClient and over the URL recorded
+// for the org. The request is counted under the channel it is routed to.
+func (s *Server) resolveClient(r *http.Request, orgID, module, version string) (clientRouting, error) {
+	c := clientRouting{module: s.canonicalModule(module)}
+	replacement, retired, err := s.retiredModule(c.module)
+	if err != nil {
+		return c, err
+	}
+	if retired {
+		return c, retiredModuleError{replacement}
+	}
+	if channel, ok := s.channelOverride(r, orgID, c.module); ok {
+		c.channel = channel
+	} else {
+		c.routing, err = s.routeClient(c.module, orgID, s.clientVersion(r.UserAgent(), version))
+		if err != nil {
+			return c, err
+		}
+	}
+	c.url = s.channelURL(c.routing, orgID)
+	s.appMetrics.incRequests(c.channel)
+	s.statsd.incr("requests." + statsdName(c.channel))
+	return c, nil
+}
+
+// resolveModule returns the name of module, given with an optional version
+// after delim, and the URL the client of orgID making request r is sent to for
+// it, as resolved by resolveClient.
+func (s *Server) resolveModule(r *http.Request, orgID, module, delim string) (string, string, error) {
+	module, version := splitModuleVersion(module, delim)
+	c, err := s.resolveClient(r, orgID, module, version)
+	if err != nil {
+		return "", "", err
+	}
+	return module, c.url, nil
+}
+
+// invalidModuleMessage is the error returned for module parameters rejected by
+// validModuleName.
+const invalidModuleMessage = "invalid parameter: 'module' must be valid UTF-8 without control characters"
+
+// eventBufferAboveHighWater reports whether the fraction of the event buffer in
+// use has reached the server's high-water mark, if any.
+func (s *Server) eventBufferAboveHighWater() bool {
+	if s.eventHighWater <= 0 || cap(*s.events) == 0 {
+		return false
+	}
+	return float64(len(*s.events)) >= s.eventHighWater*float64(cap(*s.events))
+}
+
+// maxBatchModules bounds the number of modules in a /channels request.
+const maxBatchModules = 100
+
+// partialChannelsWarning is the Warning header message of a /channels
+// response in which some modules could not be resolved.
+const partialChannelsWarning = "some modules could not be resolved; retry those with status 'error'"
+
+// handleChannels creates an http.HandlerFunc for the API endpoint /channels.
+// It resolves the channels of several modules, given as repeated module
+// parameters, for the requesting org in one request. Modules are resolved
+// through the same rule cache as /channel. As with /channel, each module may
+// carry a version suffix.
+//
+// Each module is reported with a status: "ok" along with its URL, or "error"
+// along with the reason it could not be resolved, so that a failure to look
+// up some modules still returns those that resolved. Such a partial response
+// carries a Warning header. If no module resolves, the request fails as
+// /channel would.
+func (s *Server) handleChannels() http.HandlerFunc {
+	type response struct {
+		Module string `json:"module"`
+		Status string `json:"status"`
+		URL    string `json:"url,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+	delim := config.DefaultConfig.ModuleVersionDelim
+	return func(w http.ResponseWriter, r *http.Request) {
+		modules := r.URL.Query()["module"]
+		if len(modules) < 1 {
+			formatJSONError(w, http.StatusBadRequest, "missing required parameter: 'module'")
+			return
+		}
+		if len(modules) > maxBatchModules {
+			formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("too many values for parameter 'module': at most %v allowed", maxBatchModules))
+			return
+		}
+		for _, module := range modules {
+			if name, _ := splitModuleVersion(module, delim); name == "" {
+				formatJSONError(w, http.StatusBadRequest, "empty parameter: 'module'")
+				return
+			}
+			if !validModuleName(module) {
+				formatJSONError(w, http.StatusBadRequest, invalidModuleMessage)
+				return
+			}
+		}
+
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.OrgID == "" {
+			s.appMetrics.incMissingOrgIDs()
+			formatMissingOrgIDError(w, id, s.diagnoseMissingOrgID)
+			return
+		}
+
+		resp := make([]response, 0, len(modules))
+		var firstErr error
+		resolved := 0
+		for _, module := range modules {
+			name, url, err := s.resolveModule(r, id.Identity.OrgID, module, delim)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				msg := internalErrorMessage
+				var retired retiredModuleError
+				switch {
+				case errors.Is(err, ErrDatabaseBusy):
+					msg = "database busy"
+				case errors.As(err, &retired):
+					msg = retired.Error()
+				}
+				name, _ = splitModuleVersion(module, delim)
+				log.WithFields(log.Fields{
+					"request-id": requestIDOf(r),
+					"module":     sanitizeLogValue(name),
+					"error":      err,
+				}).Warn("cannot resolve module in batch; omitting its channel")
+				resp = append(resp, response{Module: name, Status: "error", Error: msg})
+				continue
+			}
+			resp = append(resp, response{Module: name, Status: "ok", URL: url})
+			resolved++
+		}
+		if firstErr != nil {
+			if resolved == 0 {
+				formatRoutingError(w, r, firstErr)
+				return
+			}
+			w.Header().Add("Warning", warningHeader(partialChannelsWarning))
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// handleManifest creates an http.HandlerFunc for the API endpoint /manifest.
+// It responds with the channel of every known module for the requesting org
+// in a single document. The document is sent with an ETag derived from its
+// content, so that clients can revalidate it with If-None-Match and only
+// download it again when a routing decision changes.
+func (s *Server) handleManifest() http.HandlerFunc {
+	type channel struct {
 		URL string `json:"url"`
 	}
+	type response struct {
+		Modules map[string]channel `json:"modules"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.OrgID == "" {
+			s.appMetrics.incMissingOrgIDs()
+			formatMissingOrgIDError(w, id, s.diagnoseMissingOrgID)
+			return
+		}
+
+		modules, err := s.db.Modules()
+		if err != nil {
+			if errors.Is(err, ErrDatabaseBusy) {
+				formatBusyError(w)
+				return
+			}
+			formatInternalError(w, r, err)
+			return
+		}
+		resp := response{
+			Modules: make(map[string]channel, len(modules)),
+		}
+		version := s.clientVersion(r.UserAgent(), "")
+		for _, module := range modules {
+			rt, err := s.routeClient(module, id.Identity.OrgID, version)
+			if err != nil {
+				formatRoutingError(w, r, err)
+				return
+			}
+			resp.Modules[module] = channel{URL: s.channelURL(rt, id.Identity.OrgID)}
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		sum := sha256.Sum256(data)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, no-cache")
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// etagMatch reports whether the If-None-Match header value header matches
+// etag, either as one of its comma-separated entity tags or as "*". Weak
+// entity tags are compared weakly.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// clientVersion returns the version of the client making a request, being
+// version if it was given by the client and is valid, or otherwise the version
+// parsed from its User-Agent ua. It returns an empty string if the version is
+// unknown, or if routing by client version is disabled and so the version
+// is not needed.
+func (s *Server) clientVersion(ua, version string) string {
+	if !s.routeByVersion {
+		return ""
+	}
+	if version != "" {
+		if _, err := splitVersion(version); err == nil {
+			return version
+		}
+		log.Debugf("ignoring invalid client version: %v", version)
+	}
+	version, err := parseUserAgentVersion(ua, s.userAgentProduct)
+	if err != nil {
+		log.Debug(err)
+		return ""
+	}
+	return version
+}
+
+// splitModuleVersion splits a module parameter combining a module name and
+// version separated by delim, such as "insights-core@3.0.156", into its name
+// and version. The version is empty if value has no version suffix or delim is
+// empty.
+func splitModuleVersion(value, delim string) (module, version string) {
+	if delim == "" {
+		return value, ""
+	}
+	i := strings.LastIndex(value, delim)
+	if i < 1 {
+		return value, ""
+	}
+	return value[:i], value[i+len(delim):]
+}
+
+// retiredModule reports whether module is retired, and its replacement, if
+// any, through the server's module cache. Failures to look it up are handled
+// as configured by config.Config.CountErrorPolicy, like those of routing
+// rules: with "closed", they are returned; with "open" or "cached", they are
+// logged and the module is taken not to be retired, so that its clients are
+// routed as usual. ErrDatabaseBusy is always returned.
+func (s *Server) retiredModule(module string) (string, bool, error) {
+	info, err := s.modules.get(module, func() (moduleInfo, error) {
+		var info moduleInfo
+		var err error
+		info.replacement, info.retired, err = s.db.RetiredModule(module)
+		return info, err
+	})
+	if err == nil || errors.Is(err, ErrDatabaseBusy) {
+		return info.replacement, info.retired, err
+	}
+	s.appMetrics.incRoutingErrors(s.countErrorPolicy)
+	if s.countErrorPolicy == "closed" {
+		return "", false, err
+	}
+	log.WithField("error", err).Warn("cannot look up retired module, routing as usual")
+	return "", false, nil
+}
+
+// canonicalModule returns the module name that module is an alias of, or
+// module itself if it is not an alias, through the server's alias cache.
+// Lookup failures are logged and fall back to module.
+func (s *Server) canonicalModule(module string) string {
+	info, err := s.aliases.get(module, func() (moduleInfo, error) {
+		var info moduleInfo
+		var err error
+		info.canonical, err = s.db.CanonicalModule(module)
+		return info, err
+	})
+	if err != nil {
+		log.Error(err)
+		return module
+	}
+	return info.canonical
+}
+
+// routing is a routing decision: the channel a client is routed to, along
+// with the routing rule it was routed by.
+type routing struct {
+	channel string
+	// rule is empty if no rule was looked up, as for orgs on the preview
+	// allowlist, or if fallback is set.
+	rule routingRule
+	// fallback is set if the rule could not be looked up and the client was
+	// routed to the release channel instead.
+	fallback bool
+}
+
+// resolveChannel returns the channel URL fragment the given org should be
+// routed to for module, and the rule it was resolved from. version is the
+// version of the client, used when routing by client version is enabled, or
+// empty if unknown. Orgs without a rule for module are routed to the module's
+// default channel, if one is recorded, or the release channel.
+//
+// ErrDatabaseBusy is returned so that the client can retry rather than be
+// routed on a guess. Other failures to look up the org's rule are handled as
+// configured by config.Config.CountErrorPolicy: with "open", they are logged
+// and fall back to the release channel; with "closed", they are returned; with
+// "cached", the last rule cached for the org is used, if any, falling back to
+// the release channel otherwise.
+func (s *Server) resolveChannel(module, orgID, version string) (routing, error) {
+	rule, err := s.lookupRule(module, orgID)
+	if err != nil {
+		if errors.Is(err, ErrDatabaseBusy) {
+			return routing{}, err
+		}
+		s.appMetrics.incRoutingErrors(s.countErrorPolicy)
+		if s.countErrorPolicy == "closed" {
+			return routing{}, err
+		}
+		cached, ok := s.rules.stale(ruleKey{module, orgID})
+		if s.countErrorPolicy != "cached" || !ok {
+			log.Error(err)
+			return routing{channel: "/release", fallback: true}, nil
+		}
+		log.WithField("error", err).Warn("cannot look up routing rule, using last cached rule")
+		rule = cached
+	}
+	return routing{channel: s.ruleChannel(rule, version), rule: rule}, nil
+}
+
+// ruleChannel returns the channel rule routes a client of the given version
+// to, as described for resolveChannel.
+func (s *Server) ruleChannel(rule routingRule, version string) string {
+	if rule.matched {
+		if s.routeByVersion && !meetsMinVersion(rule.minVersion, version) {
+			return "/release"
+		}
+		return "/testing"
+	}
+	if rule.defaultChannel == "" {
+		return "/release"
+	}
+	return rule.defaultChannel
+}
+
+// peekChannel returns the routing decision for the client of orgID and module
+// as resolved by resolveChannel, except that orgs on the preview allowlist are
+// routed to previewChannel without looking up their rule. Unlike routeClient,
+// it neither counts the testing quota nor notifies the webhook, so it suits
+// lookups on behalf of an org.
+func (s *Server) peekChannel(module, orgID, version string) (routing, error) {
+	if s.preview.contains(orgID) {
+		return routing{channel: previewChannel}, nil
+	}
+	return s.resolveChannel(module, orgID, version)
+}
+
+// routeClient returns the routing decision for the client of orgID and
+// module, resolved as by peekChannel and then subject to the testing quota:
+// once the org has been routed to the testing channel as many times in a UTC
+// day as the quota allows, it is routed to the release channel for the rest of
+// the day. Failures to count the quota usage are logged and do not change the
+// decision, except ErrDatabaseBusy, which is returned. The quota is not
+// enforced if the server is read-only. The webhook is notified of the
+// decision.
+func (s *Server) routeClient(module, orgID, version string) (routing, error) {
+	rt, err := s.peekChannel(module, orgID, version)
+	if err != nil {
+		return routing{}, err
+	}
+	if rt.channel == "/testing" && s.testingQuota > 0 && !s.readOnly {
+		n, err := s.db.IncrementQuotaUsage(orgID, rt.channel, s.clock.Now())
+		switch {
+		case errors.Is(err, ErrDatabaseBusy):
+			return routing{}, err
+		case err != nil:
+			log.Error(err)
+		case n > s.testingQuota:
+			s.appMetrics.incQuotaExceeded(rt.channel)
+			rt.channel = "/release"
+		}
+	}
+	s.webhook.notify(module, orgID, rt.channel)
+	return rt, nil
+}
+
+// lookupRule returns the routingRule for orgID and module through the
+// server's rule cache, which caches it for the module's TTL, if any. Failures
+// to look up whether the org has a rule or the org's URL are returned, so that
+// a rule missing them is not cached; routing the org to its channel rather
+// than its dedicated URL would send it to infrastructure it may not reach.
+// Failures to look up the minimum client version, the default channel or the
+// TTL are logged and leave those fields empty.
+func (s *Server) lookupRule(module, orgID string) (routingRule, error) {
+	return s.rules.get(ruleKey{module, orgID}, func() (routingRule, error) {
+		var rule routingRule
+		count, err := s.db.Count(module, orgID)
+		if err != nil {
+			return rule, err
+		}
+		rule.matched = count > 0
+		if rule.matched && s.routeByVersion {
+			rule.minVersion, err = s.db.MinClientVersion(module)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		if !rule.matched {
+			rule.defaultChannel, err = s.db.DefaultChannel(module)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		rule.url, err = s.db.OrgModuleURL(module, orgID)
+		if err != nil {
+			return rule, err
+		}
+		rule.ttl, rule.hasTTL, err = s.db.CacheTTL(module)
+		if err != nil {
+			log.Error(err)
+		}
+		return rule, nil
+	})
+}
+
+// channelURL returns the URL the client of orgID routed by rt is sent to. In
+// order of precedence, it is the URL recorded for the org in the rule, from
+// orgs_modules_urls, for orgs with dedicated infrastructure, a mirror of the
+// channel, or the channel itself. The org's URL only replaces the URL of its
+// channel: the channel is still resolved, so that the testing quota, metrics
+// and the webhook reflect it.
+func (s *Server) channelURL(rt routing, orgID string) string {
+	if rt.rule.url != "" {
+		return rt.rule.url
+	}
+	return s.mirrorURL(rt.channel, orgID)
+}
+
+// mirrorURL returns the URL of a mirror of channel picked for orgID, or the
+// channel itself if it has no mirrors.
+func (s *Server) mirrorURL(channel, orgID string) string {
+	if mirrors, ok := s.mirrors[channel]; ok {
+		return mirrors.pick(orgID)
+	}
+	return channel
+}
+
+// handleAdminChannel creates an http.HandlerFunc for the API endpoint
+// /admin/channel. It lets Associate identities look up the URL that one or
+// more orgs, given as repeated org_id parameters, would be routed to for
+// module, as /channel would report it, but without counting the testing quota
+// or notifying the webhook. Client version routing is not applied, as the
+// request does not come from the client.
+func (s *Server) handleAdminChannel() http.HandlerFunc {
+	type response struct {
+		OrgID string `json:"org_id"`
+		URL   string `json:"url"`
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		module := r.URL.Query().Get("module")
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		params := r.URL.Query()
+		module := params.Get("module")
+		if len(module) < 1 {
+			formatJSONError(w, http.StatusBadRequest, "missing required parameter: 'module'")
+			return
+		}
+		if !validModuleName(module) {
+			formatJSONError(w, http.StatusBadRequest, invalidModuleMessage)
+			return
+		}
+		module = s.canonicalModule(module)
+		orgIDs := params["org_id"]
+		if len(orgIDs) < 1 {
+			formatJSONError(w, http.StatusBadRequest, "missing required parameter: 'org_id'")
+			return
+		}
+
+		resp := make([]response, 0, len(orgIDs))
+		for _, orgID := range orgIDs {
+			rt, err := s.peekChannel(module, orgID, "")
+			if err != nil {
+				formatRoutingError(w, r, err)
+				return
+			}
+			resp = append(resp, response{
+				OrgID: orgID,
+				URL:   s.channelURL(rt, orgID),
+			})
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// handleAdminDrain creates an http.HandlerFunc for the API endpoint
+// /admin/drain. It is restricted to Associate identities. A POST moves one or
+// more orgs, given as repeated org_id parameters, off the testing channel for
+// module: their orgs_modules records are deleted and their cached routing
+// rules invalidated, so that their next requests are routed by the module's
+// default channel without waiting for the cache TTL. It responds with the
+// number of records deleted and the URL each org is now routed to, as
+// reported by /admin/channel. Only this server's cache is invalidated; other
+// replicas route the orgs to the testing channel until their cached rules
+// expire. Orgs on the preview allowlist stay on previewChannel.
+func (s *Server) handleAdminDrain() http.HandlerFunc {
+	type response struct {
+		OrgID   string `json:"org_id"`
+		Removed int64  `json:"removed"`
+		URL     string `json:"url"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		params := r.URL.Query()
+		module := params.Get("module")
 		if len(module) < 1 {
 			formatJSONError(w, http.StatusBadRequest, "missing required parameter: 'module'")
 			return
 		}
+		if !validModuleName(module) {
+			formatJSONError(w, http.StatusBadRequest, invalidModuleMessage)
+			return
+		}
+		module = s.canonicalModule(module)
+		orgIDs := params["org_id"]
+		if len(orgIDs) < 1 {
+			formatJSONError(w, http.StatusBadRequest, "missing required parameter: 'org_id'")
+			return
+		}
+
+		resp := make([]response, 0, len(orgIDs))
+		for _, orgID := range orgIDs {
+			n, err := s.db.DeleteOrgsModules(module, orgID)
+			if err != nil {
+				formatRoutingError(w, r, err)
+				return
+			}
+			s.rules.invalidate(ruleKey{module, orgID})
+			log.WithFields(log.Fields{
+				"module":  module,
+				"org_id":  orgID,
+				"removed": n,
+			}).Info("drained org from testing channel")
+
+			rt, err := s.peekChannel(module, orgID, "")
+			if err != nil {
+				formatRoutingError(w, r, err)
+				return
+			}
+			resp = append(resp, response{
+				OrgID:   orgID,
+				Removed: n,
+				URL:     s.channelURL(rt, orgID),
+			})
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// handleAdminPreview creates an http.HandlerFunc for the API endpoint
+// /admin/preview. It is restricted to Associate identities. A GET lists the
+// org IDs on the preview allowlist, a PUT replaces them with the org_ids of
+// the request body and a DELETE empties the allowlist. Changes last until the
+// server restarts, when the allowlist is reloaded from
+// config.Config.PreviewOrgs.
+func (s *Server) handleAdminPreview() http.HandlerFunc {
+	type allowlist struct {
+		OrgIDs []string `json:"org_ids"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			body, err := readBody(r, maxPreviewBodySize)
+			if err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var req allowlist
+			if err := json.Unmarshal(body, &req); err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := s.preview.set(req.OrgIDs); err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.WithField("org_ids", len(req.OrgIDs)).Info("set preview allowlist")
+		case http.MethodDelete:
+			if err := s.preview.set(nil); err != nil {
+				formatInternalError(w, r, err)
+				return
+			}
+			log.Info("cleared preview allowlist")
+		case http.MethodGet:
+		default:
+			formatMethodNotAllowedError(w, r, http.MethodGet, http.MethodPut, http.MethodDelete)
+			return
+		}
+
+		data, err := json.Marshal(allowlist{OrgIDs: s.preview.list()})
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// handleAdminWarning creates an http.HandlerFunc for the API endpoint
+// /admin/warning. It is restricted to Associate identities. A GET reports the
+// message sent to clients in the Warning header, a PUT replaces it with the
+// message of the request body and a DELETE clears it.
+func (s *Server) handleAdminWarning() http.HandlerFunc {
+	type warning struct {
+		Message string `json:"message"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			body, err := readBody(r, 2*maxWarningLength)
+			if err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var req warning
+			if err := json.Unmarshal(body, &req); err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := s.warning.set(req.Message); err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.WithField("message", req.Message).Info("set warning message")
+		case http.MethodDelete:
+			s.warning.clear()
+			log.Info("cleared warning message")
+		case http.MethodGet:
+		default:
+			formatMethodNotAllowedError(w, r, http.MethodGet, http.MethodPut, http.MethodDelete)
+			return
+		}
 
-		resp := response{
-			URL: "/release",
+		msg := s.warning.get()
+		data, err := json.Marshal(warning{Message: msg})
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if msg != "" {
+			w.Header().Set("Warning", warningHeader(msg))
+		} else {
+			w.Header().Del("Warning")
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
 		}
+	}
+}
+
+// handleDBMaintenance creates an http.HandlerFunc for the API endpoint
+// /admin/db/maintenance. It is restricted to Associate identities. A POST
+// starts database maintenance in the background and responds 202, or 409 if a
+// run is already in progress. A GET reports the status of the latest run.
+func (s *Server) handleDBMaintenance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := identity.GetIdentity(r)
 		if err != nil {
-			formatJSONError(w, http.StatusInternalServerError, err.Error())
+			formatInternalError(w, r, err)
 			return
 		}
-		if id.Identity.OrgID == "" {
-			formatJSONError(w, http.StatusBadRequest, "missing org_id identity field")
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
 			return
 		}
-		count, err := s.db.Count(module, id.Identity.OrgID)
-		if err != nil {
-			log.Error(err)
-		}
-		if count > 0 {
-			resp.URL = "/testing"
+
+		code := http.StatusOK
+		switch r.Method {
+		case http.MethodPost:
+			if !s.maintenance.start(s.clock.Now()) {
+				formatJSONError(w, http.StatusConflict, "database maintenance already running")
+				return
+			}
+			go func() {
+				log.WithFields(log.Fields{
+					"routine": "db_maintenance",
+				}).Info("started database maintenance")
+				err := s.db.Maintain()
+				if err != nil {
+					log.WithFields(log.Fields{
+						"routine": "db_maintenance",
+						"error":   err,
+					}).Error("database maintenance failed")
+				}
+				s.maintenance.finish(s.clock.Now(), err)
+			}()
+			code = http.StatusAccepted
+		case http.MethodGet:
+		default:
+			formatMethodNotAllowedError(w, r, http.MethodGet, http.MethodPost)
+			return
 		}
-		data, err := json.Marshal(resp)
+
+		data, err := json.Marshal(s.maintenance.report())
 		if err != nil {
-			formatJSONError(w, http.StatusInternalServerError, err.Error())
+			formatInternalError(w, r, err)
 			return
 		}
-		incRequests(resp.URL)
 		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
 		if _, err := w.Write(data); err != nil {
 			log.Errorf("cannot write HTTP response: %v", err)
 		}
 	}
 }
 
+// meetsMinVersion reports whether the client version satisfies the minimum
+// client version min. An empty minimum or an unknown client version leave the
+// routing decision unchanged.
+func meetsMinVersion(min, version string) bool {
+	if min == "" || version == "" {
+		return true
+	}
+	cmp, err := compareVersions(version, min)
+	if err != nil {
+		log.Debug(err)
+		return true
+	}
+	return cmp >= 0
+}
+
+// eventsSinceHeader and eventsUntilHeader are the response headers of GET
+// /event carrying the bounds of the time window the events were selected from,
+// if bounded.
+const (
+	eventsSinceHeader = "X-Events-Since"
+	eventsUntilHeader = "X-Events-Until"
+)
+
 // handleEvent creates an http.HandlerFunc for the API endpoint /event.
+//
+// A GET selects events started within the window given by the since and until
+// parameters (RFC 3339 times, both optional). If
+// config.Config.EventMaxLookbackDays is set, since is raised to at most that
+// many days ago, so that queries never scan older events. The effective bounds
+// are returned in the X-Events-Since and X-Events-Until headers.
 func (s *Server) handleEvent() http.HandlerFunc {
+	maxBodySize := config.DefaultConfig.MaxEventBodySize
+	maxQuerySize := config.DefaultConfig.MaxEventQuerySize
+	lookbackDays := config.DefaultConfig.EventMaxLookbackDays
+	maxLookback := time.Duration(lookbackDays) * 24 * time.Hour
+	sources := parseEventSources(config.DefaultConfig.EventSources)
+	deprecated := eventDeprecatedParams
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
+			body, err := readBody(r, maxBodySize)
+			if err != nil {
+				switch {
+				case errors.Is(err, ErrUnsupportedEncoding):
+					formatJSONError(w, http.StatusUnsupportedMediaType, err.Error())
+				case errors.Is(err, ErrBodyTooLarge):
+					formatJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+				default:
+					formatJSONError(w, http.StatusBadRequest, err.Error())
+				}
+				return
+			}
+			event, err := parseEvent(body)
+			if err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if event.Source == "" {
+				event.Source = r.Header.Get(eventSourceHeader)
+			}
+			if event.Source != "" && sources != nil && !sources[event.Source] {
+				formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid field: unknown source '%v'", event.Source))
+				return
+			}
+			if s.events != nil {
+				if s.eventBufferAboveHighWater() {
+					s.appMetrics.incEventsRejected()
+					formatBackpressureError(w)
+					return
+				}
+				msg := queuedEvent{Event: event, EnqueuedAt: s.clock.Now()}
+				if tp, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+					msg.Traceparent = tp
+				}
+				// The send never blocks, so the time it takes, observed whether
+				// or not the event is dropped, stays near zero unless handlers
+				// contend for the buffer.
+				pendingEvents.add(msg.EnqueuedAt)
+				start := time.Now()
+				select {
+				case *s.events <- msg:
+					s.appMetrics.observeEventSendWait(time.Since(start))
+				default:
+					s.appMetrics.observeEventSendWait(time.Since(start))
+					pendingEvents.done(msg.EnqueuedAt)
+					s.appMetrics.incEventsDropped()
+					log.Warn("event buffer full; dropping event")
+				}
+			}
 			w.WriteHeader(http.StatusCreated)
 		case http.MethodGet:
 			id, err := identity.GetIdentity(r)
 			if err != nil {
-				formatJSONError(w, http.StatusInternalServerError, err.Error())
+				formatInternalError(w, r, err)
 				return
 			}
-			if *id.Identity.Type != "Associate" {
+			if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
 				formatJSONError(w, http.StatusUnauthorized, "")
 				return
 			}
@@ -156,6 +1735,7 @@ func (s *Server) handleEvent() http.HandlerFunc {
 				formatJSONError(w, http.StatusBadRequest, err.Error())
 				return
 			}
+			s.replaceDeprecatedParams(w, params, "event", deprecated)
 			var limit, offset int64
 			{
 				var err error
@@ -180,37 +1760,366 @@ func (s *Server) handleEvent() http.HandlerFunc {
 					formatJSONError(w, http.StatusBadRequest, err.Error())
 					return
 				}
+				if offset < 0 {
+					formatJSONError(w, http.StatusBadRequest, "invalid parameter: 'offset' must not be negative")
+					return
+				}
+			}
+			var since, until time.Time
+			if p := params.Get("since"); p != "" {
+				since, err = time.Parse(time.RFC3339, p)
+				if err != nil {
+					formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid parameter: 'since': %v", err))
+					return
+				}
+			}
+			if p := params.Get("until"); p != "" {
+				until, err = time.Parse(time.RFC3339, p)
+				if err != nil {
+					formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid parameter: 'until': %v", err))
+					return
+				}
+			}
+			if maxLookback > 0 {
+				floor := s.clock.Now().Add(-maxLookback)
+				if !until.IsZero() && !floor.Before(until) {
+					formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid parameter: 'until' must be within the last %v days", lookbackDays))
+					return
+				}
+				if since.Before(floor) {
+					since = floor
+				}
+			}
+			if !since.IsZero() && !until.IsZero() && !since.Before(until) {
+				formatJSONError(w, http.StatusBadRequest, "invalid parameters: 'since' must be before 'until'")
+				return
+			}
+			if !since.IsZero() {
+				w.Header().Set(eventsSinceHeader, since.UTC().Format(time.RFC3339))
+			}
+			if !until.IsZero() {
+				w.Header().Set(eventsUntilHeader, until.UTC().Format(time.RFC3339))
+			}
+
+			if limit > 0 {
+				total, err := s.db.CountEvents(params.Get("source"), since, until)
+				if err != nil {
+					if errors.Is(err, ErrDatabaseBusy) {
+						formatBusyError(w)
+						return
+					}
+					formatInternalError(w, r, err)
+					return
+				}
+				// Links carry the replacements of deprecated parameters, so
+				// that paging clients move off them.
+				u := *r.URL
+				u.RawQuery = params.Encode()
+				w.Header().Set("Link", eventLinks(&u, int(limit), int(offset), total))
+			}
+
+			if acceptsNDJSON(r) {
+				s.streamEvents(w, r, int(limit), int(offset), params.Get("source"), since, until)
+				return
 			}
 
-			events, err := s.db.GetEvents(int(limit), int(offset))
+			events, err := s.db.GetEventsMaxSize(int(limit), int(offset), maxQuerySize, params.Get("source"), since, until)
 			if err != nil {
-				formatJSONError(w, http.StatusInternalServerError, err.Error())
+				if errors.Is(err, ErrResultTooLarge) {
+					s.appMetrics.incOversizedEventQueries()
+					formatJSONError(w, http.StatusInsufficientStorage, "result too large: narrow the query with 'limit'")
+					return
+				}
+				if errors.Is(err, ErrDatabaseBusy) {
+					formatBusyError(w)
+					return
+				}
+				formatInternalError(w, r, err)
 				return
 			}
 			data, err := json.Marshal(&events)
 			if err != nil {
-				formatJSONError(w, http.StatusInternalServerError, err.Error())
+				formatInternalError(w, r, err)
 				return
 			}
 			w.Header().Add("Content-Type", "application/json")
-			if _, err := w.Write(data); err != nil {
+			deadline := newWriteDeadline(r, s.writeTimeout)
+			if err := writeChunked(r.Context(), w, data, deadline); err != nil {
+				if deadline.timedOut() {
+					s.appMetrics.incWriteTimeouts(s.endpointLabel(r.URL.Path))
+				}
 				log.Errorf("cannot write HTTP response: %v", err)
 			}
 		default:
-			formatJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("error: '%s' not allowed", r.Method))
+			formatMethodNotAllowedError(w, r, http.MethodGet, http.MethodPost)
+			return
+		}
+	}
+}
+
+// eventLinks returns the value of a Link header (RFC 8288) for a page of limit
+// events starting at offset out of total, requested at u. It links to the
+// first and last pages and, where they exist, to the previous and next
+// pages, each as u with the offset parameter replaced.
+func eventLinks(u *url.URL, limit, offset, total int) string {
+	link := func(rel string, offset int) string {
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(offset))
+		return fmt.Sprintf(`<%v?%v>; rel="%v"`, u.Path, q.Encode(), rel)
+	}
+
+	links := []string{link("first", 0)}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link("prev", prev))
+	}
+	if offset+limit < total {
+		links = append(links, link("next", offset+limit))
+	}
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+	links = append(links, link("last", last))
+	return strings.Join(links, ", ")
+}
+
+// ndjsonContentType is the media type of newline-delimited JSON responses.
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonFlushEvents and ndjsonFlushInterval bound the number of events and
+// the time streamEvents buffers before flushing them to the client.
+const (
+	ndjsonFlushEvents   = 100
+	ndjsonFlushInterval = time.Second
+)
+
+// acceptsNDJSON reports whether the Accept header of r asks for
+// newline-delimited JSON.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if i := strings.Index(mediaType, ";"); i >= 0 {
+				mediaType = mediaType[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(mediaType), ndjsonContentType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamEvents responds to a GET /event request asking for newline-delimited
+// JSON, writing each event on its own line as it is read from the database
+// rather than loading the result in memory, so the memory budget of GET /event
+// queries does not apply. The response is flushed every ndjsonFlushEvents
+// events or ndjsonFlushInterval, whichever comes first, so clients receive
+// large exports progressively. Each write and flush is bounded by the write
+// timeout, so that a client that stops reading is dropped without cutting off
+// a long export. Once the first event is written, an error can only be logged,
+// and ends the response early.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, limit, offset int, source string, since, until time.Time) {
+	ctx := r.Context()
+	deadline := newWriteDeadline(r, s.writeTimeout)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			deadline.extend()
+			flusher.Flush()
+		}
+	}
+
+	started := false
+	pending := 0
+	lastFlush := s.clock.Now()
+	err := s.db.EachEvent(limit, offset, source, since, until, func(event map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+		}
+		deadline.extend()
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		pending++
+		if now := s.clock.Now(); pending >= ndjsonFlushEvents || now.Sub(lastFlush) >= ndjsonFlushInterval {
+			flush()
+			pending = 0
+			lastFlush = now
+		}
+		return nil
+	})
+	switch {
+	case err == nil && !started:
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	case err == nil:
+		flush()
+	case started:
+		if deadline.timedOut() {
+			s.appMetrics.incWriteTimeouts(s.endpointLabel(r.URL.Path))
+		}
+		log.Errorf("cannot write HTTP response: %v", err)
+	case errors.Is(err, ErrDatabaseBusy):
+		formatBusyError(w)
+	default:
+		formatInternalError(w, r, err)
+	}
+}
+
+// eventStatsWindow is the time range covered by /event/stats when no start
+// is given.
+const eventStatsWindow = 30 * 24 * time.Hour
+
+// handleEventByID creates an http.HandlerFunc for the API endpoint
+// /event/{id}. It is restricted to Associate identities, like reading events
+// with GET /event, and responds with the event with the given ID, or 404 if
+// there is none. IDs that are not UUIDs are rejected with 400.
+func (s *Server) handleEventByID(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
 			return
 		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		eventID, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, prefix))
+		if err != nil {
+			formatJSONError(w, http.StatusBadRequest, "invalid event ID: must be a UUID")
+			return
+		}
+		event, ok, err := s.db.GetEvent(eventID.String())
+		if err != nil {
+			if errors.Is(err, ErrDatabaseBusy) {
+				formatBusyError(w)
+				return
+			}
+			formatInternalError(w, r, err)
+			return
+		}
+		if !ok {
+			formatJSONError(w, http.StatusNotFound, "no such event")
+			return
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
+
+// handleEventStats creates an http.HandlerFunc for the API endpoint
+// /event/stats. It is restricted to Associate identities, like reading raw
+// events with GET /event, and responds with the number of events started
+// between the from and to parameters (RFC 3339 times, defaulting to the last 30
+// days), grouped by the dimension named by the group_by parameter (defaulting
+// to "day").
+func (s *Server) handleEventStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		params := r.URL.Query()
+		dimension := params.Get("group_by")
+		if dimension == "" {
+			dimension = "day"
+		}
+		valid := false
+		for _, d := range EventDimensions {
+			valid = valid || d == dimension
+		}
+		if !valid {
+			formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid parameter: 'group_by' must be one of %v", strings.Join(EventDimensions, ", ")))
+			return
+		}
+		to := s.clock.Now().UTC()
+		if p := params.Get("to"); p != "" {
+			to, err = time.Parse(time.RFC3339, p)
+			if err != nil {
+				formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid parameter: 'to': %v", err))
+				return
+			}
+		}
+		from := to.Add(-eventStatsWindow)
+		if p := params.Get("from"); p != "" {
+			from, err = time.Parse(time.RFC3339, p)
+			if err != nil {
+				formatJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid parameter: 'from': %v", err))
+				return
+			}
+		}
+		if !from.Before(to) {
+			formatJSONError(w, http.StatusBadRequest, "invalid parameters: 'from' must be before 'to'")
+			return
+		}
+
+		stats, err := s.db.EventStats(dimension, from, to)
+		if err != nil {
+			if errors.Is(err, ErrDatabaseBusy) {
+				formatBusyError(w)
+				return
+			}
+			formatInternalError(w, r, err)
+			return
+		}
+		data, err := json.Marshal(stats)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
 	}
 }
 
 // log is an http HandlerFunc middlware handler that creates a responseWriter
-// and logs details about the HandlerFunc it wraps.
+// and logs details about the HandlerFunc it wraps. Requests whose path
+// matches one of the server's logExcludePaths are not logged, but their
+// response size is still observed.
 func (s *Server) log(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rr := newResponseRecorder(w)
-		start := time.Now()
+		rr := newResponseRecorder(w, s.logBodyMaxBytes)
+		start := s.clock.Now()
+		extra := make(log.Fields)
 
-		next(rr, r)
+		next(rr, r.WithContext(context.WithValue(r.Context(), logFieldsKey{}, extra)))
 
 		var level log.Level
 		switch {
@@ -222,46 +2131,231 @@ func (s *Server) log(next http.HandlerFunc) http.HandlerFunc {
 			level = log.InfoLevel
 		}
 
-		responseBody := rr.Body.String()
-		if len(responseBody) > 1024 {
-			responseBody = responseBody[:1024]
+		s.appMetrics.observeResponseSize(s.endpointLabel(r.URL.Path), rr.Size)
+
+		if matchesAnyPath(s.logExcludePaths, r.URL.Path) {
+			return
 		}
 
-		log.WithFields(log.Fields{
+		responseBody := rr.Body.String()
+
+		fields := make(log.Fields)
+		for k, v := range map[string]interface{}{
 			"ident":      r.Host,
 			"method":     r.Method,
-			"referer":    r.Referer(),
-			"url":        r.URL.String(),
-			"user-agent": r.UserAgent(),
+			"referer":    sanitizeLogValue(r.Referer()),
+			"url":        sanitizeLogValue(r.URL.String()),
+			"user-agent": sanitizeLogValue(r.UserAgent()),
 			"status":     rr.Code,
 			"response":   responseBody,
-			"duration":   time.Since(start),
-			"request-id": r.Header.Get("X-Request-Id"),
-		}).Log(level)
+			"duration":   s.clock.Now().Sub(start),
+			"request-id": requestIDOf(r),
+		} {
+			fields[fieldName(s.logFields, k)] = v
+		}
+		for k, v := range extra {
+			fields[fieldName(s.logFields, k)] = v
+		}
+		log.WithFields(fields).Log(level)
+	}
+}
+
+// logFieldsKey is the request context key under which the log middleware
+// stores fields to add to the access log entry.
+type logFieldsKey struct{}
+
+// addLogField adds the field k with value v to the access log entry of r. It
+// does nothing if r is not served by the log middleware.
+func addLogField(r *http.Request, k string, v interface{}) {
+	if fields, ok := r.Context().Value(logFieldsKey{}).(log.Fields); ok {
+		fields[k] = v
+	}
+}
+
+// endpoint is the metric label of an API endpoint, registered in
+// Server.endpoints under the endpoint's path. It serves nothing.
+type endpoint string
+
+func (endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	http.NotFound(w, r)
+}
+
+// newEndpoint returns the endpoint registered under the path pattern p of the
+// API root prefix: p relative to prefix, such as "channel" or "admin/drain".
+// Subtree patterns, which serve a resource by ID, are suffixed with "{id}",
+// such as "event/{id}".
+func newEndpoint(prefix, p string) endpoint {
+	e := strings.TrimPrefix(p, prefix+"/")
+	if strings.HasSuffix(e, "/") {
+		e += "{id}"
+	}
+	return endpoint(e)
+}
+
+// endpointLabel returns the name of the API endpoint registered for the
+// request path p, suitable for use as a metric label. Trailing slashes are
+// ignored, as handleAPI does. Paths that do not match a registered endpoint
+// are collapsed into "other" to keep label cardinality bounded.
+func (s *Server) endpointLabel(p string) string {
+	if trimmed := strings.TrimRight(p, "/"); trimmed != "" {
+		p = trimmed
 	}
+	h, _ := s.endpoints.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: p}})
+	if e, ok := h.(endpoint); ok {
+		return string(e)
+	}
+	return "other"
 }
 
-// requestID is an http HandlerFunc middleware handler that creates a request ID
-// and writes it to the response header map.
+// requestID is an http HandlerFunc middleware handler that reads the request
+// ID from the server's request ID header, generating one if it is absent, adds
+// it to the request context and writes it to the response header map.
 func (s *Server) requestID(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		request.RequestID(next).ServeHTTP(w, r)
+		id := r.Header.Get(s.requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		w.Header().Set(s.requestIDHeader, id)
+		next(w, withRequestID(r, id))
+	}
+}
+
+// requestIDKey is the request context key under which the requestID
+// middleware stores the request ID.
+type requestIDKey struct{}
+
+// withRequestID returns a shallow copy of r carrying the request ID id.
+func withRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestIDOf returns the request ID of r, or the empty string if the requestID
+// middleware has not run.
+func requestIDOf(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// limitURL is an http HandlerFunc middleware handler that rejects requests
+// whose URL, including the query string, is longer than the configured
+// maximum with 414, before any of it is parsed.
+func (s *Server) limitURL(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.maxURLLength > 0 && len(r.URL.RequestURI()) > s.maxURLLength {
+			formatJSONError(w, http.StatusRequestURITooLong, fmt.Sprintf("URL too long: at most %v bytes allowed", s.maxURLLength))
+			return
+		}
+		next(w, r)
 	}
 }
 
-// auth is an http HandlerFunc middleware handler that ensures a valid
-// X-Rh-Identity header is present in the request.
+// auth is an http HandlerFunc middleware handler that ensures the request
+// carries valid credentials, as verified by the server's Authenticator, and
+// adds the resulting identity to the request context.
 func (s *Server) auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		identity.Identify(next).ServeHTTP(w, r)
+		id, err := s.authenticator.Authenticate(r)
+		if err != nil {
+			reason := authRejectionReason(err)
+			s.appMetrics.incAuthRejections(reason)
+			s.statsd.incr("auth_rejections." + reason)
+			addLogField(r, "auth-rejection", reason)
+
+			code := http.StatusBadRequest
+			if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrUnknownIdentityType) {
+				code = http.StatusUnauthorized
+			}
+			formatJSONError(w, code, err.Error())
+			return
+		}
+		if id.Identity.OrgID != "" {
+			s.activeOrgs.add(id.Identity.OrgID)
+		}
+		next(w, r.WithContext(identity.NewContext(r.Context(), id)))
+	}
+}
+
+// rateLimit is an http HandlerFunc middleware handler that limits the request
+// rate of each org, as identified by the request identity, with the limit of
+// the identity type if it has one. Every rate limited response carries
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+// headers describing the org's bucket; requests over the limit are rejected
+// with 429 and a Retry-After header.
+func (s *Server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimiter == nil && len(s.typeRateLimiters) == 0 {
+			next(w, r)
+			return
+		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		limiter := s.orgRateLimiter(id)
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		allowed, state := limiter.allow(id.Identity.OrgID)
+		setRateLimitHeaders(w, state)
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(state.RetryAfter.Seconds())))
+			formatJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// orgRateLimiter returns the rate limiter of the org of id: that of its
+// identity type, if it has one, or the server's otherwise. It returns nil if
+// the org is not rate limited.
+func (s *Server) orgRateLimiter(id *identity.Identity) *rateLimiter {
+	if id.Identity.Type != nil {
+		if l, ok := s.typeRateLimiters[*id.Identity.Type]; ok {
+			return l
+		}
+	}
+	return s.rateLimiter
+}
+
+// setRateLimitHeaders describes the rate limit bucket state of an org in the
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers.
+func setRateLimitHeaders(w http.ResponseWriter, state rateLimitState) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(state.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(state.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(state.Reset.Unix(), 10))
+}
+
+// authRejectionReason classifies an error returned by an Authenticator for use
+// as a metric label and log field.
+func authRejectionReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNoCredentials):
+		return "missing_credentials"
+	case errors.Is(err, ErrInvalidToken):
+		return "invalid_token"
+	case errors.Is(err, ErrUnknownIdentityType):
+		return "unknown_identity_type"
+	case errors.Is(err, identity.ErrInvalidIdentityHeader):
+		return "invalid_identity"
+	default:
+		return "invalid_credentials"
 	}
 }
 
 // metrics is an http HandlerFunc middleware handler that creates and enables
 // a metrics recorder.
 func (s *Server) metrics(next http.HandlerFunc) http.HandlerFunc {
+	recorder := s.recorder
+	if s.statsd != nil {
+		recorder = multiRecorder{recorder, s.statsd}
+	}
 	m := middleware.New(middleware.Config{
-		Recorder: r,
+		Recorder: recorder,
 	})
 	return func(w http.ResponseWriter, r *http.Request) {
 		m.Handler("", http.Handler(next)).ServeHTTP(w, r)
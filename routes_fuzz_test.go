@@ -0,0 +1,72 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newFuzzServer bootstraps a server backed by a seeded in-memory database.
+func newFuzzServer(f *testing.F) *Server {
+	db, err := Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err := db.Migrate(false); err != nil {
+		f.Fatal(err)
+	}
+	if err := db.seedData([]byte(`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)); err != nil {
+		f.Fatal(err)
+	}
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// fuzzRequest sends a request to srv with the given raw query and identity
+// document and fails t if the handler panics or writes an invalid status.
+func fuzzRequest(t *testing.T, srv *Server, method, path, query, identity string) {
+	req := httptest.NewRequest(method, path, nil)
+	req.URL.RawQuery = query
+	req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(identity)))
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	if rr.Code < 100 || rr.Code > 599 || http.StatusText(rr.Code) == "" {
+		t.Errorf("invalid status code: %v", rr.Code)
+	}
+}
+
+func FuzzHandleChannel(f *testing.F) {
+	srv := newFuzzServer(f)
+
+	f.Add("module=insights-core", `{ "identity": { "org_id": "1979710", "type": "User" } }`)
+	f.Add("module=", `{ "identity": { "org_id": "" } }`)
+	f.Add("module=%zz", `{}`)
+	f.Add("", `null`)
+
+	f.Fuzz(func(t *testing.T, query, identity string) {
+		fuzzRequest(t, srv, http.MethodGet, "/api/module-update-router/v1/channel", query, identity)
+	})
+}
+
+func FuzzHandleEvent(f *testing.F) {
+	srv := newFuzzServer(f)
+
+	f.Add("limit=1&offset=1", `{ "identity": { "org_id": "1979710", "type": "Associate" } }`)
+	f.Add("limit=-5&offset=-1", `{ "identity": { "org_id": "1979710", "type": "Associate" } }`)
+	f.Add("limit=9223372036854775808", `{ "identity": { "org_id": "1979710", "type": "Associate" } }`)
+	f.Add("offset=1", `{ "identity": { "org_id": "1979710" } }`)
+	f.Add("%", `{ "identity": null }`)
+
+	f.Fuzz(func(t *testing.T, query, identity string) {
+		fuzzRequest(t, srv, http.MethodGet, "/api/module-update-router/v1/event", query, identity)
+	})
+}
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhatinsights/module-update-router/internal/config"
+	log "github.com/sirupsen/logrus"
 )
 
 func TestRouter(t *testing.T) {
@@ -30,6 +44,16 @@ func TestRouter(t *testing.T) {
 			input: request{http.MethodGet, "/ping", "", nil},
 			want:  response{http.StatusOK, "OK"},
 		},
+		{
+			desc:  "HEAD /ping - want OK",
+			input: request{http.MethodHead, "/ping", "", nil},
+			want:  response{http.StatusOK, "OK"},
+		},
+		{
+			desc:  "POST /ping - want 405",
+			input: request{http.MethodPost, "/ping", "", nil},
+			want:  response{http.StatusMethodNotAllowed, `{"errors":[{"status":"Method Not Allowed","title":"error: 'POST' not allowed"}]}`},
+		},
 		{
 			desc:  "GET /channel - want /testing",
 			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
@@ -40,6 +64,26 @@ func TestRouter(t *testing.T) {
 			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979711", "account_number": "540156", "type": "User", "internal": { "org_id": "1979711" } } }`))}},
 			want:  response{http.StatusOK, `{"url":"/release"}`},
 		},
+		{
+			desc:  "GET /channel - missing module",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"missing required parameter: 'module'"}]}`},
+		},
+		{
+			desc:  "GET /channel - empty module",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"empty parameter: 'module'"}]}`},
+		},
+		{
+			desc:  "GET /channel - module with control characters",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core%0Afake=entry", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid parameter: 'module' must be valid UTF-8 without control characters"}]}`},
+		},
+		{
+			desc:  "GET /channel - module with invalid UTF-8",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core%FF", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid parameter: 'module' must be valid UTF-8 without control characters"}]}`},
+		},
 		{
 			desc:  "POST /event - want CREATED",
 			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03-04:00", "exit": 1, "exception": "OSPermissionError", "ended_at": "2020-06-19T11:19:03-04:00", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156", "core_path": "/etc/rpm/insights.egg"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
@@ -105,6 +149,70 @@ func TestRouter(t *testing.T) {
 				body: `[{"core_path":"/var/lib/insights/latest.egg","core_version":"3.0.156","ended_at":"2020-07-21T13:02:31Z","event_id":"89d9352c-0f53-49c0-9f7c-27a9ee3e2dff","exception":"OSError","exit":1,"machine_id":"21f3e7da-6e33-41dd-b25f-0eab2242ae27","phase":"pre_update","started_at":"2020-07-21T13:01:04Z"}]`,
 			},
 		},
+		{
+			desc: "GET /event - ndjson",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event",
+				body:   ``,
+				headers: map[string]string{
+					"Accept":        "application/x-ndjson",
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusOK,
+				body: `{"core_path":"/etc/insights-client/rpm.egg","core_version":"3.0.156","ended_at":"2020-07-15T17:17:37Z","event_id":"af3b8e13-6b65-45d8-8310-a45e0821bd62","exit":1,"machine_id":"a9ab0a44-1241-43ae-9c02-1850acf0c36c","phase":"pre_update","started_at":"2020-06-19T11:18:03Z"}
+{"core_path":"/var/lib/insights/latest.egg","core_version":"3.0.156","ended_at":"2020-07-21T13:02:31Z","event_id":"89d9352c-0f53-49c0-9f7c-27a9ee3e2dff","exception":"OSError","exit":1,"machine_id":"21f3e7da-6e33-41dd-b25f-0eab2242ae27","phase":"pre_update","started_at":"2020-07-21T13:01:04Z"}
+`,
+			},
+		},
+		{
+			desc: "GET /event - ndjson, limit 1, offset 2",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?offset=2&limit=1",
+				body:   ``,
+				headers: map[string]string{
+					"Accept":        "application/x-ndjson",
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusOK,
+				body: ``,
+			},
+		},
+		{
+			desc: "GET /event - negative offset",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?offset=-1&limit=1",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"status":"Bad Request","title":"invalid parameter: 'offset' must not be negative"}]}`,
+			},
+		},
+		{
+			desc: "GET /event - missing identity type",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155" } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusUnauthorized,
+				body: `{"errors":[{"status":"Unauthorized","title":""}]}`,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -151,3 +259,3114 @@ func TestRouter(t *testing.T) {
 		})
 	}
 }
+
+// newTestServer bootstraps a server backed by an in-memory database seeded
+// with the given SQL statements.
+func newTestServer(t *testing.T, seeds ...string) *Server {
+	t.Helper()
+	db, err := Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, seed := range seeds {
+		if err := db.seedData([]byte(seed)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestTrustedOrgIDHeader(t *testing.T) {
+	type request struct {
+		remoteAddr string
+		headers    map[string]string
+	}
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input request
+		want  response
+	}{
+		{
+			desc:  "trusted network - want /testing",
+			input: request{"10.0.0.1:41234", map[string]string{"X-Org-Id": "1979710"}},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "untrusted network - want missing X-Rh-Identity",
+			input: request{"192.0.2.1:41234", map[string]string{"X-Org-Id": "1979710"}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"missing X-Rh-Identity header"}]}`},
+		},
+		{
+			desc:  "trusted network, X-Rh-Identity - want /release",
+			input: request{"10.0.0.1:41234", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979711", "type": "User" } }`))}},
+			want:  response{http.StatusOK, `{"url":"/release"}`},
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.TrustOrgIDHeader = true
+	config.DefaultConfig.TrustedNetworks = "10.0.0.0/8"
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.RemoteAddr = test.input.remoteAddr
+			for k, v := range test.input.headers {
+				req.Header.Add(k, v)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPollAfter(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ orgID, module string }
+		want  string
+	}{
+		{
+			desc:  "testing channel",
+			input: struct{ orgID, module string }{"1979710", "insights-core"},
+			want:  `{"url":"/testing","poll_after":630}`,
+		},
+		{
+			desc:  "release channel omitted",
+			input: struct{ orgID, module string }{"1979711", "insights-core"},
+			want:  `{"url":"/release"}`,
+		},
+		{
+			desc:  "module default channel",
+			input: struct{ orgID, module string }{"1979711", "modbar"},
+			want:  `{"url":"/beta","poll_after":330}`,
+		},
+		{
+			desc:  "preview channel",
+			input: struct{ orgID, module string }{"1979712", "insights-core"},
+			want:  `{"url":"/preview","poll_after":90}`,
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.PollAfter = "/testing=600,beta=300,/preview=60"
+	config.DefaultConfig.PollAfterJitter = 60
+	config.DefaultConfig.PreviewOrgs = "1979712"
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+				`INSERT INTO modules_default_channels (module_name, channel) VALUES ('modbar', '/beta');`,
+			)
+			defer srv.Close()
+			srv.rand = fixedRand(0.5)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module="+test.input.module, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "`+test.input.orgID+`", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChannelExpiresAt(t *testing.T) {
+	type input struct {
+		enabled  bool
+		accept   string
+		cacheTTL time.Duration
+		seed     string
+	}
+	tests := []struct {
+		desc  string
+		input input
+		want  string
+	}{
+		{
+			desc:  "disabled",
+			input: input{cacheTTL: 5 * time.Minute},
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "enabled by config",
+			input: input{enabled: true, cacheTTL: 5 * time.Minute},
+			want:  `{"url":"/testing","expires_at":"2026-10-16T09:05:00Z"}`,
+		},
+		{
+			desc:  "enabled by accept version",
+			input: input{accept: "text/plain, application/json; version=2", cacheTTL: 5 * time.Minute},
+			want:  `{"url":"/testing","expires_at":"2026-10-16T09:05:00Z"}`,
+		},
+		{
+			desc:  "other accept version",
+			input: input{accept: "application/json; version=1", cacheTTL: 5 * time.Minute},
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "module ttl",
+			input: input{enabled: true, cacheTTL: 5 * time.Minute, seed: `INSERT INTO modules_cache_ttls (module_name, ttl_seconds) VALUES ('insights-core', 60);`},
+			want:  `{"url":"/testing","expires_at":"2026-10-16T09:01:00Z"}`,
+		},
+		{
+			desc:  "zero ttl omitted",
+			input: input{enabled: true},
+			want:  `{"url":"/testing"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.ChannelExpiresAt = test.input.enabled
+			config.DefaultConfig.ChannelCacheTTL = test.input.cacheTTL
+
+			seeds := []string{`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`}
+			if test.input.seed != "" {
+				seeds = append(seeds, test.input.seed)
+			}
+			srv := newTestServer(t, seeds...)
+			defer srv.Close()
+			srv.clock = fixedClock(time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			if test.input.accept != "" {
+				req.Header.Set("Accept", test.input.accept)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChannelDualSchema(t *testing.T) {
+	type input struct {
+		dual   bool
+		sunset string
+	}
+	type response struct {
+		body   string
+		sunset string
+	}
+	tests := []struct {
+		desc  string
+		input input
+		want  response
+	}{
+		{
+			desc:  "disabled",
+			input: input{sunset: "2026-11-01T00:00:00Z"},
+			want:  response{body: `{"url":"/testing"}`},
+		},
+		{
+			desc:  "dual",
+			input: input{dual: true},
+			want:  response{body: `{"url":"/testing","channel":"testing","location":"/testing"}`},
+		},
+		{
+			desc:  "before sunset",
+			input: input{dual: true, sunset: "2026-11-01T00:00:00Z"},
+			want:  response{body: `{"url":"/testing","channel":"testing","location":"/testing"}`, sunset: "Sun, 01 Nov 2026 00:00:00 GMT"},
+		},
+		{
+			desc:  "after sunset",
+			input: input{dual: true, sunset: "2026-10-16T09:00:00Z"},
+			want:  response{body: `{"channel":"testing","location":"/testing"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.ChannelDualSchema = test.input.dual
+			config.DefaultConfig.ChannelURLSunset = test.input.sunset
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+			srv.clock = fixedClock(time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{body: rr.Body.String(), sunset: rr.Header().Get("Sunset")}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+func TestOrgURL(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ orgID, path string }
+		want  string
+	}{
+		{
+			desc:  "channel with org url",
+			input: struct{ orgID, path string }{"1979710", "/channel?module=insights-core"},
+			want:  `{"url":"https://updates.example.com/insights-core"}`,
+		},
+		{
+			desc:  "channel without org url",
+			input: struct{ orgID, path string }{"1979711", "/channel?module=insights-core"},
+			want:  `{"url":"https://release.example.com"}`,
+		},
+		{
+			desc:  "channel of other module",
+			input: struct{ orgID, path string }{"1979710", "/channel?module=compliance"},
+			want:  `{"url":"https://release.example.com"}`,
+		},
+		{
+			desc:  "channels",
+			input: struct{ orgID, path string }{"1979710", "/channels?module=insights-core&module=compliance"},
+			want:  `[{"module":"insights-core","status":"ok","url":"https://updates.example.com/insights-core"},{"module":"compliance","status":"ok","url":"https://release.example.com"}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.ReleaseMirrors = "https://release.example.com=1"
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules_urls (module_name, org_id, url) VALUES ('insights-core', '1979710', 'https://updates.example.com/insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1"+test.input.path, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "`+test.input.orgID+`", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEndpointLabel(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"/api/module-update-router/v1/channel", "channel"},
+		{"/api/module-update-router/v1/channel/", "channel"},
+		{"/api/module-update-router/v1/channels", "channels"},
+		{"/api/module-update-router/v1/manifest", "manifest"},
+		{"/api/module-update-router/v1/event", "event"},
+		{"/api/module-update-router/v1/event/stats", "event/stats"},
+		{"/api/module-update-router/v1/event/c0ffee", "event/{id}"},
+		{"/api/module-update-router/v1/admin/drain", "admin/drain"},
+		{"/api/module-update-router/v1/admin/unknown", "other"},
+		{"/api/module-update-router/v1/unknown", "other"},
+		{"/api/module-update-router/v1/", "other"},
+		{"/ping", "other"},
+		{"", "other"},
+	}
+
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			if got := srv.endpointLabel(test.input); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRouteByVersion(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "new client - want /testing",
+			input: "insights-client/3.1.7 (Core 3.0.250; requests 2.6.0)",
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "old client - want /release",
+			input: "insights-client/2.9.0 (Core 3.0.250; requests 2.6.0)",
+			want:  `{"url":"/release"}`,
+		},
+		{
+			desc:  "unparseable User-Agent - want /testing",
+			input: "curl/7.76.1",
+			want:  `{"url":"/testing"}`,
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.RouteByVersion = true
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+				`INSERT INTO modules_client_versions (module_name, min_version) VALUES ('insights-core', '3.0');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			req.Header.Add("User-Agent", test.input)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAdminChannel(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input struct{ url, identity string }
+		want  response
+	}{
+		{
+			desc: "associate, multiple orgs",
+			input: struct{ url, identity string }{
+				url:      "/api/module-update-router/v1/admin/channel?module=insights-core&org_id=1979710&org_id=1979711",
+				identity: `{ "identity": { "org_id": "1", "type": "Associate" } }`,
+			},
+			want: response{http.StatusOK, `[{"org_id":"1979710","url":"/testing"},{"org_id":"1979711","url":"https://mirror.example.com/release"}]`},
+		},
+		{
+			desc: "associate, preview, org URL and mirror",
+			input: struct{ url, identity string }{
+				url:      "/api/module-update-router/v1/admin/channel?module=insights-core&org_id=540155&org_id=6089719&org_id=1979711",
+				identity: `{ "identity": { "org_id": "1", "type": "Associate" } }`,
+			},
+			want: response{http.StatusOK, `[{"org_id":"540155","url":"/preview"},{"org_id":"6089719","url":"https://updates.example.com/insights-core"},{"org_id":"1979711","url":"https://mirror.example.com/release"}]`},
+		},
+		{
+			desc: "associate, missing org_id",
+			input: struct{ url, identity string }{
+				url:      "/api/module-update-router/v1/admin/channel?module=insights-core",
+				identity: `{ "identity": { "org_id": "1", "type": "Associate" } }`,
+			},
+			want: response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"missing required parameter: 'org_id'"}]}`},
+		},
+		{
+			desc: "user",
+			input: struct{ url, identity string }{
+				url:      "/api/module-update-router/v1/admin/channel?module=insights-core&org_id=1979710",
+				identity: `{ "identity": { "org_id": "1979711", "type": "User" } }`,
+			},
+			want: response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":""}]}`},
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.PreviewOrgs = "540155"
+	config.DefaultConfig.ReleaseMirrors = "https://mirror.example.com/release"
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+				`INSERT INTO orgs_modules_urls (module_name, org_id, url) VALUES ('insights-core', '6089719', 'https://updates.example.com/insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, test.input.url, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(test.input.identity)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventContentEncoding(t *testing.T) {
+	gzipped := func(s string) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	event := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156", "core_path": "/etc/rpm/insights.egg"}`
+
+	tests := []struct {
+		desc  string
+		input struct{ encoding, body string }
+		want  int
+	}{
+		{
+			desc:  "gzip",
+			input: struct{ encoding, body string }{"gzip", gzipped(event)},
+			want:  http.StatusCreated,
+		},
+		{
+			desc:  "invalid gzip",
+			input: struct{ encoding, body string }{"gzip", event},
+			want:  http.StatusBadRequest,
+		},
+		{
+			desc:  "unsupported encoding",
+			input: struct{ encoding, body string }{"br", event},
+			want:  http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:  "decoded body too large",
+			input: struct{ encoding, body string }{"gzip", gzipped(strings.Repeat(" ", 1024) + event)},
+			want:  http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.MaxEventBodySize = 1024
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(test.input.body))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			req.Header.Add("Content-Encoding", test.input.encoding)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != test.want {
+				t.Errorf("%v != %v", rr.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestDefaultModule(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "module absent - want default",
+			input: "/api/module-update-router/v1/channel",
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "module present",
+			input: "/api/module-update-router/v1/channel?module=modfoo",
+			want:  `{"url":"/release"}`,
+		},
+		{
+			desc:  "module empty - want error",
+			input: "/api/module-update-router/v1/channel?module=",
+			want:  `{"errors":[{"status":"Bad Request","title":"empty parameter: 'module'"}]}`,
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.DefaultModule = "insights-core"
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, test.input, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDBMaintenance(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	do := func(method string, identity string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/module-update-router/v1/admin/db/maintenance", nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(identity)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+	associate := `{ "identity": { "org_id": "1", "type": "Associate" } }`
+
+	if rr := do(http.MethodPost, `{ "identity": { "org_id": "1979710", "type": "User" } }`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("%v != %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := do(http.MethodGet, associate); rr.Body.String() != `{"state":"idle"}` {
+		t.Fatalf("%v != %v", rr.Body.String(), `{"state":"idle"}`)
+	}
+	if rr := do(http.MethodPost, associate); rr.Code != http.StatusAccepted {
+		t.Fatalf("%v != %v", rr.Code, http.StatusAccepted)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := do(http.MethodGet, associate)
+		if strings.Contains(rr.Body.String(), `"state":"succeeded"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("maintenance did not succeed: %v", rr.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	type request struct {
+		redirect bool
+		path     string
+	}
+	type response struct {
+		code     int
+		location string
+		body     string
+	}
+
+	tests := []struct {
+		desc  string
+		input request
+		want  response
+	}{
+		{
+			desc:  "canonical",
+			input: request{false, "/api/module-update-router/v1/channel?module=insights-core"},
+			want:  response{http.StatusOK, "", `{"url":"/testing"}`},
+		},
+		{
+			desc:  "trailing slash - want served",
+			input: request{false, "/api/module-update-router/v1/channel/?module=insights-core"},
+			want:  response{http.StatusOK, "", `{"url":"/testing"}`},
+		},
+		{
+			desc:  "canonical with redirect",
+			input: request{true, "/api/module-update-router/v1/channel?module=insights-core"},
+			want:  response{http.StatusOK, "", `{"url":"/testing"}`},
+		},
+		{
+			desc:  "trailing slash - want redirect",
+			input: request{true, "/api/module-update-router/v1/channel/?module=insights-core"},
+			want:  response{http.StatusMovedPermanently, "/api/module-update-router/v1/channel?module=insights-core", ""},
+		},
+		{
+			desc:  "API root - want not found",
+			input: request{true, "/api/module-update-router/v1/"},
+			want:  response{http.StatusNotFound, "", "404 page not found\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.RedirectTrailingSlash = test.input.redirect
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, test.input.path, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Header().Get("Location"), rr.Body.String()}
+			if got.code == http.StatusMovedPermanently {
+				got.body = ""
+			}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	type response struct {
+		code      int
+		remaining string
+		body      string
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.RateLimit = 1
+	config.DefaultConfig.RateLimitBurst = 1
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	want := []response{
+		{http.StatusOK, "0", `{"url":"/testing"}`},
+		{http.StatusTooManyRequests, "0", `{"errors":[{"status":"Too Many Requests","title":"rate limit exceeded"}]}`},
+	}
+	for i, want := range want {
+		req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		got := response{rr.Code, rr.Header().Get("X-RateLimit-Remaining"), rr.Body.String()}
+
+		if !cmp.Equal(got, want, cmp.AllowUnexported(response{})) {
+			t.Errorf("request %v\ngot:  %+v\nwant: %+v", i, got, want)
+		}
+		if rr.Header().Get("X-RateLimit-Limit") != "1" || rr.Header().Get("X-RateLimit-Reset") == "" {
+			t.Errorf("request %v: missing rate limit headers: %v", i, rr.Header())
+		}
+	}
+}
+
+func TestTypeRateLimits(t *testing.T) {
+	type response struct {
+		code      int
+		remaining string
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.RateLimit = 1
+	config.DefaultConfig.RateLimitBurst = 1
+	config.DefaultConfig.TypeRateLimits = "User=1:2,System=0"
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	tests := []struct {
+		desc  string
+		input string
+		want  []response
+	}{
+		{
+			desc:  "type limit",
+			input: "User",
+			want:  []response{{http.StatusOK, "1"}, {http.StatusOK, "0"}, {http.StatusTooManyRequests, "0"}},
+		},
+		{
+			desc:  "exempt type",
+			input: "System",
+			want:  []response{{http.StatusOK, ""}, {http.StatusOK, ""}, {http.StatusOK, ""}},
+		},
+		{
+			desc:  "default limit",
+			input: "Associate",
+			want:  []response{{http.StatusOK, "0"}, {http.StatusTooManyRequests, "0"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			for i, want := range test.want {
+				req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+				req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "`+test.input+`" } }`)))
+				rr := httptest.NewRecorder()
+				srv.ServeHTTP(rr, req)
+				got := response{rr.Code, rr.Header().Get("X-RateLimit-Remaining")}
+
+				if !cmp.Equal(got, want, cmp.AllowUnexported(response{})) {
+					t.Errorf("request %v\ngot:  %+v\nwant: %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChannelDecisionsByIdentityType(t *testing.T) {
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "user",
+			input: `"type": "User"`,
+			want:  "User",
+		},
+		{
+			desc:  "system",
+			input: `"type": "System"`,
+			want:  "System",
+		},
+		{
+			desc:  "unknown type",
+			input: `"type": "Partner"`,
+			want:  "other",
+		},
+		{
+			desc:  "no type",
+			input: `"account_number": "540155"`,
+			want:  "none",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			counter := srv.appMetrics.channelDecisions.With(prometheus.Labels{"channel": "/testing", "identity_type": test.want})
+			before := testutil.ToFloat64(counter)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", `+test.input+` } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%v != %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+			}
+
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("want 1 decision counted, got %v", got)
+			}
+		})
+	}
+}
+
+func TestDisabledEndpoints(t *testing.T) {
+	type request struct {
+		enableChannel bool
+		enableEvent   bool
+		path          string
+	}
+
+	tests := []struct {
+		desc  string
+		input request
+		want  int
+	}{
+		{
+			desc:  "channel enabled",
+			input: request{true, false, "/api/module-update-router/v1/channel?module=insights-core"},
+			want:  http.StatusOK,
+		},
+		{
+			desc:  "channel disabled",
+			input: request{false, true, "/api/module-update-router/v1/channel?module=insights-core"},
+			want:  http.StatusNotFound,
+		},
+		{
+			desc:  "event enabled",
+			input: request{false, true, "/api/module-update-router/v1/event"},
+			want:  http.StatusOK,
+		},
+		{
+			desc:  "event disabled",
+			input: request{true, false, "/api/module-update-router/v1/event"},
+			want:  http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.EnableChannel = test.input.enableChannel
+			config.DefaultConfig.EnableEvent = test.input.enableEvent
+
+			srv := newTestServer(t)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, test.input.path, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != test.want {
+				t.Errorf("%v != %v", rr.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestEventTraceContext(t *testing.T) {
+	event := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	want := queuedEvent{
+		Event: Event{
+			Phase:       "pre_update",
+			StartedAt:   time.Date(2020, time.June, 19, 11, 18, 3, 0, time.UTC),
+			EndedAt:     time.Date(2020, time.June, 19, 11, 19, 3, 0, time.UTC),
+			MachineID:   "60654767-dfba-47af-8bca-cb2d1d01d9a6",
+			CoreVersion: "3.0.156",
+		},
+		EnqueuedAt: now,
+	}
+
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "valid traceparent",
+			input: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			desc:  "invalid traceparent",
+			input: "invalid",
+			want:  "",
+		},
+		{
+			desc:  "no traceparent",
+			input: "",
+			want:  "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			db, err := Open("sqlite3", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Migrate(false); err != nil {
+				t.Fatal(err)
+			}
+			events := make(chan queuedEvent, 1)
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, &events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			srv.clock = fixedClock(now)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(event))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			if test.input != "" {
+				req.Header.Add("traceparent", test.input)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("%v != %v", rr.Code, http.StatusCreated)
+			}
+			select {
+			case got := <-events:
+				want := want
+				want.Traceparent = test.want
+				if !cmp.Equal(got, want) {
+					t.Errorf("%v", cmp.Diff(got, want))
+				}
+			default:
+				t.Errorf("no event queued")
+			}
+		})
+	}
+}
+
+func TestEventSource(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.EventSources = "insights-client, rhc"
+
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc   string
+		body   string
+		header string
+		want   response
+		source string
+	}{
+		{
+			desc:   "source field",
+			body:   `"source": "rhc"`,
+			want:   response{code: http.StatusCreated},
+			source: "rhc",
+		},
+		{
+			desc:   "source header",
+			header: "insights-client",
+			want:   response{code: http.StatusCreated},
+			source: "insights-client",
+		},
+		{
+			desc:   "field takes precedence",
+			body:   `"source": "rhc"`,
+			header: "insights-client",
+			want:   response{code: http.StatusCreated},
+			source: "rhc",
+		},
+		{
+			desc: "no source",
+			want: response{code: http.StatusCreated},
+		},
+		{
+			desc:   "unknown source",
+			header: "yggdrasil",
+			want: response{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"status":"Bad Request","title":"invalid field: unknown source 'yggdrasil'"}]}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			db, err := Open("sqlite3", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Migrate(false); err != nil {
+				t.Fatal(err)
+			}
+			events := make(chan queuedEvent, 1)
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, &events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+
+			body := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"`
+			if test.body != "" {
+				body += ", " + test.body
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(body+"}"))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			if test.header != "" {
+				req.Header.Add("X-Event-Source", test.header)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{
+				code: rr.Code,
+				body: strings.TrimSpace(rr.Body.String()),
+			}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Fatalf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+			if got.code != http.StatusCreated {
+				return
+			}
+			select {
+			case e := <-events:
+				if e.Event.Source != test.source {
+					t.Errorf("%v != %v", e.Event.Source, test.source)
+				}
+			default:
+				t.Errorf("no event queued")
+			}
+		})
+	}
+}
+
+func TestEventBufferHighWater(t *testing.T) {
+	type response struct {
+		code       int
+		retryAfter string
+		body       string
+	}
+
+	tests := []struct {
+		desc  string
+		input struct {
+			highWater float64
+			queued    int
+		}
+		want response
+	}{
+		{
+			desc: "disabled",
+			input: struct {
+				highWater float64
+				queued    int
+			}{0, 3},
+			want: response{http.StatusCreated, "", ""},
+		},
+		{
+			desc: "below high-water mark",
+			input: struct {
+				highWater float64
+				queued    int
+			}{0.75, 2},
+			want: response{http.StatusCreated, "", ""},
+		},
+		{
+			desc: "at high-water mark",
+			input: struct {
+				highWater float64
+				queued    int
+			}{0.75, 3},
+			want: response{http.StatusServiceUnavailable, "5", `{"errors":[{"status":"Service Unavailable","title":"event buffer full; retry later"}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.EventBufferHighWater = test.input.highWater
+
+			db, err := Open("sqlite3", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Migrate(false); err != nil {
+				t.Fatal(err)
+			}
+			events := make(chan queuedEvent, 4)
+			for i := 0; i < test.input.queued; i++ {
+				events <- queuedEvent{}
+			}
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, &events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+
+			body := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(body))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, rr.Header().Get("Retry-After"), strings.TrimSpace(rr.Body.String())}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+// pipeListener is a net.Listener accepting the server ends of net.Pipe
+// connections sent on conns.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// dial returns the client end of a connection accepted by l.
+func (l *pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func TestEventWriteTimeout(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+	}{
+		{
+			desc:  "json",
+			input: "application/json",
+		},
+		{
+			desc:  "ndjson",
+			input: "application/x-ndjson",
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.WriteTimeout = 50 * time.Millisecond
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t, `WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 500)
+INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path)
+SELECT printf('00000000-0000-0000-0000-%012d', i), 'pre_update', '2020-06-19T11:18:03Z', 1, NULL, '2020-07-15T17:17:37Z', 'a9ab0a44-1241-43ae-9c02-1850acf0c36c', '3.0.156', '/etc/insights-client/rpm.egg' FROM n;`)
+			defer srv.Close()
+
+			ln := newPipeListener()
+			defer ln.Close()
+			go srv.Serve(ln)
+
+			timeouts := func() float64 {
+				return testutil.ToFloat64(srv.appMetrics.writeTimeouts.With(prometheus.Labels{"endpoint": "event"}))
+			}
+			before := timeouts()
+
+			// The client sends its request and never reads the response.
+			conn := ln.dial()
+			defer conn.Close()
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/api/module-update-router/v1/event", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Add("Accept", test.input)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			go req.Write(conn)
+
+			// The timeout is counted once the handler's blocked write fails
+			// and the handler returns.
+			for deadline := time.Now().Add(5 * time.Second); timeouts() == before; {
+				if time.Now().After(deadline) {
+					t.Fatal("handler did not return")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestEventSendMetrics(t *testing.T) {
+	// sendWaits returns the number of sends observed by the
+	// event_send_wait_seconds histogram gathered from g.
+	sendWaits := func(g prometheus.Gatherer) uint64 {
+		families, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n uint64
+		for _, family := range families {
+			if strings.HasSuffix(family.GetName(), "event_send_wait_seconds") {
+				for _, m := range family.GetMetric() {
+					n += m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		desc        string
+		input       int
+		wantDropped float64
+	}{
+		{
+			desc:        "sent",
+			input:       0,
+			wantDropped: 0,
+		},
+		{
+			desc:        "buffer full",
+			input:       1,
+			wantDropped: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			db, err := Open("sqlite3", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Migrate(false); err != nil {
+				t.Fatal(err)
+			}
+			events := make(chan queuedEvent, 1)
+			for i := 0; i < test.input; i++ {
+				events <- queuedEvent{}
+			}
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, &events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+
+			waitsBefore, droppedBefore := sendWaits(srv.registry), testutil.ToFloat64(srv.appMetrics.eventsDropped)
+			body := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(body))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusCreated {
+				t.Errorf("%v != %v", rr.Code, http.StatusCreated)
+			}
+			if got := sendWaits(srv.registry) - waitsBefore; got != 1 {
+				t.Errorf("send waits: %v != 1", got)
+			}
+			if got := testutil.ToFloat64(srv.appMetrics.eventsDropped) - droppedBefore; got != test.wantDropped {
+				t.Errorf("dropped: %v != %v", got, test.wantDropped)
+			}
+		})
+	}
+}
+
+func TestAdminWarning(t *testing.T) {
+	type response struct {
+		code    int
+		warning string
+		body    string
+	}
+
+	tests := []struct {
+		desc   string
+		method string
+		body   string
+		want   response
+	}{
+		{
+			desc:   "get configured",
+			method: http.MethodGet,
+			want:   response{http.StatusOK, `299 - "v1 is deprecated"`, `{"message":"v1 is deprecated"}`},
+		},
+		{
+			desc:   "set",
+			method: http.MethodPut,
+			body:   `{"message": "migrate to \"v2\" by 2027-01-01"}`,
+			want:   response{http.StatusOK, `299 - "migrate to \"v2\" by 2027-01-01"`, `{"message":"migrate to \"v2\" by 2027-01-01"}`},
+		},
+		{
+			desc:   "set invalid",
+			method: http.MethodPut,
+			body:   `{"message": "line\nbreak"}`,
+			want:   response{http.StatusBadRequest, `299 - "migrate to \"v2\" by 2027-01-01"`, `{"errors":[{"status":"Bad Request","title":"invalid warning message: must be printable ASCII of at most 1024 bytes"}]}`},
+		},
+		{
+			desc:   "clear",
+			method: http.MethodDelete,
+			want:   response{http.StatusOK, "", `{"message":""}`},
+		},
+		{
+			desc:   "get cleared",
+			method: http.MethodGet,
+			want:   response{http.StatusOK, "", `{"message":""}`},
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.WarningMessage = "v1 is deprecated"
+
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/api/module-update-router/v1/admin/warning", strings.NewReader(test.body))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, rr.Header().Get("Warning"), strings.TrimSpace(rr.Body.String())}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input struct{ method, query, identityType string }
+		want  response
+	}{
+		{
+			desc:  "drain",
+			input: struct{ method, query, identityType string }{http.MethodPost, "module=insights-core&org_id=1979710&org_id=540155", "Associate"},
+			want:  response{http.StatusOK, `[{"org_id":"1979710","removed":1,"url":"/release"},{"org_id":"540155","removed":0,"url":"/release"}]`},
+		},
+		{
+			desc:  "missing org_id",
+			input: struct{ method, query, identityType string }{http.MethodPost, "module=insights-core", "Associate"},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"missing required parameter: 'org_id'"}]}`},
+		},
+		{
+			desc:  "not associate",
+			input: struct{ method, query, identityType string }{http.MethodPost, "module=insights-core&org_id=1979710", "User"},
+			want:  response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":""}]}`},
+		},
+		{
+			desc:  "not allowed",
+			input: struct{ method, query, identityType string }{http.MethodGet, "module=insights-core&org_id=1979710", "Associate"},
+			want:  response{http.StatusMethodNotAllowed, `{"errors":[{"status":"Method Not Allowed","title":"error: 'GET' not allowed"}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.ChannelCacheTTL = time.Hour
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			channel := func() string {
+				req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+				req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+				rr := httptest.NewRecorder()
+				srv.ServeHTTP(rr, req)
+				return rr.Body.String()
+			}
+			// Cache the org's rule before draining it.
+			if got, want := channel(), `{"url":"/testing"}`; got != want {
+				t.Fatalf("%v != %v", got, want)
+			}
+
+			req := httptest.NewRequest(test.input.method, "/api/module-update-router/v1/admin/drain?"+test.input.query, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "`+test.input.identityType+`" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, strings.TrimSpace(rr.Body.String())}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+			want := `{"url":"/testing"}`
+			if rr.Code == http.StatusOK {
+				want = `{"url":"/release"}`
+			}
+			if got := channel(); got != want {
+				t.Errorf("%v != %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAdminPreview(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc   string
+		method string
+		body   string
+		want   response
+	}{
+		{
+			desc:   "get configured",
+			method: http.MethodGet,
+			want:   response{http.StatusOK, `{"org_ids":["1979710","540155"]}`},
+		},
+		{
+			desc:   "set",
+			method: http.MethodPut,
+			body:   `{"org_ids": ["6089719", " 1979711 "]}`,
+			want:   response{http.StatusOK, `{"org_ids":["1979711","6089719"]}`},
+		},
+		{
+			desc:   "set invalid",
+			method: http.MethodPut,
+			body:   `{"org_ids": ["6089719", ""]}`,
+			want:   response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid org_id: must be non-empty valid UTF-8 without control characters"}]}`},
+		},
+		{
+			desc:   "get set",
+			method: http.MethodGet,
+			want:   response{http.StatusOK, `{"org_ids":["1979711","6089719"]}`},
+		},
+		{
+			desc:   "clear",
+			method: http.MethodDelete,
+			want:   response{http.StatusOK, `{"org_ids":[]}`},
+		},
+		{
+			desc:   "not allowed",
+			method: http.MethodPost,
+			want:   response{http.StatusMethodNotAllowed, `{"errors":[{"status":"Method Not Allowed","title":"error: 'POST' not allowed"}]}`},
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.PreviewOrgs = "540155, 1979710,"
+
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/api/module-update-router/v1/admin/preview", strings.NewReader(test.body))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, strings.TrimSpace(rr.Body.String())}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+func TestPreviewRouting(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "listed org with testing rule",
+			input: "1979710",
+			want:  `{"url":"/preview"}`,
+		},
+		{
+			desc:  "listed org without rule",
+			input: "540155",
+			want:  `{"url":"/preview"}`,
+		},
+		{
+			desc:  "unlisted org",
+			input: "1979711",
+			want:  `{"url":"/testing"}`,
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.PreviewOrgs = "1979710,540155"
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core'), ('1979711', 'insights-core');`)
+	defer srv.Close()
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "`+test.input+`", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWarningHeader(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.WarningMessage = "v1 is deprecated"
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	for _, p := range []string{"/api/module-update-router/v1/channel?module=insights-core", "/api/module-update-router/v1/channel?module="} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		if got, want := rr.Header().Get("Warning"), `299 - "v1 is deprecated"`; got != want {
+			t.Errorf("%v: %v != %v", p, got, want)
+		}
+	}
+
+	config.DefaultConfig.WarningMessage = "line\nbreak"
+	if _, err := NewServer(":8080", nil, srv.db, nil); !errors.Is(err, ErrInvalidWarning) {
+		t.Errorf("want %v, got %v", ErrInvalidWarning, err)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	for _, ready := range []bool{true, false, true} {
+		srv.SetReady(ready)
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		want := http.StatusOK
+		if !ready {
+			want = http.StatusServiceUnavailable
+		}
+		if rr.Code != want {
+			t.Errorf("ready %v: %v != %v", ready, rr.Code, want)
+		}
+	}
+
+	if err := srv.db.handle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("database closed: %v != %v", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestLogExcludePaths(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		wantLog bool
+	}{
+		{
+			desc:    "excluded",
+			input:   "/api/module-update-router/v1/channel?module=insights-core",
+			wantLog: false,
+		},
+		{
+			desc:    "not excluded",
+			input:   "/api/module-update-router/v1/channels?module=insights-core",
+			wantLog: true,
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.LogExcludePaths = "/api/*/v1/channel"
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest(http.MethodGet, test.input, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%v != %v", rr.Code, http.StatusOK)
+			}
+			if got := strings.Contains(buf.String(), "status=200"); got != test.wantLog {
+				t.Errorf("logged: %v != %v: %q", got, test.wantLog, buf.String())
+			}
+		})
+	}
+
+	config.DefaultConfig.LogExcludePaths = "/api/["
+	if _, err := NewServer(":8080", nil, srv.db, nil); err == nil {
+		t.Error("want error for malformed pattern, got nil")
+	}
+}
+
+func TestUnprefixedPaths(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input struct{ mode, prefix string }
+		want  response
+	}{
+		{
+			desc:  "reject",
+			input: struct{ mode, prefix string }{"reject", "/api"},
+			want:  response{http.StatusNotFound, "404 page not found\n"},
+		},
+		{
+			desc:  "serve",
+			input: struct{ mode, prefix string }{"serve", ""},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "forwarded",
+			input: struct{ mode, prefix string }{"forwarded", "/api"},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "forwarded without prefix",
+			input: struct{ mode, prefix string }{"forwarded", ""},
+			want:  response{http.StatusNotFound, "404 page not found\n"},
+		},
+		{
+			desc:  "forwarded unknown prefix",
+			input: struct{ mode, prefix string }{"forwarded", "/other"},
+			want:  response{http.StatusNotFound, "404 page not found\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.UnprefixedPaths.Value = test.input.mode
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			if test.input.prefix != "" {
+				req.Header.Add("X-Forwarded-Prefix", test.input.prefix)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProbesBypassMiddleware(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	// requestMetrics sums the request counters and histogram sample counts of
+	// the server's metrics.
+	requestMetrics := func() float64 {
+		families, err := srv.registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum float64
+		for _, family := range families {
+			if !strings.HasPrefix(family.GetName(), srv.metricsPrefix+"_") {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				sum += m.GetCounter().GetValue() + float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+		return sum
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, p := range []string{"/ping", "/readyz"} {
+		t.Run(p, func(t *testing.T) {
+			buf.Reset()
+			before := requestMetrics()
+
+			req := httptest.NewRequest(http.MethodGet, p, nil)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("%v != %v", rr.Code, http.StatusOK)
+			}
+			if id := rr.Header().Get(srv.requestIDHeader); id != "" {
+				t.Errorf("want no request ID, got %v", id)
+			}
+			if buf.Len() > 0 {
+				t.Errorf("want no log entries, got %q", buf.String())
+			}
+			if after := requestMetrics(); after != before {
+				t.Errorf("want no request metrics, got %v more", after-before)
+			}
+		})
+	}
+}
+
+func TestModuleAlias(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "alias - want canonical module",
+			input: "/api/module-update-router/v1/channel?module=core",
+			want:  `{"url":"/testing","module":"insights-core"}`,
+		},
+		{
+			desc:  "canonical",
+			input: "/api/module-update-router/v1/channel?module=insights-core",
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "unknown",
+			input: "/api/module-update-router/v1/channel?module=modfoo",
+			want:  `{"url":"/release"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+				`INSERT INTO modules_aliases (alias, module_name) VALUES ('core', 'insights-core');`,
+			)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, test.input, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCountErrorPolicy(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+
+	type response struct {
+		code int
+		body string
+	}
+	type input struct {
+		policy string
+		// closeDB closes the whole database rather than dropping the table
+		// of the routing rules.
+		closeDB bool
+	}
+	tests := []struct {
+		desc  string
+		input input
+		want  response
+	}{
+		{
+			desc:  "open",
+			input: input{policy: "open"},
+			want:  response{http.StatusOK, `{"url":"/release"}`},
+		},
+		{
+			desc:  "closed",
+			input: input{policy: "closed"},
+			want:  response{http.StatusInternalServerError, `{"errors":[{"id":"c0ffee","status":"Internal Server Error","title":"internal server error"}]}`},
+		},
+		{
+			desc:  "cached",
+			input: input{policy: "cached"},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "open, database closed",
+			input: input{policy: "open", closeDB: true},
+			want:  response{http.StatusOK, `{"url":"/release"}`},
+		},
+		{
+			desc:  "closed, database closed",
+			input: input{policy: "closed", closeDB: true},
+			want:  response{http.StatusInternalServerError, `{"errors":[{"id":"c0ffee","status":"Internal Server Error","title":"internal server error"}]}`},
+		},
+		{
+			desc:  "cached, database closed",
+			input: input{policy: "cached", closeDB: true},
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			config.DefaultConfig.CountErrorPolicy.Value = test.input.policy
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			get := func() response {
+				req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+				req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+				req.Header.Add("X-Request-Id", "c0ffee")
+				rr := httptest.NewRecorder()
+				srv.ServeHTTP(rr, req)
+				return response{rr.Code, strings.TrimSpace(rr.Body.String())}
+			}
+			if got, want := get(), (response{http.StatusOK, `{"url":"/testing"}`}); got != want {
+				t.Fatalf("before failure: %+v != %+v", got, want)
+			}
+			if test.input.closeDB {
+				if err := srv.db.handle.Close(); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, err := srv.db.handle.Exec(`DROP TABLE orgs_modules;`); err != nil {
+				t.Fatal(err)
+			}
+
+			got := get()
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+func TestLookupRuleURLError(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.ChannelCacheTTL = time.Hour
+	config.DefaultConfig.CountErrorPolicy.Value = "closed"
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	get := func() response {
+		req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return response{rr.Code, strings.TrimSpace(rr.Body.String())}
+	}
+
+	if _, err := srv.db.handle.Exec(`DROP TABLE orgs_modules_urls;`); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got.code != http.StatusInternalServerError {
+		t.Fatalf("%v != %v", got.code, http.StatusInternalServerError)
+	}
+
+	// The failed lookup must not be cached, so the URL is served once the
+	// table is back.
+	if _, err := srv.db.handle.Exec(`CREATE TABLE orgs_modules_urls (module_name VARCHAR(256), org_id VARCHAR(256), url VARCHAR(2048) NOT NULL, PRIMARY KEY(module_name, org_id));
+INSERT INTO orgs_modules_urls (module_name, org_id, url) VALUES ('insights-core', '1979710', 'https://updates.example.com/insights-core');`); err != nil {
+		t.Fatal(err)
+	}
+	want := response{http.StatusOK, `{"url":"https://updates.example.com/insights-core"}`}
+	if got := get(); !cmp.Equal(got, want, cmp.AllowUnexported(response{})) {
+		t.Errorf("%v", cmp.Diff(got, want, cmp.AllowUnexported(response{})))
+	}
+}
+
+func TestRetiredModule(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+	tests := []struct {
+		desc  string
+		input string
+		want  response
+	}{
+		{
+			desc:  "retired with replacement",
+			input: "modfoo",
+			want:  response{http.StatusGone, `{"error":"module retired","replacement":"insights-core"}`},
+		},
+		{
+			desc:  "retired alias",
+			input: "foo",
+			want:  response{http.StatusGone, `{"error":"module retired","replacement":"insights-core"}`},
+		},
+		{
+			desc:  "retired without replacement",
+			input: "modbar",
+			want:  response{http.StatusGone, `{"error":"module retired"}`},
+		},
+		{
+			desc:  "replacement",
+			input: "insights-core",
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core'), ('1979710', 'modfoo');`,
+				`INSERT INTO modules_aliases (alias, module_name) VALUES ('foo', 'modfoo');`,
+				`INSERT INTO modules_retired (module_name, replacement) VALUES ('modfoo', 'insights-core'), ('modbar', '');`,
+			)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module="+test.input, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, rr.Body.String()}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+func TestRetiredModuleCached(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.ChannelCacheTTL = time.Hour
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	get := func(orgID string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "`+orgID+`", "type": "User" } }`)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if got := get("1979710"); got != http.StatusOK {
+		t.Fatalf("%v != %v", got, http.StatusOK)
+	}
+	if _, err := srv.db.handle.Exec(`INSERT INTO modules_retired (module_name, replacement) VALUES ('insights-core', '');`); err != nil {
+		t.Fatal(err)
+	}
+	// The retired status is cached per module, so it holds for other orgs
+	// until the cache TTL expires.
+	if got := get("1979711"); got != http.StatusOK {
+		t.Errorf("%v != %v", got, http.StatusOK)
+	}
+}
+
+func TestModuleAliasCached(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.ChannelCacheTTL = time.Hour
+
+	srv := newTestServer(t,
+		`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+		`INSERT INTO modules_aliases (alias, module_name) VALUES ('core', 'insights-core');`,
+	)
+	defer srv.Close()
+
+	get := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=core", nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	if got, want := get(), `{"url":"/testing","module":"insights-core"}`; got != want {
+		t.Fatalf("%v != %v", got, want)
+	}
+	if _, err := srv.db.handle.Exec(`DELETE FROM modules_aliases;`); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(), `{"url":"/testing","module":"insights-core"}`; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestModuleDefaultChannel(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ orgID, module string }
+		want  string
+	}{
+		{
+			desc:  "rule - want /testing",
+			input: struct{ orgID, module string }{"1979710", "modbar"},
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "no rule, module default - want /beta",
+			input: struct{ orgID, module string }{"1979711", "modbar"},
+			want:  `{"url":"/beta"}`,
+		},
+		{
+			desc:  "no rule, no module default - want /release",
+			input: struct{ orgID, module string }{"1979711", "insights-core"},
+			want:  `{"url":"/release"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'modbar');`,
+				`INSERT INTO modules_default_channels (module_name, channel) VALUES ('modbar', '/beta');`,
+			)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module="+test.input.module, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "`+test.input.orgID+`", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChannelHeader(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ header, orgID string }
+		want  string
+	}{
+		{
+			desc:  "testing",
+			input: struct{ header, orgID string }{"X-Channel", "1979710"},
+			want:  "testing",
+		},
+		{
+			desc:  "release",
+			input: struct{ header, orgID string }{"X-Channel", "1979711"},
+			want:  "release",
+		},
+		{
+			desc:  "renamed",
+			input: struct{ header, orgID string }{"X-Update-Channel", "1979710"},
+			want:  "testing",
+		},
+		{
+			desc:  "disabled",
+			input: struct{ header, orgID string }{"", "1979710"},
+			want:  "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.ChannelHeader = test.input.header
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "`+test.input.orgID+`", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			header := test.input.header
+			if header == "" {
+				header = "X-Channel"
+			}
+			if got := rr.Header().Get(header); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChannels(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input string
+		want  response
+	}{
+		{
+			desc:  "several modules",
+			input: "?module=insights-core&module=compliance",
+			want:  response{http.StatusOK, `[{"module":"insights-core","status":"ok","url":"/testing"},{"module":"compliance","status":"ok","url":"/release"}]`},
+		},
+		{
+			desc:  "alias",
+			input: "?module=core",
+			want:  response{http.StatusOK, `[{"module":"core","status":"ok","url":"/testing"}]`},
+		},
+		{
+			desc:  "missing module",
+			input: "",
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"missing required parameter: 'module'"}]}`},
+		},
+		{
+			desc:  "empty module",
+			input: "?module=insights-core&module=",
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"empty parameter: 'module'"}]}`},
+		},
+		{
+			desc:  "too many modules",
+			input: "?" + strings.Repeat("module=insights-core&", maxBatchModules+1),
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"too many values for parameter 'module': at most 100 allowed"}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+				`INSERT INTO modules_aliases (alias, module_name) VALUES ('core', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channels"+test.input, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChannelsPartialFailure(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.CountErrorPolicy.Value = "closed"
+	config.DefaultConfig.ChannelCacheTTL = time.Hour
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channels"+query, nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+		req.Header.Add("X-Request-Id", "c0ffee")
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+	// Cache the rule of insights-core, so that it still resolves once its
+	// table is gone.
+	if rr := get("?module=insights-core"); rr.Code != http.StatusOK {
+		t.Fatalf("%v != %v", rr.Code, http.StatusOK)
+	}
+	if _, err := srv.db.handle.Exec(`DROP TABLE orgs_modules;`); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := get("?module=insights-core&module=compliance")
+	if rr.Code != http.StatusOK {
+		t.Errorf("%v != %v", rr.Code, http.StatusOK)
+	}
+	if got, want := rr.Body.String(), `[{"module":"insights-core","status":"ok","url":"/testing"},{"module":"compliance","status":"error","error":"internal server error"}]`; got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+	if got, want := rr.Header().Get("Warning"), warningHeader(partialChannelsWarning); got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	rr = get("?module=compliance")
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("%v != %v", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	srv := newTestServer(t,
+		`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+		`INSERT INTO modules_default_channels (module_name, channel) VALUES ('compliance', '/beta');`)
+	defer srv.Close()
+
+	get := func(orgID, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/manifest", nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "`+orgID+`", "type": "User" } }`)))
+		if ifNoneMatch != "" {
+			req.Header.Add("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr
+	}
+
+	testingChannel := get("1979710", "")
+	releaseChannel := get("1979711", "")
+	tests := []struct {
+		desc  string
+		input *httptest.ResponseRecorder
+		want  response
+	}{
+		{
+			desc:  "testing",
+			input: testingChannel,
+			want:  response{http.StatusOK, `{"modules":{"compliance":{"url":"/beta"},"insights-core":{"url":"/testing"}}}`},
+		},
+		{
+			desc:  "release",
+			input: releaseChannel,
+			want:  response{http.StatusOK, `{"modules":{"compliance":{"url":"/beta"},"insights-core":{"url":"/release"}}}`},
+		},
+		{
+			desc:  "not modified",
+			input: get("1979710", testingChannel.Header().Get("ETag")),
+			want:  response{http.StatusNotModified, ""},
+		},
+		{
+			desc:  "modified",
+			input: get("1979710", releaseChannel.Header().Get("ETag")),
+			want:  response{http.StatusOK, `{"modules":{"compliance":{"url":"/beta"},"insights-core":{"url":"/testing"}}}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := response{test.input.Code, test.input.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+			if test.input.Header().Get("ETag") == "" {
+				t.Error("missing ETag")
+			}
+		})
+	}
+}
+
+func TestDatabaseBusy(t *testing.T) {
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+	srv.db.SetMaxConns(1, 10*time.Millisecond)
+	release, err := srv.db.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+	req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("%v != %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got, want := rr.Body.String(), `{"errors":[{"status":"Service Unavailable","title":"database busy"}]}`; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("%v != %v", got, "1")
+	}
+}
+
+func TestTestingQuota(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.TestingQuota = 2
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+	clock := &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+	srv.clock = clock
+
+	tests := []struct {
+		desc  string
+		input time.Duration
+		want  string
+	}{
+		{"first", 0, `{"url":"/testing"}`},
+		{"second", 0, `{"url":"/testing"}`},
+		{"exhausted", 0, `{"url":"/release"}`},
+		{"next day", 24 * time.Hour, `{"url":"/testing"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			clock.t = clock.t.Add(test.input)
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitModuleVersion(t *testing.T) {
+	tests := []struct {
+		description string
+		input       struct{ value, delim string }
+		want        struct{ module, version string }
+	}{
+		{
+			description: "combined",
+			input:       struct{ value, delim string }{"insights-core@3.0.156", "@"},
+			want:        struct{ module, version string }{"insights-core", "3.0.156"},
+		},
+		{
+			description: "plain",
+			input:       struct{ value, delim string }{"insights-core", "@"},
+			want:        struct{ module, version string }{"insights-core", ""},
+		},
+		{
+			description: "disabled",
+			input:       struct{ value, delim string }{"insights-core@3.0.156", ""},
+			want:        struct{ module, version string }{"insights-core@3.0.156", ""},
+		},
+		{
+			description: "leading delimiter",
+			input:       struct{ value, delim string }{"@3.0.156", "@"},
+			want:        struct{ module, version string }{"@3.0.156", ""},
+		},
+		{
+			description: "multi-character delimiter",
+			input:       struct{ value, delim string }{"insights-core::3.0.156", "::"},
+			want:        struct{ module, version string }{"insights-core", "3.0.156"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			module, version := splitModuleVersion(test.input.value, test.input.delim)
+			got := struct{ module, version string }{module, version}
+
+			if got != test.want {
+				t.Errorf("%+v != %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestModuleVersion(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ query, userAgent string }
+		want  string
+	}{
+		{
+			desc:  "combined meets minimum",
+			input: struct{ query, userAgent string }{"module=insights-core@3.1.0", ""},
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "combined below minimum",
+			input: struct{ query, userAgent string }{"module=insights-core@2.9.0", "insights-client/3.1.0"},
+			want:  `{"url":"/release"}`,
+		},
+		{
+			desc:  "separate below minimum",
+			input: struct{ query, userAgent string }{"module=insights-core&version=2.9.0", "insights-client/3.1.0"},
+			want:  `{"url":"/release"}`,
+		},
+		{
+			desc:  "separate takes precedence",
+			input: struct{ query, userAgent string }{"module=insights-core@2.9.0&version=3.1.0", ""},
+			want:  `{"url":"/testing"}`,
+		},
+		{
+			desc:  "invalid suffix falls back to User-Agent",
+			input: struct{ query, userAgent string }{"module=insights-core@latest", "insights-client/2.9.0"},
+			want:  `{"url":"/release"}`,
+		},
+		{
+			desc:  "plain",
+			input: struct{ query, userAgent string }{"module=insights-core", "insights-client/3.1.0"},
+			want:  `{"url":"/testing"}`,
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.RouteByVersion = true
+	config.DefaultConfig.ModuleVersionDelim = "@"
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t,
+				`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`,
+				`INSERT INTO modules_client_versions (module_name, min_version) VALUES ('insights-core', '3.0');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?"+test.input.query, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			req.Header.Add("User-Agent", test.input.userAgent)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input string
+		want  response
+	}{
+		{
+			desc:  "within limit",
+			input: "/api/module-update-router/v1/channel?module=insights-core",
+			want:  response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:  "long query",
+			input: "/api/module-update-router/v1/channel?module=insights-core&" + strings.Repeat("x", 64),
+			want:  response{http.StatusRequestURITooLong, `{"errors":[{"status":"Request URI Too Long","title":"URL too long: at most 100 bytes allowed"}]}`},
+		},
+	}
+
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.MaxURLLength = 100
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, test.input, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventStats(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate", "internal": { "org_id": "1979710" } } }`))
+	user := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`))
+
+	tests := []struct {
+		desc  string
+		input struct{ query, identity string }
+		want  response
+	}{
+		{
+			desc:  "grouped by phase",
+			input: struct{ query, identity string }{"?group_by=phase&from=2020-07-01T00:00:00Z&to=2020-08-01T00:00:00Z", associate},
+			want:  response{http.StatusOK, `[{"key":"pre_update","count":1}]`},
+		},
+		{
+			desc:  "empty range",
+			input: struct{ query, identity string }{"?from=2021-07-01T00:00:00Z&to=2021-08-01T00:00:00Z", associate},
+			want:  response{http.StatusOK, `[]`},
+		},
+		{
+			desc:  "invalid dimension",
+			input: struct{ query, identity string }{"?group_by=machine_id", associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid parameter: 'group_by' must be one of core_version, day, exit, phase"}]}`},
+		},
+		{
+			desc:  "inverted range",
+			input: struct{ query, identity string }{"?from=2020-08-01T00:00:00Z&to=2020-07-01T00:00:00Z", associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid parameters: 'from' must be before 'to'"}]}`},
+		},
+		{
+			desc:  "not associate",
+			input: struct{ query, identity string }{"?group_by=phase", user},
+			want:  response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":""}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			if err := srv.db.InsertEvents("pre_update", time.Date(2020, 7, 15, 17, 16, 55, 0, time.UTC), 0, sql.NullString{}, time.Date(2020, 7, 15, 17, 17, 37, 0, time.UTC), "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg", ""); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/event/stats"+test.input.query, nil)
+			req.Header.Add("X-Rh-Identity", test.input.identity)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventLookback(t *testing.T) {
+	type response struct {
+		code  int
+		body  string
+		since string
+		until string
+	}
+	const (
+		first  = `{"core_path":"/etc/insights-client/rpm.egg","core_version":"3.0.156","ended_at":"2020-07-15T17:17:37Z","event_id":"af3b8e13-6b65-45d8-8310-a45e0821bd62","exit":1,"machine_id":"a9ab0a44-1241-43ae-9c02-1850acf0c36c","phase":"pre_update","started_at":"2020-06-19T11:18:03Z"}`
+		second = `{"core_path":"/var/lib/insights/latest.egg","core_version":"3.0.156","ended_at":"2020-07-21T13:02:31Z","event_id":"89d9352c-0f53-49c0-9f7c-27a9ee3e2dff","exception":"OSError","exit":1,"machine_id":"21f3e7da-6e33-41dd-b25f-0eab2242ae27","phase":"pre_update","started_at":"2020-07-21T13:01:04Z"}`
+	)
+
+	tests := []struct {
+		desc  string
+		input struct {
+			lookbackDays int
+			query        string
+		}
+		want response
+	}{
+		{
+			desc: "unlimited",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{0, ""},
+			want: response{http.StatusOK, "[" + first + "," + second + "]", "", ""},
+		},
+		{
+			desc: "unlimited, since and until",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{0, "?since=2020-06-01T00:00:00Z&until=2020-07-01T00:00:00Z"},
+			want: response{http.StatusOK, "[" + first + "]", "2020-06-01T00:00:00Z", "2020-07-01T00:00:00Z"},
+		},
+		{
+			desc: "lookback",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{30, ""},
+			want: response{http.StatusOK, "[" + second + "]", "2020-06-25T00:00:00Z", ""},
+		},
+		{
+			desc: "lookback, earlier since",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{30, "?since=2020-06-01T00:00:00Z"},
+			want: response{http.StatusOK, "[" + second + "]", "2020-06-25T00:00:00Z", ""},
+		},
+		{
+			desc: "lookback, narrower until",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{30, "?until=2020-07-01T00:00:00Z"},
+			want: response{http.StatusOK, "[]", "2020-06-25T00:00:00Z", "2020-07-01T00:00:00Z"},
+		},
+		{
+			desc: "lookback, until outside window",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{30, "?until=2020-06-20T00:00:00Z"},
+			want: response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid parameter: 'until' must be within the last 30 days"}]}`, "", ""},
+		},
+		{
+			desc: "since after until",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{0, "?since=2020-07-01T00:00:00Z&until=2020-06-01T00:00:00Z"},
+			want: response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid parameters: 'since' must be before 'until'"}]}`, "", ""},
+		},
+		{
+			desc: "invalid since",
+			input: struct {
+				lookbackDays int
+				query        string
+			}{0, "?since=yesterday"},
+			want: response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid parameter: 'since': parsing time \"yesterday\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"yesterday\" as \"2006\""}]}`, "", ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.EventMaxLookbackDays = test.input.lookbackDays
+
+			srv := newTestServer(t,
+				`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-06-19T11:18:03Z", 1, NULL, "2020-07-15T17:17:37Z", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg");`,
+				`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("89d9352c-0f53-49c0-9f7c-27a9ee3e2dff", "pre_update", "2020-07-21T13:01:04Z", 1, "OSError", "2020-07-21T13:02:31Z", "21f3e7da-6e33-41dd-b25f-0eab2242ae27", "3.0.156", "/var/lib/insights/latest.egg");`,
+			)
+			defer srv.Close()
+			srv.clock = fixedClock(time.Date(2020, 7, 25, 0, 0, 0, 0, time.UTC))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/event"+test.input.query, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String(), rr.Header().Get("X-Events-Since"), rr.Header().Get("X-Events-Until")}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventByID(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate", "internal": { "org_id": "1979710" } } }`))
+	user := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`))
+
+	tests := []struct {
+		desc  string
+		input struct{ method, id, identity string }
+		want  response
+	}{
+		{
+			desc:  "found",
+			input: struct{ method, id, identity string }{http.MethodGet, "af3b8e13-6b65-45d8-8310-a45e0821bd62", associate},
+			want:  response{http.StatusOK, `{"core_path":"/etc/insights-client/rpm.egg","core_version":"3.0.156","ended_at":"2020-07-15T17:17:37Z","event_id":"af3b8e13-6b65-45d8-8310-a45e0821bd62","exit":1,"machine_id":"a9ab0a44-1241-43ae-9c02-1850acf0c36c","phase":"pre_update","started_at":"2020-06-19T11:18:03Z"}`},
+		},
+		{
+			desc:  "missing",
+			input: struct{ method, id, identity string }{http.MethodGet, "89d9352c-0f53-49c0-9f7c-27a9ee3e2dff", associate},
+			want:  response{http.StatusNotFound, `{"errors":[{"status":"Not Found","title":"no such event"}]}`},
+		},
+		{
+			desc:  "invalid ID",
+			input: struct{ method, id, identity string }{http.MethodGet, "af3b8e13", associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","title":"invalid event ID: must be a UUID"}]}`},
+		},
+		{
+			desc:  "not associate",
+			input: struct{ method, id, identity string }{http.MethodGet, "af3b8e13-6b65-45d8-8310-a45e0821bd62", user},
+			want:  response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":""}]}`},
+		},
+		{
+			desc:  "DELETE",
+			input: struct{ method, id, identity string }{http.MethodDelete, "af3b8e13-6b65-45d8-8310-a45e0821bd62", associate},
+			want:  response{http.StatusMethodNotAllowed, `{"errors":[{"status":"Method Not Allowed","title":"error: 'DELETE' not allowed"}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			if err := srv.db.seedData([]byte(`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path)
+			VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-06-19T11:18:03Z", 1, NULL, "2020-07-15T17:17:37Z", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg");`)); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(test.input.method, "/api/module-update-router/v1/event/"+test.input.id, nil)
+			req.Header.Add("X-Rh-Identity", test.input.identity)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAcceptsNDJSON(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []string
+		want  bool
+	}{
+		{"none", nil, false},
+		{"json", []string{"application/json"}, false},
+		{"ndjson", []string{"application/x-ndjson"}, true},
+		{"list", []string{"application/json;q=0.5, Application/X-NDJSON;q=1"}, true},
+		{"repeated", []string{"application/json", "application/x-ndjson"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, v := range test.input {
+				req.Header.Add("Accept", v)
+			}
+			if got := acceptsNDJSON(req); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.ReadOnly = true
+	config.DefaultConfig.TestingQuota = 1
+
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc   string
+		method string
+		url    string
+		body   string
+		want   response
+	}{
+		{
+			desc:   "channel",
+			method: http.MethodGet,
+			url:    "/api/module-update-router/v1/channel?module=insights-core",
+			want:   response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:   "channel, quota not counted",
+			method: http.MethodGet,
+			url:    "/api/module-update-router/v1/channel?module=insights-core",
+			want:   response{http.StatusOK, `{"url":"/testing"}`},
+		},
+		{
+			desc:   "get events",
+			method: http.MethodGet,
+			url:    "/api/module-update-router/v1/event",
+			want:   response{http.StatusOK, `[]`},
+		},
+		{
+			desc:   "post event",
+			method: http.MethodPost,
+			url:    "/api/module-update-router/v1/event",
+			body:   `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`,
+			want:   response{http.StatusServiceUnavailable, `{"errors":[{"status":"Service Unavailable","title":"server is read-only"}]}`},
+		},
+		{
+			desc:   "start maintenance",
+			method: http.MethodPost,
+			url:    "/api/module-update-router/v1/admin/db/maintenance",
+			want:   response{http.StatusServiceUnavailable, `{"errors":[{"status":"Service Unavailable","title":"server is read-only"}]}`},
+		},
+	}
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, strings.TrimSpace(rr.Body.String())}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ header, value string }
+		want  string
+	}{
+		{
+			desc:  "default header",
+			input: struct{ header, value string }{"X-Request-Id", "c0ffee"},
+			want:  "c0ffee",
+		},
+		{
+			desc:  "configured header",
+			input: struct{ header, value string }{"X-Correlation-Id", "c0ffee"},
+			want:  "c0ffee",
+		},
+		{
+			desc:  "configured header absent - want generated",
+			input: struct{ header, value string }{"X-Correlation-Id", ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.RequestIDHeader = test.input.header
+			config.DefaultConfig.CountErrorPolicy.Value = "closed"
+
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+			if _, err := srv.db.handle.Exec(`DROP TABLE orgs_modules;`); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			if test.input.value != "" {
+				req.Header.Add(test.input.header, test.input.value)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := rr.Header().Get(test.input.header)
+			if test.want == "" {
+				if got == "" {
+					t.Fatalf("want generated request ID in %v", test.input.header)
+				}
+			} else if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+			var body struct {
+				Errors []struct {
+					ID string `json:"id"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Errors) != 1 || body.Errors[0].ID != got {
+				t.Errorf("%+v: want error id %v", body, got)
+			}
+		})
+	}
+}
+
+func TestNotFoundResponse(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	tests := []struct {
+		desc  string
+		input string
+		want  response
+	}{
+		{
+			desc:  "terse",
+			input: "terse",
+			want:  response{http.StatusNotFound, "404 page not found"},
+		},
+		{
+			desc:  "endpoints",
+			input: "endpoints",
+			want:  response{http.StatusNotFound, `{"errors":[{"meta":{"endpoints":["/api/module-update-router/v1/channel","/api/module-update-router/v1/channels","/api/module-update-router/v1/manifest","/api/module-update-router/v1/event","/api/module-update-router/v1/event/stats","/api/module-update-router/v1/event/","/api/module-update-router/v1/admin/channel","/api/module-update-router/v1/admin/db/maintenance","/api/module-update-router/v1/admin/drain","/api/module-update-router/v1/admin/metrics/snapshot","/api/module-update-router/v1/admin/preview","/api/module-update-router/v1/admin/selftest","/api/module-update-router/v1/admin/warning"],"version":"v1"},"status":"Not Found","title":"no such endpoint"}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+			config.DefaultConfig.NotFoundResponse.Value = test.input
+
+			srv := newTestServer(t)
+			defer srv.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/chanel", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, strings.TrimSpace(rr.Body.String())}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
+
+func TestEventLinks(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ limit, offset, total int }
+		want  string
+	}{
+		{
+			desc:  "first page",
+			input: struct{ limit, offset, total int }{2, 0, 5},
+			want:  `</event?limit=2&offset=0&source=rhc>; rel="first", </event?limit=2&offset=2&source=rhc>; rel="next", </event?limit=2&offset=4&source=rhc>; rel="last"`,
+		},
+		{
+			desc:  "middle page",
+			input: struct{ limit, offset, total int }{2, 2, 5},
+			want:  `</event?limit=2&offset=0&source=rhc>; rel="first", </event?limit=2&offset=0&source=rhc>; rel="prev", </event?limit=2&offset=4&source=rhc>; rel="next", </event?limit=2&offset=4&source=rhc>; rel="last"`,
+		},
+		{
+			desc:  "last page",
+			input: struct{ limit, offset, total int }{2, 4, 5},
+			want:  `</event?limit=2&offset=0&source=rhc>; rel="first", </event?limit=2&offset=2&source=rhc>; rel="prev", </event?limit=2&offset=4&source=rhc>; rel="last"`,
+		},
+		{
+			desc:  "unaligned offset",
+			input: struct{ limit, offset, total int }{2, 1, 5},
+			want:  `</event?limit=2&offset=0&source=rhc>; rel="first", </event?limit=2&offset=0&source=rhc>; rel="prev", </event?limit=2&offset=3&source=rhc>; rel="next", </event?limit=2&offset=4&source=rhc>; rel="last"`,
+		},
+		{
+			desc:  "empty",
+			input: struct{ limit, offset, total int }{2, 0, 0},
+			want:  `</event?limit=2&offset=0&source=rhc>; rel="first", </event?limit=2&offset=0&source=rhc>; rel="last"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			u, err := url.Parse("/event?source=rhc&limit=9&offset=9")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := eventLinks(u, test.input.limit, test.input.offset, test.input.total); got != test.want {
+				t.Errorf("\ngot:  %v\nwant: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventLinkHeader(t *testing.T) {
+	srv := newTestServer(t,
+		`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-06-19T11:18:03Z", 1, NULL, "2020-07-15T17:17:37Z", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg");`,
+		`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("89d9352c-0f53-49c0-9f7c-27a9ee3e2dff", "pre_update", "2020-07-21T13:01:04Z", 1, "OSError", "2020-07-21T13:02:31Z", "21f3e7da-6e33-41dd-b25f-0eab2242ae27", "3.0.156", "/var/lib/insights/latest.egg");`,
+	)
+	defer srv.Close()
+
+	tests := []struct {
+		desc   string
+		url    string
+		accept string
+		want   string
+	}{
+		{
+			desc: "limit",
+			url:  "/api/module-update-router/v1/event?limit=1",
+			want: `</api/module-update-router/v1/event?limit=1&offset=0>; rel="first", </api/module-update-router/v1/event?limit=1&offset=1>; rel="next", </api/module-update-router/v1/event?limit=1&offset=1>; rel="last"`,
+		},
+		{
+			desc:   "limit, ndjson",
+			url:    "/api/module-update-router/v1/event?limit=1&offset=1",
+			accept: "application/x-ndjson",
+			want:   `</api/module-update-router/v1/event?limit=1&offset=0>; rel="first", </api/module-update-router/v1/event?limit=1&offset=0>; rel="prev", </api/module-update-router/v1/event?limit=1&offset=1>; rel="last"`,
+		},
+		{
+			desc: "no limit",
+			url:  "/api/module-update-router/v1/event",
+			want: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			if test.accept != "" {
+				req.Header.Add("Accept", test.accept)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%v != %v", rr.Code, http.StatusOK)
+			}
+			if got := rr.Header().Get("Link"); got != test.want {
+				t.Errorf("\ngot:  %v\nwant: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	for _, keepAlive := range []time.Duration{0, 15 * time.Second} {
+		t.Run(keepAlive.String(), func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			srv.addr = "127.0.0.1:0"
+			srv.tcpKeepAlive = keepAlive
+
+			ln, err := srv.listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			go func() {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err == nil {
+					conn.Close()
+				}
+			}()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ method, url string }
+		want  string
+	}{
+		{
+			desc:  "ping",
+			input: struct{ method, url string }{http.MethodDelete, "/ping"},
+			want:  "GET, HEAD",
+		},
+		{
+			desc:  "readyz",
+			input: struct{ method, url string }{http.MethodPost, "/readyz"},
+			want:  "GET, HEAD",
+		},
+		{
+			desc:  "admin warning",
+			input: struct{ method, url string }{http.MethodPost, "/api/module-update-router/v1/admin/warning"},
+			want:  "GET, PUT, DELETE",
+		},
+		{
+			desc:  "event",
+			input: struct{ method, url string }{http.MethodDelete, "/api/module-update-router/v1/event"},
+			want:  "GET, POST",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+
+			req := httptest.NewRequest(test.input.method, test.input.url, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("%v != %v: %v", rr.Code, http.StatusMethodNotAllowed, rr.Body.String())
+			}
+			if got := rr.Header().Get("Allow"); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/redhatinsights/module-update-router/identity"
+	"github.com/redhatinsights/module-update-router/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// selftestStep is the outcome of one step of a self-test.
+type selftestStep struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// selftestResult is the outcome of a self-test.
+type selftestResult struct {
+	OK              bool           `json:"ok"`
+	OrgID           string         `json:"org_id"`
+	Module          string         `json:"module"`
+	Channel         string         `json:"channel,omitempty"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Steps           []selftestStep `json:"steps"`
+}
+
+// selftest resolves the channel of module for orgID as /channel does, but
+// reading every part of the routing rule from the database rather than the
+// rule cache, and without counting quota usage or notifying the webhook, so
+// that it writes nothing. Each query is run as a step, timed and checked for
+// errors; the self-test stops at the first failed step. A resolved channel
+// that is not a path is reported as a failure.
+func (s *Server) selftest(orgID, module string) selftestResult {
+	result := selftestResult{OrgID: orgID, Module: module}
+	start := s.clock.Now()
+	step := func(name string, run func() error) bool {
+		stepStart := s.clock.Now()
+		err := run()
+		st := selftestStep{Name: name, DurationSeconds: s.clock.Now().Sub(stepStart).Seconds()}
+		if err != nil {
+			st.Error = err.Error()
+		}
+		result.Steps = append(result.Steps, st)
+		return err == nil
+	}
+
+	var rule routingRule
+	ok := step("canonical_module", func() error {
+		canonical, err := s.db.CanonicalModule(module)
+		module = canonical
+		return err
+	}) && step("retired_module", func() error {
+		_, _, err := s.db.RetiredModule(module)
+		return err
+	}) && step("count", func() error {
+		count, err := s.db.Count(module, orgID)
+		rule.matched = count > 0
+		return err
+	}) && step("min_client_version", func() error {
+		var err error
+		rule.minVersion, err = s.db.MinClientVersion(module)
+		return err
+	}) && step("default_channel", func() error {
+		var err error
+		rule.defaultChannel, err = s.db.DefaultChannel(module)
+		return err
+	}) && step("org_url", func() error {
+		var err error
+		rule.url, err = s.db.OrgModuleURL(module, orgID)
+		return err
+	}) && step("cache_ttl", func() error {
+		var err error
+		rule.ttl, rule.hasTTL, err = s.db.CacheTTL(module)
+		return err
+	}) && step("resolve", func() error {
+		result.Channel = s.ruleChannel(rule, "")
+		if !strings.HasPrefix(result.Channel, "/") {
+			return fmt.Errorf("unexpected channel: %q", result.Channel)
+		}
+		return nil
+	})
+
+	result.OK = ok
+	result.DurationSeconds = s.clock.Now().Sub(start).Seconds()
+	return result
+}
+
+// handleAdminSelftest creates an http.HandlerFunc for the API endpoint
+// /admin/selftest. It is restricted to Associate identities. A GET runs a
+// self-test (see selftest) for the org and module given by the org_id and
+// module parameters, or config.Config.SelftestOrgID and
+// config.Config.SelftestModule by default, and reports it with 200 if it
+// passed or 503 if it failed, as a deeper probe than /readyz.
+func (s *Server) handleAdminSelftest() http.HandlerFunc {
+	defaultOrgID := config.DefaultConfig.SelftestOrgID
+	defaultModule := config.DefaultConfig.SelftestModule
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		params := r.URL.Query()
+		orgID, module := defaultOrgID, defaultModule
+		if v := params.Get("org_id"); v != "" {
+			orgID = v
+		}
+		if v := params.Get("module"); v != "" {
+			module = v
+		}
+		if !validModuleName(module) {
+			formatJSONError(w, http.StatusBadRequest, invalidModuleMessage)
+			return
+		}
+
+		result := s.selftest(orgID, module)
+		data, err := json.Marshal(result)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		code := http.StatusOK
+		if !result.OK {
+			code = http.StatusServiceUnavailable
+			failed := result.Steps[len(result.Steps)-1]
+			log.WithFields(log.Fields{
+				"org_id": orgID,
+				"module": module,
+				"step":   failed.Name,
+				"error":  failed.Error,
+			}).Warn("self-test failed")
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
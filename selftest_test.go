@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandleAdminSelftest(t *testing.T) {
+	type response struct {
+		code int
+		body string
+	}
+
+	steps := `{"name":"canonical_module","duration_seconds":0},{"name":"retired_module","duration_seconds":0},{"name":"count","duration_seconds":0},{"name":"min_client_version","duration_seconds":0},{"name":"default_channel","duration_seconds":0},{"name":"org_url","duration_seconds":0},{"name":"cache_ttl","duration_seconds":0},{"name":"resolve","duration_seconds":0}`
+
+	tests := []struct {
+		desc  string
+		input struct {
+			identityType string
+			query        string
+			closeDB      bool
+		}
+		want response
+	}{
+		{
+			desc: "default org and module",
+			input: struct {
+				identityType string
+				query        string
+				closeDB      bool
+			}{"Associate", "", false},
+			want: response{http.StatusOK, `{"ok":true,"org_id":"selftest","module":"insights-core","channel":"/release","duration_seconds":0,"steps":[` + steps + `]}`},
+		},
+		{
+			desc: "org with rule",
+			input: struct {
+				identityType string
+				query        string
+				closeDB      bool
+			}{"Associate", "?org_id=1979710&module=insights-core", false},
+			want: response{http.StatusOK, `{"ok":true,"org_id":"1979710","module":"insights-core","channel":"/testing","duration_seconds":0,"steps":[` + steps + `]}`},
+		},
+		{
+			desc: "not associate",
+			input: struct {
+				identityType string
+				query        string
+				closeDB      bool
+			}{"User", "", false},
+			want: response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","title":""}]}`},
+		},
+		{
+			desc: "database closed",
+			input: struct {
+				identityType string
+				query        string
+				closeDB      bool
+			}{"Associate", "", true},
+			want: response{http.StatusServiceUnavailable, `{"ok":false,"org_id":"selftest","module":"insights-core","duration_seconds":0,"steps":[{"name":"canonical_module","duration_seconds":0,"error":"db: db.preparedStatement failed: db: db.handle.Preparex failed: sql: database is closed"}]}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+			defer srv.Close()
+			srv.clock = fixedClock(time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+			if test.input.closeDB {
+				srv.db.Close()
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/admin/selftest"+test.input.query, nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "`+test.input.identityType+`" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			got := response{rr.Code, strings.TrimSpace(rr.Body.String())}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmp.AllowUnexported(response{})))
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redhatinsights/module-update-router/identity"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricSample is the value of a metric with a set of labels at the time of a
+// metricsSnapshot.
+type metricSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// metricsSnapshot is the value of every metric exposed by the server at a
+// point in time.
+type metricsSnapshot struct {
+	Time    time.Time      `json:"time"`
+	Metrics []metricSample `json:"metrics"`
+}
+
+// snapshotMetrics gathers the server's metrics, as MetricsHandler serves them.
+// Histograms and summaries are flattened into the samples of the exposition
+// format: a _bucket sample per bucket (labeled le) or a sample per quantile
+// (labeled quantile), and the _sum and _count samples. Infinite and NaN
+// values, which JSON cannot represent, are left out.
+func (s *Server) snapshotMetrics() (metricsSnapshot, error) {
+	snapshot := metricsSnapshot{Time: s.clock.Now().UTC(), Metrics: []metricSample{}}
+	families, err := s.registry.Gather()
+	if err != nil {
+		return snapshot, err
+	}
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			add := func(name string, value float64, extra ...string) {
+				if math.IsInf(value, 0) || math.IsNaN(value) {
+					return
+				}
+				sample := metricSample{Name: name, Value: value}
+				if len(labels)+len(extra) > 0 {
+					sample.Labels = make(map[string]string, len(labels)+len(extra)/2)
+					for k, v := range labels {
+						sample.Labels[k] = v
+					}
+					for i := 0; i+1 < len(extra); i += 2 {
+						sample.Labels[extra[i]] = extra[i+1]
+					}
+				}
+				snapshot.Metrics = append(snapshot.Metrics, sample)
+			}
+			switch {
+			case m.GetCounter() != nil:
+				add(name, m.GetCounter().GetValue())
+			case m.GetGauge() != nil:
+				add(name, m.GetGauge().GetValue())
+			case m.GetUntyped() != nil:
+				add(name, m.GetUntyped().GetValue())
+			case m.GetHistogram() != nil:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case m.GetSummary() != nil:
+				sm := m.GetSummary()
+				for _, q := range sm.GetQuantile() {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", sm.GetSampleSum())
+				add(name+"_count", float64(sm.GetSampleCount()))
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// formatFloat formats f as label values are formatted in the exposition
+// format.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// handleAdminMetricsSnapshot creates an http.HandlerFunc for the API endpoint
+// /admin/metrics/snapshot. It is restricted to Associate identities. A GET
+// responds with a timestamped metricsSnapshot, to be attached to bug reports
+// where no prometheus scrapes the server. The response is offered as a
+// download named after the time of the snapshot.
+func (s *Server) handleAdminMetricsSnapshot() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		id, err := identity.GetIdentity(r)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		if id.Identity.Type == nil || *id.Identity.Type != "Associate" {
+			formatJSONError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		snapshot, err := s.snapshotMetrics()
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			formatInternalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="metrics-%v.json"`, snapshot.Time.Format("20060102T150405Z")))
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("cannot write HTTP response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSnapshotMetrics(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	srv.clock = fixedClock(time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "snapshot_test_total"}, []string{"endpoint"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "snapshot_test_seconds", Buckets: []float64{0.5, 1}})
+	srv.registry.MustRegister(counter, histogram)
+	counter.WithLabelValues("channel").Add(2)
+	histogram.Observe(0.25)
+	histogram.Observe(0.75)
+
+	got, err := srv.snapshotMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC); !got.Time.Equal(want) {
+		t.Errorf("%v != %v", got.Time, want)
+	}
+	var samples []metricSample
+	for _, m := range got.Metrics {
+		if strings.HasPrefix(m.Name, "snapshot_test_") {
+			samples = append(samples, m)
+		}
+	}
+	want := []metricSample{
+		{Name: "snapshot_test_seconds_bucket", Labels: map[string]string{"le": "0.5"}, Value: 1},
+		{Name: "snapshot_test_seconds_bucket", Labels: map[string]string{"le": "1"}, Value: 2},
+		{Name: "snapshot_test_seconds_bucket", Labels: map[string]string{"le": "+Inf"}, Value: 2},
+		{Name: "snapshot_test_seconds_sum", Value: 1},
+		{Name: "snapshot_test_seconds_count", Value: 2},
+		{Name: "snapshot_test_total", Labels: map[string]string{"endpoint": "channel"}, Value: 2},
+	}
+	if !cmp.Equal(samples, want) {
+		t.Errorf("%v", cmp.Diff(samples, want))
+	}
+}
+
+func TestHandleAdminMetricsSnapshot(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input struct{ method, identityType string }
+		want  int
+	}{
+		{
+			desc:  "associate",
+			input: struct{ method, identityType string }{http.MethodGet, "Associate"},
+			want:  http.StatusOK,
+		},
+		{
+			desc:  "not associate",
+			input: struct{ method, identityType string }{http.MethodGet, "User"},
+			want:  http.StatusUnauthorized,
+		},
+		{
+			desc:  "POST",
+			input: struct{ method, identityType string }{http.MethodPost, "Associate"},
+			want:  http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			srv.clock = fixedClock(time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+
+			req := httptest.NewRequest(test.input.method, "/api/module-update-router/v1/admin/metrics/snapshot", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "`+test.input.identityType+`" } }`)))
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != test.want {
+				t.Fatalf("%v != %v: %v", rr.Code, test.want, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			if got, want := rr.Header().Get("Content-Disposition"), `attachment; filename="metrics-20261016T090000Z.json"`; got != want {
+				t.Errorf("%v != %v", got, want)
+			}
+			var snapshot struct {
+				Time    time.Time                `json:"time"`
+				Metrics []map[string]interface{} `json:"metrics"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshot.Metrics) == 0 {
+				t.Error("want metrics, got none")
+			}
+		})
+	}
+}
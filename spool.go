@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spoolRetryBatch bounds the number of spooled events read from the database
+// at a time while retrying.
+const spoolRetryBatch = 100
+
+// eventSpool holds events whose produce to Kafka failed in the event_spool
+// table of db until a retry succeeds. At most max events are kept; adding one
+// beyond that drops the oldest. The spool depth and drops are recorded in
+// metrics.
+type eventSpool struct {
+	db      *DB
+	max     int
+	metrics *appMetrics
+}
+
+// add spools v, dropping the oldest spooled events beyond the spool's size.
+func (s *eventSpool) add(v queuedEvent) error {
+	data, err := json.Marshal(v.Event)
+	if err != nil {
+		return fmt.Errorf("spool: json.Marshal failed: %w", err)
+	}
+	dropped, err := s.db.SpoolEvent(v.EnqueuedAt, v.Traceparent, string(data), s.max)
+	if err != nil {
+		return fmt.Errorf("spool: db.SpoolEvent failed: %w", err)
+	}
+	s.metrics.addEventSpoolDropped(dropped)
+	return s.updateDepth()
+}
+
+// retry produces spooled events with produce, oldest first, removing each from
+// the spool once produce returns nil. It stops at the first failure, leaving
+// that event and any later ones spooled, and returns the number of events
+// produced. Spooled events that cannot be decoded are logged and removed.
+func (s *eventSpool) retry(produce func(v queuedEvent) error) (int, error) {
+	defer s.updateDepth()
+
+	var produced int
+	for {
+		events, err := s.db.SpooledEvents(spoolRetryBatch)
+		if err != nil {
+			return produced, fmt.Errorf("spool: db.SpooledEvents failed: %w", err)
+		}
+		if len(events) == 0 {
+			return produced, nil
+		}
+		for _, e := range events {
+			v := queuedEvent{Traceparent: e.Traceparent, EnqueuedAt: e.EnqueuedAt}
+			if err := json.Unmarshal([]byte(e.Event), &v.Event); err != nil {
+				log.WithFields(log.Fields{
+					"spool_id": e.ID,
+					"error":    err,
+				}).Error("cannot decode spooled event; dropping")
+			} else if err := produce(v); err != nil {
+				return produced, err
+			} else {
+				produced++
+			}
+			if err := s.db.DeleteSpooledEvent(e.ID); err != nil {
+				return produced, fmt.Errorf("spool: db.DeleteSpooledEvent failed: %w", err)
+			}
+		}
+	}
+}
+
+// updateDepth sets the event_spool_depth gauge to the number of spooled
+// events.
+func (s *eventSpool) updateDepth() error {
+	n, err := s.db.CountSpooledEvents()
+	if err != nil {
+		return fmt.Errorf("spool: db.CountSpooledEvents failed: %w", err)
+	}
+	s.metrics.setEventSpoolDepth(n)
+	return nil
+}
+
+// run retries spooled events with produce every interval. It blocks forever.
+func (s *eventSpool) run(interval time.Duration, produce func(v queuedEvent) error) {
+	if err := s.updateDepth(); err != nil {
+		log.Errorf("cannot count spooled events: %v", err)
+	}
+	for range time.Tick(interval) {
+		n, err := s.retry(produce)
+		if n > 0 {
+			log.WithField("produced", n).Info("produced spooled events")
+		}
+		if err != nil {
+			log.Errorf("spooled event retry failed; will try again: %v", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEventSpoolRetry(t *testing.T) {
+	db, err := Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	spool := &eventSpool{db: db, max: 3, metrics: newTestMetrics(t)}
+	droppedBefore := testutil.ToFloat64(spool.metrics.eventSpoolDropped)
+	start := time.Date(2020, time.July, 15, 17, 16, 55, 0, time.UTC)
+	for i, machineID := range []string{"a", "b", "c", "d"} {
+		v := queuedEvent{
+			Event:       Event{Phase: "pre_update", MachineID: machineID},
+			Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			EnqueuedAt:  start.Add(time.Duration(i) * time.Second),
+		}
+		if err := spool.add(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(spool.metrics.eventSpoolDropped) - droppedBefore; got != 1 {
+		t.Errorf("dropped: %v != 1", got)
+	}
+	if got := testutil.ToFloat64(spool.metrics.eventSpoolDepth); got != 3 {
+		t.Errorf("depth: %v != 3", got)
+	}
+
+	var produced []string
+	errUnavailable := errors.New("broker unavailable")
+	n, err := spool.retry(func(v queuedEvent) error {
+		if v.Event.MachineID == "c" {
+			return errUnavailable
+		}
+		produced = append(produced, v.Event.MachineID)
+		return nil
+	})
+	if !errors.Is(err, errUnavailable) {
+		t.Errorf("%v != %v", err, errUnavailable)
+	}
+	if n != 1 {
+		t.Errorf("produced: %v != 1", n)
+	}
+	if got := testutil.ToFloat64(spool.metrics.eventSpoolDepth); got != 2 {
+		t.Errorf("depth: %v != 2", got)
+	}
+
+	n, err = spool.retry(func(v queuedEvent) error {
+		if !v.EnqueuedAt.Equal(start.Add(time.Duration(len(produced)+1) * time.Second)) {
+			t.Errorf("enqueued at: %v", v.EnqueuedAt)
+		}
+		produced = append(produced, v.Event.MachineID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("produced: %v != 2", n)
+	}
+	if want := []string{"b", "c", "d"}; !cmp.Equal(produced, want) {
+		t.Errorf("%v", cmp.Diff(produced, want))
+	}
+	if got := testutil.ToFloat64(spool.metrics.eventSpoolDepth); got != 0 {
+		t.Errorf("depth: %v != 0", got)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/slok/go-http-metrics/metrics"
+)
+
+// statsdClient writes metrics in the StatsD line protocol to a UDP endpoint.
+// A nil *statsdClient is valid and discards all metrics.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+}
+
+// newStatsdClient creates a statsdClient sending to the UDP address addr, with
+// every metric name prefixed by prefix.
+func newStatsdClient(addr, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: net.Dial failed: %w", err)
+	}
+	return &statsdClient{
+		conn:   conn,
+		prefix: prefix,
+	}, nil
+}
+
+// Close closes the underlying connection.
+func (c *statsdClient) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// send writes a single metric of type typ. Write errors are logged and
+// otherwise ignored; metrics are best-effort.
+func (c *statsdClient) send(name string, value interface{}, typ string) {
+	if c == nil {
+		return
+	}
+	if c.prefix != "" {
+		name = c.prefix + "." + name
+	}
+	if _, err := fmt.Fprintf(c.conn, "%v:%v|%v", name, value, typ); err != nil {
+		log.Debugf("cannot write statsd metric: %v", err)
+	}
+}
+
+// incr increments the counter name by one.
+func (c *statsdClient) incr(name string) {
+	c.send(name, 1, "c")
+}
+
+// statsdName converts s into a StatsD metric name component by replacing
+// separator and reserved characters with underscores.
+func statsdName(s string) string {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return "root"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '.', ':', '|', '@', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// ObserveHTTPRequestDuration implements metrics.Recorder.
+func (c *statsdClient) ObserveHTTPRequestDuration(_ context.Context, p metrics.HTTPReqProperties, duration time.Duration) {
+	c.send(fmt.Sprintf("http.request.duration.%v.%v.%v", statsdName(p.ID), p.Method, p.Code), duration.Milliseconds(), "ms")
+}
+
+// ObserveHTTPResponseSize implements metrics.Recorder.
+func (c *statsdClient) ObserveHTTPResponseSize(_ context.Context, p metrics.HTTPReqProperties, sizeBytes int64) {
+	c.send(fmt.Sprintf("http.response.size.%v.%v.%v", statsdName(p.ID), p.Method, p.Code), sizeBytes, "h")
+}
+
+// AddInflightRequests implements metrics.Recorder.
+func (c *statsdClient) AddInflightRequests(_ context.Context, p metrics.HTTPProperties, quantity int) {
+	c.send(fmt.Sprintf("http.requests.inflight.%v", statsdName(p.ID)), fmt.Sprintf("%+d", quantity), "g")
+}
+
+// multiRecorder is a metrics.Recorder that records to each of its recorders.
+type multiRecorder []metrics.Recorder
+
+// ObserveHTTPRequestDuration implements metrics.Recorder.
+func (m multiRecorder) ObserveHTTPRequestDuration(ctx context.Context, p metrics.HTTPReqProperties, duration time.Duration) {
+	for _, r := range m {
+		r.ObserveHTTPRequestDuration(ctx, p, duration)
+	}
+}
+
+// ObserveHTTPResponseSize implements metrics.Recorder.
+func (m multiRecorder) ObserveHTTPResponseSize(ctx context.Context, p metrics.HTTPReqProperties, sizeBytes int64) {
+	for _, r := range m {
+		r.ObserveHTTPResponseSize(ctx, p, sizeBytes)
+	}
+}
+
+// AddInflightRequests implements metrics.Recorder.
+func (m multiRecorder) AddInflightRequests(ctx context.Context, p metrics.HTTPProperties, quantity int) {
+	for _, r := range m {
+		r.AddInflightRequests(ctx, p, quantity)
+	}
+}
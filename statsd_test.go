@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdClient(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c, err := newStatsdClient(conn.LocalAddr().String(), "module_update_router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.incr("requests." + statsdName("/testing"))
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "module_update_router.requests.testing:1|c"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestStatsdName(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"/release", "release"},
+		{"/api/module-update-router/v1/channel", "api_module-update-router_v1_channel"},
+		{"/", "root"},
+		{"a.b:c|d", "a_b_c_d"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			if got := statsdName(test.input); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
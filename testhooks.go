@@ -0,0 +1,127 @@
+//go:build testhooks
+// +build testhooks
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// settableClock is a Clock whose time can be pinned at runtime. A zero time
+// falls back to the system clock.
+type settableClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *settableClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.t.IsZero() {
+		return time.Now()
+	}
+	return c.t
+}
+
+// settableRand is a Rand whose value can be pinned at runtime. A negative
+// value falls back to the system source.
+type settableRand struct {
+	mu sync.Mutex
+	f  float64
+}
+
+func (r *settableRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f < 0 {
+		return systemRand{}.Float64()
+	}
+	return r.f
+}
+
+func (r *settableRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f < 0 {
+		return systemRand{}.Intn(n)
+	}
+	return int(r.f * float64(n))
+}
+
+// testSources replaces the server's clock and random source with settable
+// ones. It is called by NewServer before any component reading them is built,
+// so that pinning them applies throughout the server.
+func (s *Server) testSources() {
+	s.clock = &settableClock{}
+	s.rand = &settableRand{f: -1}
+}
+
+// testHooks registers the endpoints /testhooks/clock and /testhooks/rand,
+// which pin the settable clock and random source installed by testSources to
+// the value PUT in the request body. An empty body restores the system source.
+// An endpoint whose source was since replaced, such as by a test, responds
+// 404. These endpoints exist only in binaries built with the "testhooks" build
+// tag.
+func (s *Server) testHooks() {
+	clock, _ := s.clock.(*settableClock)
+	random, _ := s.rand.(*settableRand)
+
+	s.mux.HandleFunc("/testhooks/clock", func(w http.ResponseWriter, r *http.Request) {
+		if clock == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !allowMethods(w, r, http.MethodPut) {
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			formatJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var t time.Time
+		if v := strings.TrimSpace(string(data)); v != "" {
+			t, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				formatJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		clock.mu.Lock()
+		clock.t = t
+		clock.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	s.mux.HandleFunc("/testhooks/rand", func(w http.ResponseWriter, r *http.Request) {
+		if random == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !allowMethods(w, r, http.MethodPut) {
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			formatJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f := -1.0
+		if v := strings.TrimSpace(string(data)); v != "" {
+			f, err = strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f >= 1 {
+				formatJSONError(w, http.StatusBadRequest, "value must be in [0.0,1.0)")
+				return
+			}
+		}
+		random.mu.Lock()
+		random.f = f
+		random.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !testhooks
+// +build !testhooks
+
+package main
+
+// testHooks is a no-op unless the binary is built with the "testhooks" build
+// tag.
+func (s *Server) testHooks() {}
+
+// testSources is a no-op unless the binary is built with the "testhooks" build
+// tag.
+func (s *Server) testSources() {}
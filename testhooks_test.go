@@ -0,0 +1,58 @@
+//go:build testhooks
+// +build testhooks
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/module-update-router/internal/config"
+)
+
+func TestTestHooksClock(t *testing.T) {
+	defer func(c config.Config) { config.DefaultConfig = c }(config.DefaultConfig)
+	config.DefaultConfig.ChannelCacheTTL = time.Hour
+
+	srv := newTestServer(t, `INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)
+	defer srv.Close()
+
+	get := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+	put := func(path, body string) int {
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, path, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	if got, want := get(), `{"url":"/testing"}`; got != want {
+		t.Fatalf("%v != %v", got, want)
+	}
+	if _, err := srv.db.handle.Exec(`DELETE FROM orgs_modules;`); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(), `{"url":"/testing"}`; got != want {
+		t.Errorf("cached: %v != %v", got, want)
+	}
+
+	// Pinning the clock past the cache TTL expires the cached rule.
+	if got := put("/testhooks/clock", time.Now().Add(2*time.Hour).UTC().Format(time.RFC3339)); got != http.StatusNoContent {
+		t.Fatalf("%v != %v", got, http.StatusNoContent)
+	}
+	if got, want := get(), `{"url":"/release"}`; got != want {
+		t.Errorf("expired: %v != %v", got, want)
+	}
+
+	if got := put("/testhooks/rand", "1.5"); got != http.StatusBadRequest {
+		t.Errorf("%v != %v", got, http.StatusBadRequest)
+	}
+}
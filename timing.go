@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// debugTimingHeader is the request header asking for the timing breakdown of
+// the request when debug timing is enabled.
+const debugTimingHeader = "X-Debug-Timing"
+
+// stage is a named middleware of the API handler chain.
+type stage struct {
+	name       string
+	middleware func(http.HandlerFunc) http.HandlerFunc
+}
+
+// chain wraps handler in the middlewares of stages, the first stage being the
+// outermost. The start of each stage, and of handler, is marked for debug
+// timing.
+func chain(handler http.HandlerFunc, stages ...stage) http.HandlerFunc {
+	h := markStage("handler", handler)
+	for i := len(stages) - 1; i >= 0; i-- {
+		h = markStage(stages[i].name, stages[i].middleware(h))
+	}
+	return h
+}
+
+// markStage is an http HandlerFunc middleware handler that records the start
+// of the stage name in the request's stage timer, if any, before calling next.
+func markStage(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := r.Context().Value(stageTimerKey{}).(*stageTimer); ok {
+			t.enter(name)
+		}
+		next(w, r)
+	}
+}
+
+// stageTimerKey is the request context key under which the timing middleware
+// stores the request's stage timer.
+type stageTimerKey struct{}
+
+// stageTiming is the time spent in a stage of the handler chain.
+type stageTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// stageTimer records the start of each stage of the handler chain as a request
+// passes through it. The time spent in a stage is the time until the next
+// stage starts; the time spent in the last stage is the time until the given
+// end. It is safe for concurrent use.
+type stageTimer struct {
+	clock Clock
+
+	mu     sync.Mutex
+	names  []string
+	starts []time.Time
+}
+
+// enter records the start of the stage name.
+func (t *stageTimer) enter(name string) {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names = append(t.names, name)
+	t.starts = append(t.starts, now)
+}
+
+// breakdown returns the time spent in each stage entered so far, in order,
+// with the last stage ending at end.
+func (t *stageTimer) breakdown(end time.Time) []stageTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := make([]stageTiming, len(t.names))
+	for i, name := range t.names {
+		next := end
+		if i+1 < len(t.starts) {
+			next = t.starts[i+1]
+		}
+		timings[i] = stageTiming{name, next.Sub(t.starts[i])}
+	}
+	return timings
+}
+
+// serverTiming formats timings as the value of a Server-Timing header, with
+// durations in milliseconds.
+func serverTiming(timings []stageTiming) string {
+	metrics := make([]string, len(timings))
+	for i, t := range timings {
+		metrics[i] = t.name + ";dur=" + strconv.FormatFloat(float64(t.duration)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// timingWriter is an http.ResponseWriter that adds a Server-Timing header,
+// breaking down the time spent in each stage until the response was started,
+// to the response.
+type timingWriter struct {
+	http.ResponseWriter
+	timer   *stageTimer
+	started bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if !w.started {
+		w.started = true
+		w.Header().Set("Server-Timing", serverTiming(w.timer.breakdown(w.timer.clock.Now())))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(buf []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush flushes the wrapped http.ResponseWriter, if it supports flushing.
+func (w *timingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// timing is an http HandlerFunc middleware handler that, when debug timing is
+// enabled and the request carries the X-Debug-Timing header, times each stage
+// of the handler chain next. The time spent in each stage until the response
+// is started is sent in a Server-Timing response header, and the time spent in
+// each stage until the request completes is logged.
+func (s *Server) timing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.debugTiming || r.Header.Get(debugTimingHeader) == "" {
+			next(w, r)
+			return
+		}
+		timer := &stageTimer{clock: s.clock}
+		start := s.clock.Now()
+		next(&timingWriter{ResponseWriter: w, timer: timer}, r.WithContext(context.WithValue(r.Context(), stageTimerKey{}, timer)))
+		end := s.clock.Now()
+
+		fields := log.Fields{
+			"url":        sanitizeLogValue(r.URL.String()),
+			"request-id": w.Header().Get(s.requestIDHeader),
+			"total":      end.Sub(start),
+		}
+		for _, t := range timer.breakdown(end) {
+			fields["stage."+t.name] = t.duration
+		}
+		log.WithFields(fields).Info("request timing")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStageTimerBreakdown(t *testing.T) {
+	clock := &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+	timer := &stageTimer{clock: clock}
+	for _, s := range []struct {
+		name    string
+		elapsed time.Duration
+	}{
+		{"auth", 3 * time.Millisecond},
+		{"rate-limit", 250 * time.Microsecond},
+		{"handler", 2 * time.Millisecond},
+	} {
+		timer.enter(s.name)
+		clock.t = clock.t.Add(s.elapsed)
+	}
+
+	got := timer.breakdown(clock.Now())
+	want := []stageTiming{
+		{"auth", 3 * time.Millisecond},
+		{"rate-limit", 250 * time.Microsecond},
+		{"handler", 2 * time.Millisecond},
+	}
+	if !cmp.Equal(got, want, cmp.AllowUnexported(stageTiming{})) {
+		t.Errorf("%v", cmp.Diff(got, want, cmp.AllowUnexported(stageTiming{})))
+	}
+	if got, want := serverTiming(got), "auth;dur=3.000, rate-limit;dur=0.250, handler;dur=2.000"; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestDebugTiming(t *testing.T) {
+	tests := []struct {
+		desc    string
+		enabled bool
+		header  string
+		want    string
+	}{
+		{
+			desc:    "enabled, requested",
+			enabled: true,
+			header:  "1",
+			want:    "metrics;dur=0.000, request-id;dur=0.000, log;dur=0.000, limit-url;dur=0.000, auth;dur=0.000, rate-limit;dur=0.000, handler;dur=0.000",
+		},
+		{
+			desc:    "enabled, not requested",
+			enabled: true,
+			want:    "",
+		},
+		{
+			desc:   "disabled",
+			header: "1",
+			want:   "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv := newTestServer(t)
+			defer srv.Close()
+			srv.debugTiming = test.enabled
+			srv.clock = fixedClock(time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "User" } }`)))
+			if test.header != "" {
+				req.Header.Add(debugTimingHeader, test.header)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%v != %v", rr.Code, http.StatusOK)
+			}
+			if got := rr.Header().Get("Server-Timing"); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
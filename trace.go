@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+)
+
+// parseTraceparent validates a W3C Trace Context traceparent header value of
+// the form version-traceid-parentid-flags, returning it normalized to lower
+// case. It reports false if s is not a valid traceparent.
+func parseTraceparent(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 {
+		return "", false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" || !isHex(traceID, 32) || !isHex(parentID, 16) || !isHex(flags, 2) {
+		return "", false
+	}
+	// Version 00 has exactly four fields; later versions may append more.
+	if version == "00" && len(parts) != 4 {
+		return "", false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", false
+	}
+	return s, true
+}
+
+// isHex reports whether s consists of exactly n lower case hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantOK      bool
+	}{
+		{
+			description: "valid",
+			input:       "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:        "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantOK:      true,
+		},
+		{
+			description: "upper case",
+			input:       "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+			want:        "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantOK:      true,
+		},
+		{
+			description: "future version with extra field",
+			input:       "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-ab",
+			want:        "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-ab",
+			wantOK:      true,
+		},
+		{
+			description: "version 00 with extra field",
+			input:       "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-ab",
+		},
+		{
+			description: "invalid version",
+			input:       "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			description: "zero trace ID",
+			input:       "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			description: "zero parent ID",
+			input:       "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		},
+		{
+			description: "short trace ID",
+			input:       "00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		},
+		{
+			description: "empty",
+			input:       "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, ok := parseTraceparent(test.input)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("(%q, %v) != (%q, %v)", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
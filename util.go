@@ -1,6 +1,14 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 // DefaultEnv retrieves the value of the environment variable named by the key.
 // If the variable is not present in the environment, defaultValue is returned.
@@ -11,3 +19,116 @@ func DefaultEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+// ParseFieldMap parses a comma-separated list of key=name pairs into a map
+// from key to name. Whitespace around keys and names is ignored, as are empty
+// pairs.
+func ParseFieldMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid field mapping: %q", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+// parsePollAfter parses a comma-separated list of channel=seconds pairs into a
+// map from channel to seconds. Channels are keyed with a leading slash, as
+// channels are resolved, whether or not they are given with one, so that
+// "testing" and "/testing" name the same channel. Seconds must not be
+// negative; zero omits poll_after for the channel.
+func parsePollAfter(s string) (map[string]int, error) {
+	pairs, err := ParseFieldMap(s)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]int, len(pairs))
+	for channel, value := range pairs {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid poll_after for channel %v: %q", channel, value)
+		}
+		m["/"+strings.TrimPrefix(channel, "/")] = seconds
+	}
+	return m, nil
+}
+
+// parsePathPatterns parses a comma-separated list of path.Match patterns,
+// ignoring whitespace and empty entries. A malformed pattern is an error.
+func parsePathPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern: %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matchesAnyPath reports whether p matches any of patterns, as by path.Match.
+func matchesAnyPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldName returns the name key is mapped to in m, or key itself if it is
+// not mapped.
+func fieldName(m map[string]string, key string) string {
+	if name, ok := m[key]; ok {
+		return name
+	}
+	return key
+}
+
+// validModuleName reports whether name is valid UTF-8 free of control
+// characters, and so safe to use in logs and metric labels.
+func validModuleName(name string) bool {
+	if !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeLogValue returns s with control characters and invalid UTF-8
+// escaped as in a Go string literal, so that client-controlled values, such as
+// request URLs, cannot forge log lines.
+func sanitizeLogValue(s string) string {
+	if validModuleName(s) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case unicode.IsControl(r):
+			q := strconv.QuoteRune(r)
+			b.WriteString(q[1 : len(q)-1])
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	return b.String()
+}
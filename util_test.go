@@ -3,6 +3,8 @@ package main
 import (
 	"os"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestDefaultEnv(t *testing.T) {
@@ -45,3 +47,222 @@ func TestDefaultEnv(t *testing.T) {
 		})
 	}
 }
+
+func TestParseFieldMap(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        map[string]string
+		wantError   bool
+	}{
+		{
+			description: "empty",
+			input:       "",
+			want:        map[string]string{},
+		},
+		{
+			description: "pairs",
+			input:       "time=@timestamp, msg=message,,user-agent=http.user_agent",
+			want:        map[string]string{"time": "@timestamp", "msg": "message", "user-agent": "http.user_agent"},
+		},
+		{
+			description: "missing name",
+			input:       "time=",
+			wantError:   true,
+		},
+		{
+			description: "missing separator",
+			input:       "time",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := ParseFieldMap(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("want error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%v", cmp.Diff(got, test.want))
+				}
+			}
+		})
+	}
+}
+
+func TestParsePollAfter(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        map[string]int
+		wantError   bool
+	}{
+		{
+			description: "empty",
+			input:       "",
+			want:        map[string]int{},
+		},
+		{
+			description: "pairs",
+			input:       "/release=3600, testing=600,,/preview=0",
+			want:        map[string]int{"/release": 3600, "/testing": 600, "/preview": 0},
+		},
+		{
+			description: "negative",
+			input:       "/release=-1",
+			wantError:   true,
+		},
+		{
+			description: "not a number",
+			input:       "/release=1h",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parsePollAfter(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("want error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%v", cmp.Diff(got, test.want))
+				}
+			}
+		})
+	}
+}
+
+func TestParsePathPatterns(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []string
+		wantError   bool
+	}{
+		{
+			description: "empty",
+			input:       "",
+		},
+		{
+			description: "patterns",
+			input:       "/api/*/v1/channel, ,/api/module-update-router/v1/admin/*",
+			want:        []string{"/api/*/v1/channel", "/api/module-update-router/v1/admin/*"},
+		},
+		{
+			description: "malformed",
+			input:       "/api/[",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parsePathPatterns(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("want error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%v", cmp.Diff(got, test.want))
+				}
+			}
+		})
+	}
+}
+
+func TestValidModuleName(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  bool
+	}{
+		{
+			desc:  "plain",
+			input: "insights-core",
+			want:  true,
+		},
+		{
+			desc:  "non-ASCII",
+			input: "insights-cöre",
+			want:  true,
+		},
+		{
+			desc:  "newline",
+			input: "insights-core\nlevel=error",
+			want:  false,
+		},
+		{
+			desc:  "escape sequence",
+			input: "insights-core\x1b[31m",
+			want:  false,
+		},
+		{
+			desc:  "invalid UTF-8",
+			input: "insights-core\xff",
+			want:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := validModuleName(test.input)
+
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLogValue(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  string
+	}{
+		{
+			desc:  "unchanged",
+			input: "/api/module-update-router/v1/channel?module=insights-cöre",
+			want:  "/api/module-update-router/v1/channel?module=insights-cöre",
+		},
+		{
+			desc:  "control characters",
+			input: "curl/7.61.1\r\nlevel=error\t\x1b[31m",
+			want:  `curl/7.61.1\r\nlevel=error\t\x1b[31m`,
+		},
+		{
+			desc:  "invalid UTF-8",
+			input: "insights-core\xff\xfe",
+			want:  `insights-core\xff\xfe`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := sanitizeLogValue(test.input)
+
+			if got != test.want {
+				t.Errorf("%q != %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseUserAgentVersion returns the version of the given product token in the
+// User-Agent string ua. For example, given the product "insights-client" and
+// the User-Agent "insights-client/3.1.7 (Core 3.0.250; requests 2.6.0)", it
+// returns "3.1.7". An error is returned if the product is not present or has
+// no version.
+func parseUserAgentVersion(ua, product string) (string, error) {
+	for _, field := range strings.Fields(ua) {
+		name, version := field, ""
+		if i := strings.Index(field, "/"); i >= 0 {
+			name, version = field[:i], field[i+1:]
+		}
+		if name != product {
+			continue
+		}
+		if version == "" {
+			return "", fmt.Errorf("missing version for product: %v", product)
+		}
+		return version, nil
+	}
+	return "", fmt.Errorf("product not found in User-Agent: %v", product)
+}
+
+// compareVersions compares two dotted numeric version strings, returning -1 if
+// a < b, 0 if a == b and +1 if a > b. Missing trailing components are treated
+// as zero, so "3" and "3.0.0" are equal. Any pre-release or build suffix
+// following a "-" or "+" is ignored.
+func compareVersions(a, b string) (int, error) {
+	x, err := splitVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := splitVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var m, n int
+		if i < len(x) {
+			m = x[i]
+		}
+		if i < len(y) {
+			n = y[i]
+		}
+		switch {
+		case m < n:
+			return -1, nil
+		case m > n:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func splitVersion(v string) ([]int, error) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version: %q", v)
+		}
+		nums[i] = n
+	}
+	return nums, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseUserAgentVersion(t *testing.T) {
+	tests := []struct {
+		description string
+		input       struct{ ua, product string }
+		want        string
+		wantError   bool
+	}{
+		{
+			description: "insights-client",
+			input:       struct{ ua, product string }{"insights-client/3.1.7 (Core 3.0.250; requests 2.6.0) Red Hat Enterprise Linux Server 7.9", "insights-client"},
+			want:        "3.1.7",
+		},
+		{
+			description: "product not first",
+			input:       struct{ ua, product string }{"python-requests/2.6.0 insights-client/3.0.0", "insights-client"},
+			want:        "3.0.0",
+		},
+		{
+			description: "missing product",
+			input:       struct{ ua, product string }{"curl/7.76.1", "insights-client"},
+			wantError:   true,
+		},
+		{
+			description: "missing version",
+			input:       struct{ ua, product string }{"insights-client/", "insights-client"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseUserAgentVersion(test.input.ua, test.input.product)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("want error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Errorf("%v != %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		description string
+		input       struct{ a, b string }
+		want        int
+		wantError   bool
+	}{
+		{
+			description: "less",
+			input:       struct{ a, b string }{"2.9.12", "3.0.0"},
+			want:        -1,
+		},
+		{
+			description: "equal with missing components",
+			input:       struct{ a, b string }{"3", "3.0.0"},
+			want:        0,
+		},
+		{
+			description: "greater numerically",
+			input:       struct{ a, b string }{"3.10", "3.9"},
+			want:        1,
+		},
+		{
+			description: "suffix ignored",
+			input:       struct{ a, b string }{"v3.1.0-rc1", "3.1"},
+			want:        0,
+		},
+		{
+			description: "invalid",
+			input:       struct{ a, b string }{"three", "3"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := compareVersions(test.input.a, test.input.b)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("want error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Errorf("%v != %v", got, test.want)
+				}
+			}
+		})
+	}
+}
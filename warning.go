@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// maxWarningLength bounds the length in bytes of a warning message.
+const maxWarningLength = 1024
+
+// ErrInvalidWarning occurs when a warning message is too long or is not
+// printable ASCII, and so cannot be sent in a header.
+var ErrInvalidWarning = errors.New("invalid warning message: must be printable ASCII of at most 1024 bytes")
+
+// warningBanner holds the message sent to API clients in a Warning header,
+// such as an upcoming deprecation. It is safe for concurrent use.
+type warningBanner struct {
+	v atomic.Value
+}
+
+// get returns the current message, or the empty string if there is none.
+func (b *warningBanner) get() string {
+	msg, _ := b.v.Load().(string)
+	return msg
+}
+
+// set replaces the current message with msg, which must be printable ASCII of
+// at most maxWarningLength bytes. The empty string clears it.
+func (b *warningBanner) set(msg string) error {
+	if len(msg) > maxWarningLength {
+		return ErrInvalidWarning
+	}
+	for i := 0; i < len(msg); i++ {
+		if msg[i] < ' ' || msg[i] > '~' {
+			return ErrInvalidWarning
+		}
+	}
+	b.v.Store(msg)
+	return nil
+}
+
+// clear removes the current message.
+func (b *warningBanner) clear() {
+	b.v.Store("")
+}
+
+// warningHeader returns the value of a Warning header carrying msg, with the
+// miscellaneous persistent warning code 299 of RFC 7234.
+func warningHeader(msg string) string {
+	return `299 - "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(msg) + `"`
+}
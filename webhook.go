@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookQueueSize bounds the number of channel changes waiting to be
+	// delivered. Changes are dropped while the queue is full.
+	webhookQueueSize = 1000
+	// webhookMaxAttempts is the number of times delivery of a channel change
+	// is attempted before it is given up.
+	webhookMaxAttempts = 4
+	// webhookMaxOrgs bounds the number of org and module decisions remembered
+	// to detect changes.
+	webhookMaxOrgs = 100000
+)
+
+// channelChange is the payload delivered to the channel-decision webhook when
+// the channel an org is routed to for a module changes.
+type channelChange struct {
+	OrgID           string    `json:"org_id"`
+	Module          string    `json:"module"`
+	Channel         string    `json:"channel"`
+	PreviousChannel string    `json:"previous_channel"`
+	ChangedAt       time.Time `json:"changed_at"`
+}
+
+// webhookNotifier delivers channel changes to a webhook URL. Deliveries are
+// made asynchronously by a single goroutine and retried with exponential
+// backoff; notify never blocks. Each request body is signed with HMAC-SHA256
+// using secret and the hex-encoded signature sent in the X-Signature-256
+// header as "sha256=<signature>". Deliveries and retries are counted in
+// metrics. A nil *webhookNotifier is valid and discards all notifications.
+type webhookNotifier struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	clock   Clock
+	metrics *appMetrics
+	backoff time.Duration
+	sleep   func(time.Duration)
+
+	mu   sync.Mutex
+	last map[ruleKey]string
+
+	queue chan channelChange
+	done  chan struct{}
+}
+
+// newWebhookNotifier creates a webhookNotifier delivering to url and starts
+// its delivery goroutine. Call Close to stop it.
+func newWebhookNotifier(url, secret string, clock Clock, metrics *appMetrics) *webhookNotifier {
+	n := &webhookNotifier{
+		url:     url,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		clock:   clock,
+		metrics: metrics,
+		backoff: time.Second,
+		sleep:   time.Sleep,
+		last:    make(map[ruleKey]string),
+		queue:   make(chan channelChange, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// notify records channel as the decision for orgID and module and, if it
+// differs from the previously recorded decision, queues a channel change for
+// delivery. The first decision recorded for an org and module is not a
+// change.
+func (n *webhookNotifier) notify(module, orgID, channel string) {
+	if n == nil {
+		return
+	}
+	key := ruleKey{module, orgID}
+	n.mu.Lock()
+	previous, ok := n.last[key]
+	if !ok && len(n.last) >= webhookMaxOrgs {
+		n.last = make(map[ruleKey]string)
+	}
+	n.last[key] = channel
+	n.mu.Unlock()
+	if !ok || previous == channel {
+		return
+	}
+
+	change := channelChange{
+		OrgID:           orgID,
+		Module:          module,
+		Channel:         channel,
+		PreviousChannel: previous,
+		ChangedAt:       n.clock.Now().UTC(),
+	}
+	select {
+	case n.queue <- change:
+	default:
+		n.metrics.incWebhookDeliveries("dropped")
+		log.WithFields(log.Fields{
+			"org_id": orgID,
+			"module": module,
+		}).Warn("webhook queue full, dropping channel change")
+	}
+}
+
+// Close stops delivering channel changes once the queued changes have been
+// delivered or given up.
+func (n *webhookNotifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	close(n.queue)
+	<-n.done
+	return nil
+}
+
+// run delivers queued channel changes until the queue is closed.
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+	for change := range n.queue {
+		if err := n.deliver(change); err != nil {
+			n.metrics.incWebhookDeliveries("failed")
+			log.WithFields(log.Fields{
+				"org_id": change.OrgID,
+				"module": change.Module,
+				"error":  err,
+			}).Error("cannot deliver channel change to webhook")
+			continue
+		}
+		n.metrics.incWebhookDeliveries("delivered")
+	}
+}
+
+// deliver posts change to the webhook, retrying failed attempts with
+// exponential backoff.
+func (n *webhookNotifier) deliver(change channelChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("webhook: json.Marshal failed: %w", err)
+	}
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		err = n.post(body)
+		if err == nil || attempt == webhookMaxAttempts {
+			return err
+		}
+		n.metrics.incWebhookRetries()
+		n.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single signed delivery attempt of body.
+func (n *webhookNotifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook: http.NewRequest failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-256", "sha256="+webhookSignature(n.secret, body))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: http.Client.Do failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected response status: %v", resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature returns the hex-encoded HMAC-SHA256 of body keyed with
+// secret.
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
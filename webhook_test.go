@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	type decision struct {
+		orgID   string
+		channel string
+	}
+
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		description string
+		input       []decision
+		want        []channelChange
+	}{
+		{
+			description: "first decision",
+			input:       []decision{{"1979710", "/testing"}},
+			want:        nil,
+		},
+		{
+			description: "unchanged",
+			input:       []decision{{"1979710", "/testing"}, {"1979710", "/testing"}},
+			want:        nil,
+		},
+		{
+			description: "changed",
+			input:       []decision{{"1979710", "/release"}, {"1979711", "/release"}, {"1979710", "/testing"}},
+			want:        []channelChange{{OrgID: "1979710", Module: "insights-core", Channel: "/testing", PreviousChannel: "/release", ChangedAt: now}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []channelChange
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if sig := r.Header.Get("X-Signature-256"); sig != "sha256="+webhookSignature([]byte("secret"), body) {
+					t.Errorf("invalid signature: %v", sig)
+				}
+				var change channelChange
+				if err := json.Unmarshal(body, &change); err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				got = append(got, change)
+				mu.Unlock()
+			}))
+			defer ts.Close()
+
+			n := newWebhookNotifier(ts.URL, "secret", &manualClock{now}, newTestMetrics(t))
+			for _, d := range test.input {
+				n.notify("insights-core", d.orgID, d.channel)
+			}
+			if err := n.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestWebhookNotifierRetry(t *testing.T) {
+	tests := []struct {
+		description string
+		input       int
+		want        int
+	}{
+		{
+			description: "recovers",
+			input:       2,
+			want:        3,
+		},
+		{
+			description: "gives up",
+			input:       webhookMaxAttempts,
+			want:        webhookMaxAttempts,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var mu sync.Mutex
+			var attempts int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if attempts <= test.input {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer ts.Close()
+
+			n := newWebhookNotifier(ts.URL, "secret", &manualClock{time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}, newTestMetrics(t))
+			var backoffs []time.Duration
+			n.sleep = func(d time.Duration) { backoffs = append(backoffs, d) }
+			n.notify("insights-core", "1979710", "/release")
+			n.notify("insights-core", "1979710", "/testing")
+			if err := n.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if attempts != test.want {
+				t.Errorf("%v != %v", attempts, test.want)
+			}
+			for i := 1; i < len(backoffs); i++ {
+				if backoffs[i] != 2*backoffs[i-1] {
+					t.Errorf("backoff %v: %v != %v", i, backoffs[i], 2*backoffs[i-1])
+				}
+			}
+		})
+	}
+}